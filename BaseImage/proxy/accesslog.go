@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AccessRecord is the access log line for one API request. TTFBMs, the time
+// to the first byte, is only set for streamed responses. Token counts are
+// taken from the response's usage object and are 0 when it has none.
+type AccessRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	RequestID        string    `json:"requestId,omitempty"`
+	ClientID         string    `json:"clientId,omitempty"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Model            string    `json:"model,omitempty"`
+	Status           int       `json:"status"`
+	DurationMs       int64     `json:"durationMs"`
+	Stream           bool      `json:"stream"`
+	TTFBMs           int64     `json:"ttfbMs,omitempty"`
+	Bytes            int64     `json:"bytes"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	TotalTokens      int       `json:"totalTokens"`
+}
+
+// accessLogger writes access records as bare JSON lines, without the
+// standard logger's timestamp prefix
+var accessLogger = log.New(os.Stdout, "", 0)
+
+// clientIDLength is how many hex digits of the API key's SHA-256 identify a
+// client in the access log
+const clientIDLength = 12
+
+// clientID identifies the caller by a truncated SHA-256 of its API key, so
+// requests can be told apart by client without logging the key. It is empty
+// for requests without a key.
+func clientID(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:clientIDLength]
+}
+
+type accessLogKey struct{}
+
+// accessLogEntry carries what only the handler knows to the access log
+type accessLogEntry struct {
+	model string
+}
+
+// setAccessLogModel records the model a request asked for in its access log
+// line; it does nothing when the access log is off or the request is part of
+// a batch
+func setAccessLogModel(ctx context.Context, model string) {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry); ok && entry != nil {
+		entry.model = model
+	}
+}
+
+// accessLogWriter records the status, size, first byte and tail of a
+// response for its access log line
+type accessLogWriter struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64
+	firstByte time.Time
+	tail      responseTail
+}
+
+func (aw *accessLogWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	if aw.firstByte.IsZero() {
+		aw.firstByte = now()
+	}
+	aw.tail.write(aw.Header(), p)
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessLogWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// withAccessLog writes an access log line for each request served by next
+// once it completes, when ACCESS_LOG is on
+func (p *Proxy) withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.cfg.AccessLog {
+			next(w, r)
+			return
+		}
+
+		start := now()
+		entry := &accessLogEntry{}
+		aw := &accessLogWriter{ResponseWriter: w}
+		next(aw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		record := AccessRecord{
+			Timestamp:  start.UTC(),
+			RequestID:  w.Header().Get(requestIDHeader),
+			ClientID:   clientID(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Model:      entry.model,
+			Status:     aw.status,
+			DurationMs: now().Sub(start).Milliseconds(),
+			Stream:     strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream"),
+			Bytes:      aw.bytes,
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if record.Stream && !aw.firstByte.IsZero() {
+			record.TTFBMs = aw.firstByte.Sub(start).Milliseconds()
+		}
+		var result RequestResult
+		aw.tail.parse(&result)
+		record.PromptTokens = result.PromptTokens
+		record.CompletionTokens = result.CompletionTokens
+		record.TotalTokens = result.TotalTokens
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("Failed to encode access log record for request %s: %v", record.RequestID, err)
+			return
+		}
+		accessLogger.Print(string(line))
+	}
+}
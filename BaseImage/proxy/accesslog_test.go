@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// captureAccessLog enables the access log and collects its lines until the
+// returned function is called
+func captureAccessLog(t *testing.T) (*bytes.Buffer, func()) {
+	t.Helper()
+	cfg := config
+	enabled := cfg
+	enabled.AccessLog = true
+	applyConfig(enabled)
+
+	var buf bytes.Buffer
+	accessLogger.SetOutput(&buf)
+	return &buf, func() {
+		accessLogger.SetOutput(os.Stdout)
+		applyConfig(cfg)
+	}
+}
+
+func decodeAccessRecord(t *testing.T, buf *bytes.Buffer) AccessRecord {
+	t.Helper()
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d access log lines, want 1: %q", len(lines), buf.String())
+	}
+	var record AccessRecord
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatalf("access log line is not JSON: %v: %s", err, lines[0])
+	}
+	return record
+}
+
+func TestAccessLogCompletion(t *testing.T) {
+	server := newMarketplaceServer("access-model", "Access Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(readUsageFixture(t, "completion.json"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	req := newChatRequest(`{"model": "Access Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req.Header.Set("Authorization", "Bearer client-key")
+	req.Header.Set(requestIDHeader, "access-request")
+	w := httptest.NewRecorder()
+	NewProxy().withAccessLog(ProxyChatCompletion)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	record := decodeAccessRecord(t, buf)
+	if record.Method != "POST" || record.Path != "/v1/chat/completions" {
+		t.Errorf("method and path = %s %s, want POST /v1/chat/completions", record.Method, record.Path)
+	}
+	if record.Model != "Access Model" || record.Status != http.StatusOK || record.Stream {
+		t.Errorf("record = %+v, want model Access Model, status 200 and no stream", record)
+	}
+	if record.RequestID != "access-request" {
+		t.Errorf("requestId = %q, want access-request", record.RequestID)
+	}
+	if record.ClientID == "" || bytes.Contains(buf.Bytes(), []byte("client-key")) {
+		t.Errorf("clientId = %q, want a hash that does not reveal the key", record.ClientID)
+	}
+	if record.TotalTokens == 0 || record.PromptTokens+record.CompletionTokens != record.TotalTokens {
+		t.Errorf("tokens = %d+%d=%d, want the response's usage", record.PromptTokens, record.CompletionTokens, record.TotalTokens)
+	}
+	if record.Bytes != int64(w.Body.Len()) {
+		t.Errorf("bytes = %d, want %d", record.Bytes, w.Body.Len())
+	}
+	if record.TTFBMs != 0 {
+		t.Errorf("ttfbMs = %d, want none for a non-streaming response", record.TTFBMs)
+	}
+}
+
+func TestAccessLogStreamTimeToFirstByte(t *testing.T) {
+	clock := newFakeClock()
+	defer SetClock(SetClock(clock))
+	server := newMarketplaceServer("access-stream", "Access Stream", func(w http.ResponseWriter, r *http.Request) {
+		clock.Advance(150 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(readUsageFixture(t, "stream.txt"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	buf, restore := captureAccessLog(t)
+	defer restore()
+
+	w := newFlushRecorder()
+	NewProxy().withAccessLog(ProxyChatCompletion)(w, newChatRequest(`{"model": "Access Stream", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	record := decodeAccessRecord(t, buf)
+	if !record.Stream {
+		t.Fatalf("record = %+v, want a stream", record)
+	}
+	if record.TTFBMs != 150 {
+		t.Errorf("ttfbMs = %d, want 150", record.TTFBMs)
+	}
+	if record.DurationMs < record.TTFBMs {
+		t.Errorf("durationMs = %d, want at least the time to first byte", record.DurationMs)
+	}
+	if record.PromptTokens != 800 || record.CompletionTokens != 200 || record.TotalTokens != 1000 {
+		t.Errorf("tokens = %d/%d/%d, want 800/200/1000", record.PromptTokens, record.CompletionTokens, record.TotalTokens)
+	}
+}
+
+func TestAccessLogErrorAndDisabled(t *testing.T) {
+	t.Run("error status", func(t *testing.T) {
+		buf, restore := captureAccessLog(t)
+		defer restore()
+
+		w := httptest.NewRecorder()
+		NewProxy().withAccessLog(ProxyChatCompletion)(w, newChatRequest(`{"messages": []}`))
+
+		record := decodeAccessRecord(t, buf)
+		if record.Status != http.StatusBadRequest || record.Model != "" || record.ClientID != "" {
+			t.Errorf("record = %+v, want a 400 with no model or client", record)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var buf bytes.Buffer
+		accessLogger.SetOutput(&buf)
+		defer accessLogger.SetOutput(os.Stdout)
+
+		NewProxy().withAccessLog(ProxyChatCompletion)(httptest.NewRecorder(), newChatRequest(`{"messages": []}`))
+
+		if buf.Len() != 0 {
+			t.Errorf("access log written while disabled: %q", buf.String())
+		}
+	})
+}
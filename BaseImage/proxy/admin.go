@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// getAPIKey returns the key that protects the admin and debug endpoints.
+// When unset, those endpoints are disabled.
+func getAPIKey() string {
+	return strings.TrimSpace(os.Getenv("API_KEY"))
+}
+
+// requestAPIKey extracts the API key from an "Authorization: Bearer" or
+// "X-API-Key" header.
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// requireAPIKey wraps a handler so it is only reachable with the configured API key
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := getAPIKey()
+		if apiKey == "" {
+			respondWithError(w, http.StatusForbidden, "Admin endpoints are disabled; set API_KEY to enable them")
+			return
+		}
+		if !isAdminRequest(r) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid or missing API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdminRequest reports whether r carries the configured API key. It is
+// always false when API_KEY is unset.
+func isAdminRequest(r *http.Request) bool {
+	apiKey := getAPIKey()
+	return apiKey != "" && subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(apiKey)) == 1
+}
@@ -0,0 +1,627 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The Anthropic Messages API, served on /v1/messages when
+// ANTHROPIC_MESSAGES_API is set. Requests are translated into chat
+// completions, served by ProxyChatCompletion, and the responses, streamed or
+// not, translated back. Text and image content is supported; tool use is not.
+
+// anthropicStopReasons maps OpenAI finish reasons to Anthropic stop reasons
+var anthropicStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "end_turn",
+}
+
+// anthropicErrorTypeForStatus maps an HTTP status to an Anthropic error type
+func anthropicErrorTypeForStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	}
+	if statusCode >= 500 {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type anthropicErrorResponse struct {
+	Type  string         `json:"type"` // always "error"
+	Error anthropicError `json:"error"`
+}
+
+func newAnthropicError(statusCode int, message string) anthropicErrorResponse {
+	return anthropicErrorResponse{
+		Type:  "error",
+		Error: anthropicError{Type: anthropicErrorTypeForStatus(statusCode), Message: message},
+	}
+}
+
+// respondWithAnthropicError is respondWithError in the Anthropic error shape
+func respondWithAnthropicError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(newAnthropicError(statusCode, message))
+}
+
+type anthropicContentBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text,omitempty"`
+	Source *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicMessage is the response body of a non-streaming request
+type anthropicMessage struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []anthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        anthropicUsage          `json:"usage"`
+}
+
+// anthropicParams are the request fields passed to the chat completion
+// under their OpenAI names
+var anthropicParams = map[string]string{
+	"max_tokens":     "max_tokens",
+	"temperature":    "temperature",
+	"top_p":          "top_p",
+	"stop_sequences": "stop",
+	"stream":         "stream",
+}
+
+// translateAnthropicRequest turns a Messages API request body into a chat
+// completion request body
+func translateAnthropicRequest(body map[string]interface{}) (map[string]interface{}, error) {
+	model, ok := body["model"].(string)
+	if !ok || model == "" {
+		return nil, fmt.Errorf("model: field required")
+	}
+	if _, ok := body["max_tokens"]; !ok {
+		return nil, fmt.Errorf("max_tokens: field required")
+	}
+	if _, ok := body["tools"]; ok {
+		return nil, fmt.Errorf("tools are not supported")
+	}
+
+	var messages []interface{}
+	if system, ok := body["system"]; ok && system != nil {
+		text, err := anthropicText(system)
+		if err != nil {
+			return nil, fmt.Errorf("system: %v", err)
+		}
+		messages = append(messages, map[string]interface{}{"role": "system", "content": text})
+	}
+
+	list, ok := body["messages"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("messages: at least one message is required")
+	}
+	for i, item := range list {
+		message, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages.%d: must be an object", i)
+		}
+		role, _ := message["role"].(string)
+		if role != "user" && role != "assistant" {
+			return nil, fmt.Errorf("messages.%d.role: must be user or assistant", i)
+		}
+		content, err := anthropicMessageContent(message["content"])
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %v", i, err)
+		}
+		messages = append(messages, map[string]interface{}{"role": role, "content": content})
+	}
+
+	translated := map[string]interface{}{"model": model, "messages": messages}
+	for from, to := range anthropicParams {
+		if value, ok := body[from]; ok {
+			translated[to] = value
+		}
+	}
+	return translated, nil
+}
+
+// anthropicText joins the text of a string or a list of text blocks, as
+// the system prompt may be given
+func anthropicText(value interface{}) (string, error) {
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	blocks, err := decodeAnthropicBlocks(value)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return "", fmt.Errorf("content block type %q is not supported here", block.Type)
+		}
+		texts = append(texts, block.Text)
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// anthropicMessageContent translates message content. Text-only content
+// becomes a string; content with images becomes OpenAI content parts.
+func anthropicMessageContent(value interface{}) (interface{}, error) {
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	blocks, err := decodeAnthropicBlocks(value)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]interface{}, 0, len(blocks))
+	textOnly := true
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, map[string]interface{}{"type": "text", "text": block.Text})
+		case "image":
+			if block.Source == nil {
+				return nil, fmt.Errorf("image block without a source")
+			}
+			url := block.Source.URL
+			if block.Source.Type == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+			}
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+			textOnly = false
+		default:
+			return nil, fmt.Errorf("content block type %q is not supported", block.Type)
+		}
+	}
+	if textOnly {
+		return anthropicText(value)
+	}
+	return parts, nil
+}
+
+func decodeAnthropicBlocks(value interface{}) ([]anthropicContentBlock, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, fmt.Errorf("must be a string or a list of content blocks")
+	}
+	return blocks, nil
+}
+
+// anthropicMessageID derives a message ID from a chat completion ID
+func anthropicMessageID(completionID string) string {
+	if completionID == "" {
+		return "msg_" + newRequestID()
+	}
+	return "msg_" + strings.TrimPrefix(completionID, "chatcmpl-")
+}
+
+// anthropicStopReason translates a finish reason, nil if there is none
+func anthropicStopReason(finishReason string) *string {
+	if finishReason == "" {
+		return nil
+	}
+	reason, ok := anthropicStopReasons[finishReason]
+	if !ok {
+		reason = "end_turn"
+	}
+	return &reason
+}
+
+// chatCompletion is the part of a chat completion, or one chunk of a
+// streamed one, that the Messages API needs
+type chatCompletion struct {
+	ID      string `json:"id"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *APIError `json:"error"`
+}
+
+// translateChatCompletion turns a chat completion into a Messages API
+// response for model
+func translateChatCompletion(completion chatCompletion, model string) anthropicMessage {
+	message := anthropicMessage{
+		ID:      anthropicMessageID(completion.ID),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []anthropicContentBlock{},
+	}
+	if len(completion.Choices) > 0 {
+		choice := completion.Choices[0]
+		message.Content = append(message.Content, anthropicContentBlock{Type: "text", Text: choice.Message.Content})
+		message.StopReason = anthropicStopReason(choice.FinishReason)
+	}
+	if completion.Usage != nil {
+		message.Usage = anthropicUsage{InputTokens: completion.Usage.PromptTokens, OutputTokens: completion.Usage.CompletionTokens}
+	}
+	return message
+}
+
+// handleAnthropicMessages serves the Anthropic Messages API on top of
+// ProxyChatCompletion
+func handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithAnthropicError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithAnthropicError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	body, err := decodeRequestBody(raw)
+	if err != nil || body == nil {
+		respondWithAnthropicError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	translated, err := translateAnthropicRequest(body)
+	if err != nil {
+		respondWithAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	encoded, err := encodeRequestBody(translated)
+	if err != nil {
+		respondWithAnthropicError(w, http.StatusInternalServerError, "Failed to translate request")
+		return
+	}
+
+	model := translated["model"].(string)
+	chatReq := r.Clone(r.Context())
+	chatReq.URL.Path = "/v1/chat/completions"
+	chatReq.Body = io.NopCloser(bytes.NewReader(encoded))
+	chatReq.ContentLength = int64(len(encoded))
+	// The response is translated, so it must come back uncompressed
+	chatReq.Header.Del("Accept-Encoding")
+	log.Printf("Translated Messages API request for model %s to a chat completion", model)
+
+	if stream, _ := translated["stream"].(bool); stream {
+		aw := newAnthropicStreamWriter(w, model)
+		ProxyChatCompletion(aw, chatReq)
+		aw.finish()
+		return
+	}
+
+	rec := newBufferedResponseWriter()
+	ProxyChatCompletion(rec, chatReq)
+	copyProxyHeaders(w, rec.header)
+	writeAnthropicResponse(w, rec.status, rec.body.Bytes(), model)
+}
+
+// writeAnthropicResponse translates a buffered chat completion response
+func writeAnthropicResponse(w http.ResponseWriter, status int, body []byte, model string) {
+	var completion chatCompletion
+	if err := json.Unmarshal(body, &completion); err != nil {
+		if status == http.StatusOK {
+			status = http.StatusBadGateway
+		}
+		respondWithAnthropicError(w, status, "Invalid response from the marketplace")
+		return
+	}
+	if status != http.StatusOK || completion.Error != nil {
+		message := http.StatusText(status)
+		if completion.Error != nil {
+			message = completion.Error.Message
+		}
+		respondWithAnthropicError(w, status, message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(translateChatCompletion(completion, model))
+}
+
+// copyProxyHeaders carries the proxy's own response headers, such as the
+// request ID and served model, over to a translated response
+func copyProxyHeaders(w http.ResponseWriter, header http.Header) {
+	for _, name := range []string{requestIDHeader, servedModelHeader, cacheStatusHeader, "Age", "Retry-After"} {
+		if value := header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// bufferedResponseWriter keeps a whole response for translation
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header)}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// anthropicStreamWriter receives a streamed chat completion and writes it to
+// the client as Messages API events. Error responses, and completions that
+// arrive unstreamed, are buffered and translated by finish.
+type anthropicStreamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	model   string
+	header  http.Header
+	status  int
+
+	streaming bool         // the upstream answered with an event stream
+	buffered  bytes.Buffer // the whole body when not streaming
+	partial   []byte       // the start of a line not yet complete
+
+	started    bool // message_start and content_block_start were sent
+	stopped    bool // message_stop was sent
+	stopReason *string
+	usage      anthropicUsage
+}
+
+func newAnthropicStreamWriter(w http.ResponseWriter, model string) *anthropicStreamWriter {
+	flusher, _ := w.(http.Flusher)
+	return &anthropicStreamWriter{w: w, flusher: flusher, model: model, header: make(http.Header)}
+}
+
+func (a *anthropicStreamWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *anthropicStreamWriter) WriteHeader(code int) {
+	if a.status != 0 {
+		return
+	}
+	a.status = code
+	a.streaming = code == http.StatusOK && isEventStream(a.header)
+	if a.streaming {
+		copyProxyHeaders(a.w, a.header)
+		setStreamingHeaders(a.w)
+		a.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *anthropicStreamWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	if !a.streaming {
+		return a.buffered.Write(p)
+	}
+
+	data := append(a.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if err := a.translateLine(string(data[:i])); err != nil {
+			return 0, err
+		}
+		data = data[i+1:]
+	}
+	a.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Unwrap returns the client's ResponseWriter, for http.ResponseController
+func (a *anthropicStreamWriter) Unwrap() http.ResponseWriter {
+	return a.w
+}
+
+// Flush flushes the translated events written so far
+func (a *anthropicStreamWriter) Flush() {
+	if a.streaming && a.flusher != nil {
+		a.flusher.Flush()
+	}
+}
+
+// translateLine translates one line of the chat completion stream
+func (a *anthropicStreamWriter) translateLine(line string) error {
+	data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+	if !ok {
+		return nil
+	}
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		return a.stop()
+	}
+
+	var chunk chatCompletion
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		log.Printf("Skipping undecodable chunk in translated stream: %v", err)
+		return nil
+	}
+	if chunk.Error != nil {
+		return a.event("error", newAnthropicError(http.StatusBadGateway, chunk.Error.Message))
+	}
+	if err := a.start(chunk.ID); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		a.usage = anthropicUsage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			if err := a.event("content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": 0,
+				"delta": map[string]string{"type": "text_delta", "text": choice.Delta.Content},
+			}); err != nil {
+				return err
+			}
+		}
+		if reason := anthropicStopReason(choice.FinishReason); reason != nil {
+			a.stopReason = reason
+		}
+	}
+	return nil
+}
+
+// start sends message_start and opens the text block, once
+func (a *anthropicStreamWriter) start(completionID string) error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	message := translateChatCompletion(chatCompletion{ID: completionID}, a.model)
+	if err := a.event("message_start", map[string]interface{}{"type": "message_start", "message": message}); err != nil {
+		return err
+	}
+	return a.event("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         0,
+		"content_block": map[string]string{"type": "text", "text": ""},
+	})
+}
+
+// stop closes the text block and the message, once
+func (a *anthropicStreamWriter) stop() error {
+	if a.stopped {
+		return nil
+	}
+	if err := a.start(""); err != nil {
+		return err
+	}
+	a.stopped = true
+	events := []struct {
+		name string
+		data interface{}
+	}{
+		{"content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 0}},
+		{"message_delta", map[string]interface{}{
+			"type":  "message_delta",
+			"delta": map[string]interface{}{"stop_reason": a.stopReason, "stop_sequence": nil},
+			"usage": map[string]int{"output_tokens": a.usage.OutputTokens},
+		}},
+		{"message_stop", map[string]string{"type": "message_stop"}},
+	}
+	for _, e := range events {
+		if err := a.event(e.name, e.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// event writes one Messages API server-sent event
+func (a *anthropicStreamWriter) event(name string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.w, "event: %s\ndata: %s\n\n", name, encoded)
+	return err
+}
+
+// finish completes the response once ProxyChatCompletion has returned:
+// buffered responses are translated, and a stream that ended early is
+// closed
+func (a *anthropicStreamWriter) finish() {
+	if a.streaming {
+		if len(a.partial) > 0 {
+			a.translateLine(string(a.partial))
+		}
+		if a.started && !a.stopped {
+			log.Printf("Translated stream for model %s ended without [DONE]", a.model)
+		}
+		a.Flush()
+		return
+	}
+
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	copyProxyHeaders(a.w, a.header)
+	if a.status != http.StatusOK {
+		writeAnthropicResponse(a.w, a.status, a.buffered.Bytes(), a.model)
+		return
+	}
+
+	// The upstream answered the stream request with a whole completion;
+	// send it as the events a stream of it would have produced
+	var completion chatCompletion
+	if err := json.Unmarshal(a.buffered.Bytes(), &completion); err != nil {
+		respondWithAnthropicError(a.w, http.StatusBadGateway, "Invalid response from the marketplace")
+		return
+	}
+	setStreamingHeaders(a.w)
+	a.w.WriteHeader(http.StatusOK)
+	a.streaming = true
+	message := translateChatCompletion(completion, a.model)
+	a.start(completion.ID)
+	if len(message.Content) > 0 && message.Content[0].Text != "" {
+		a.event("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": message.Content[0].Text},
+		})
+	}
+	a.stopReason = message.StopReason
+	a.usage = message.Usage
+	a.stop()
+	a.Flush()
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAnthropicFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "anthropic", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// assertSameJSON compares two JSON documents regardless of formatting
+func assertSameJSON(t *testing.T, got, want []byte) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("invalid fixture %q: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func newAnthropicRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestTranslateAnthropicRequest(t *testing.T) {
+	body, err := decodeRequestBody(readAnthropicFixture(t, "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	translated, err := translateAnthropicRequest(body)
+	if err != nil {
+		t.Fatalf("translateAnthropicRequest() error = %v", err)
+	}
+	got, _ := json.Marshal(translated)
+	assertSameJSON(t, got, readAnthropicFixture(t, "chat_request.json"))
+}
+
+func TestTranslateAnthropicRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"missing model", `{"max_tokens": 1, "messages": [{"role": "user", "content": "Hi"}]}`, "model"},
+		{"missing max_tokens", `{"model": "m", "messages": [{"role": "user", "content": "Hi"}]}`, "max_tokens"},
+		{"no messages", `{"model": "m", "max_tokens": 1, "messages": []}`, "messages"},
+		{"system role", `{"model": "m", "max_tokens": 1, "messages": [{"role": "system", "content": "Hi"}]}`, "messages.0.role"},
+		{"tool result", `{"model": "m", "max_tokens": 1, "messages": [{"role": "user", "content": [{"type": "tool_result"}]}]}`, "tool_result"},
+		{"tools", `{"model": "m", "max_tokens": 1, "tools": [], "messages": [{"role": "user", "content": "Hi"}]}`, "tools"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleAnthropicMessages(w, newAnthropicRequest(tt.body))
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %v, want 400", w.Code)
+			}
+			var resp anthropicErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid error body %q: %v", w.Body.String(), err)
+			}
+			if resp.Type != "error" || resp.Error.Type != "invalid_request_error" {
+				t.Errorf("error = %+v, want an invalid_request_error", resp)
+			}
+			if !strings.Contains(resp.Error.Message, tt.want) {
+				t.Errorf("message = %q, want it to mention %q", resp.Error.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	var upstreamBody map[string]interface{}
+	server := newMarketplaceServer("claude-model", "Claude Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(readAnthropicFixture(t, "completion.json"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	handleAnthropicMessages(w, newAnthropicRequest(string(readAnthropicFixture(t, "request.json"))))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	assertSameJSON(t, w.Body.Bytes(), readAnthropicFixture(t, "message.json"))
+	if _, ok := upstreamBody["stop"]; !ok {
+		t.Errorf("upstream request was not translated: %v", upstreamBody)
+	}
+	if w.Header().Get(requestIDHeader) == "" {
+		t.Error("expected the request ID header")
+	}
+}
+
+func TestAnthropicMessagesStreaming(t *testing.T) {
+	server := newMarketplaceServer("claude-model", "Claude Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(readAnthropicFixture(t, "stream.txt"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	handleAnthropicMessages(w, newAnthropicRequest(`{"model": "Claude Model", "max_tokens": 16, "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	if got, want := w.Body.String(), string(readAnthropicFixture(t, "stream_events.txt")); got != want {
+		t.Errorf("events:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAnthropicMessagesStreamingUnstreamedResponse(t *testing.T) {
+	server := newMarketplaceServer("claude-model", "Claude Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(readAnthropicFixture(t, "completion.json"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	handleAnthropicMessages(w, newAnthropicRequest(`{"model": "Claude Model", "max_tokens": 16, "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	body := w.Body.String()
+	for _, want := range []string{"event: message_start", `"text":"A PNG image."`, `"stop_reason":"max_tokens"`, "event: message_stop"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("events missing %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestAnthropicMessagesUpstreamError(t *testing.T) {
+	server := newMarketplaceServer("claude-model", "Claude Model", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "model not supported"}`, http.StatusBadRequest)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	for _, stream := range []string{"false", "true"} {
+		t.Run("stream="+stream, func(t *testing.T) {
+			w := newFlushRecorder()
+			handleAnthropicMessages(w, newAnthropicRequest(`{"model": "Claude Model", "max_tokens": 16, "stream": `+stream+`, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if w.Code < 400 {
+				t.Fatalf("status = %v, want an error", w.Code)
+			}
+			var resp anthropicErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Type != "error" || resp.Error.Type == "" {
+				t.Errorf("body = %q, want an Anthropic error", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAnthropicMessagesRoute(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+
+	for _, enabled := range []bool{false, true} {
+		c := cfg
+		c.AnthropicMessagesAPI = enabled
+		mux := newTestMux(t, &c)
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, newAnthropicRequest(`{}`))
+		resp, _ := io.ReadAll(w.Body)
+		if got := w.Code != http.StatusNotFound; got != enabled {
+			t.Errorf("enabled=%v: status = %v: %s", enabled, w.Code, resp)
+		}
+	}
+}
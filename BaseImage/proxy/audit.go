@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the audit log entry for one chat completion request. It
+// holds no prompt or completion text: the prompt is identified only by a
+// truncated hash, so records can be kept without storing personal data.
+type AuditRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	RequestID        string    `json:"requestId"`
+	Model            string    `json:"model"`
+	ModelID          string    `json:"modelId,omitempty"`
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	LatencyMs        int64     `json:"latencyMs"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	TotalTokens      int       `json:"totalTokens"`
+	PromptHash       string    `json:"promptHash,omitempty"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// newAuditRecord builds the audit record for a published request result
+func newAuditRecord(result RequestResult) AuditRecord {
+	return AuditRecord{
+		Timestamp:        now().UTC(),
+		RequestID:        result.RequestID,
+		Model:            result.Model,
+		ModelID:          result.ModelID,
+		Stream:           result.Stream,
+		Status:           result.Status,
+		LatencyMs:        result.Latency.Milliseconds(),
+		PromptTokens:     result.PromptTokens,
+		CompletionTokens: result.CompletionTokens,
+		TotalTokens:      result.TotalTokens,
+		PromptHash:       result.PromptHash,
+		Error:            result.Error,
+	}
+}
+
+// AuditLogger persists audit records. Log is called on the request path once
+// the response has been written, so it must not block.
+type AuditLogger interface {
+	Log(record AuditRecord)
+	Close() error
+}
+
+var auditRecordsDropped = metrics.counter("morpheus_proxy_audit_records_dropped_total",
+	"Audit records dropped because the audit log could not keep up")
+
+var audit struct {
+	sync.RWMutex
+	logger AuditLogger
+	// configured is the file logger set up from AUDIT_LOG_PATH, if that
+	// is the current logger
+	configured *fileAuditLogger
+}
+
+// SetAuditLogger sets where audit records are written and returns the
+// previous logger, which the caller is responsible for closing; nil stops
+// auditing. Without one, a file logger is used when AUDIT_LOG_PATH is set.
+func SetAuditLogger(logger AuditLogger) AuditLogger {
+	audit.Lock()
+	defer audit.Unlock()
+	previous := audit.logger
+	audit.logger, audit.configured = logger, nil
+	return previous
+}
+
+func getAuditLogger() AuditLogger {
+	audit.RLock()
+	defer audit.RUnlock()
+	return audit.logger
+}
+
+// configureAuditLog makes a file logger writing to path the audit logger,
+// or removes it if path is empty, closing the one it replaces. A logger set
+// through SetAuditLogger is left in place.
+func configureAuditLog(path string) {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.logger != nil && audit.logger != AuditLogger(audit.configured) {
+		if path != "" {
+			log.Printf("Ignoring AUDIT_LOG_PATH: an audit logger is already set")
+		}
+		return
+	}
+	if audit.configured != nil {
+		if err := audit.configured.Close(); err != nil {
+			log.Printf("Error closing audit log: %v", err)
+		}
+		audit.logger, audit.configured = nil, nil
+	}
+	if path == "" {
+		return
+	}
+	logger, err := newFileAuditLogger(path, auditBufferSize)
+	if err != nil {
+		log.Printf("Failed to open audit log, auditing is disabled: %v", err)
+		return
+	}
+	audit.logger, audit.configured = logger, logger
+}
+
+// closeAuditLog flushes and closes the audit logger, if any
+func closeAuditLog() {
+	if logger := SetAuditLogger(nil); logger != nil {
+		if err := logger.Close(); err != nil {
+			log.Printf("Error closing audit log: %v", err)
+		}
+	}
+}
+
+// auditBufferSize is how many records may wait to be written before new
+// ones are dropped
+const auditBufferSize = 1024
+
+// fileAuditLogger appends audit records to a file as JSON lines. Records are
+// queued on a buffered channel and written by a single goroutine, so Log
+// never waits on the disk; when the queue is full the record is dropped and
+// counted.
+type fileAuditLogger struct {
+	file    *os.File
+	records chan AuditRecord
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newFileAuditLogger opens path for appending, creating it if needed, and
+// starts the goroutine writing to it
+func newFileAuditLogger(path string, bufferSize int) (*fileAuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %v", path, err)
+	}
+	logger := &fileAuditLogger{
+		file:    file,
+		records: make(chan AuditRecord, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go logger.run()
+	return logger, nil
+}
+
+func (l *fileAuditLogger) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.file)
+	for record := range l.records {
+		if err := enc.Encode(record); err != nil {
+			log.Printf("Failed to write audit record for request %s: %v", record.RequestID, err)
+		}
+	}
+}
+
+// Log queues record to be written without blocking
+func (l *fileAuditLogger) Log(record AuditRecord) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		auditRecordsDropped.Inc()
+		return
+	}
+	select {
+	case l.records <- record:
+	default:
+		auditRecordsDropped.Inc()
+	}
+}
+
+// Close writes the queued records and closes the file
+func (l *fileAuditLogger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+
+	<-l.done
+	return l.file.Close()
+}
+
+// promptHashLength is how many hex digits of the prompt's SHA-256 are kept
+const promptHashLength = 16
+
+// hashPrompt returns a truncated SHA-256 of a chat request's messages, enough
+// to tell whether two audited requests sent the same prompt
+func hashPrompt(requestBody map[string]interface{}) string {
+	messages, ok := requestBody["messages"]
+	if !ok {
+		return ""
+	}
+	encoded, err := json.Marshal(messages)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])[:promptHashLength]
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLogRecordsRequests(t *testing.T) {
+	server := newMarketplaceServer("audit-model", "Audit Model", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"hi\"}}]}\n\n" +
+				"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 7, \"completion_tokens\": 2, \"total_tokens\": 9}}\n\n" +
+				"data: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "hi"}}], "usage": {"prompt_tokens": 5, "completion_tokens": 1, "total_tokens": 6}}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := config
+	defer applyConfig(cfg)
+	audited := cfg
+	audited.AuditLogPath = path
+	applyConfig(audited)
+
+	const secret = "my card number is 4111"
+	ProxyChatCompletion(newFlushRecorder(), newChatRequest(`{"model": "Audit Model", "messages": [{"role": "user", "content": "`+secret+`"}]}`))
+	ProxyChatCompletion(newFlushRecorder(), newChatRequest(`{"model": "Audit Model", "stream": true, "messages": [{"role": "user", "content": "`+secret+`"}]}`))
+	ProxyChatCompletion(newFlushRecorder(), newChatRequest(`{"model": "Audit Model", "seed": "abc", "messages": []}`))
+	closeAuditLog()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Errorf("audit log contains prompt text:\n%s", data)
+	}
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit line %q is not JSON: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("audit records = %d, want 3:\n%s", len(records), data)
+	}
+
+	plain, stream, failed := records[0], records[1], records[2]
+	if plain.Model != "Audit Model" || plain.ModelID != "audit-model" || plain.Status != http.StatusOK || plain.Stream {
+		t.Errorf("non-streaming record = %+v", plain)
+	}
+	if plain.PromptTokens != 5 || plain.CompletionTokens != 1 || plain.TotalTokens != 6 {
+		t.Errorf("non-streaming usage = %d/%d/%d, want 5/1/6", plain.PromptTokens, plain.CompletionTokens, plain.TotalTokens)
+	}
+	if !stream.Stream || stream.Status != http.StatusOK || stream.TotalTokens != 9 {
+		t.Errorf("streaming record = %+v, want one record with the final usage", stream)
+	}
+	if len(plain.PromptHash) != promptHashLength || plain.PromptHash != stream.PromptHash {
+		t.Errorf("prompt hashes = %q and %q, want equal %d-digit hashes", plain.PromptHash, stream.PromptHash, promptHashLength)
+	}
+	if failed.Status != http.StatusBadRequest || failed.Error == "" {
+		t.Errorf("failed request record = %+v, want a 400 with its error", failed)
+	}
+	if plain.RequestID == "" || plain.Timestamp.IsZero() {
+		t.Errorf("record is missing its request ID or timestamp: %+v", plain)
+	}
+}
+
+type recordingAuditLogger struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (l *recordingAuditLogger) Log(record AuditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+}
+
+func (l *recordingAuditLogger) Close() error { return nil }
+
+func TestSetAuditLoggerSurvivesConfigReload(t *testing.T) {
+	logger := &recordingAuditLogger{}
+	defer SetAuditLogger(SetAuditLogger(logger))
+
+	cfg := config
+	defer applyConfig(cfg)
+	reloaded := cfg
+	reloaded.AuditLogPath = filepath.Join(t.TempDir(), "ignored.jsonl")
+	applyConfig(reloaded)
+
+	if got := getAuditLogger(); got != AuditLogger(logger) {
+		t.Errorf("audit logger after reload = %v, want the one set with SetAuditLogger", got)
+	}
+}
+
+func TestFileAuditLoggerDropsAfterClose(t *testing.T) {
+	logger, err := newFileAuditLogger(filepath.Join(t.TempDir(), "audit.jsonl"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := auditRecordsDropped.Value()
+	logger.Log(AuditRecord{RequestID: "late"})
+	if got := auditRecordsDropped.Value() - dropped; got != 1 {
+		t.Errorf("dropped records = %v, want 1", got)
+	}
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInsufficientBalance marks upstream refusals caused by the wallet being
+// unable to fund a session
+var ErrInsufficientBalance = errors.New("insufficient wallet balance")
+
+const insufficientBalanceMessage = "The proxy wallet has insufficient balance to fund a session; top up WALLET_ADDRESS and retry"
+
+// WalletBalance is the wallet balance reported by the consumer node, in wei
+type WalletBalance struct {
+	ETH     *big.Int
+	MOR     *big.Int
+	Checked time.Time
+}
+
+var balanceCache = struct {
+	sync.Mutex
+	balance *WalletBalance
+	// err is the last failed fetch, reported until errUntil rather than
+	// querying a failing node on every request
+	err      error
+	errUntil time.Time
+	// fetch is the query to the node in progress, if any
+	fetch *balanceFetch
+}{}
+
+// balanceFetch is a wallet balance query shared by the requests that need
+// it; done is closed once balance or err is set
+type balanceFetch struct {
+	done    chan struct{}
+	balance *WalletBalance
+	err     error
+}
+
+// walletBalanceErrorCacheDuration is how long a failed balance fetch is
+// reported before the node is queried again
+const walletBalanceErrorCacheDuration = 5 * time.Second
+
+// getWalletBalanceEndpoint returns the URL queried for the wallet balance
+func getWalletBalanceEndpoint() string {
+	return getEnvOrDefault("WALLET_BALANCE_URL", fmt.Sprintf("%s/blockchain/balance", getMarketplaceBaseURL()))
+}
+
+func getWalletBalanceCacheDuration() time.Duration {
+	return time.Duration(getEnvInt("WALLET_BALANCE_CACHE_SECONDS", 60)) * time.Second
+}
+
+// getAdmissionMinBalance returns the MOR balance (in wei) below which new
+// requests are refused. ok is false when admission control is disabled.
+func getAdmissionMinBalance() (min *big.Int, ok bool) {
+	minStr := strings.TrimSpace(os.Getenv("ADMISSION_MIN_BALANCE"))
+	if minStr == "" {
+		return nil, false
+	}
+	min, ok = new(big.Int).SetString(minStr, 10)
+	if !ok {
+		log.Printf("Invalid ADMISSION_MIN_BALANCE value: %s, admission control disabled", minStr)
+		return nil, false
+	}
+	return min, true
+}
+
+// fetchWalletBalance queries the consumer node for the wallet balance
+func fetchWalletBalance() (*WalletBalance, error) {
+	client := newMarketplaceClient(10 * time.Second)
+	resp, err := client.Get(getWalletBalanceEndpoint())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch wallet balance: %v", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wallet balance: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch wallet balance, status: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var result struct {
+		ETH string `json:"eth"`
+		MOR string `json:"mor"`
+	}
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode wallet balance: %v", err)
+	}
+
+	balance := &WalletBalance{ETH: new(big.Int), MOR: new(big.Int), Checked: now()}
+	if _, ok := balance.MOR.SetString(result.MOR, 10); !ok {
+		return nil, fmt.Errorf("invalid MOR balance in response: %q", result.MOR)
+	}
+	if result.ETH != "" {
+		if _, ok := balance.ETH.SetString(result.ETH, 10); !ok {
+			return nil, fmt.Errorf("invalid ETH balance in response: %q", result.ETH)
+		}
+	}
+	return balance, nil
+}
+
+// currentWalletBalance returns the cached wallet balance, refreshing it once
+// it is older than WALLET_BALANCE_CACHE_SECONDS. The node is queried without
+// holding the cache lock, and concurrent callers share a single query.
+func currentWalletBalance() (*WalletBalance, error) {
+	balanceCache.Lock()
+	if balanceCache.balance != nil && now().Sub(balanceCache.balance.Checked) < getWalletBalanceCacheDuration() {
+		balance := balanceCache.balance
+		balanceCache.Unlock()
+		return balance, nil
+	}
+	if balanceCache.err != nil && now().Before(balanceCache.errUntil) {
+		err := balanceCache.err
+		balanceCache.Unlock()
+		return nil, err
+	}
+	if fetch := balanceCache.fetch; fetch != nil {
+		balanceCache.Unlock()
+		<-fetch.done
+		return fetch.balance, fetch.err
+	}
+	fetch := &balanceFetch{done: make(chan struct{})}
+	balanceCache.fetch = fetch
+	balanceCache.Unlock()
+
+	fetch.balance, fetch.err = fetchWalletBalance()
+
+	balanceCache.Lock()
+	balanceCache.fetch = nil
+	if fetch.err != nil {
+		balanceCache.err, balanceCache.errUntil = fetch.err, now().Add(walletBalanceErrorCacheDuration)
+	} else {
+		balanceCache.balance, balanceCache.err = fetch.balance, nil
+	}
+	balanceCache.Unlock()
+	close(fetch.done)
+	return fetch.balance, fetch.err
+}
+
+// invalidateWalletBalance forces the next balance read to query the node
+func invalidateWalletBalance() {
+	balanceCache.Lock()
+	defer balanceCache.Unlock()
+	balanceCache.balance = nil
+	balanceCache.err = nil
+}
+
+// isCriticalRequest reports whether a request is exempt from admission control
+func isCriticalRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("X-Request-Priority"), "critical")
+}
+
+// checkBalanceAdmission returns an error if a new request should be refused
+// because the wallet balance is below ADMISSION_MIN_BALANCE. Only new requests
+// are checked, so requests already in flight are allowed to finish. If the
+// balance cannot be determined the request is admitted.
+func checkBalanceAdmission(r *http.Request) error {
+	min, ok := getAdmissionMinBalance()
+	if !ok || isCriticalRequest(r) {
+		return nil
+	}
+
+	balance, err := currentWalletBalance()
+	if err != nil {
+		log.Printf("Skipping balance admission check: %v", err)
+		return nil
+	}
+
+	if balance.MOR.Cmp(min) < 0 {
+		return fmt.Errorf("wallet balance %s is below the admission threshold of %s", balance.MOR, min)
+	}
+	return nil
+}
+
+// isInsufficientBalanceResponse reports whether an upstream error response
+// means the wallet cannot pay for the session
+func isInsufficientBalanceResponse(status int, body []byte) bool {
+	if status == http.StatusPaymentRequired {
+		return true
+	}
+	lower := strings.ToLower(string(body))
+	return strings.Contains(lower, "insufficient") &&
+		(strings.Contains(lower, "balance") || strings.Contains(lower, "funds") || strings.Contains(lower, "allowance"))
+}
+
+// getMinWalletBalance returns the MOR balance (in wei) below which a warning is
+// logged at startup, defaulting to zero
+func getMinWalletBalance() *big.Int {
+	min := new(big.Int)
+	minStr := strings.TrimSpace(os.Getenv("MIN_WALLET_BALANCE"))
+	if minStr == "" {
+		return min
+	}
+	if _, ok := min.SetString(minStr, 10); !ok {
+		log.Printf("Invalid MIN_WALLET_BALANCE value: %s, using default of 0", minStr)
+		return new(big.Int)
+	}
+	return min
+}
+
+// checkWalletBalanceAtStartup logs the wallet balance and warns when it is
+// empty or below MIN_WALLET_BALANCE; a balance of exactly the minimum is
+// enough. Failures are logged; they never stop startup.
+func checkWalletBalanceAtStartup() {
+	wallet := os.Getenv("WALLET_ADDRESS")
+	balance, err := currentWalletBalance()
+	if err != nil {
+		log.Printf("WARNING: could not check balance for wallet %s: %v", wallet, err)
+		return
+	}
+
+	min := getMinWalletBalance()
+	if balance.MOR.Sign() == 0 || balance.MOR.Cmp(min) < 0 {
+		log.Printf("WARNING: wallet %s MOR balance %s is below the minimum of %s; sessions may fail to open", wallet, balance.MOR, min)
+		return
+	}
+	log.Printf("Wallet %s balance: %s MOR wei, %s ETH wei", wallet, balance.MOR, balance.ETH)
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBalanceServer(mor string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/balance" {
+			fmt.Fprintf(w, `{"eth": "1000000000000000000", "mor": "%s"}`, mor)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+func TestCheckBalanceAdmission(t *testing.T) {
+	tests := []struct {
+		name     string
+		balance  string
+		minimum  string
+		priority string
+		wantErr  bool
+	}{
+		{
+			name:    "disabled without threshold",
+			balance: "10",
+			minimum: "",
+			wantErr: false,
+		},
+		{
+			name:    "balance above threshold",
+			balance: "5000",
+			minimum: "1000",
+			wantErr: false,
+		},
+		{
+			name:    "balance below threshold",
+			balance: "10",
+			minimum: "1000",
+			wantErr: true,
+		},
+		{
+			name:     "critical request bypasses threshold",
+			balance:  "10",
+			minimum:  "1000",
+			priority: "critical",
+			wantErr:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newBalanceServer(tt.balance)
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("ADMISSION_MIN_BALANCE", tt.minimum)
+			defer os.Unsetenv("ADMISSION_MIN_BALANCE")
+			invalidateWalletBalance()
+			defer invalidateWalletBalance()
+
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			if tt.priority != "" {
+				req.Header.Set("X-Request-Priority", tt.priority)
+			}
+
+			err := checkBalanceAdmission(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkBalanceAdmission() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionBalanceAdmission(t *testing.T) {
+	server := newBalanceServer("10")
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("ADMISSION_MIN_BALANCE", "1000")
+	defer os.Unsetenv("ADMISSION_MIN_BALANCE")
+	invalidateWalletBalance()
+	defer invalidateWalletBalance()
+
+	reqBytes := []byte(`{"model": "Test Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(reqBytes))
+	w := httptest.NewRecorder()
+
+	ProxyChatCompletion(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected status 402, got %v", w.Code)
+	}
+}
+
+func TestCurrentWalletBalanceSharesFetch(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		fail := failing
+		mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		<-release
+		fmt.Fprint(w, `{"eth": "1", "mor": "42"}`)
+	}))
+	defer server.Close()
+	os.Setenv("WALLET_BALANCE_URL", server.URL)
+	defer os.Unsetenv("WALLET_BALANCE_URL")
+	invalidateWalletBalance()
+	defer invalidateWalletBalance()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			balance, err := currentWalletBalance()
+			if err == nil && balance.MOR.String() != "42" {
+				err = fmt.Errorf("balance = %s, want 42", balance.MOR)
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetches = %d, want concurrent callers to share one", fetches)
+	}
+
+	// A failing node is not queried again until the error has aged out
+	invalidateWalletBalance()
+	mu.Lock()
+	failing, fetches = true, 0
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if _, err := currentWalletBalance(); err == nil {
+			t.Error("currentWalletBalance() = nil error from a failing node")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 1 {
+		t.Errorf("fetches = %d, want the failure cached", fetches)
+	}
+}
+
+func TestInsufficientBalanceSessionError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: "broke-model", Name: "Broke Model"}},
+			})
+		case "/blockchain/models/broke-model/session":
+			attempts++
+			http.Error(w, `{"error": "insufficient balance to open session"}`, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+
+	reqBytes := []byte(`{"model": "Broke Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(reqBytes))
+	w := httptest.NewRecorder()
+
+	ProxyChatCompletion(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected status 402, got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "insufficient balance") {
+		t.Errorf("Expected a clear balance error, got %s", w.Body.String())
+	}
+	if attempts != 1 {
+		t.Errorf("insufficient balance should not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestCheckWalletBalanceAtStartupWarns(t *testing.T) {
+	os.Setenv("MIN_WALLET_BALANCE", "100")
+	defer os.Unsetenv("MIN_WALLET_BALANCE")
+	defer invalidateWalletBalance()
+
+	for balance, wantWarning := range map[string]bool{"5": true, "100": false, "101": false} {
+		server := newBalanceServer(balance)
+		restoreURL := useMarketplaceURL(server.URL)
+		invalidateWalletBalance()
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		checkWalletBalanceAtStartup()
+		log.SetOutput(os.Stderr)
+		restoreURL()
+		server.Close()
+
+		warned := strings.Contains(buf.String(), "WARNING") && strings.Contains(buf.String(), "below the minimum")
+		if warned != wantWarning {
+			t.Errorf("balance %s of a minimum 100: warned = %v, want %v: %q", balance, warned, wantWarning, buf.String())
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultBatchMaxSize is the most chat requests one /v1/batch call may carry
+// when BATCH_MAX_SIZE is unset
+const defaultBatchMaxSize = 100
+
+// getBatchMaxSize returns BATCH_MAX_SIZE, the most chat requests one batch
+// may carry
+func getBatchMaxSize() int {
+	return getEnvInt("BATCH_MAX_SIZE", defaultBatchMaxSize)
+}
+
+// defaultBatchTimeout bounds a whole /v1/batch call when BATCH_TIMEOUT_SECONDS
+// is unset
+const defaultBatchTimeout = 10 * time.Minute
+
+// getBatchTimeout returns BATCH_TIMEOUT_SECONDS, how long a batch may run
+// before its unfinished requests are cancelled; 0 is unlimited
+func getBatchTimeout() time.Duration {
+	return getEnvSeconds("BATCH_TIMEOUT_SECONDS", defaultBatchTimeout)
+}
+
+// isBatchItem reports whether ctx is that of a request served as part of a
+// batch
+func isBatchItem(ctx context.Context) bool {
+	item, _ := ctx.Value(batchItemKey).(bool)
+	return item
+}
+
+// acquireSlot takes a slot in pool for a request, waiting up to wait for one.
+// A batch item, whose batch already bounds how many of its requests run at
+// once, waits as long as its batch allows rather than fail while other
+// traffic holds the slots.
+func acquireSlot(ctx context.Context, pool *concurrencyPool, wait time.Duration) bool {
+	if isBatchItem(ctx) {
+		return pool.wait(ctx)
+	}
+	return pool.acquire(ctx, wait)
+}
+
+// BatchResult is the outcome of one chat request in a batch: the status and
+// body it would have been answered with on its own
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+var batchItems = metrics.counter("morpheus_proxy_batch_items_total",
+	"Chat requests served as part of a batch, by status code", "code")
+
+// handleBatch serves /v1/batch. It takes a JSON array of chat completion
+// requests, serves them concurrently, at most MAX_CONCURRENT_UPSTREAM at a
+// time, over the models' shared sessions, and answers with their results in
+// input order. A failed request is reported in its result and does not fail
+// the batch. Streaming is not supported.
+//
+// A batch may well outlast SERVER_WRITE_TIMEOUT_SECONDS, so the server's
+// write deadline is lifted and the batch bounded by BATCH_TIMEOUT_SECONDS
+// instead; requests unfinished by then are answered with a 504 in their
+// results, alongside those that completed.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	requestID := ensureRequestID(w, r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if isDraining() {
+		respondDraining(w)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read request body")
+		return
+	}
+	var requests []json.RawMessage
+	if err := json.Unmarshal(bodyBytes, &requests); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Request body must be a JSON array of chat completion requests")
+		return
+	}
+	if len(requests) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Batch is empty")
+		return
+	}
+	if maxSize := getBatchMaxSize(); maxSize > 0 && len(requests) > maxSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Batch of %d requests exceeds the limit of %d", len(requests), maxSize))
+		return
+	}
+	log.Printf("Batch request %s with %d chat requests", requestID, len(requests))
+
+	clearWriteDeadline(w)
+	ctx := r.Context()
+	if timeout := getBatchTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// The batch's own access log line is not the items' to fill in
+	ctx = context.WithValue(ctx, accessLogKey{}, (*accessLogEntry)(nil))
+	ctx = context.WithValue(ctx, batchItemKey, true)
+	limit := config.MaxConcurrentUpstream
+	if limit <= 0 || limit > len(requests) {
+		limit = len(requests)
+	}
+	slots := make(chan struct{}, limit)
+	results := make([]BatchResult, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request json.RawMessage) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results[i] = batchCancelled(ctx, i)
+				return
+			}
+			results[i] = serveBatchItem(ctx, r, requestID, i, request)
+			if results[i].Status != http.StatusOK && ctx.Err() != nil {
+				results[i] = batchCancelled(ctx, i)
+			}
+		}(i, request)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		batchItems.Inc(strconv.Itoa(result.Status))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// serveBatchItem serves one request of a batch as a chat completion of its
+// own, with the batch's headers and a request ID derived from the batch's
+func serveBatchItem(ctx context.Context, r *http.Request, requestID string, index int, request json.RawMessage) BatchResult {
+	var fields struct {
+		Stream bool `json:"stream"`
+	}
+	if json.Unmarshal(request, &fields) == nil && fields.Stream {
+		return batchError(index, http.StatusBadRequest, "Streaming is not supported in a batch")
+	}
+
+	item := r.Clone(ctx)
+	item.URL.Path = "/v1/chat/completions"
+	item.Body = io.NopCloser(bytes.NewReader(request))
+	item.ContentLength = int64(len(request))
+	item.Header.Set(requestIDHeader, fmt.Sprintf("%s-%d", requestID, index))
+	// The result is embedded in the batch's body, so it must be uncompressed
+	item.Header.Del("Accept-Encoding")
+	// A key for the whole batch would make every item replay the first
+	item.Header.Del(idempotencyKeyHeader)
+
+	rec := newBufferedResponseWriter()
+	ProxyChatCompletion(rec, item)
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := rec.body.Bytes()
+	if !json.Valid(body) {
+		return batchError(index, http.StatusBadGateway, "Invalid response from the marketplace")
+	}
+	return BatchResult{Index: index, Status: status, Body: json.RawMessage(body)}
+}
+
+// batchCancelled is the result of a batch item cut short by the batch's
+// context: by BATCH_TIMEOUT_SECONDS, or by the client going away
+func batchCancelled(ctx context.Context, index int) BatchResult {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return batchError(index, http.StatusGatewayTimeout, fmt.Sprintf("Batch did not complete within %v", getBatchTimeout()))
+	}
+	return batchError(index, http.StatusServiceUnavailable, "Batch request was cancelled")
+}
+
+// batchError is the result of a batch item that failed with message, in the
+// same shape as the error response it would have had on its own
+func batchError(index, status int, message string) BatchResult {
+	rec := newBufferedResponseWriter()
+	respondWithError(rec, status, message)
+	return BatchResult{Index: index, Status: status, Body: json.RawMessage(rec.body.Bytes())}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBatchRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestBatchMixedResults(t *testing.T) {
+	server := newMarketplaceServer("batch-model", "Batch Model", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Messages[0].Content == "fail" {
+			http.Error(w, `{"error": {"message": "model not supported"}}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"content": "echo " + body.Messages[0].Content}}},
+		})
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	handleBatch(w, newBatchRequest(`[
+		{"model": "Batch Model", "messages": [{"role": "user", "content": "one"}]},
+		{"model": "Batch Model", "messages": [{"role": "user", "content": "fail"}]},
+		{"messages": [{"role": "user", "content": "no model"}]},
+		{"model": "Batch Model", "stream": true, "messages": [{"role": "user", "content": "stream"}]},
+		{"model": "Batch Model", "messages": [{"role": "user", "content": "two"}]}
+	]`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	var results []struct {
+		Index  int `json:"index"`
+		Status int `json:"status"`
+		Body   struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Error *APIError `json:"error"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid batch response: %v: %s", err, w.Body.String())
+	}
+
+	wantStatus := []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK}
+	if len(results) != len(wantStatus) {
+		t.Fatalf("got %d results, want %d", len(results), len(wantStatus))
+	}
+	for i, result := range results {
+		if result.Index != i || result.Status != wantStatus[i] {
+			t.Errorf("result %d = index %d status %d, want index %d status %d", i, result.Index, result.Status, i, wantStatus[i])
+		}
+		if result.Status != http.StatusOK && result.Body.Error == nil {
+			t.Errorf("result %d has no error body", i)
+		}
+	}
+	if got := results[0].Body.Choices[0].Message.Content; got != "echo one" {
+		t.Errorf("result 0 content = %q, want echo one", got)
+	}
+	if got := results[4].Body.Choices[0].Message.Content; got != "echo two" {
+		t.Errorf("result 4 content = %q, want results in input order", got)
+	}
+}
+
+func TestBatchBoundedConcurrency(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	bounded := cfg
+	bounded.MaxConcurrentUpstream = 2
+	applyConfig(bounded)
+
+	var inFlight, peak atomic.Int32
+	server := newMarketplaceServer("bounded-model", "Bounded Model", func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	item := `{"model": "Bounded Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	w := httptest.NewRecorder()
+	handleBatch(w, newBatchRequest("["+strings.Repeat(item+",", 5)+item+"]"))
+
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid batch response: %v: %s", err, w.Body.String())
+	}
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			t.Errorf("result %d status = %d, want 200: %s", result.Index, result.Status, result.Body)
+		}
+	}
+	if got := peak.Load(); got > 2 {
+		t.Errorf("peak upstream concurrency = %d, want at most 2", got)
+	}
+}
+
+func TestBatchRejectsInvalidBatches(t *testing.T) {
+	os.Setenv("BATCH_MAX_SIZE", "2")
+	defer os.Unsetenv("BATCH_MAX_SIZE")
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not an array", `{"model": "m"}`},
+		{"empty", `[]`},
+		{"too large", `[{}, {}, {}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleBatch(w, newBatchRequest(tt.body))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %v, want 400: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBatchItemsWaitForUpstreamSlots(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	bounded := cfg
+	bounded.MaxConcurrentUpstream = 1
+	bounded.UpstreamQueueTimeout = 0
+	applyConfig(bounded)
+
+	server := newMarketplaceServer("queued-model", "Queued Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	// Other traffic holds the only upstream slot for a while
+	if !upstreamPool.tryAcquire() {
+		t.Fatal("could not take the upstream slot")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		upstreamPool.release()
+	}()
+
+	item := `{"model": "Queued Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	w := httptest.NewRecorder()
+	handleBatch(w, newBatchRequest("["+item+","+item+"]"))
+
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid batch response: %v: %s", err, w.Body.String())
+	}
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			t.Errorf("result %d status = %d, want 200 once the slot was free: %s", result.Index, result.Status, result.Body)
+		}
+	}
+}
+
+func TestBatchTimeoutKeepsCompletedResults(t *testing.T) {
+	os.Setenv("BATCH_TIMEOUT_SECONDS", "1")
+	defer os.Unsetenv("BATCH_TIMEOUT_SECONDS")
+
+	server := newMarketplaceServer("timed-model", "Timed Model", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "slow") {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handleBatch(w, newBatchRequest(`[
+		{"model": "Timed Model", "messages": [{"role": "user", "content": "fast"}]},
+		{"model": "Timed Model", "messages": [{"role": "user", "content": "slow"}]}
+	]`))
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("batch took %v, want it cut off after about 1s", elapsed)
+	}
+
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid batch response: %v: %s", err, w.Body.String())
+	}
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusGatewayTimeout {
+		t.Errorf("results = %+v, want the fast request's 200 and a 504 for the slow one", results)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sony/gobreaker"
+)
+
+// breakerOverride is an operator's manual setting of the circuit breaker,
+// which takes precedence over gobreaker's own state until reset
+type breakerOverride string
+
+const (
+	// breakerAutomatic leaves the state to gobreaker
+	breakerAutomatic breakerOverride = "none"
+	// breakerForcedOpen refuses all marketplace traffic
+	breakerForcedOpen breakerOverride = "forced-open"
+	// breakerForcedClosed lets all marketplace traffic through, even while
+	// gobreaker would refuse it
+	breakerForcedClosed breakerOverride = "forced-closed"
+)
+
+// ErrBreakerOpen marks marketplace calls refused by an open circuit breaker
+var ErrBreakerOpen = gobreaker.ErrOpenState
+
+// marketplaceBreaker wraps the gobreaker circuit breaker with manual
+// overrides. Reset drops the override and starts gobreaker afresh.
+type marketplaceBreaker struct {
+	mu       sync.RWMutex
+	settings gobreaker.Settings
+	cb       *gobreaker.CircuitBreaker
+	override breakerOverride
+}
+
+func newMarketplaceBreaker(settings gobreaker.Settings) *marketplaceBreaker {
+	return &marketplaceBreaker{settings: settings, cb: gobreaker.NewCircuitBreaker(settings), override: breakerAutomatic}
+}
+
+// Name returns the breaker's name
+func (b *marketplaceBreaker) Name() string {
+	return b.settings.Name
+}
+
+// State returns the effective state: the override's, if there is one,
+// otherwise gobreaker's
+func (b *marketplaceBreaker) State() gobreaker.State {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	switch b.override {
+	case breakerForcedOpen:
+		return gobreaker.StateOpen
+	case breakerForcedClosed:
+		return gobreaker.StateClosed
+	}
+	return b.cb.State()
+}
+
+// Execute runs req through the breaker. While forced open req is not run;
+// while forced closed it runs without gobreaker counting it.
+func (b *marketplaceBreaker) Execute(req func() (interface{}, error)) (interface{}, error) {
+	b.mu.RLock()
+	override, cb := b.override, b.cb
+	b.mu.RUnlock()
+	switch override {
+	case breakerForcedOpen:
+		return nil, ErrBreakerOpen
+	case breakerForcedClosed:
+		return req()
+	}
+	return cb.Execute(req)
+}
+
+// allow reports ErrBreakerOpen if the breaker refuses traffic
+func (b *marketplaceBreaker) allow() error {
+	if b.State() == gobreaker.StateOpen {
+		return ErrBreakerOpen
+	}
+	return nil
+}
+
+// errServerError marks a 5xx marketplace response to gobreaker, which counts
+// it as a failure although the response is still relayed
+var errServerError = errors.New("marketplace server error")
+
+// do sends a marketplace request through the breaker. Transport errors and
+// 5xx responses count as failures; a 5xx response is still returned. A request
+// cut short by its caller going away is not held against the marketplace.
+// When the breaker refuses the request, the error wraps ErrBreakerOpen.
+func (b *marketplaceBreaker) do(ctx context.Context, send func() (*http.Response, error)) (*http.Response, error) {
+	var resp *http.Response
+	var sendErr error
+	_, err := b.Execute(func() (interface{}, error) {
+		resp, sendErr = send()
+		switch {
+		case sendErr != nil && errors.Is(ctx.Err(), context.Canceled):
+			return nil, nil
+		case sendErr != nil:
+			return nil, sendErr
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return nil, errServerError
+		}
+		return nil, nil
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return nil, fmt.Errorf("%w: %v", ErrBreakerOpen, err)
+	}
+	return resp, sendErr
+}
+
+// setOverride forces the breaker open or closed, or with breakerAutomatic
+// resets it
+func (b *marketplaceBreaker) setOverride(override breakerOverride) {
+	b.mu.Lock()
+	previous := b.override
+	b.override = override
+	if override == breakerAutomatic {
+		b.cb = gobreaker.NewCircuitBreaker(b.settings)
+	}
+	b.mu.Unlock()
+	log.Printf("Circuit breaker override changed from %s to %s", previous, override)
+}
+
+// BreakerStatus is the response of the circuit breaker admin endpoints
+type BreakerStatus struct {
+	State          string           `json:"state"`
+	AutomaticState string           `json:"automaticState"`
+	Override       breakerOverride  `json:"override"`
+	Counts         gobreaker.Counts `json:"counts"`
+}
+
+func (b *marketplaceBreaker) status() BreakerStatus {
+	b.mu.RLock()
+	override, cb := b.override, b.cb
+	b.mu.RUnlock()
+	return BreakerStatus{
+		State:          b.State().String(),
+		AutomaticState: cb.State().String(),
+		Override:       override,
+		Counts:         cb.Counts(),
+	}
+}
+
+// breakerActions are the admin actions under /admin/breaker/
+var breakerActions = map[string]breakerOverride{
+	"open":  breakerForcedOpen,
+	"close": breakerForcedClosed,
+	"reset": breakerAutomatic,
+}
+
+// handleBreaker serves GET /admin/breaker with the breaker's state, and
+// POST /admin/breaker/{open,close,reset} to override or reset it
+func handleBreaker(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/breaker"), "/")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+	} else {
+		override, ok := breakerActions[action]
+		if !ok {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Unknown circuit breaker action %q", action))
+			return
+		}
+		if r.Method != http.MethodPost {
+			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		circuitBreaker.setOverride(override)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circuitBreaker.status())
+}
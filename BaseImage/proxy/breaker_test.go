@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sony/gobreaker"
+)
+
+// tripBreaker fails calls through b until gobreaker opens it
+func tripBreaker(t *testing.T, b *marketplaceBreaker) {
+	t.Helper()
+	for i := 0; i < 10 && b.State() != gobreaker.StateOpen; i++ {
+		b.Execute(func() (interface{}, error) { return nil, errors.New("provider down") })
+	}
+	if b.State() != gobreaker.StateOpen {
+		t.Fatal("breaker did not trip")
+	}
+}
+
+func TestBreakerOverridePrecedence(t *testing.T) {
+	b := newCircuitBreaker(config)
+	ran := false
+	run := func() (interface{}, error) { ran = true; return nil, nil }
+
+	// Forced open wins over a closed breaker
+	b.setOverride(breakerForcedOpen)
+	if b.State() != gobreaker.StateOpen {
+		t.Errorf("forced-open state = %v, want open", b.State())
+	}
+	if _, err := b.Execute(run); !errors.Is(err, ErrBreakerOpen) || ran {
+		t.Errorf("Execute() while forced open = %v, ran = %v", err, ran)
+	}
+	if b.allow() == nil {
+		t.Error("allow() while forced open = nil")
+	}
+
+	// Forced closed wins over a breaker gobreaker has opened
+	b.setOverride(breakerAutomatic)
+	tripBreaker(t, b)
+	b.setOverride(breakerForcedClosed)
+	if b.State() != gobreaker.StateClosed {
+		t.Errorf("forced-closed state = %v, want closed", b.State())
+	}
+	if _, err := b.Execute(run); err != nil || !ran {
+		t.Errorf("Execute() while forced closed = %v, ran = %v", err, ran)
+	}
+	if got := b.status(); got.AutomaticState != "open" || got.Override != breakerForcedClosed {
+		t.Errorf("status = %+v, want gobreaker open under a forced-closed override", got)
+	}
+
+	// Reset hands the state back to a fresh gobreaker
+	b.setOverride(breakerAutomatic)
+	if b.State() != gobreaker.StateClosed || b.allow() != nil {
+		t.Errorf("state after reset = %v, want closed", b.State())
+	}
+}
+
+func TestBreakerAdminEndpoints(t *testing.T) {
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+	cfg := config
+	defer applyConfig(cfg)
+	mux := newTestMux(t, &cfg)
+
+	call := func(method, path string) (int, BreakerStatus) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", "secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var status BreakerStatus
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status
+	}
+
+	if code, status := call(http.MethodGet, "/admin/breaker"); code != http.StatusOK || status.State != "closed" || status.Override != breakerAutomatic {
+		t.Errorf("GET /admin/breaker = %v %+v", code, status)
+	}
+	if code, status := call(http.MethodPost, "/admin/breaker/open"); code != http.StatusOK || status.State != "open" {
+		t.Errorf("POST /admin/breaker/open = %v %+v", code, status)
+	}
+	if code, _ := call(http.MethodGet, "/admin/breaker/close"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/breaker/close = %v, want 405", code)
+	}
+	if code, _ := call(http.MethodPost, "/admin/breaker/explode"); code != http.StatusNotFound {
+		t.Errorf("POST /admin/breaker/explode = %v, want 404", code)
+	}
+	if code, status := call(http.MethodPost, "/admin/breaker/reset"); code != http.StatusOK || status.State != "closed" || status.Override != breakerAutomatic {
+		t.Errorf("POST /admin/breaker/reset = %v %+v", code, status)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/breaker/open", nil))
+	if w.Code != http.StatusUnauthorized || circuitBreaker.State() != gobreaker.StateClosed {
+		t.Errorf("unauthenticated override: status %v, state %v", w.Code, circuitBreaker.State())
+	}
+}
+
+func TestForcedOpenBreakerStopsTraffic(t *testing.T) {
+	calls := 0
+	server := newMarketplaceServer("breaker-model", "Breaker Model", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	cfg := config
+	defer applyConfig(cfg)
+	applyConfig(cfg)
+
+	circuitBreaker.setOverride(breakerForcedOpen)
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Breaker Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusServiceUnavailable || calls != 0 {
+		t.Errorf("forced open: status = %v, upstream calls = %d, want 503 and none", w.Code, calls)
+	}
+
+	circuitBreaker.setOverride(breakerAutomatic)
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Breaker Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK || calls != 1 {
+		t.Errorf("after reset: status = %v, upstream calls = %d, want 200 and one", w.Code, calls)
+	}
+}
+
+func TestFailingForwardsOpenBreaker(t *testing.T) {
+	calls := 0
+	server := newMarketplaceServer("tripping-model", "Tripping Model", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "provider crashed"}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	cfg := config
+	defer applyConfig(cfg)
+	applyConfig(cfg)
+
+	body := `{"model": "Tripping Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	for i := 0; i < 10 && circuitBreaker.State() != gobreaker.StateOpen; i++ {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("request %d: status = %v, want the marketplace's 500 relayed", i+1, w.Code)
+		}
+	}
+	if circuitBreaker.State() != gobreaker.StateOpen {
+		t.Fatalf("breaker state after %d failing forwards = %v, want open", calls, circuitBreaker.State())
+	}
+
+	tripped := calls
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusServiceUnavailable || calls != tripped {
+		t.Errorf("open breaker: status = %v, upstream calls = %d, want 503 and no new call", w.Code, calls-tripped)
+	}
+
+	// Forced closed lets traffic through without gobreaker counting it
+	circuitBreaker.setOverride(breakerForcedClosed)
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if calls != tripped+1 || circuitBreaker.status().AutomaticState != "open" {
+		t.Errorf("forced closed: upstream calls = %d, status = %+v", calls-tripped, circuitBreaker.status())
+	}
+}
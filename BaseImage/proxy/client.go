@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Redirect policies accepted by MARKETPLACE_REDIRECT_POLICY
+const (
+	redirectPolicyFollow = "follow" // follow redirects, re-attaching the session header
+	redirectPolicyReject = "reject" // do not follow; surface the redirect as an error
+)
+
+const maxMarketplaceRedirects = 10
+
+// marketplaceTransport is the transport used for all marketplace requests.
+// nil means http.DefaultTransport; it is replaced to record or replay exchanges.
+var marketplaceTransport http.RoundTripper
+
+func getMarketplaceRedirectPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("MARKETPLACE_REDIRECT_POLICY")))
+	switch policy {
+	case "":
+		return redirectPolicyFollow
+	case redirectPolicyFollow, redirectPolicyReject:
+		return policy
+	default:
+		log.Printf("Invalid MARKETPLACE_REDIRECT_POLICY value: %s, using default of %s", policy, redirectPolicyFollow)
+		return redirectPolicyFollow
+	}
+}
+
+// newMarketplaceClient returns an HTTP client for requests to the marketplace
+// with redirect handling configured explicitly rather than left to the defaults.
+func newMarketplaceClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport:     marketplaceTransport,
+		Timeout:       timeout,
+		CheckRedirect: checkMarketplaceRedirect,
+	}
+}
+
+// checkMarketplaceRedirect applies MARKETPLACE_REDIRECT_POLICY. When following,
+// the session header from the original request is re-attached so the redirected
+// request is still bound to the same session, but only on the same scheme and
+// host: the session ID is never sent to another origin. A 301, 302 or 303 in
+// answer to a POST is not followed, since the client would resend it as a GET
+// without its body.
+func checkMarketplaceRedirect(req *http.Request, via []*http.Request) error {
+	if getMarketplaceRedirectPolicy() == redirectPolicyReject {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= maxMarketplaceRedirects {
+		return fmt.Errorf("stopped after %d marketplace redirects", maxMarketplaceRedirects)
+	}
+	if last := via[len(via)-1]; last.Method == http.MethodPost && req.Response != nil {
+		switch status := req.Response.StatusCode; status {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+			return fmt.Errorf("marketplace redirected a POST to %s with status %d, which would drop its body", req.URL, status)
+		}
+	}
+	sessionID := via[0].Header.Get(getSessionHeader())
+	if req.URL.Scheme == via[0].URL.Scheme && req.URL.Host == via[0].URL.Host {
+		if sessionID != "" {
+			setSessionHeader(req.Header, sessionID)
+		}
+	} else {
+		// The client copies custom headers across hosts
+		req.Header.Del(getSessionHeader())
+		if sessionID != "" {
+			log.Printf("Not sending the session header on the marketplace redirect to %s", req.URL.Host)
+		}
+	}
+	log.Printf("Following marketplace redirect (%d) to %s", len(via), req.URL)
+	return nil
+}
+
+// checkRedirectResponse returns an error describing an unfollowed redirect and
+// closes its body, or nil if resp is not a redirect.
+func checkRedirectResponse(resp *http.Response) error {
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+		return nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	log.Printf("Marketplace redirected request with status %d to %s", resp.StatusCode, location)
+	return fmt.Errorf("marketplace redirected request to %s (status %d) and MARKETPLACE_REDIRECT_POLICY is %s", location, resp.StatusCode, redirectPolicyReject)
+}
+
+// deadlineBody is a response body that is cut off once timeout has passed,
+// by cancelling the request's context. Closing it releases the context.
+type deadlineBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func newDeadlineBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *deadlineBody {
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	return &deadlineBody{ReadCloser: body, timer: timer, cancel: cancel}
+}
+
+func (b *deadlineBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
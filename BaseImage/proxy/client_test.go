@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardRequestRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chat/completions":
+			http.Redirect(w, r, "/moved/chat/completions", http.StatusTemporaryRedirect)
+		case "/moved/chat/completions":
+			if r.Header.Get("session_id") != "redirect-session" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"choices": []}`)
+		}
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions["redirect-model"] = &MorpheusSession{
+		SessionID: "redirect-session",
+		ModelID:   "redirect-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "redirect-model")
+
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name:    "default follows and keeps session header",
+			policy:  "",
+			wantErr: false,
+		},
+		{
+			name:    "follow keeps session header",
+			policy:  "follow",
+			wantErr: false,
+		},
+		{
+			name:    "reject surfaces redirect",
+			policy:  "reject",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("MARKETPLACE_REDIRECT_POLICY", tt.policy)
+			defer os.Unsetenv("MARKETPLACE_REDIRECT_POLICY")
+
+			resp, err := forwardRequest(httptest.NewRequest("POST", "/v1/chat/completions", nil), map[string]interface{}{"model": "redirect-model"}, "redirect-model")
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("forwardRequest() expected redirect error, got nil")
+				}
+				if !strings.Contains(err.Error(), "/moved/chat/completions") {
+					t.Errorf("error should mention redirect location, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("forwardRequest() error = %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected status OK after redirect, got %v", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestForwardRequestRedirectToAnotherHost(t *testing.T) {
+	var gotSession string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSession = r.Header.Get("session_id")
+		fmt.Fprint(w, `{"choices": []}`)
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/chat/completions", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions["cross-host-model"] = &MorpheusSession{SessionID: "cross-host-session", ModelID: "cross-host-model", Created: time.Now()}
+	defer delete(activeSessions, "cross-host-model")
+
+	resp, err := forwardRequest(httptest.NewRequest("POST", "/v1/chat/completions", nil), map[string]interface{}{"model": "cross-host-model"}, "cross-host-model")
+	if err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	resp.Body.Close()
+	if gotSession != "" {
+		t.Errorf("redirect to another host received session header %q", gotSession)
+	}
+}
+
+func TestForwardRequestRedirectDropsPost(t *testing.T) {
+	followed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chat/completions":
+			http.Redirect(w, r, "/moved/chat/completions", http.StatusFound)
+		case "/moved/chat/completions":
+			followed = true
+			fmt.Fprint(w, `{"choices": []}`)
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions["found-model"] = &MorpheusSession{SessionID: "found-session", ModelID: "found-model", Created: time.Now()}
+	defer delete(activeSessions, "found-model")
+
+	resp, err := forwardRequest(httptest.NewRequest("POST", "/v1/chat/completions", nil), map[string]interface{}{"model": "found-model"}, "found-model")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("forwardRequest() followed a 302 after a POST, want an error")
+	}
+	if followed {
+		t.Error("302 after a POST was followed")
+	}
+}
+
+func TestForwardFirstByteAndBodyTimeouts(t *testing.T) {
+	server := newMarketplaceServer("ttfb-model", "TTFB Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["user"] == "hung" {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		// Answer at once, then take longer than the first byte timeout to finish
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices": [`))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	defer func(firstByte, body time.Duration) {
+		config.ForwardTimeout, config.BodyTimeout = firstByte, body
+	}(config.ForwardTimeout, config.BodyTimeout)
+	config.ForwardTimeout = 100 * time.Millisecond
+	config.BodyTimeout = time.Second
+
+	t.Run("fast first byte, slow body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "TTFB Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+		if w.Code != http.StatusOK || w.Body.String() != `{"choices": []}` {
+			t.Errorf("slow body was cut off: %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("no first byte", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "TTFB Model", "user": "hung", "messages": [{"role": "user", "content": "Hello"}]}`))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want 504", w.Code)
+		}
+	})
+
+	t.Run("body timeout", func(t *testing.T) {
+		config.BodyTimeout = 50 * time.Millisecond
+		defer func() { config.BodyTimeout = time.Second }()
+
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "TTFB Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+		if w.Body.String() == `{"choices": []}` {
+			t.Errorf("body outlived the body timeout")
+		}
+	})
+}
+
+func TestForwardTimeoutPerModel(t *testing.T) {
+	server := newMarketplaceServer("reasoning-model", "Reasoning Model", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	cfg := config
+	defer applyConfig(cfg)
+	const body = `{"model": "Reasoning Model", "messages": [{"role": "user", "content": "Hello"}]}`
+
+	t.Run("override outlasts the global timeout", func(t *testing.T) {
+		override := cfg
+		override.ForwardTimeout = 50 * time.Millisecond
+		override.ModelForwardTimeouts = map[string]time.Duration{"reasoning-model": time.Second}
+		applyConfig(override)
+
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200 within the model's own timeout: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("override cuts a slow model short", func(t *testing.T) {
+		override := cfg
+		override.ForwardTimeout = time.Second
+		override.ForwardRetries = 0
+		override.ModelForwardTimeouts = map[string]time.Duration{"reasoning-model": 50 * time.Millisecond}
+		applyConfig(override)
+
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want 504 after the model's 50ms timeout", w.Code)
+		}
+	})
+
+	t.Run("other models use the global timeout", func(t *testing.T) {
+		override := cfg
+		override.ForwardTimeout = 45 * time.Second
+		override.ModelForwardTimeouts = map[string]time.Duration{"reasoning-model": 5 * time.Minute}
+		applyConfig(override)
+
+		if got := forwardTimeout("reasoning-model"); got != 5*time.Minute {
+			t.Errorf("forwardTimeout(reasoning-model) = %v, want 5m", got)
+		}
+		if got := forwardTimeout("small-model"); got != 45*time.Second {
+			t.Errorf("forwardTimeout(small-model) = %v, want the global 45s", got)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Session expiry, cache ages and upstream
+// timings are read through clock rather than time.Now so tests can move time
+// forward without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var (
+	clockMu sync.RWMutex
+	clock   Clock = realClock{}
+)
+
+// now returns the current time from the active clock
+func now() time.Time {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock.Now()
+}
+
+// SetClock replaces the clock used for time reads and returns the previous
+// one. A nil clock restores the wall clock.
+func SetClock(c Clock) Clock {
+	if c == nil {
+		c = realClock{}
+	}
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	previous := clock
+	clock = c
+	return previous
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSessionRefreshAndExpiryWithFakeClock(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+
+	defer func(seconds int) { config.SessionExpirationSeconds = seconds }(config.SessionExpirationSeconds)
+	config.SessionExpirationSeconds = 60
+
+	sessionsOpened := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: "clock-model", Name: "Clock Model"}}})
+		case "/blockchain/models/clock-model/session":
+			sessionsOpened++
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "clock-session"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions = make(map[string]*MorpheusSession)
+	SessionManagerInstance.UpdateSession("", "")
+
+	ensure := func(step string, wantOpened int) {
+		t.Helper()
+		if err := ensureSession(context.Background(), "clock-model"); err != nil {
+			t.Fatalf("%s: ensureSession: %v", step, err)
+		}
+		if sessionsOpened != wantOpened {
+			t.Errorf("%s: sessions opened = %d, want %d", step, sessionsOpened, wantOpened)
+		}
+	}
+
+	ensure("first request", 1)
+
+	// Each use inside the window refreshes the session, so two steps that
+	// together exceed it still reuse the same session
+	fake.Advance(59 * time.Second)
+	ensure("after 59s", 1)
+	fake.Advance(59 * time.Second)
+	ensure("59s after last use", 1)
+	if got := activeSessions["clock-model"].LastUsed; !got.Equal(fake.Now()) {
+		t.Errorf("LastUsed = %v, want %v", got, fake.Now())
+	}
+
+	// Idle past the window, the session is replaced
+	fake.Advance(61 * time.Second)
+	ensure("after expiry", 2)
+
+	// And removed by cleanup once it expires unused
+	fake.Advance(61 * time.Second)
+	cleanupExpiredSessions()
+	if _, exists := activeSessions["clock-model"]; exists {
+		t.Error("expired session was not cleaned up")
+	}
+}
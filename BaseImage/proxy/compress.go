@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip,
+// honouring "q=0" refusals and the "*" wildcard
+func acceptsGzip(r *http.Request) bool {
+	wildcard := false
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			accepted := true
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				weight, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+				accepted = err == nil && weight > 0
+			}
+			if name == "gzip" {
+				return accepted
+			}
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+// shouldCompress reports whether a non-streaming marketplace response is
+// gzipped for the client: GZIP_RESPONSES is on, the client accepts gzip, and
+// the response is neither already encoded nor an event stream, whose
+// flushing compression would defeat
+func shouldCompress(r *http.Request, resp *http.Response) bool {
+	if !config.GzipResponses || !acceptsGzip(r) {
+		return false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	return !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// copyCompressedResponse relays a marketplace response to the client
+// gzipped. Like copyResponse, an error writing to the client wraps
+// errClientGone.
+func copyCompressedResponse(w http.ResponseWriter, resp *http.Response) error {
+	copyHeaders(w, resp.Header)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.WriteHeader(resp.StatusCode)
+
+	gz := gzip.NewWriter(clientWriter{w})
+	if _, err := io.Copy(gz, resp.Body); err != nil {
+		return err
+	}
+	return gz.Close()
+}
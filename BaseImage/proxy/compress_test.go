@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("response is not gzipped: %v", err)
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestGzipResponses(t *testing.T) {
+	const completion = `{"choices": [{"message": {"content": "a long answer"}}]}`
+	server := newMarketplaceServer("gzip-model", "Gzip Model", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") == "gzip" && os.Getenv("FORWARD_HEADERS") != "" {
+			// The marketplace compresses the response itself
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(completion))
+			gz.Close()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(completion))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(enabled bool) { config.GzipResponses = enabled }(config.GzipResponses)
+
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := newChatRequest(`{"model": "Gzip Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	config.GzipResponses = true
+	w := request("gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != completion {
+		t.Errorf("decompressed body = %s, want %s", got, completion)
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+	}
+
+	if w = request(""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != completion {
+		t.Errorf("client without gzip got Content-Encoding %q: %q", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+
+	// An already compressed response is relayed, not compressed twice
+	os.Setenv("FORWARD_HEADERS", "Accept-Encoding")
+	w = request("gzip")
+	os.Unsetenv("FORWARD_HEADERS")
+	if got := gunzip(t, w.Body.Bytes()); got != completion {
+		t.Errorf("body decompressed once = %q, want %s", got, completion)
+	}
+
+	config.GzipResponses = false
+	if w = request("gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != completion {
+		t.Errorf("with GZIP_RESPONSES off got Content-Encoding %q: %q", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+}
+
+func TestGzipSkipsStreaming(t *testing.T) {
+	server := newMarketplaceServer("gzip-stream-model", "Gzip Stream Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(enabled bool) { config.GzipResponses = enabled }(config.GzipResponses)
+	config.GzipResponses = true
+
+	r := newChatRequest(`{"model": "Gzip Stream Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, r)
+
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("stream sent with Content-Encoding %q", got)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("[DONE]")) {
+		t.Errorf("stream body = %q", w.Body.String())
+	}
+}
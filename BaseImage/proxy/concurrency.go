@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Concurrency pools for chat requests. They are rebuilt by applyConfig.
+// upstreamPool bounds the calls forwardRequest has in flight to the
+// marketplace, whatever kind of request they serve. establishmentPool bounds
+// the sessions being opened at once, across all models.
+var (
+	streamPool        *concurrencyPool
+	requestPool       *concurrencyPool
+	upstreamPool      *concurrencyPool
+	establishmentPool *concurrencyPool
+)
+
+var upstreamInFlight = metrics.gauge("morpheus_proxy_upstream_in_flight",
+	"Chat completions currently forwarded to the marketplace")
+
+var (
+	queueDepth = metrics.gauge("morpheus_proxy_queue_depth",
+		"Requests waiting for a slot in each concurrency pool", "pool")
+	queueWait = metrics.histogram("morpheus_proxy_queue_wait_seconds",
+		"Time requests spent waiting for a slot in each concurrency pool, whether or not they got one",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "pool")
+)
+
+// concurrencyPool limits how many requests of one kind are in flight. A limit
+// of 0 leaves the pool unbounded. Requests that wait for a slot queue first
+// come, first served; a released slot goes straight to the head of the queue.
+type concurrencyPool struct {
+	name     string
+	limit    int
+	maxQueue int // requests acquire lets wait at once; 0 is unbounded
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  list.List // of chan struct{}, closed when handed a slot
+}
+
+func newConcurrencyPool(name string, limit int) *concurrencyPool {
+	return &concurrencyPool{name: name, limit: limit}
+}
+
+// newQueuedPool returns a pool whose acquire lets at most maxQueue requests
+// wait for a slot, rejecting the rest at once; 0 is unbounded
+func newQueuedPool(name string, limit, maxQueue int) *concurrencyPool {
+	pool := newConcurrencyPool(name, limit)
+	pool.maxQueue = maxQueue
+	return pool
+}
+
+// tryAcquire takes a slot without waiting, reporting whether one was free.
+// A free slot is not taken from under requests already queued for one.
+func (p *concurrencyPool) tryAcquire() bool {
+	if p.limit <= 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.takeLocked()
+}
+
+func (p *concurrencyPool) takeLocked() bool {
+	if p.inFlight >= p.limit || p.waiters.Len() > 0 {
+		return false
+	}
+	p.inFlight++
+	return true
+}
+
+// acquire takes a slot, waiting up to wait for one to be released. It reports
+// false if none was free in time, the queue was full, or ctx ended first.
+func (p *concurrencyPool) acquire(ctx context.Context, wait time.Duration) bool {
+	if p.limit <= 0 {
+		return true
+	}
+	if wait <= 0 {
+		return p.tryAcquire()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	return p.enqueue(ctx, timer.C, p.maxQueue)
+}
+
+// wait takes a slot, queueing until one is released. It reports false if ctx
+// ended first.
+func (p *concurrencyPool) wait(ctx context.Context) bool {
+	if p.limit <= 0 {
+		return true
+	}
+	return p.enqueue(ctx, nil, 0)
+}
+
+// enqueue takes a free slot or joins the queue for one, unless maxQueue
+// requests are already waiting. A request leaves the queue when it is handed
+// a slot, timeout fires or ctx ends.
+func (p *concurrencyPool) enqueue(ctx context.Context, timeout <-chan time.Time, maxQueue int) bool {
+	p.mu.Lock()
+	if p.takeLocked() {
+		p.mu.Unlock()
+		return true
+	}
+	if maxQueue > 0 && p.waiters.Len() >= maxQueue {
+		p.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	waiter := p.waiters.PushBack(ready)
+	queueDepth.Set(float64(p.waiters.Len()), p.name)
+	p.mu.Unlock()
+
+	start := now()
+	defer func() { queueWait.Observe(now().Sub(start).Seconds(), p.name) }()
+
+	select {
+	case <-ready:
+		return true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-ready:
+		// Handed a slot while giving up; pass it on
+		p.releaseLocked()
+	default:
+		p.waiters.Remove(waiter)
+		queueDepth.Set(float64(p.waiters.Len()), p.name)
+	}
+	return false
+}
+
+// release returns a slot taken by tryAcquire, acquire or wait
+func (p *concurrencyPool) release() {
+	if p.limit <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first queued request, or frees it
+func (p *concurrencyPool) releaseLocked() {
+	if front := p.waiters.Front(); front != nil {
+		p.waiters.Remove(front)
+		queueDepth.Set(float64(p.waiters.Len()), p.name)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	p.inFlight--
+}
+
+// inUse returns the number of slots currently taken
+func (p *concurrencyPool) inUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight
+}
+
+// queued returns the number of requests waiting for a slot
+func (p *concurrencyPool) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiters.Len()
+}
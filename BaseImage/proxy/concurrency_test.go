@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyPoolsAreIndependent(t *testing.T) {
+	server := newMarketplaceServer("pool-model", "Pool Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	defer func(streams, requests *concurrencyPool) {
+		streamPool, requestPool = streams, requests
+	}(streamPool, requestPool)
+	streamPool = newConcurrencyPool("streaming", 1)
+	requestPool = newConcurrencyPool("non-streaming", 1)
+
+	const streamBody = `{"model": "Pool Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+	const plainBody = `{"model": "Pool Model", "messages": [{"role": "user", "content": "Hello"}]}`
+
+	// Fill the streaming pool; non-streaming requests must still get through
+	streamPool.tryAcquire()
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(plainBody))
+	if w.Code != http.StatusOK {
+		t.Errorf("non-streaming with full stream pool: status = %v, want 200", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(streamBody))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("streaming with full stream pool: status = %v, want 429", w.Code)
+	}
+	streamPool.release()
+
+	// And the other way round
+	requestPool.tryAcquire()
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(streamBody))
+	if w.Code != http.StatusOK {
+		t.Errorf("streaming with full request pool: status = %v, want 200", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(plainBody))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("non-streaming with full request pool: status = %v, want 429", w.Code)
+	}
+	requestPool.release()
+
+	if streamPool.inUse() != 0 || requestPool.inUse() != 0 {
+		t.Errorf("slots leaked: streaming %d, non-streaming %d", streamPool.inUse(), requestPool.inUse())
+	}
+}
+
+func TestConcurrencyPoolUnlimited(t *testing.T) {
+	pool := newConcurrencyPool("test", 0)
+	for i := 0; i < 100; i++ {
+		if !pool.tryAcquire() {
+			t.Fatalf("unlimited pool refused acquire %d", i)
+		}
+	}
+}
+
+func TestConcurrencyPoolQueuesInOrder(t *testing.T) {
+	pool := newQueuedPool("fifo-test", 1, 0)
+	observed := queueWait.Count("fifo-test")
+	if !pool.tryAcquire() {
+		t.Fatal("tryAcquire() on an empty pool = false")
+	}
+
+	const waiters = 5
+	order := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			if pool.acquire(context.Background(), 5*time.Second) {
+				order <- i
+				pool.release()
+			}
+		}(i)
+		// Let each waiter join the queue before the next one
+		for pool.queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if got := queueDepth.Value("fifo-test"); got != waiters {
+		t.Errorf("queue depth gauge = %v, want %d", got, waiters)
+	}
+
+	pool.release()
+	for want := 0; want < waiters; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("waiter %d got the slot, want waiter %d", got, want)
+		}
+	}
+	if pool.inUse() != 0 || queueDepth.Value("fifo-test") != 0 {
+		t.Errorf("after draining: in use %d, queue depth %v, want 0 and 0", pool.inUse(), queueDepth.Value("fifo-test"))
+	}
+	if got := queueWait.Count("fifo-test") - observed; got != waiters {
+		t.Errorf("queue wait observations = %d, want %d", got, waiters)
+	}
+}
+
+func TestConcurrencyPoolQueueLimits(t *testing.T) {
+	pool := newQueuedPool("bounded-test", 1, 1)
+	pool.tryAcquire()
+
+	// The first waiter gives up when its context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- pool.acquire(ctx, 5*time.Second) }()
+	for pool.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so a second request is refused at once
+	start := time.Now()
+	if pool.acquire(context.Background(), 5*time.Second) {
+		t.Error("acquire() with a full queue = true")
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("acquire() with a full queue waited %v", waited)
+	}
+
+	cancel()
+	if <-done {
+		t.Error("acquire() with a cancelled context = true")
+	}
+	if pool.queued() != 0 {
+		t.Errorf("cancelled request still queued: %d waiting", pool.queued())
+	}
+
+	// A timed out waiter leaves the queue too
+	if pool.acquire(context.Background(), 10*time.Millisecond) {
+		t.Error("acquire() past its wait = true")
+	}
+	if pool.queued() != 0 {
+		t.Errorf("timed out request still queued: %d waiting", pool.queued())
+	}
+
+	pool.release()
+	if !pool.tryAcquire() {
+		t.Error("slot was not freed once the queue emptied")
+	}
+}
+
+func TestUpstreamConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	server := newMarketplaceServer("upstream-model", "Upstream Model", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	defer func(pool *concurrencyPool, wait time.Duration) {
+		upstreamPool, config.UpstreamQueueTimeout = pool, wait
+	}(upstreamPool, config.UpstreamQueueTimeout)
+	upstreamPool = newConcurrencyPool("upstream", 1)
+	config.UpstreamQueueTimeout = 0
+
+	const body = `{"model": "Upstream Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	first := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		first <- w.Code
+	}()
+	<-started
+	if got := upstreamInFlight.Value(); got != 1 {
+		t.Errorf("in-flight gauge = %v, want 1", got)
+	}
+
+	// Without a queue timeout the excess request is rejected at once
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("excess request: status = %v, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// With one, it waits for the slot to be released
+	config.UpstreamQueueTimeout = 5 * time.Second
+	second := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		second <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first request: status = %v, want 200", code)
+	}
+	<-started
+	release <- struct{}{}
+	if code := <-second; code != http.StatusOK {
+		t.Errorf("queued request: status = %v, want 200", code)
+	}
+
+	if upstreamPool.inUse() != 0 || upstreamInFlight.Value() != 0 {
+		t.Errorf("slots leaked: pool %d, gauge %v", upstreamPool.inUse(), upstreamInFlight.Value())
+	}
+}
+
+// TestSessionEstablishmentLimit expires sessions for many models at once and
+// checks that no more than the global cap are opened concurrently
+func TestSessionEstablishmentLimit(t *testing.T) {
+	const limit, models = 2, 6
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+		case strings.HasSuffix(r.URL.Path, "/session"):
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "session-" + r.URL.Path})
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(pool *concurrencyPool) { establishmentPool = pool }(establishmentPool)
+	establishmentPool = newConcurrencyPool("establishment", limit)
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionMutex.Unlock()
+
+	errs := make(chan error, models)
+	for i := 0; i < models; i++ {
+		modelID := fmt.Sprintf("expired-model-%d", i)
+		go func() { errs <- ensureSession(context.Background(), modelID) }()
+	}
+
+	// Wait for the cap to fill, then give the queued establishments a chance
+	// to exceed it
+	deadline := time.After(2 * time.Second)
+	for establishmentPool.inUse() < limit {
+		select {
+		case <-deadline:
+			t.Fatalf("expected %d establishments in flight, got %d", limit, establishmentPool.inUse())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < models; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("ensureSession() error = %v", err)
+		}
+	}
+	if peak != limit {
+		t.Errorf("peak concurrent establishments = %d, want %d", peak, limit)
+	}
+}
@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// Config holds the tunables that were previously hardcoded. Every field can be
+// set from the environment variable named in its comment; the value in
+// parentheses is the default.
+type Config struct {
+	// MarketplaceURL is the marketplace base URL, normalized by
+	// parseMarketplaceURL. An invalid value is kept as given for NewMux to
+	// reject. MARKETPLACE_URL (none)
+	MarketplaceURL string
+	// SessionExpirationSeconds is how long an idle session is reused before a
+	// new one is opened. SESSION_EXPIRATION_SECONDS (1800)
+	SessionExpirationSeconds int
+	// SessionDurationSeconds is how long the node is asked to keep a new
+	// session open, as a duration such as "1h" or in seconds.
+	// SESSION_DURATION (1h)
+	SessionDurationSeconds int
+	// MaxSessionAge is how long a session is used, however often, before it
+	// is closed and a new one opened, whatever duration the node granted;
+	// 0 is no limit. MAX_SESSION_AGE, in seconds (0)
+	MaxSessionAge time.Duration
+	// SessionCleanupInterval is how often expired sessions are removed.
+	// SESSION_CLEANUP_INTERVAL_SECONDS (300)
+	SessionCleanupInterval time.Duration
+	// ModelCacheTTL is how long a model name to ID match is cached.
+	// MODEL_CACHE_TTL_SECONDS (3600)
+	ModelCacheTTL time.Duration
+	// SessionSummaryInterval is how often a summary of the active sessions is
+	// logged; 0 disables it. SESSION_SUMMARY_INTERVAL_SECONDS (0)
+	SessionSummaryInterval time.Duration
+
+	// ForwardTimeout bounds the wait for the marketplace to start answering a
+	// chat completion forwarded by ProxyChatCompletion (time to first byte).
+	// FORWARD_TIMEOUT_SECONDS (30)
+	ForwardTimeout time.Duration
+	// ModelForwardTimeouts overrides ForwardTimeout for the models named by
+	// ID, for those much faster or slower to answer than the rest, e.g.
+	// "0xabc=10,0xdef=300" in seconds. MODEL_FORWARD_TIMEOUTS (none)
+	ModelForwardTimeouts map[string]time.Duration
+	// BodyTimeout bounds reading the rest of that response once it has
+	// started; 0 is unlimited. FORWARD_BODY_TIMEOUT_SECONDS (300)
+	BodyTimeout time.Duration
+	// ForwardRetries is how many times a non-streaming chat completion is
+	// retried, with backoff, after a connection failure before the request
+	// was sent or a 502, 503 or 504 from the marketplace, as happens while a
+	// provider fails over. A 502 or 503 goes to the fallback model instead
+	// when there is one. FORWARD_RETRIES (2)
+	ForwardRetries int
+	// ForwardRetryDelay is the delay before the first of those retries,
+	// doubling with each further one. FORWARD_RETRY_DELAY_MS (100)
+	ForwardRetryDelay time.Duration
+	// ChatTimeout bounds a chat completion forwarded by the Proxy handler.
+	// CHAT_TIMEOUT_SECONDS (300)
+	ChatTimeout time.Duration
+	// ModelsTimeout bounds model listing and model operation requests.
+	// MODELS_TIMEOUT_SECONDS (10)
+	ModelsTimeout time.Duration
+	// SessionTimeout bounds establishing a session, every attempt and
+	// backoff included; 0 is unlimited. SESSION_ESTABLISH_TIMEOUT_SECONDS (30)
+	SessionTimeout time.Duration
+	// SessionCloseTimeout bounds closing the open sessions on the
+	// marketplace at shutdown; 0 leaves them open to time out.
+	// SESSION_CLOSE_TIMEOUT_SECONDS (5)
+	SessionCloseTimeout time.Duration
+	// AdminPort, when set, moves /metrics, /stats, /admin/* and /debug/* off
+	// PORT onto a second listener on this port, for internal access only.
+	// ADMIN_PORT (none)
+	AdminPort string
+	// ServerReadHeaderTimeout bounds reading a client request's headers.
+	// SERVER_READ_HEADER_TIMEOUT_SECONDS (10)
+	ServerReadHeaderTimeout time.Duration
+	// ServerReadTimeout bounds reading a whole client request, body
+	// included. SERVER_READ_TIMEOUT_SECONDS (60)
+	ServerReadTimeout time.Duration
+	// ServerWriteTimeout bounds writing a response, counted from the end
+	// of the request headers, so it must outlast FORWARD_TIMEOUT_SECONDS
+	// plus FORWARD_BODY_TIMEOUT_SECONDS; 0 is unlimited. Streams lift it
+	// once they start. SERVER_WRITE_TIMEOUT_SECONDS (360)
+	ServerWriteTimeout time.Duration
+	// ServerIdleTimeout is how long an idle keep-alive connection is kept
+	// open. SERVER_IDLE_TIMEOUT_SECONDS (120)
+	ServerIdleTimeout time.Duration
+	// HealthCheckInterval is how often the marketplace's /healthcheck is
+	// probed in the background; 0 disables the probe.
+	// HEALTHCHECK_INTERVAL_SECONDS (0)
+	HealthCheckInterval time.Duration
+
+	// BreakerMaxRequests is the number of requests let through while the
+	// circuit breaker is half-open. BREAKER_MAX_REQUESTS (3)
+	BreakerMaxRequests uint32
+	// BreakerInterval is the period after which a closed breaker clears its
+	// counts. BREAKER_INTERVAL_SECONDS (10)
+	BreakerInterval time.Duration
+	// BreakerTimeout is how long the breaker stays open before going
+	// half-open. BREAKER_TIMEOUT_SECONDS (60)
+	BreakerTimeout time.Duration
+
+	// MaxConcurrentStreams caps streaming requests in flight; 0 is unlimited.
+	// MAX_CONCURRENT_STREAMS (0)
+	MaxConcurrentStreams int
+	// MaxConcurrentRequests caps non-streaming requests in flight, separately
+	// from streams; 0 is unlimited. MAX_CONCURRENT_REQUESTS (0)
+	MaxConcurrentRequests int
+	// MaxConcurrentUpstream caps chat completions forwarded to the
+	// marketplace at once, across both kinds; 0 is unlimited.
+	// MAX_CONCURRENT_UPSTREAM (0)
+	MaxConcurrentUpstream int
+	// UpstreamQueueTimeout is how long a request waits for an upstream slot
+	// before it is rejected with a 429; 0 rejects at once. Waiting requests
+	// get slots in the order they arrived. UPSTREAM_QUEUE_TIMEOUT_MS (0)
+	UpstreamQueueTimeout time.Duration
+	// UpstreamQueueMax caps the requests waiting for an upstream slot; once
+	// it is reached, further requests are rejected with a 429 at once. 0 is
+	// unbounded. UPSTREAM_QUEUE_MAX (100)
+	UpstreamQueueMax int
+	// MaxConcurrentEstablishments caps sessions being opened at once across
+	// all models, so a mass expiry doesn't flood the marketplace; further
+	// establishments queue. 0 is unlimited.
+	// MAX_CONCURRENT_SESSION_ESTABLISHMENTS (1)
+	MaxConcurrentEstablishments int
+	// SessionPoolSize is how many sessions are kept open per model and
+	// handed out to requests in turn; 0 disables the pool.
+	// SESSION_POOL_SIZE (0)
+	SessionPoolSize int
+	// SessionPoolRefreshInterval is how often pooled sessions about to
+	// expire are replaced and the pools topped up.
+	// SESSION_POOL_REFRESH_SECONDS (60)
+	SessionPoolRefreshInterval time.Duration
+
+	// EmbeddingBatchWindow is how long single-input embedding requests are
+	// collected into one upstream request; 0 disables batching.
+	// EMBEDDING_BATCH_WINDOW_MS (0)
+	EmbeddingBatchWindow time.Duration
+	// EmbeddingBatchMax sends a batch early once it has this many inputs.
+	// EMBEDDING_BATCH_MAX (32)
+	EmbeddingBatchMax int
+
+	// IdempotencyTTL is how long a successful non-streaming completion is
+	// kept for replay to requests repeating its Idempotency-Key; 0 disables
+	// idempotency keys. IDEMPOTENCY_TTL_SECONDS (600)
+	IdempotencyTTL time.Duration
+	// IdempotencyCacheSize caps the completions kept for replay, evicting
+	// the oldest. IDEMPOTENCY_CACHE_SIZE (1000)
+	IdempotencyCacheSize int
+
+	// ValidateJSONResponses checks that non-streaming completions requested
+	// with a JSON response_format parse as JSON, retrying once when they
+	// don't. VALIDATE_JSON_RESPONSES (false)
+	ValidateJSONResponses bool
+
+	// GzipResponses gzips non-streaming completions for clients that send
+	// "Accept-Encoding: gzip". GZIP_RESPONSES (false)
+	GzipResponses bool
+
+	// StaleOnOutage answers a non-streaming completion with the last
+	// successful response to the same request, however old, when the
+	// marketplace is down. SERVE_STALE_ON_OUTAGE (false)
+	StaleOnOutage bool
+	// StaleCacheSize caps the responses kept for outages, evicting the
+	// least recently stored. STALE_CACHE_SIZE (1000)
+	StaleCacheSize int
+
+	// CORSAllowedOrigins are the browser origins allowed to call the /v1
+	// endpoints, or "*" for any; none disables CORS.
+	// CORS_ALLOWED_ORIGINS (none)
+	CORSAllowedOrigins []string
+	// CORSAllowedMethods are the methods allowed by preflight requests.
+	// CORS_ALLOWED_METHODS (GET,POST,OPTIONS)
+	CORSAllowedMethods []string
+	// CORSAllowedHeaders are the request headers allowed by preflight
+	// requests. CORS_ALLOWED_HEADERS
+	// (Authorization,Content-Type,X-Request-ID,Idempotency-Key)
+	CORSAllowedHeaders []string
+
+	// UsageAccounting tallies the token usage reported by completions, by
+	// model, with the spend estimated from MODEL_PRICING, for /stats and
+	// /metrics. USAGE_ACCOUNTING (false)
+	UsageAccounting bool
+
+	// AccessLog logs one JSON line per API request, with its status,
+	// latency and token counts, to stdout. ACCESS_LOG (false)
+	AccessLog bool
+	// DebugLog also logs the detail that is only wanted while diagnosing
+	// requests, such as the fields stripped from them. LOG_LEVEL, debug or
+	// info (info)
+	DebugLog bool
+
+	// AuditLogPath is the file each chat request's audit record is
+	// appended to as a JSON line; empty disables the audit log.
+	// AUDIT_LOG_PATH (none)
+	AuditLogPath string
+
+	// SessionStore is where sessions are kept: "memory", for this process
+	// only, or "redis", shared through REDIS_URL with the other replicas
+	// so they reuse each other's sessions. SESSION_STORE (memory)
+	SessionStore string
+	// RedisURL is the Redis server of the redis session store, as
+	// redis://[[username]:password@]host[:port][/db], or rediss:// for TLS.
+	// REDIS_URL (none)
+	RedisURL string
+
+	// AnthropicMessagesAPI serves the Anthropic Messages API on /v1/messages,
+	// translated to and from chat completions. ANTHROPIC_MESSAGES_API (false)
+	AnthropicMessagesAPI bool
+}
+
+// config is the active configuration. It is loaded when the package is
+// initialised and reloaded by StartProxyServer.
+var config Config
+
+// applyConfig makes cfg the active configuration and rebuilds the components
+// derived from it
+func applyConfig(cfg Config) {
+	config = cfg
+	circuitBreaker = newCircuitBreaker(cfg)
+	streamPool = newConcurrencyPool("streaming", cfg.MaxConcurrentStreams)
+	requestPool = newConcurrencyPool("non-streaming", cfg.MaxConcurrentRequests)
+	upstreamPool = newQueuedPool("upstream", cfg.MaxConcurrentUpstream, cfg.UpstreamQueueMax)
+	establishmentPool = newConcurrencyPool("establishment", cfg.MaxConcurrentEstablishments)
+	embeddings = newEmbeddingBatcher(cfg.EmbeddingBatchWindow, cfg.EmbeddingBatchMax, sendEmbeddingBatch)
+	idempotency = newIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencyCacheSize)
+	staleResponses = newStaleCache(cfg.StaleOnOutage, cfg.StaleCacheSize)
+	configureAuditLog(cfg.AuditLogPath)
+	configureSessionStore(cfg)
+}
+
+// validate reports the first setting in c that cannot be used
+func (c Config) validate() error {
+	if c.MarketplaceURL != "" {
+		if _, err := parseMarketplaceURL(c.MarketplaceURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads the configuration from the environment
+func LoadConfig() Config {
+	return Config{
+		MarketplaceURL:              loadMarketplaceURL(),
+		SessionExpirationSeconds:    getSessionExpirationSeconds(),
+		SessionDurationSeconds:      getSessionDurationSeconds(),
+		MaxSessionAge:               getEnvSeconds("MAX_SESSION_AGE", 0),
+		SessionCleanupInterval:      getEnvSeconds("SESSION_CLEANUP_INTERVAL_SECONDS", 5*time.Minute),
+		ModelCacheTTL:               getEnvSeconds("MODEL_CACHE_TTL_SECONDS", time.Hour),
+		SessionSummaryInterval:      getEnvSeconds("SESSION_SUMMARY_INTERVAL_SECONDS", 0),
+		ForwardTimeout:              getEnvSeconds("FORWARD_TIMEOUT_SECONDS", 30*time.Second),
+		ModelForwardTimeouts:        getEnvSecondsMap("MODEL_FORWARD_TIMEOUTS"),
+		BodyTimeout:                 getEnvSeconds("FORWARD_BODY_TIMEOUT_SECONDS", 5*time.Minute),
+		ForwardRetries:              getEnvInt("FORWARD_RETRIES", 2),
+		ForwardRetryDelay:           time.Duration(getEnvInt("FORWARD_RETRY_DELAY_MS", 100)) * time.Millisecond,
+		ChatTimeout:                 getEnvSeconds("CHAT_TIMEOUT_SECONDS", 5*time.Minute),
+		ModelsTimeout:               getEnvSeconds("MODELS_TIMEOUT_SECONDS", 10*time.Second),
+		SessionTimeout:              getEnvSeconds("SESSION_ESTABLISH_TIMEOUT_SECONDS", 30*time.Second),
+		SessionCloseTimeout:         getEnvSeconds("SESSION_CLOSE_TIMEOUT_SECONDS", 5*time.Second),
+		AdminPort:                   strings.TrimSpace(os.Getenv("ADMIN_PORT")),
+		ServerReadHeaderTimeout:     getEnvSeconds("SERVER_READ_HEADER_TIMEOUT_SECONDS", 10*time.Second),
+		ServerReadTimeout:           getEnvSeconds("SERVER_READ_TIMEOUT_SECONDS", time.Minute),
+		ServerWriteTimeout:          getEnvSeconds("SERVER_WRITE_TIMEOUT_SECONDS", 6*time.Minute),
+		ServerIdleTimeout:           getEnvSeconds("SERVER_IDLE_TIMEOUT_SECONDS", 2*time.Minute),
+		HealthCheckInterval:         getEnvSeconds("HEALTHCHECK_INTERVAL_SECONDS", 0),
+		BreakerMaxRequests:          uint32(getEnvInt("BREAKER_MAX_REQUESTS", 3)),
+		BreakerInterval:             getEnvSeconds("BREAKER_INTERVAL_SECONDS", 10*time.Second),
+		BreakerTimeout:              getEnvSeconds("BREAKER_TIMEOUT_SECONDS", 60*time.Second),
+		MaxConcurrentStreams:        getEnvInt("MAX_CONCURRENT_STREAMS", 0),
+		MaxConcurrentRequests:       getEnvInt("MAX_CONCURRENT_REQUESTS", 0),
+		MaxConcurrentUpstream:       getEnvInt("MAX_CONCURRENT_UPSTREAM", 0),
+		MaxConcurrentEstablishments: getEnvInt("MAX_CONCURRENT_SESSION_ESTABLISHMENTS", 1),
+		SessionPoolSize:             getEnvInt("SESSION_POOL_SIZE", 0),
+		SessionPoolRefreshInterval:  getEnvSeconds("SESSION_POOL_REFRESH_SECONDS", time.Minute),
+		UpstreamQueueTimeout:        time.Duration(getEnvInt("UPSTREAM_QUEUE_TIMEOUT_MS", 0)) * time.Millisecond,
+		UpstreamQueueMax:            getEnvInt("UPSTREAM_QUEUE_MAX", 100),
+		EmbeddingBatchWindow:        time.Duration(getEnvInt("EMBEDDING_BATCH_WINDOW_MS", 0)) * time.Millisecond,
+		EmbeddingBatchMax:           getEnvInt("EMBEDDING_BATCH_MAX", 32),
+		IdempotencyTTL:              getEnvSeconds("IDEMPOTENCY_TTL_SECONDS", 10*time.Minute),
+		IdempotencyCacheSize:        getEnvInt("IDEMPOTENCY_CACHE_SIZE", 1000),
+		ValidateJSONResponses:       getEnvBool("VALIDATE_JSON_RESPONSES", false),
+		GzipResponses:               getEnvBool("GZIP_RESPONSES", false),
+		StaleOnOutage:               getEnvBool("SERVE_STALE_ON_OUTAGE", false),
+		StaleCacheSize:              getEnvInt("STALE_CACHE_SIZE", 1000),
+		CORSAllowedOrigins:          getEnvList("CORS_ALLOWED_ORIGINS", nil),
+		CORSAllowedMethods:          getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "OPTIONS"}),
+		CORSAllowedHeaders:          getEnvList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "X-Request-ID", "Idempotency-Key"}),
+		UsageAccounting:             getEnvBool("USAGE_ACCOUNTING", false),
+		AccessLog:                   getEnvBool("ACCESS_LOG", false),
+		DebugLog:                    getDebugLog(),
+		AuditLogPath:                strings.TrimSpace(os.Getenv("AUDIT_LOG_PATH")),
+		SessionStore:                strings.ToLower(getEnvOrDefault("SESSION_STORE", sessionStoreMemory)),
+		RedisURL:                    strings.TrimSpace(os.Getenv("REDIS_URL")),
+		AnthropicMessagesAPI:        getEnvBool("ANTHROPIC_MESSAGES_API", false),
+	}
+}
+
+// getEnvList returns a comma-separated environment variable as a list, or
+// defaultValue if it is unset or empty
+func getEnvList(key string, defaultValue []string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values
+}
+
+// getDebugLog reports whether LOG_LEVEL asks for debug logging
+func getDebugLog() bool {
+	switch level := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL"))); level {
+	case "debug":
+		return true
+	case "", "info":
+		return false
+	default:
+		log.Printf("Invalid LOG_LEVEL value: %s, using default of info", level)
+		return false
+	}
+}
+
+// debugf logs like log.Printf when LOG_LEVEL is debug
+func debugf(format string, args ...interface{}) {
+	if config.DebugLog {
+		log.Printf(format, args...)
+	}
+}
+
+// getEnvSeconds returns an environment variable given in whole seconds as a
+// duration, or defaultValue if it is unset or invalid
+func getEnvSeconds(key string, defaultValue time.Duration) time.Duration {
+	return time.Duration(getEnvInt(key, int(defaultValue/time.Second))) * time.Second
+}
+
+// getEnvSecondsMap returns an environment variable of comma-separated
+// "name=seconds" pairs as durations by name, skipping invalid entries
+func getEnvSecondsMap(key string) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for name, value := range getEnvSettings(key) {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || name == "" {
+			log.Printf("Invalid %s entry %s=%s, ignoring it", key, name, value)
+			continue
+		}
+		durations[name] = time.Duration(seconds) * time.Second
+	}
+	return durations
+}
+
+// forwardTimeout returns how long the marketplace has to start answering a
+// request for modelID: its MODEL_FORWARD_TIMEOUTS entry, or ForwardTimeout
+func forwardTimeout(modelID string) time.Duration {
+	if timeout, ok := config.ModelForwardTimeouts[modelID]; ok {
+		return timeout
+	}
+	return config.ForwardTimeout
+}
+
+// newCircuitBreaker builds the marketplace circuit breaker from cfg
+func newCircuitBreaker(cfg Config) *marketplaceBreaker {
+	return newMarketplaceBreaker(gobreaker.Settings{
+		Name:        "marketplace",
+		MaxRequests: cfg.BreakerMaxRequests,
+		Interval:    cfg.BreakerInterval,
+		Timeout:     cfg.BreakerTimeout,
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("Circuit breaker state changed from %v to %v", from, to)
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg := LoadConfig()
+
+	if cfg.SessionExpirationSeconds != 1800 {
+		t.Errorf("SessionExpirationSeconds = %d, want 1800", cfg.SessionExpirationSeconds)
+	}
+	if cfg.ForwardTimeout != 30*time.Second {
+		t.Errorf("ForwardTimeout = %v, want 30s", cfg.ForwardTimeout)
+	}
+	if cfg.BreakerMaxRequests != 3 || cfg.BreakerInterval != 10*time.Second || cfg.BreakerTimeout != 60*time.Second {
+		t.Errorf("unexpected breaker defaults: %d, %v, %v", cfg.BreakerMaxRequests, cfg.BreakerInterval, cfg.BreakerTimeout)
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	env := map[string]string{
+		"FORWARD_TIMEOUT_SECONDS":  "45",
+		"BREAKER_MAX_REQUESTS":     "7",
+		"BREAKER_TIMEOUT_SECONDS":  "5",
+		"BREAKER_INTERVAL_SECONDS": "invalid",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	cfg := LoadConfig()
+
+	if cfg.ForwardTimeout != 45*time.Second {
+		t.Errorf("ForwardTimeout = %v, want 45s", cfg.ForwardTimeout)
+	}
+	if cfg.BreakerMaxRequests != 7 {
+		t.Errorf("BreakerMaxRequests = %d, want 7", cfg.BreakerMaxRequests)
+	}
+	if cfg.BreakerTimeout != 5*time.Second {
+		t.Errorf("BreakerTimeout = %v, want 5s", cfg.BreakerTimeout)
+	}
+	if cfg.BreakerInterval != 10*time.Second {
+		t.Errorf("BreakerInterval = %v, want default of 10s for an invalid value", cfg.BreakerInterval)
+	}
+
+	if cb := newCircuitBreaker(cfg); cb.Name() != "marketplace" {
+		t.Errorf("circuit breaker name = %s, want marketplace", cb.Name())
+	}
+}
+
+func TestLoadConfigModelForwardTimeouts(t *testing.T) {
+	os.Setenv("MODEL_FORWARD_TIMEOUTS", "0xsmall=10, 0xreasoning=300, 0xbad=soon, 0xzero=0")
+	defer os.Unsetenv("MODEL_FORWARD_TIMEOUTS")
+
+	cfg := LoadConfig()
+
+	want := map[string]time.Duration{"0xsmall": 10 * time.Second, "0xreasoning": 5 * time.Minute}
+	if len(cfg.ModelForwardTimeouts) != len(want) {
+		t.Fatalf("ModelForwardTimeouts = %v, want %v", cfg.ModelForwardTimeouts, want)
+	}
+	for model, timeout := range want {
+		if got := cfg.ModelForwardTimeouts[model]; got != timeout {
+			t.Errorf("ModelForwardTimeouts[%s] = %v, want %v", model, got, timeout)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser clients may read
+var corsExposedHeaders = []string{requestIDHeader, servedModelHeader, "Retry-After", idempotentReplayHeader, cacheStatusHeader, maxTokensClampedHeader, samplingClampedHeader}
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight answer
+const corsMaxAge = "600"
+
+// withCORS lets browsers on CORS_ALLOWED_ORIGINS call next. The headers are
+// set before next runs, so they precede a streamed response's first event.
+// Preflight requests are answered here. With no origins configured, next is
+// served as is.
+func (p *Proxy) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed, ok := corsAllowedOrigin(p.cfg.CORSAllowedOrigins, origin)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.cfg.CORSAllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.cfg.CORSAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next(w, r)
+	}
+}
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for a
+// request from origin, reporting false if origins does not allow it
+func corsAllowedOrigin(origins []string, origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newCORSProxy returns a Proxy allowing CORS requests from origins
+func newCORSProxy(origins ...string) *Proxy {
+	c := config
+	c.CORSAllowedOrigins = origins
+	c.CORSAllowedMethods = []string{"GET", "POST", "OPTIONS"}
+	c.CORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+	return newProxy(c)
+}
+
+func newCORSMux(t *testing.T, origins ...string) *http.ServeMux {
+	return newTestMux(t, &newCORSProxy(origins...).cfg)
+}
+
+func newPreflightRequest(origin string) *http.Request {
+	r := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "content-type")
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	mux := newCORSMux(t, "https://agent.example")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newPreflightRequest("https://agent.example"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %v, want 204", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://agent.example",
+		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, newPreflightRequest("https://evil.example"))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	mux := newCORSMux(t)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newPreflightRequest("https://agent.example"))
+	// OPTIONS is still answered, with the allowed methods but no CORS grant
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("preflight answered with CORS disabled: %v %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	mux := newCORSMux(t, "*")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newPreflightRequest("https://anywhere.example"))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
+
+func TestCORSHeadersOnStream(t *testing.T) {
+	server := newMarketplaceServer("cors-model", "CORS Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	handler := newCORSProxy("https://agent.example").withCORS(ProxyChatCompletion)
+
+	r := newChatRequest(`{"model": "CORS Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	r.Header.Set("Origin", "https://agent.example")
+	w := newFlushRecorder()
+	handler(w, r)
+
+	if !strings.Contains(w.Body.String(), "[DONE]") {
+		t.Fatalf("stream body = %q", w.Body.String())
+	}
+	// The headers the client saw with the first event, not set afterwards
+	header := w.Result().Header
+	if got := header.Get("Access-Control-Allow-Origin"); got != "https://agent.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := header.Get("Access-Control-Expose-Headers"); !strings.Contains(got, requestIDHeader) {
+		t.Errorf("Access-Control-Expose-Headers = %q, want it to include %s", got, requestIDHeader)
+	}
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sony/gobreaker"
+)
+
+// ModelError is the most recent failure observed for a model
+type ModelError struct {
+	Message   string    `json:"message"`
+	Status    int       `json:"status,omitempty"` // upstream HTTP status, 0 if the request never got a response
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var modelErrors = struct {
+	sync.RWMutex
+	m map[string]ModelError
+}{m: make(map[string]ModelError)}
+
+// recordModelError stores message as the last error for modelID
+func recordModelError(modelID string, status int, message string) {
+	modelErrors.Lock()
+	defer modelErrors.Unlock()
+	modelErrors.m[modelID] = ModelError{
+		Message:   message,
+		Status:    status,
+		Timestamp: now(),
+	}
+}
+
+// lastModelError returns the last error recorded for modelID
+func lastModelError(modelID string) (ModelError, bool) {
+	modelErrors.RLock()
+	defer modelErrors.RUnlock()
+	modelErr, exists := modelErrors.m[modelID]
+	return modelErr, exists
+}
+
+// handleModelErrors serves the last error per model, or for a single model
+// when the "model" query parameter is set.
+func handleModelErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if modelID := r.URL.Query().Get("model"); modelID != "" {
+		modelErr, exists := lastModelError(modelID)
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "No error recorded for model "+modelID)
+			return
+		}
+		json.NewEncoder(w).Encode(modelErr)
+		return
+	}
+
+	modelErrors.RLock()
+	defer modelErrors.RUnlock()
+	json.NewEncoder(w).Encode(modelErrors.m)
+}
+
+// redactSessionID shortens a session ID to a prefix that is enough to correlate
+// log lines without exposing the full ID
+func redactSessionID(sessionID string) string {
+	const visible = 8
+	if len(sessionID) <= visible {
+		return sessionID
+	}
+	return sessionID[:visible] + "..."
+}
+
+// SessionDebugInfo describes an active session for /debug/session
+type SessionDebugInfo struct {
+	SessionID string    `json:"sessionId"`
+	ModelID   string    `json:"modelId"`
+	ModelName string    `json:"modelName,omitempty"`
+	Wallet    string    `json:"wallet,omitempty"`
+	Provider  string    `json:"provider,omitempty"` // redacted like the session ID
+	Price     string    `json:"price,omitempty"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Current   bool      `json:"current"`
+	Pooled    bool      `json:"pooled,omitempty"` // held in the model's session pool
+}
+
+// SessionDebugResponse is the body served by /debug/session
+type SessionDebugResponse struct {
+	Sessions           []SessionDebugInfo `json:"sessions"`
+	CircuitBreakerOpen bool               `json:"circuitBreakerOpen"`
+	CircuitBreaker     string             `json:"circuitBreakerState"`
+	Marketplace        *MarketplaceHealth `json:"marketplace,omitempty"` // last background health check
+}
+
+// handleDebugSession reports the in-memory session state. Session IDs are
+// redacted unless the "reveal" query parameter is true.
+func handleDebugSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal"))
+
+	sessionMutex.Lock()
+	sessions := make([]SessionDebugInfo, 0, len(activeSessions))
+	for key, session := range activeSessions {
+		currentSessionID, currentKey := currentSessionManagerLocked(key).GetSessionInfo()
+		sessionID, provider := session.SessionID, session.Provider
+		if !reveal {
+			sessionID, provider = redactSessionID(sessionID), redactWallet(provider)
+		}
+		sessions = append(sessions, SessionDebugInfo{
+			SessionID: sessionID,
+			ModelID:   session.ModelID,
+			ModelName: session.ModelName,
+			Wallet:    redactWallet(session.Wallet),
+			Provider:  provider,
+			Price:     session.Price,
+			Created:   session.Created,
+			LastUsed:  session.lastActive(),
+			ExpiresAt: session.expiresAt(),
+			Current:   session.SessionID == currentSessionID && key == currentKey,
+		})
+	}
+	sessionMutex.Unlock()
+
+	sessionPools.Lock()
+	pools := make([]*sessionPool, 0, len(sessionPools.m))
+	for _, pool := range sessionPools.m {
+		pools = append(pools, pool)
+	}
+	sessionPools.Unlock()
+	for _, pool := range pools {
+		for _, session := range pool.snapshot() {
+			sessionID, provider := session.SessionID, session.Provider
+			if !reveal {
+				sessionID, provider = redactSessionID(sessionID), redactWallet(provider)
+			}
+			sessions = append(sessions, SessionDebugInfo{
+				SessionID: sessionID,
+				ModelID:   session.ModelID,
+				ModelName: session.ModelName,
+				Wallet:    redactWallet(session.Wallet),
+				Provider:  provider,
+				Price:     session.Price,
+				Created:   session.Created,
+				LastUsed:  session.lastActive(),
+				ExpiresAt: session.expiresAt(),
+				Pooled:    true,
+			})
+		}
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].ModelID < sessions[j].ModelID
+	})
+
+	state := circuitBreaker.State()
+	response := SessionDebugResponse{
+		Sessions:           sessions,
+		CircuitBreakerOpen: state == gobreaker.StateOpen,
+		CircuitBreaker:     state.String(),
+	}
+	if health, checked := lastMarketplaceHealth(); checked {
+		response.Marketplace = &health
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// debugConfigHeader requests, and carries back, the effective config applied
+// to a chat request
+const debugConfigHeader = "X-Debug-Config"
+
+// RequestDebugConfig is the effective config applied to one chat request
+type RequestDebugConfig struct {
+	RequestID      string `json:"requestId"`
+	Model          string `json:"model"`
+	ModelID        string `json:"modelId"`
+	Stream         bool   `json:"stream"`
+	StreamPolicy   string `json:"streamPolicy"`
+	TimeoutMs      int64  `json:"timeoutMs"`
+	BodyTimeoutMs  int64  `json:"bodyTimeoutMs"`
+	SessionRetries int    `json:"sessionRetries"`
+	// SessionDecision says why the request's session was reused or
+	// established: reused, new, expired, evicted or pooled
+	SessionDecision string `json:"sessionDecision"`
+	Node            string `json:"node"`
+}
+
+// setDebugConfigHeader echoes debug as JSON in the X-Debug-Config response
+// header when the request asked for it with "X-Debug-Config: true" and
+// carries the admin API key. Other requests are left untouched.
+func setDebugConfigHeader(w http.ResponseWriter, r *http.Request, debug RequestDebugConfig) {
+	if want, _ := strconv.ParseBool(r.Header.Get(debugConfigHeader)); !want {
+		return
+	}
+	if !isAdminRequest(r) {
+		log.Printf("Ignoring %s on request %s without a valid API key", debugConfigHeader, debug.RequestID)
+		return
+	}
+	encoded, err := json.Marshal(debug)
+	if err != nil {
+		log.Printf("Failed to encode debug config: %v", err)
+		return
+	}
+	w.Header().Set(debugConfigHeader, string(encoded))
+}
+
+// redactedHeaders are header names whose values are never logged in full,
+// besides the session header
+var redactedHeaders = map[string]bool{
+	"authorization": true,
+	"x-api-key":     true,
+}
+
+// formatHeadersForLog renders headers for logging, redacting credentials and
+// session IDs to a short prefix
+func formatHeadersForLog(headers http.Header) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := headers[key]
+		if redactedHeaders[strings.ToLower(key)] || strings.EqualFold(key, getSessionHeader()) {
+			redacted := make([]string, len(values))
+			for i, value := range values {
+				redacted[i] = redactSessionID(value)
+			}
+			values = redacted
+		}
+		parts = append(parts, key+"="+strings.Join(values, ","))
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// logRequestHeaders logs outbound request headers when LOG_REQUEST_HEADERS is enabled
+func logRequestHeaders(headers http.Header) {
+	if !getEnvBool("LOG_REQUEST_HEADERS", false) {
+		return
+	}
+	log.Printf("Request headers: %s", formatHeadersForLog(headers))
+}
+
+// defaultLogBodyMaxBytes is how much of a request or response body is logged
+// when LOG_BODY_MAX_BYTES is unset
+const defaultLogBodyMaxBytes = 4096
+
+// formatBodyForLog returns a body for logging, cut to LOG_BODY_MAX_BYTES
+// (0 logs it whole) with a marker giving its full size
+func formatBodyForLog(body []byte) string {
+	limit := getEnvInt("LOG_BODY_MAX_BYTES", defaultLogBodyMaxBytes)
+	if limit == 0 || len(body) <= limit {
+		return string(body)
+	}
+	// Cut at a rune boundary so the log stays valid UTF-8
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... [truncated, %d bytes total]", body[:cut], len(body))
+}
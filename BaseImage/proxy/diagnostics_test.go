@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastModelErrorAfterFailedForward(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "provider offline"}`, http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+
+	activeSessions["failing-model"] = &MorpheusSession{
+		SessionID: "failing-session",
+		ModelID:   "failing-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "failing-model")
+
+	resp, err := forwardRequest(httptest.NewRequest("POST", "/v1/chat/completions", nil), map[string]interface{}{"model": "failing-model"}, "failing-model")
+	if err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	resp.Body.Close()
+
+	handler := requireAPIKey(handleModelErrors)
+
+	// Without the key the endpoint must not leak diagnostics
+	req := httptest.NewRequest("GET", "/admin/errors?model=failing-model", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without API key, got %v", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/errors?model=failing-model", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+
+	var modelErr ModelError
+	if err := json.NewDecoder(w.Body).Decode(&modelErr); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if modelErr.Status != http.StatusBadGateway {
+		t.Errorf("Status = %d, want %d", modelErr.Status, http.StatusBadGateway)
+	}
+	if modelErr.Message == "" || modelErr.Timestamp.IsZero() {
+		t.Errorf("Expected message and timestamp to be recorded, got %+v", modelErr)
+	}
+}
+
+func TestRequireAPIKeyDisabledWithoutKey(t *testing.T) {
+	os.Unsetenv("API_KEY")
+
+	req := httptest.NewRequest("GET", "/admin/errors", nil)
+	w := httptest.NewRecorder()
+	requireAPIKey(handleModelErrors)(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 when API_KEY is unset, got %v", w.Code)
+	}
+}
+
+func TestDebugSession(t *testing.T) {
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+
+	created := time.Now().Add(-time.Minute)
+	activeSessions["debug-model"] = &MorpheusSession{
+		SessionID: "0123456789abcdef",
+		ModelID:   "debug-model",
+		Created:   created,
+	}
+	defer delete(activeSessions, "debug-model")
+
+	tests := []struct {
+		name        string
+		query       string
+		wantSession string
+	}{
+		{
+			name:        "redacted by default",
+			query:       "",
+			wantSession: "01234567...",
+		},
+		{
+			name:        "revealed on request",
+			query:       "?reveal=true",
+			wantSession: "0123456789abcdef",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/debug/session"+tt.query, nil)
+			req.Header.Set("X-API-Key", "secret")
+			w := httptest.NewRecorder()
+			requireAPIKey(handleDebugSession)(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status OK, got %v", w.Code)
+			}
+
+			var resp SessionDebugResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+
+			var found *SessionDebugInfo
+			for i := range resp.Sessions {
+				if resp.Sessions[i].ModelID == "debug-model" {
+					found = &resp.Sessions[i]
+				}
+			}
+			if found == nil {
+				t.Fatalf("debug-model session missing from %+v", resp.Sessions)
+			}
+			if found.SessionID != tt.wantSession {
+				t.Errorf("SessionID = %s, want %s", found.SessionID, tt.wantSession)
+			}
+			if !found.ExpiresAt.After(found.Created) {
+				t.Errorf("ExpiresAt %v should be after Created %v", found.ExpiresAt, found.Created)
+			}
+			if resp.CircuitBreaker == "" {
+				t.Error("Expected circuit breaker state to be reported")
+			}
+		})
+	}
+}
+
+func TestLogRequestHeadersRedactsSessionID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("session_id", "0xabcdef0123456789abcdef")
+
+	// Header logging is opt-in
+	os.Unsetenv("LOG_REQUEST_HEADERS")
+	logRequestHeaders(headers)
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no header log by default, got %q", buf.String())
+	}
+
+	os.Setenv("LOG_REQUEST_HEADERS", "true")
+	defer os.Unsetenv("LOG_REQUEST_HEADERS")
+	logRequestHeaders(headers)
+
+	line := buf.String()
+	if strings.Contains(line, "0xabcdef0123456789abcdef") {
+		t.Errorf("session ID logged in plaintext: %q", line)
+	}
+	if !strings.Contains(line, "0xabcdef...") {
+		t.Errorf("Expected redacted session ID prefix in %q", line)
+	}
+	if !strings.Contains(line, "application/json") {
+		t.Errorf("Expected non-sensitive headers in %q", line)
+	}
+}
+
+func TestDebugConfigEcho(t *testing.T) {
+	server := newMarketplaceServer("debug-model", "Debug Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+
+	defer func(timeout time.Duration) { config.ForwardTimeout = timeout }(config.ForwardTimeout)
+	config.ForwardTimeout = 12 * time.Second
+
+	const body = `{"model": "Debug Model", "messages": [{"role": "user", "content": "Hello"}]}`
+
+	t.Run("admin", func(t *testing.T) {
+		req := newChatRequest(body)
+		req.Header.Set(debugConfigHeader, "true")
+		req.Header.Set("X-API-Key", "secret")
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, req)
+
+		var debug RequestDebugConfig
+		if err := json.Unmarshal([]byte(w.Header().Get(debugConfigHeader)), &debug); err != nil {
+			t.Fatalf("invalid %s header %q: %v", debugConfigHeader, w.Header().Get(debugConfigHeader), err)
+		}
+		if debug.Model != "Debug Model" || debug.ModelID != "debug-model" {
+			t.Errorf("resolved model = %s (%s), want Debug Model (debug-model)", debug.Model, debug.ModelID)
+		}
+		if debug.TimeoutMs != 12000 || debug.SessionRetries != maxRetries || debug.Node != server.URL {
+			t.Errorf("debug config does not reflect the applied settings: %+v", debug)
+		}
+		if debug.SessionDecision == "" {
+			t.Error("debug config is missing the session decision")
+		}
+	})
+
+	t.Run("without API key", func(t *testing.T) {
+		req := newChatRequest(body)
+		req.Header.Set(debugConfigHeader, "true")
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, req)
+
+		if got := w.Header().Get(debugConfigHeader); got != "" {
+			t.Errorf("debug config leaked to a non-admin request: %s", got)
+		}
+	})
+}
+
+func TestRequestBodyLogTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	os.Setenv("LOG_BODY_MAX_BYTES", "100")
+	defer os.Unsetenv("LOG_BODY_MAX_BYTES")
+
+	body := `{"messages": [{"role": "user", "content": "` + strings.Repeat("a", 10000) + `"}]}`
+	ProxyChatCompletion(httptest.NewRecorder(), newChatRequest(body))
+
+	want := fmt.Sprintf("Received chat request body: %s... [truncated, %d bytes total]\n", body[:100], len(body))
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("log does not contain the truncated body %q:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), strings.Repeat("a", 101)) {
+		t.Error("log contains more of the body than LOG_BODY_MAX_BYTES")
+	}
+}
+
+func TestFormatBodyForLog(t *testing.T) {
+	defer os.Unsetenv("LOG_BODY_MAX_BYTES")
+	tests := []struct {
+		limit, body, want string
+	}{
+		{"10", "short", "short"},
+		{"4", "abcdefgh", "abcd... [truncated, 8 bytes total]"},
+		{"0", "abcdefgh", "abcdefgh"},
+		// "é" is two bytes; it is not split
+		{"2", "aéb", "a... [truncated, 4 bytes total]"},
+	}
+	for _, tt := range tests {
+		os.Setenv("LOG_BODY_MAX_BYTES", tt.limit)
+		if got := formatBodyForLog([]byte(tt.body)); got != tt.want {
+			t.Errorf("formatBodyForLog(%q) with limit %s = %q, want %q", tt.body, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var drainingGauge = metrics.gauge("morpheus_proxy_draining",
+	"1 while the proxy is draining and refusing new completion requests")
+
+// draining is set while the proxy finishes its in-flight requests ahead of
+// a deploy or shutdown. New completion requests are refused and /ready
+// reports 503, while /health stays up.
+var draining atomic.Bool
+
+// isDraining reports whether the proxy is draining
+func isDraining() bool {
+	return draining.Load()
+}
+
+// setDraining turns drain mode on or off, reporting whether it changed
+func setDraining(on bool) bool {
+	if draining.Swap(on) == on {
+		return false
+	}
+	value := 0.0
+	if on {
+		value = 1
+		log.Printf("Draining: refusing new completion requests")
+	} else {
+		log.Printf("Drain mode lifted: accepting completion requests")
+	}
+	drainingGauge.Set(value)
+	return true
+}
+
+// respondDraining refuses a request that arrived while draining
+func respondDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	respondWithError(w, http.StatusServiceUnavailable, "The proxy is draining and not accepting new requests")
+}
+
+// handleDrain serves POST /admin/drain
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	handleDrainChange(w, r, true)
+}
+
+// handleUndrain serves POST /admin/undrain, reversing /admin/drain
+func handleUndrain(w http.ResponseWriter, r *http.Request) {
+	handleDrainChange(w, r, false)
+}
+
+func handleDrainChange(w http.ResponseWriter, r *http.Request, on bool) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	changed := setDraining(on)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"draining": on, "changed": changed})
+}
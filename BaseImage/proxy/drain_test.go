@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainMode(t *testing.T) {
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+	defer setDraining(false)
+	cfg := config
+	defer applyConfig(cfg)
+	mux := newTestMux(t, &cfg)
+
+	admin := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("X-API-Key", "secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := admin("/admin/drain"); code != http.StatusOK {
+		t.Fatalf("drain status = %v, want 200", code)
+	}
+	if !isDraining() {
+		t.Fatal("expected the proxy to be draining")
+	}
+	if code := get("/health"); code != http.StatusOK {
+		t.Errorf("/health while draining = %v, want 200", code)
+	}
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready while draining = %v, want 503", code)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newChatRequest(`{"model": "Any Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("completion while draining = %v, want 503 with Retry-After", w.Code)
+	}
+
+	if code := admin("/admin/undrain"); code != http.StatusOK {
+		t.Fatalf("undrain status = %v, want 200", code)
+	}
+	if isDraining() {
+		t.Error("expected drain mode to be lifted")
+	}
+	if code := get("/ready"); code != http.StatusOK {
+		t.Errorf("/ready after undrain = %v, want 200", code)
+	}
+}
+
+func TestDrainRequiresAPIKey(t *testing.T) {
+	os.Setenv("API_KEY", "secret")
+	defer os.Unsetenv("API_KEY")
+	defer setDraining(false)
+	cfg := config
+	defer applyConfig(cfg)
+
+	w := httptest.NewRecorder()
+	newTestMux(t, &cfg).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/drain", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %v, want 401", w.Code)
+	}
+	if isDraining() {
+		t.Error("unauthenticated request started draining")
+	}
+}
+
+func TestDrainFinishesInFlightStream(t *testing.T) {
+	defer setDraining(false)
+	release := make(chan struct{})
+	server := newMarketplaceServer("drain-model", "Drain Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"first\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"second\"}}]}\n\ndata: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ProxyChatCompletion(w, newChatRequest(`{"model": "Drain Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	}()
+
+	// Drain once the stream is under way, then let it finish
+	for w.flushCount() == 0 {
+		select {
+		case <-done:
+			t.Fatal("stream ended before draining")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	setDraining(true)
+	close(release)
+	<-done
+
+	if body := w.Body.String(); !strings.Contains(body, "second") || !strings.Contains(body, "[DONE]") {
+		t.Errorf("in-flight stream was cut short by draining: %s", body)
+	}
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddings batches single-input embedding requests. It is rebuilt by
+// applyConfig and is disabled unless EMBEDDING_BATCH_WINDOW_MS is set.
+var embeddings *embeddingBatcher
+
+func getMarketplaceEmbeddingsEndpoint() string {
+	if config.MarketplaceURL == "" && !isMockUpstream() {
+		return ""
+	}
+	return getMarketplaceBaseURL() + "/embeddings"
+}
+
+// embeddingSender sends one upstream embeddings request for inputs and returns
+// the embedding objects in input order
+type embeddingSender func(ctx context.Context, modelID string, params map[string]interface{}, inputs []interface{}) ([]map[string]interface{}, error)
+
+// embeddingBatcher collects single-input embedding requests that arrive within
+// a short window and sends them upstream as one request, then fans the results
+// back out to the callers. Only requests for the same model with identical
+// parameters are batched together.
+type embeddingBatcher struct {
+	window   time.Duration
+	maxBatch int
+	send     embeddingSender
+
+	mu      sync.Mutex
+	pending map[string]*embeddingBatch
+}
+
+type embeddingBatch struct {
+	modelID string
+	params  map[string]interface{}
+	inputs  []interface{}
+	waiters []chan embeddingResult
+	timer   *time.Timer
+}
+
+type embeddingResult struct {
+	embedding map[string]interface{}
+	err       error
+}
+
+func newEmbeddingBatcher(window time.Duration, maxBatch int, send embeddingSender) *embeddingBatcher {
+	if maxBatch <= 0 {
+		maxBatch = 1
+	}
+	return &embeddingBatcher{
+		window:   window,
+		maxBatch: maxBatch,
+		send:     send,
+		pending:  make(map[string]*embeddingBatch),
+	}
+}
+
+// Enabled reports whether requests are batched at all
+func (b *embeddingBatcher) Enabled() bool {
+	return b != nil && b.window > 0
+}
+
+// Embed queues a single input for modelID and waits for its embedding. params
+// are the request fields other than the input. The returned embedding object
+// has its index set to 0, as if it had been requested alone.
+func (b *embeddingBatcher) Embed(ctx context.Context, modelID string, params map[string]interface{}, input interface{}) (map[string]interface{}, error) {
+	paramBytes, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode embedding parameters: %v", err)
+	}
+	key := modelID + "\x00" + string(paramBytes)
+	result := make(chan embeddingResult, 1)
+
+	b.mu.Lock()
+	batch, exists := b.pending[key]
+	if !exists {
+		batch = &embeddingBatch{modelID: modelID, params: params}
+		b.pending[key] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.flush(key, batch) })
+	}
+	batch.inputs = append(batch.inputs, input)
+	batch.waiters = append(batch.waiters, result)
+	full := len(batch.inputs) >= b.maxBatch
+	b.mu.Unlock()
+
+	if full {
+		batch.timer.Stop()
+		go b.flush(key, batch)
+	}
+
+	select {
+	case res := <-result:
+		return res.embedding, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush sends batch upstream unless it has already been sent
+func (b *embeddingBatcher) flush(key string, batch *embeddingBatch) {
+	b.mu.Lock()
+	if b.pending[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+
+	log.Printf("Sending batch of %d embedding inputs for model %s", len(batch.inputs), batch.modelID)
+	results, err := b.send(context.Background(), batch.modelID, batch.params, batch.inputs)
+	if err == nil && len(results) != len(batch.inputs) {
+		err = fmt.Errorf("marketplace returned %d embeddings for %d inputs", len(results), len(batch.inputs))
+	}
+
+	for i, waiter := range batch.waiters {
+		if err != nil {
+			waiter <- embeddingResult{err: err}
+			continue
+		}
+		embedding := make(map[string]interface{}, len(results[i]))
+		for k, v := range results[i] {
+			embedding[k] = v
+		}
+		embedding["index"] = 0
+		waiter <- embeddingResult{embedding: embedding}
+	}
+}
+
+// sendEmbeddingBatch is the embeddingSender used in production. It sends one
+// embeddings request on the model's session.
+func sendEmbeddingBatch(ctx context.Context, modelID string, params map[string]interface{}, inputs []interface{}) ([]map[string]interface{}, error) {
+	if err := ensureSession(ctx, modelID); err != nil {
+		return nil, err
+	}
+
+	body := make(map[string]interface{}, len(params)+2)
+	for k, v := range params {
+		body[k] = v
+	}
+	body["model"] = modelID
+	body["input"] = inputs
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embeddings request: %v", err)
+	}
+
+	resp, err := forwardEmbeddings(ctx, modelID, "", bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embeddings response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marketplace returned status %d for embeddings: %s", resp.StatusCode, string(respBytes))
+	}
+
+	var result struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(respBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings response: %v", err)
+	}
+
+	// Results are matched to inputs by index, not by response order
+	ordered := make([]map[string]interface{}, len(inputs))
+	for i, item := range result.Data {
+		index := i
+		if idx, ok := item["index"].(float64); ok {
+			index = int(idx)
+		}
+		if index < 0 || index >= len(ordered) {
+			return nil, fmt.Errorf("marketplace returned embedding index %d for %d inputs", index, len(inputs))
+		}
+		ordered[index] = item
+	}
+	for i, item := range ordered {
+		if item == nil {
+			return nil, fmt.Errorf("marketplace returned no embedding for input %d", i)
+		}
+	}
+	return ordered, nil
+}
+
+// forwardEmbeddings sends an embeddings request body to the marketplace on
+// the model's session. Like chat completions, errors matching
+// RETRYABLE_ERROR_SUBSTRINGS are retried per the model's retry policy, and
+// requests are refused while the circuit breaker is open. Any other response
+// is returned with its body still readable.
+func forwardEmbeddings(ctx context.Context, modelID, modelHandle string, body []byte) (*http.Response, error) {
+	policy := getRetryPolicy(modelID, modelHandle)
+	for attempt := 1; ; attempt++ {
+		resp, err := forwardEmbeddingsOnce(ctx, modelID, body)
+		if err != nil || resp.StatusCode == http.StatusOK {
+			return resp, err
+		}
+
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		recordModelError(modelID, resp.StatusCode, string(respBody))
+		if !isRetryableUpstreamError(respBody) {
+			return resp, nil
+		}
+		if attempt >= policy.maxRetries {
+			retriesExhausted.Inc("embeddings")
+			return nil, fmt.Errorf("%w after %d attempts: marketplace returned %d: %s", ErrRetriesExhausted, attempt, resp.StatusCode, string(respBody))
+		}
+
+		delay := policy.backoff(attempt)
+		log.Printf("Retryable marketplace error for embeddings on model %s (attempt %d/%d), retrying after %v: %s", modelID, attempt, policy.maxRetries, delay, string(respBody))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// forwardEmbeddingsOnce sends one embeddings request on the model's session,
+// or on a session from its pool as chat completions are
+func forwardEmbeddingsOnce(ctx context.Context, modelID string, body []byte) (*http.Response, error) {
+	endpoint := getMarketplaceEmbeddingsEndpoint()
+	if endpoint == "" {
+		return nil, fmt.Errorf("MARKETPLACE_URL environment variable is not set")
+	}
+	if err := circuitBreaker.allow(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embeddings request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	session, exists := checkoutSession(sessionKey(modelID, providerOverride(ctx)))
+	if !exists || session.SessionID == "" {
+		return nil, fmt.Errorf("no active session for model %s", modelID)
+	}
+	setUpstreamHeaders(req.Header, session)
+	setSessionHeader(req.Header, session.SessionID)
+
+	client := newMarketplaceClient(forwardTimeout(modelID))
+	resp, err := circuitBreaker.do(ctx, func() (*http.Response, error) { return client.Do(req) })
+	if errors.Is(err, ErrBreakerOpen) {
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+	}
+	if err != nil {
+		recordModelError(modelID, 0, err.Error())
+		return nil, fmt.Errorf("failed to forward embeddings request: %v", err)
+	}
+	return resp, nil
+}
+
+// getEmbeddingModelHandle returns EMBEDDING_MODEL_ID, the model embeddings
+// requests are served by when they do not name one. It is separate from the
+// chat model since embedding models differ.
+func getEmbeddingModelHandle() string {
+	return strings.TrimSpace(os.Getenv("EMBEDDING_MODEL_ID"))
+}
+
+// handleEmbeddings serves /v1/embeddings. The request is forwarded on a
+// session for the embedding model and the marketplace's response relayed as
+// is. With EMBEDDING_BATCH_WINDOW_MS set, single-input requests are batched.
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	requestID := ensureRequestID(w, r)
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if isDraining() {
+		respondDraining(w)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read request body")
+		return
+	}
+	requestBody, err := decodeRequestBody(bodyBytes)
+	if err != nil || requestBody == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	input, ok := requestBody["input"]
+	if !ok || input == nil {
+		respondWithError(w, http.StatusBadRequest, "input field is required")
+		return
+	}
+
+	modelHandle, _ := requestBody["model"].(string)
+	if modelHandle == "" {
+		modelHandle = getEmbeddingModelHandle()
+	}
+	if modelHandle == "" {
+		respondWithError(w, http.StatusBadRequest, "model field is required")
+		return
+	}
+	modelID, err := validateModelHandle(resolveModelAlias(modelHandle))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	setAccessLogModel(r.Context(), modelHandle)
+	log.Printf("Embeddings request %s for model %s (%s)", requestID, modelHandle, modelID)
+
+	if err := ensureSession(r.Context(), modelID); err != nil {
+		respondWithForwardError(w, err, "Failed to establish session")
+		return
+	}
+
+	if _, single := input.(string); single && embeddings.Enabled() {
+		params := make(map[string]interface{}, len(requestBody))
+		for k, v := range requestBody {
+			if k != "model" && k != "input" {
+				params[k] = v
+			}
+		}
+		embedding, err := embeddings.Embed(r.Context(), modelID, params, input)
+		if err != nil {
+			respondWithForwardError(w, err, "Failed to forward embeddings request")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   []interface{}{embedding},
+			"model":  modelHandle,
+		})
+		return
+	}
+
+	requestBody["model"] = modelID
+	body, err := encodeRequestBody(requestBody)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to encode request body")
+		return
+	}
+	resp, err := forwardEmbeddings(r.Context(), modelID, modelHandle, body)
+	if err != nil {
+		respondWithForwardError(w, err, "Failed to forward embeddings request")
+		return
+	}
+	defer resp.Body.Close()
+	if err := copyResponse(w, resp); err != nil {
+		log.Printf("Error copying embeddings response for request %s: %v", requestID, err)
+	}
+}
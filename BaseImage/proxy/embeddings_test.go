@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEmbeddingBatcherBatchesConcurrentRequests(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]interface{}
+	send := func(ctx context.Context, modelID string, params map[string]interface{}, inputs []interface{}) ([]map[string]interface{}, error) {
+		mu.Lock()
+		calls = append(calls, inputs)
+		mu.Unlock()
+		results := make([]map[string]interface{}, len(inputs))
+		for i, input := range inputs {
+			results[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": input}
+		}
+		return results, nil
+	}
+	batcher := newEmbeddingBatcher(50*time.Millisecond, 32, send)
+
+	const n = 5
+	var wg sync.WaitGroup
+	got := make([]map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			embedding, err := batcher.Embed(context.Background(), "embed-model", nil, fmt.Sprintf("input-%d", i))
+			if err != nil {
+				t.Errorf("Embed(%d) error = %v", i, err)
+				return
+			}
+			got[i] = embedding
+		}(i)
+	}
+	wg.Wait()
+
+	if len(calls) != 1 || len(calls[0]) != n {
+		t.Fatalf("expected one upstream call with %d inputs, got %v", n, calls)
+	}
+	for i, embedding := range got {
+		if embedding["embedding"] != fmt.Sprintf("input-%d", i) {
+			t.Errorf("request %d got embedding for %v", i, embedding["embedding"])
+		}
+		if embedding["index"] != 0 {
+			t.Errorf("request %d index = %v, want 0", i, embedding["index"])
+		}
+	}
+}
+
+func TestEmbeddingBatcherSeparatesParameters(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	send := func(ctx context.Context, modelID string, params map[string]interface{}, inputs []interface{}) ([]map[string]interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return []map[string]interface{}{{"index": 0}}, nil
+	}
+	batcher := newEmbeddingBatcher(20*time.Millisecond, 32, send)
+
+	var wg sync.WaitGroup
+	for _, dims := range []int{256, 512} {
+		wg.Add(1)
+		go func(dims int) {
+			defer wg.Done()
+			batcher.Embed(context.Background(), "embed-model", map[string]interface{}{"dimensions": dims}, "text")
+		}(dims)
+	}
+	wg.Wait()
+
+	if calls != 2 {
+		t.Errorf("requests with different parameters were batched together: %d calls", calls)
+	}
+}
+
+func TestSendEmbeddingBatchOrdersByIndex(t *testing.T) {
+	var upstreamInput []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+		case "/embeddings":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			upstreamInput, _ = body["input"].([]interface{})
+			w.Write([]byte(`{"data": [{"index": 1, "embedding": [0.2]}, {"index": 0, "embedding": [0.1]}]}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "embed-session"})
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	results, err := sendEmbeddingBatch(context.Background(), "embed-batch-model", nil, []interface{}{"a", "b"})
+	if err != nil {
+		t.Fatalf("sendEmbeddingBatch() error = %v", err)
+	}
+	if len(upstreamInput) != 2 {
+		t.Errorf("upstream input = %v, want both inputs", upstreamInput)
+	}
+	if fmt.Sprint(results[0]["embedding"]) != "[0.1]" || fmt.Sprint(results[1]["embedding"]) != "[0.2]" {
+		t.Errorf("results not ordered by index: %v", results)
+	}
+}
+
+// newEmbeddingsServer serves a marketplace with one model whose embeddings
+// requests are answered by embed
+func newEmbeddingsServer(modelID, modelName string, embed http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: modelID, Name: modelName}},
+			})
+		case "/blockchain/models/" + modelID + "/session":
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": modelID + "-session"})
+		case "/embeddings":
+			embed(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newEmbeddingsRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestHandleEmbeddingsRelaysResponse(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "embeddings", "response.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forwarded map[string]interface{}
+	var session string
+	server := newEmbeddingsServer("embed-model-id", "Embed Model", func(w http.ResponseWriter, r *http.Request) {
+		session = r.Header.Get(getSessionHeader())
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(fixture)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	w := httptest.NewRecorder()
+	cfg := config
+	newTestMux(t, &cfg).ServeHTTP(w, newEmbeddingsRequest(`{"model": "Embed Model", "input": ["hello", "world"], "encoding_format": "float"}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	assertSameJSON(t, w.Body.Bytes(), fixture)
+	if session != "embed-model-id-session" {
+		t.Errorf("session header = %q, want the model's session", session)
+	}
+	if forwarded["model"] != "embed-model-id" || forwarded["encoding_format"] != "float" {
+		t.Errorf("forwarded body = %v, want the model ID and the other fields unchanged", forwarded)
+	}
+}
+
+func TestHandleEmbeddingsDefaultModel(t *testing.T) {
+	tests := []struct {
+		name         string
+		defaultModel string
+		body         string
+		wantStatus   int
+	}{
+		{name: "default model", defaultModel: "Embed Default", body: `{"input": "hello"}`, wantStatus: http.StatusOK},
+		{name: "no model", body: `{"input": "hello"}`, wantStatus: http.StatusBadRequest},
+		{name: "no input", defaultModel: "Embed Default", body: `{"model": "Embed Default"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown model", body: `{"model": "Nope", "input": "hello"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newEmbeddingsServer("embed-default-id", "Embed Default", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.5]}]}`))
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("EMBEDDING_MODEL_ID", tt.defaultModel)
+			defer os.Unsetenv("EMBEDDING_MODEL_ID")
+			activeSessions = make(map[string]*MorpheusSession)
+
+			w := httptest.NewRecorder()
+			handleEmbeddings(w, newEmbeddingsRequest(tt.body))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleEmbeddingsRetriesRetryableErrors(t *testing.T) {
+	var calls int32
+	server := newEmbeddingsServer("embed-retry-id", "Embed Retry", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error": "provider busy"}`))
+			return
+		}
+		w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.5]}]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("RETRYABLE_ERROR_SUBSTRINGS", "provider busy")
+	defer os.Unsetenv("RETRYABLE_ERROR_SUBSTRINGS")
+	os.Setenv("MODEL_RETRY_POLICIES", "embed-retry-id=3:1ms")
+	defer os.Unsetenv("MODEL_RETRY_POLICIES")
+	activeSessions = make(map[string]*MorpheusSession)
+
+	w := httptest.NewRecorder()
+	handleEmbeddings(w, newEmbeddingsRequest(`{"model": "Embed Retry", "input": ["hello"]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
+
+func TestHandleEmbeddingsWithSessionPool(t *testing.T) {
+	var sessions []string
+	var mu sync.Mutex
+	server := newEmbeddingsServer("embed-pool-id", "Embed Pool", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessions = append(sessions, r.Header.Get(getSessionHeader()))
+		mu.Unlock()
+		w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.5]}]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	cfg := config
+	defer applyConfig(cfg)
+	pooled := cfg
+	pooled.SessionPoolSize = 1
+	pooled.MaxConcurrentEstablishments = 0
+	applyConfig(pooled)
+	activeSessions = make(map[string]*MorpheusSession)
+	resetSessionPools()
+	defer resetSessionPools()
+
+	pool := getSessionPool("embed-pool-id")
+	deadline := time.Now().Add(2 * time.Second)
+	for !pool.ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("pool did not fill")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	handleEmbeddings(w, newEmbeddingsRequest(`{"model": "Embed Pool", "input": ["hello"]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if _, ok := getActiveSession("embed-pool-id"); ok {
+		t.Error("an active session was opened although the pool was ready")
+	}
+	if len(sessions) != 1 || sessions[0] != "embed-pool-id-session" {
+		t.Errorf("session headers = %v, want the pooled session", sessions)
+	}
+}
+
+func TestHandleEmbeddingsRejectsNonPost(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleEmbeddings(w, httptest.NewRequest("GET", "/v1/embeddings", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import "net/http"
+
+// APIError is the error object of an OpenAI-compatible error response. SDKs
+// expect it nested under "error" and fail to parse a flat message.
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+
+	// Set on upstream timeouts so clients can tell them from upstream errors
+	WaitedMs  int64 `json:"waitedMs,omitempty"`
+	TimeoutMs int64 `json:"timeoutMs,omitempty"`
+}
+
+// errorResponse is the body of every error the proxy returns itself
+type errorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// newAPIError builds the error object for statusCode, with the type and code
+// an OpenAI client would see for the same status
+func newAPIError(statusCode int, message string) APIError {
+	errType, code := errorTypeForStatus(statusCode)
+	apiErr := APIError{Message: message, Type: errType}
+	if code != "" {
+		apiErr.Code = &code
+	}
+	return apiErr
+}
+
+// errorTypeForStatus maps an HTTP status to an OpenAI error type and, where
+// OpenAI has one, an error code
+func errorTypeForStatus(statusCode int) (errType, code string) {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return "authentication_error", "invalid_api_key"
+	case http.StatusPaymentRequired:
+		return "insufficient_quota", "insufficient_quota"
+	case http.StatusForbidden:
+		return "permission_error", ""
+	case http.StatusTooManyRequests:
+		return "rate_limit_error", "rate_limit_exceeded"
+	case http.StatusGatewayTimeout:
+		return "server_error", "timeout"
+	}
+	if statusCode >= 500 {
+		return "server_error", ""
+	}
+	return "invalid_request_error", ""
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondWithErrorOpenAISchema(t *testing.T) {
+	tests := []struct {
+		status   int
+		wantType string
+		wantCode interface{}
+	}{
+		{http.StatusBadRequest, "invalid_request_error", nil},
+		{http.StatusUnauthorized, "authentication_error", "invalid_api_key"},
+		{http.StatusPaymentRequired, "insufficient_quota", "insufficient_quota"},
+		{http.StatusNotFound, "invalid_request_error", nil},
+		{http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded"},
+		{http.StatusInternalServerError, "server_error", nil},
+		{http.StatusServiceUnavailable, "server_error", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			respondWithError(w, tt.status, "something went wrong")
+
+			if w.Code != tt.status {
+				t.Errorf("status = %v, want %v", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+
+			// Decode generically so the exact shape, including the null
+			// fields, is checked rather than what the Go type accepts
+			var body map[string]map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("error body is not an object under \"error\": %v: %s", err, w.Body.String())
+			}
+			errObj := body["error"]
+			if errObj["message"] != "something went wrong" {
+				t.Errorf("message = %v", errObj["message"])
+			}
+			if errObj["type"] != tt.wantType {
+				t.Errorf("type = %v, want %v", errObj["type"], tt.wantType)
+			}
+			if code, ok := errObj["code"]; !ok || code != tt.wantCode {
+				t.Errorf("code = %v (present %v), want %v", code, ok, tt.wantCode)
+			}
+			if param, ok := errObj["param"]; !ok || param != nil {
+				t.Errorf("param = %v (present %v), want null", param, ok)
+			}
+		})
+	}
+}
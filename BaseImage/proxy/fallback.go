@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// servedModelHeader names the model that actually answered a chat request,
+// which differs from the requested one when the fallback model was used
+const servedModelHeader = "X-Served-Model"
+
+// getFallbackModelID resolves FALLBACK_MODEL_ID, an ID or model name to switch
+// to when modelID cannot be served. It reports false when no fallback is
+// configured, it cannot be resolved, or it is modelID itself.
+func getFallbackModelID(modelID string) (string, bool) {
+	handle := strings.TrimSpace(os.Getenv("FALLBACK_MODEL_ID"))
+	if handle == "" {
+		return "", false
+	}
+	fallbackID, err := validateModelHandle(resolveModelAlias(handle))
+	if err != nil {
+		log.Printf("Cannot resolve FALLBACK_MODEL_ID %s: %v", handle, err)
+		return "", false
+	}
+	return fallbackID, fallbackID != modelID
+}
+
+// isProviderUnavailable reports whether a marketplace status means the
+// model's provider could not serve the request
+func isProviderUnavailable(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable
+}
+
+// fallsBack reports whether a response with statusCode to a request for
+// modelID is handed to the fallback model
+func fallsBack(r *http.Request, modelID string, statusCode int) bool {
+	if !isProviderUnavailable(statusCode) {
+		return false
+	}
+	_, ok := fallbackModelFor(r, modelID)
+	return ok
+}
+
+// fallbackModelFor returns the model a request for modelID falls back to. It
+// reports false when there is none, or the request is pinned to a provider
+// and so wants that provider's answer or none.
+func fallbackModelFor(r *http.Request, modelID string) (string, bool) {
+	fallbackID, ok := getFallbackModelID(modelID)
+	if !ok || providerOverride(r.Context()) != "" {
+		return "", false
+	}
+	return fallbackID, true
+}
+
+// forwardToFallback retries a request whose provider was unavailable on the
+// fallback model. resp is the primary's response; it is returned, still
+// readable, when there is no fallback or the fallback cannot take the request
+// or is unavailable too, so the client sees the primary's error.
+func forwardToFallback(r *http.Request, requestBody map[string]interface{}, modelID string, resp *http.Response) (*http.Response, error) {
+	fallbackID, ok := fallbackModelFor(r, modelID)
+	if !ok {
+		return resp, nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	log.Printf("Provider for model %s unavailable (status %d), falling back to model %s", modelID, resp.StatusCode, fallbackID)
+	if err := ensureSession(r.Context(), fallbackID); err != nil {
+		log.Printf("Fallback model %s is unavailable too: %v", fallbackID, err)
+		return resp, nil
+	}
+
+	fallbackBody := make(map[string]interface{}, len(requestBody))
+	for k, v := range requestBody {
+		fallbackBody[k] = v
+	}
+	fallbackBody["model"] = fallbackID
+	fallbackResp, err := forwardWithRetries(r, fallbackBody, fallbackID)
+	if err == nil && isProviderUnavailable(fallbackResp.StatusCode) {
+		err = fmt.Errorf("status %d", fallbackResp.StatusCode)
+	}
+	if err != nil {
+		if fallbackResp != nil {
+			fallbackResp.Body.Close()
+		}
+		log.Printf("Fallback model %s failed too, answering with model %s's error: %v", fallbackID, modelID, err)
+		return resp, nil
+	}
+	fallbackResp.Header.Set(servedModelHeader, fallbackID)
+	return fallbackResp, nil
+}
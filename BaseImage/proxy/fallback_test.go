@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newFallbackMarketplace serves a primary and a fallback model. Each model's
+// session and chat endpoints answer 503 when that part of it is down; the
+// fallback's chat endpoint is down along with its session.
+func newFallbackMarketplace(primarySessionDown, primaryChatDown, fallbackDown, fallbackChatDown bool, servedModels *[]string) *httptest.Server {
+	down := map[string]bool{
+		"/blockchain/models/primary-model/session":  primarySessionDown,
+		"/blockchain/models/fallback-model/session": fallbackDown,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {
+				{Id: "primary-model", Name: "Primary Model"},
+				{Id: "fallback-model", Name: "Fallback Model"},
+			}})
+		case "/blockchain/models/primary-model/session", "/blockchain/models/fallback-model/session":
+			if down[r.URL.Path] {
+				http.Error(w, `{"error": "no providers available"}`, http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": r.URL.Path})
+		case "/chat/completions":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			model, _ := body["model"].(string)
+			*servedModels = append(*servedModels, model)
+			if (model == "primary-model" && primaryChatDown) || (model == "fallback-model" && (fallbackDown || fallbackChatDown)) {
+				http.Error(w, `{"error": "provider offline"}`, http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"choices": []}`))
+		}
+	}))
+}
+
+func TestFallbackModel(t *testing.T) {
+	defer func(d time.Duration) { baseDelay = d }(baseDelay)
+	baseDelay = time.Millisecond
+
+	tests := []struct {
+		name               string
+		fallback           string
+		primarySessionDown bool
+		primaryChatDown    bool
+		fallbackDown       bool
+		fallbackChatDown   bool
+		wantCode           int
+		wantServedBy       string
+		wantForwarded      []string
+	}{
+		{
+			name:          "primary up",
+			fallback:      "Fallback Model",
+			wantCode:      http.StatusOK,
+			wantServedBy:  "primary-model",
+			wantForwarded: []string{"primary-model"},
+		},
+		{
+			name:               "primary session down, fallback up",
+			fallback:           "Fallback Model",
+			primarySessionDown: true,
+			wantCode:           http.StatusOK,
+			wantServedBy:       "fallback-model",
+			wantForwarded:      []string{"fallback-model"},
+		},
+		{
+			name:            "primary provider down, fallback up",
+			fallback:        "Fallback Model",
+			primaryChatDown: true,
+			wantCode:        http.StatusOK,
+			wantServedBy:    "fallback-model",
+			wantForwarded:   []string{"primary-model", "fallback-model"},
+		},
+		{
+			name:               "both sessions down",
+			fallback:           "Fallback Model",
+			primarySessionDown: true,
+			fallbackDown:       true,
+			wantCode:           http.StatusServiceUnavailable,
+		},
+		{
+			name:            "both providers down",
+			fallback:        "Fallback Model",
+			primaryChatDown: true,
+			fallbackDown:    true,
+			wantCode:        http.StatusServiceUnavailable,
+			wantServedBy:    "primary-model",
+			wantForwarded:   []string{"primary-model"},
+		},
+		{
+			name:             "both providers down after the fallback session opened",
+			fallback:         "Fallback Model",
+			primaryChatDown:  true,
+			fallbackChatDown: true,
+			wantCode:         http.StatusServiceUnavailable,
+			wantServedBy:     "primary-model",
+			// The fallback, having none of its own, is retried
+			wantForwarded: []string{"primary-model", "fallback-model", "fallback-model", "fallback-model"},
+		},
+		{
+			name:               "no fallback configured",
+			primarySessionDown: true,
+			wantCode:           http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded []string
+			server := newFallbackMarketplace(tt.primarySessionDown, tt.primaryChatDown, tt.fallbackDown, tt.fallbackChatDown, &forwarded)
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("FALLBACK_MODEL_ID", tt.fallback)
+			defer os.Unsetenv("FALLBACK_MODEL_ID")
+			defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+			consumerNodeURL = server.URL
+
+			sessionMutex.Lock()
+			activeSessions = make(map[string]*MorpheusSession)
+			sessionMutex.Unlock()
+
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Primary Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get(servedModelHeader); got != tt.wantServedBy {
+				t.Errorf("%s = %q, want %q", servedModelHeader, got, tt.wantServedBy)
+			}
+			if len(forwarded) != len(tt.wantForwarded) {
+				t.Fatalf("forwarded to %v, want %v", forwarded, tt.wantForwarded)
+			}
+			for i := range forwarded {
+				if forwarded[i] != tt.wantForwarded[i] {
+					t.Errorf("forwarded to %v, want %v", forwarded, tt.wantForwarded)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+var finishReasons = metrics.counter("morpheus_proxy_finish_reasons_total",
+	"Completed choices by model and finish_reason (stop, length, content_filter, ...)", "model", "reason")
+
+// recordFinishReasons counts the finish_reason of every finished choice in a
+// chat completion or a single chat.completion.chunk payload. Chunks that are
+// not the last for their choice carry a null finish_reason and are ignored.
+func recordFinishReasons(modelID string, payload []byte) {
+	var completion struct {
+		Choices []struct {
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(payload, &completion); err != nil {
+		return
+	}
+	for _, choice := range completion.Choices {
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			finishReasons.Inc(modelID, *choice.FinishReason)
+		}
+	}
+}
+
+// recordEventFinishReasons counts the finish reasons in the data lines of one
+// relayed SSE event
+func recordEventFinishReasons(modelID string, event string) {
+	for _, line := range strings.Split(event, "\n") {
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		if !ok || isStreamDone(line) {
+			continue
+		}
+		recordFinishReasons(modelID, []byte(strings.TrimSpace(data)))
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFinishReasonCounter(t *testing.T) {
+	t.Run("non-streaming", func(t *testing.T) {
+		server := newMarketplaceServer("finish-model", "Finish Model", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices": [
+				{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"},
+				{"index": 1, "message": {"role": "assistant", "content": "Hel"}, "finish_reason": "length"}
+			]}`))
+		})
+		defer server.Close()
+		defer useMarketplaceURL(server.URL)()
+
+		stops := finishReasons.Value("finish-model", "stop")
+		lengths := finishReasons.Value("finish-model", "length")
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Finish Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+			}
+		}
+		if got := finishReasons.Value("finish-model", "stop") - stops; got != 2 {
+			t.Errorf("stop count = %v, want 2", got)
+		}
+		if got := finishReasons.Value("finish-model", "length") - lengths; got != 2 {
+			t.Errorf("length count = %v, want 2", got)
+		}
+	})
+
+	t.Run("streaming counts only the final chunk", func(t *testing.T) {
+		server := newMarketplaceServer("finish-stream-model", "Finish Stream Model", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hi\"}, \"finish_reason\": null}]}\n\n" +
+				"data: {\"choices\": [{\"index\": 0, \"delta\": {}, \"finish_reason\": \"content_filter\"}]}\n\n" +
+				"data: [DONE]\n\n"))
+		})
+		defer server.Close()
+		defer useMarketplaceURL(server.URL)()
+
+		filtered := finishReasons.Value("finish-stream-model", "content_filter")
+		unfinished := finishReasons.Value("finish-stream-model", "")
+		w := newFlushRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "Finish Stream Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v", w.Code)
+		}
+		if got := finishReasons.Value("finish-stream-model", "content_filter") - filtered; got != 1 {
+			t.Errorf("content_filter count = %v, want 1", got)
+		}
+		if got := finishReasons.Value("finish-stream-model", "") - unfinished; got != 0 {
+			t.Errorf("unfinished chunks should not be counted, got %v", got)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerServesRoutes(t *testing.T) {
+	os.Unsetenv("API_KEY")
+	handler, err := Handler()
+	if err != nil {
+		t.Fatalf("Handler() failed: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{method: "GET", path: "/health", want: http.StatusOK},
+		{method: "GET", path: "/metrics", want: http.StatusOK},
+		{method: "POST", path: "/v1/chat/completions", body: "", want: http.StatusBadRequest},
+		{method: "GET", path: "/admin/errors", want: http.StatusForbidden},
+		{method: "GET", path: "/debug/session", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", tt.method, tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+// newTestMux returns NewMux(cfg), failing t if cfg is rejected
+func newTestMux(t *testing.T, cfg *Config) *http.ServeMux {
+	t.Helper()
+	mux, err := NewMux(cfg)
+	if err != nil {
+		t.Fatalf("NewMux failed: %v", err)
+	}
+	return mux
+}
+
+func TestNewMuxRejectsInvalidConfig(t *testing.T) {
+	for _, marketplaceURL := range []string{"marketplace:9000", "http://marketplace:9000/chat/completions", "https://marketplace.example/?key=abc"} {
+		cfg := config
+		cfg.MarketplaceURL = marketplaceURL
+		if _, err := NewMux(&cfg); err == nil || !strings.Contains(err.Error(), "MARKETPLACE_URL") {
+			t.Errorf("NewMux with MarketplaceURL %q error = %v, want an invalid MARKETPLACE_URL error", marketplaceURL, err)
+		}
+	}
+}
+
+func TestNewMuxComposesWithMiddleware(t *testing.T) {
+	cfg := config
+	cfg.ForwardTimeout = config.ForwardTimeout + 7*time.Second
+
+	mux := http.NewServeMux()
+	mux.Handle("/proxy/", http.StripPrefix("/proxy", newTestMux(t, &cfg)))
+	wrapped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Middleware", "seen")
+		mux.ServeHTTP(w, r)
+	})
+
+	w := httptest.NewRecorder()
+	wrapped.ServeHTTP(w, httptest.NewRequest("GET", "/proxy/health", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Middleware") != "seen" {
+		t.Errorf("mounted proxy status = %d, middleware header = %q", w.Code, w.Header().Get("X-Middleware"))
+	}
+	if config.ForwardTimeout == cfg.ForwardTimeout {
+		t.Errorf("NewMux changed the active config, ForwardTimeout = %v", config.ForwardTimeout)
+	}
+}
+
+func TestNewMuxConfigsAreIndependent(t *testing.T) {
+	first, second := config, config
+	first.CORSAllowedOrigins = []string{"https://first.example"}
+	second.CORSAllowedOrigins = []string{"https://second.example"}
+	muxes := []*http.ServeMux{newTestMux(t, &first), newTestMux(t, &second)}
+
+	for i, origin := range []string{"https://first.example", "https://second.example"} {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		muxes[i].ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("mux %d: Access-Control-Allow-Origin = %q, want %q", i, got, origin)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// defaultSessionHeader carries the Morpheus session ID on requests to the
+// marketplace. The node reads it as "session_id"; header names are
+// case-insensitive and Go sends it canonicalized as "Session_id", so both
+// spellings refer to the same header.
+const defaultSessionHeader = "session_id"
+
+// getSessionHeader returns SESSION_HEADER_NAME, the header carrying the
+// session ID, for nodes that expect another one such as "X-Session-Id"
+func getSessionHeader() string {
+	if name := strings.TrimSpace(os.Getenv("SESSION_HEADER_NAME")); name != "" {
+		return name
+	}
+	return defaultSessionHeader
+}
+
+// setSessionHeader binds an outbound marketplace request to a session,
+// replacing any session header copied from the client. Always set the session
+// this way so the request carries a single value under a single name.
+func setSessionHeader(headers http.Header, sessionID string) {
+	headers.Set(getSessionHeader(), sessionID)
+}
+
+// getUpstreamHeaders returns UPSTREAM_HEADERS, static headers sent on every
+// request forwarded to the marketplace, as "Name=value" pairs, e.g.
+// "X-Chain-Id=42161". Newer nodes need some of these beyond the session.
+func getUpstreamHeaders() map[string]string {
+	return getEnvSettings("UPSTREAM_HEADERS")
+}
+
+// getProviderHeader returns UPSTREAM_PROVIDER_HEADER, the header that carries
+// the session's negotiated provider address on forwarded requests, or "" to
+// leave it out
+func getProviderHeader() string {
+	return strings.TrimSpace(os.Getenv("UPSTREAM_PROVIDER_HEADER"))
+}
+
+// setUpstreamHeaders adds the UPSTREAM_HEADERS and, if configured and known,
+// the session's provider address to an outbound marketplace request. They
+// replace any header of the same name forwarded from the client. The session
+// header is never overridden here; it is set by setSessionHeader.
+func setUpstreamHeaders(headers http.Header, session MorpheusSession) {
+	for name, value := range getUpstreamHeaders() {
+		if name == "" || http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(getSessionHeader()) {
+			continue
+		}
+		headers.Set(name, value)
+	}
+	if name := getProviderHeader(); name != "" && session.Provider != "" {
+		headers.Set(name, session.Provider)
+	}
+}
+
+// defaultForwardHeaders are the inbound headers forwarded to the marketplace
+// when FORWARD_HEADERS is unset
+var defaultForwardHeaders = []string{"X-Request-ID", "traceparent", "tracestate"}
+
+// getForwardHeaders returns the canonical names of inbound headers that are
+// forwarded to the marketplace, from the comma-separated FORWARD_HEADERS list
+func getForwardHeaders() []string {
+	names := defaultForwardHeaders
+	if value, ok := os.LookupEnv("FORWARD_HEADERS"); ok {
+		names = strings.Split(value, ",")
+	}
+
+	headers := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			headers = append(headers, http.CanonicalHeaderKey(name))
+		}
+	}
+	return headers
+}
+
+// forwardClientHeaders copies allowlisted headers from the inbound request to
+// the outbound marketplace request
+func forwardClientHeaders(dst, src http.Header) {
+	for _, name := range getForwardHeaders() {
+		for _, value := range src.Values(name) {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// ensureRequestID returns the request's X-Request-ID, generating one if the
+// client did not send it, and echoes it on the response
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+		r.Header.Set(requestIDHeader, requestID)
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	return requestID
+}
+
+// newRequestID returns a random 128-bit hex request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// copyMetadataHeaders copies the marketplace's rate-limit and request ID
+// headers to a response whose other headers the proxy sets itself, such as a
+// relayed stream, so clients see them whatever the stream mode. Rate-limit
+// headers are Retry-After and any starting with X-RateLimit-.
+func copyMetadataHeaders(w http.ResponseWriter, headers http.Header) {
+	for key, values := range headers {
+		canonical := http.CanonicalHeaderKey(key)
+		if canonical == requestIDHeader {
+			if len(values) > 0 && values[0] != "" {
+				w.Header().Set(requestIDHeader, values[0])
+			}
+			continue
+		}
+		if canonical != "Retry-After" && !strings.HasPrefix(canonical, "X-Ratelimit-") {
+			continue
+		}
+		w.Header().Del(canonical)
+		for _, value := range values {
+			w.Header().Add(canonical, value)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForwardRequestForwardsAllowlistedHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions["header-model"] = &MorpheusSession{
+		SessionID: "header-session",
+		ModelID:   "header-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "header-model")
+
+	inbound := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	inbound.Header.Set("X-Request-ID", "req-123")
+	inbound.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	inbound.Header.Set("Cookie", "secret=1")
+
+	resp, err := forwardRequest(inbound, map[string]interface{}{"model": "header-model"}, "header-model")
+	if err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := received.Get("X-Request-ID"); got != "req-123" {
+		t.Errorf("X-Request-ID = %q, want req-123", got)
+	}
+	if received.Get("traceparent") == "" {
+		t.Error("traceparent was not forwarded")
+	}
+	if received.Get("Cookie") != "" {
+		t.Error("Cookie should not be forwarded")
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "req-123")
+	copyHeaders(w, resp.Header)
+	if got := w.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != "req-123" {
+		t.Errorf("response X-Request-ID = %v, want [req-123]", got)
+	}
+}
+
+func TestEnsureRequestID(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+
+	requestID := ensureRequestID(w, req)
+	if requestID == "" {
+		t.Fatal("Expected a generated request ID")
+	}
+	if req.Header.Get("X-Request-ID") != requestID || w.Header().Get("X-Request-ID") != requestID {
+		t.Error("Generated request ID should be set on the request and the response")
+	}
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set("X-Request-ID", "client-id")
+	if got := ensureRequestID(httptest.NewRecorder(), req); got != "client-id" {
+		t.Errorf("ensureRequestID() = %s, want client-id", got)
+	}
+}
+
+func TestForwardRequestSendsSingleSessionHeader(t *testing.T) {
+	var sessionValues []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionValues = r.Header.Values("session_id")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+	// Even if an operator allowlists the session header, the client cannot override it
+	os.Setenv("FORWARD_HEADERS", "X-Request-ID,session_id")
+	defer os.Unsetenv("FORWARD_HEADERS")
+
+	activeSessions["single-header-model"] = &MorpheusSession{
+		SessionID: "proxy-session",
+		ModelID:   "single-header-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "single-header-model")
+
+	inbound := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	inbound.Header.Set("session_id", "client-session")
+
+	resp, err := forwardRequest(inbound, map[string]interface{}{"model": "single-header-model"}, "single-header-model")
+	if err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	resp.Body.Close()
+
+	if len(sessionValues) != 1 || sessionValues[0] != "proxy-session" {
+		t.Errorf("session header values = %v, want [proxy-session]", sessionValues)
+	}
+}
+
+func TestForwardRequestUsesConfiguredSessionHeader(t *testing.T) {
+	var upstream http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("SESSION_HEADER_NAME", "X-Session-Id")
+	defer os.Unsetenv("SESSION_HEADER_NAME")
+
+	activeSessions["header-name-model"] = &MorpheusSession{
+		SessionID: "proxy-session",
+		ModelID:   "header-name-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "header-name-model")
+
+	inbound := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	resp, err := forwardRequest(inbound, map[string]interface{}{"model": "header-name-model"}, "header-name-model")
+	if err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	resp.Body.Close()
+
+	if got := upstream.Values("X-Session-Id"); len(got) != 1 || got[0] != "proxy-session" {
+		t.Errorf("X-Session-Id values = %v, want [proxy-session]", got)
+	}
+	if got := upstream.Get("session_id"); got != "" {
+		t.Errorf("default session header also sent: %q", got)
+	}
+}
+
+func TestForwardRequestSendsUpstreamHeaders(t *testing.T) {
+	tests := []struct {
+		name           string
+		upstream       string // UPSTREAM_HEADERS
+		providerHeader string // UPSTREAM_PROVIDER_HEADER
+		provider       string
+		want           map[string]string
+	}{
+		{
+			name: "none configured",
+			want: map[string]string{"X-Chain-Id": "client", "X-Provider": ""},
+		},
+		{
+			name:     "static headers replace client values",
+			upstream: "X-Chain-Id=42161, X-Node-Version=2",
+			want:     map[string]string{"X-Chain-Id": "42161", "X-Node-Version": "2"},
+		},
+		{
+			name:     "session header cannot be overridden",
+			upstream: "session_id=static-session",
+			want:     map[string]string{"Session_id": "proxy-session"},
+		},
+		{
+			name:           "provider address",
+			providerHeader: "X-Provider",
+			provider:       "0xprovider",
+			want:           map[string]string{"X-Provider": "0xprovider"},
+		},
+		{
+			name:           "provider unknown",
+			providerHeader: "X-Provider",
+			want:           map[string]string{"X-Provider": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Clone()
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("FORWARD_HEADERS", "X-Chain-Id")
+			defer os.Unsetenv("FORWARD_HEADERS")
+			os.Setenv("UPSTREAM_HEADERS", tt.upstream)
+			defer os.Unsetenv("UPSTREAM_HEADERS")
+			os.Setenv("UPSTREAM_PROVIDER_HEADER", tt.providerHeader)
+			defer os.Unsetenv("UPSTREAM_PROVIDER_HEADER")
+
+			activeSessions["upstream-header-model"] = &MorpheusSession{
+				SessionID: "proxy-session",
+				ModelID:   "upstream-header-model",
+				Provider:  tt.provider,
+				Created:   time.Now(),
+			}
+			defer delete(activeSessions, "upstream-header-model")
+
+			inbound := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			inbound.Header.Set("X-Chain-Id", "client")
+
+			resp, err := forwardRequest(inbound, map[string]interface{}{"model": "upstream-header-model"}, "upstream-header-model")
+			if err != nil {
+				t.Fatalf("forwardRequest() error = %v", err)
+			}
+			resp.Body.Close()
+
+			for name, want := range tt.want {
+				if got := received.Values(name); want == "" && len(got) != 0 || want != "" && (len(got) != 1 || got[0] != want) {
+					t.Errorf("%s = %v, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitHeadersRelayedInEveryStreamMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    bool
+		streaming string // STREAMING_DISABLED_MODELS
+	}{
+		{name: "non-streaming"},
+		{name: "streaming", stream: true},
+		{name: "buffered streaming", stream: true, streaming: "ratelimit-model=buffer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMarketplaceServer("ratelimit-model", "RateLimit Model", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-RateLimit-Remaining", "41")
+				w.Header().Set("x-ratelimit-reset-requests", "2s")
+				w.Header().Set("Retry-After", "3")
+				w.Header().Set("X-Request-ID", "upstream-req")
+				w.Header().Set("X-Internal", "not for clients")
+				var req struct {
+					Stream bool `json:"stream"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				if req.Stream {
+					w.Header().Set("Content-Type", "text/event-stream")
+					w.Write([]byte("data: {\"choices\": []}\n\ndata: [DONE]\n\n"))
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "hi"}}]}`))
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("STREAMING_DISABLED_MODELS", tt.streaming)
+			defer os.Unsetenv("STREAMING_DISABLED_MODELS")
+
+			body := fmt.Sprintf(`{"model": "RateLimit Model", "stream": %t, "messages": [{"role": "user", "content": "Hello"}]}`, tt.stream)
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(body))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			headers := w.Result().Header
+			for name, want := range map[string]string{
+				"X-Ratelimit-Remaining":      "41",
+				"X-Ratelimit-Reset-Requests": "2s",
+				"Retry-After":                "3",
+			} {
+				if got := headers.Values(name); len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %v, want [%s]", name, got, want)
+				}
+			}
+			if got := headers.Values(requestIDHeader); len(got) != 1 || got[0] != "upstream-req" {
+				t.Errorf("%s = %v, want [upstream-req]", requestIDHeader, got)
+			}
+			if tt.stream && headers.Get("X-Internal") != "" {
+				t.Errorf("stream relayed a header outside the allowlist")
+			}
+		})
+	}
+}
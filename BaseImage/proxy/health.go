@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	marketplaceUp = metrics.gauge("morpheus_proxy_marketplace_up",
+		"1 if the last marketplace health check succeeded, 0 if it failed")
+	marketplaceHealthLatency = metrics.gauge("morpheus_proxy_marketplace_healthcheck_latency_seconds",
+		"Latency of the last marketplace health check")
+	marketplaceHealthChecked = metrics.gauge("morpheus_proxy_marketplace_healthcheck_timestamp_seconds",
+		"Unix time of the last marketplace health check")
+)
+
+// MarketplaceHealth is the result of a marketplace health check
+type MarketplaceHealth struct {
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checkedAt"`
+	LatencyMs int64     `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// marketplaceHealth caches the last result of the background health check.
+// It stays nil while the check is disabled or has not run yet.
+var marketplaceHealth struct {
+	sync.RWMutex
+	last *MarketplaceHealth
+}
+
+func getMarketplaceHealthEndpoint() string {
+	return fmt.Sprintf("%s/healthcheck", getMarketplaceBaseURL())
+}
+
+// lastMarketplaceHealth returns the cached health check result, reporting
+// false if there is none
+func lastMarketplaceHealth() (MarketplaceHealth, bool) {
+	marketplaceHealth.RLock()
+	defer marketplaceHealth.RUnlock()
+	if marketplaceHealth.last == nil {
+		return MarketplaceHealth{}, false
+	}
+	return *marketplaceHealth.last, true
+}
+
+// runHealthChecks probes the marketplace at once and then every interval
+// until ctx is done, caching each result
+func runHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkMarketplaceHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkMarketplaceHealth probes the marketplace's /healthcheck, caches the
+// result and records it in the metrics
+func checkMarketplaceHealth(ctx context.Context) MarketplaceHealth {
+	start := now()
+	health := MarketplaceHealth{CheckedAt: start}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getMarketplaceHealthEndpoint(), nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = newMarketplaceClient(config.ModelsTimeout).Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+	}
+	latency := now().Sub(start)
+	health.LatencyMs = latency.Milliseconds()
+	health.Healthy = err == nil
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	marketplaceHealth.Lock()
+	previous := marketplaceHealth.last
+	marketplaceHealth.last = &health
+	marketplaceHealth.Unlock()
+
+	if previous == nil || previous.Healthy != health.Healthy {
+		if health.Healthy {
+			log.Printf("Marketplace health check passed in %v", latency)
+		} else {
+			log.Printf("Marketplace health check failed after %v: %v", latency, err)
+		}
+	}
+	up := 0.0
+	if health.Healthy {
+		up = 1
+	}
+	marketplaceUp.Set(up)
+	marketplaceHealthLatency.Set(latency.Seconds())
+	marketplaceHealthChecked.Set(float64(health.CheckedAt.Unix()))
+	return health
+}
+
+// handleReady reports whether the proxy can serve requests, going by the
+// cached marketplace health. Without a health check it is always ready,
+// unless draining.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	health, checked := lastMarketplaceHealth()
+	status, code := "ready", http.StatusOK
+	if checked && !health.Healthy {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	if isDraining() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+
+	body := map[string]interface{}{"status": status}
+	if checked {
+		body["marketplace"] = health
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func resetMarketplaceHealth() {
+	marketplaceHealth.Lock()
+	marketplaceHealth.last = nil
+	marketplaceHealth.Unlock()
+}
+
+func TestCheckMarketplaceHealth(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthcheck" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer resetMarketplaceHealth()
+
+	healthy.Store(true)
+	if health := checkMarketplaceHealth(context.Background()); !health.Healthy {
+		t.Fatalf("expected healthy marketplace, got %+v", health)
+	}
+	if got := marketplaceUp.Value(); got != 1 {
+		t.Errorf("marketplace up gauge = %v, want 1", got)
+	}
+
+	healthy.Store(false)
+	health := checkMarketplaceHealth(context.Background())
+	if health.Healthy || health.Error != "status 503" {
+		t.Fatalf("expected unhealthy marketplace, got %+v", health)
+	}
+	if cached, ok := lastMarketplaceHealth(); !ok || cached != health {
+		t.Errorf("cached health = %+v, want %+v", cached, health)
+	}
+	if got := marketplaceUp.Value(); got != 0 {
+		t.Errorf("marketplace up gauge = %v, want 0", got)
+	}
+}
+
+func TestRunHealthChecksStopsOnCancel(t *testing.T) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer resetMarketplaceHealth()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runHealthChecks(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.After(2 * time.Second)
+	for probes.Load() < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected repeated probes, got %d", probes.Load())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("health check loop did not stop on cancel")
+	}
+}
+
+func TestReadyUsesCachedHealth(t *testing.T) {
+	defer resetMarketplaceHealth()
+	cfg := config
+	defer applyConfig(cfg)
+	mux := newTestMux(t, &cfg)
+
+	tests := []struct {
+		name   string
+		health *MarketplaceHealth
+		want   int
+	}{
+		{name: "not checked", want: http.StatusOK},
+		{name: "healthy", health: &MarketplaceHealth{Healthy: true}, want: http.StatusOK},
+		{name: "unhealthy", health: &MarketplaceHealth{Error: "status 503"}, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marketplaceHealth.Lock()
+			marketplaceHealth.last = tt.health
+			marketplaceHealth.Unlock()
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+
+			w = httptest.NewRecorder()
+			handleDebugSession(w, httptest.NewRequest(http.MethodGet, "/debug/session", nil))
+			var debug SessionDebugResponse
+			if err := json.NewDecoder(w.Body).Decode(&debug); err != nil {
+				t.Fatal(err)
+			}
+			if (debug.Marketplace != nil) != (tt.health != nil) {
+				t.Errorf("debug marketplace = %+v, want %+v", debug.Marketplace, tt.health)
+			}
+		})
+	}
+}
+
+func TestEnsureSessionFailsFastWhenMarketplaceUnhealthy(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer resetMarketplaceHealth()
+
+	marketplaceHealth.Lock()
+	marketplaceHealth.last = &MarketplaceHealth{CheckedAt: now(), Error: "status 503"}
+	marketplaceHealth.Unlock()
+
+	err := ensureSession(context.Background(), "unhealthy-model")
+	if !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("ensureSession() error = %v, want ErrUpstreamUnavailable", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected no marketplace requests, got %d", n)
+	}
+}
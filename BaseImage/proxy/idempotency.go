@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader lets clients mark retries of the same completion, so
+// a repeat within IDEMPOTENCY_TTL_SECONDS is answered from cache rather than
+// paid for twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayHeader is set on responses served from the cache
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// ErrIdempotencyKeyReused marks a request repeating an Idempotency-Key with a
+// different body than the request that first used it
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request body")
+
+// idempotency is rebuilt by applyConfig
+var idempotency *idempotencyCache
+
+var idempotencyHits = metrics.counter("morpheus_proxy_idempotency_hits_total",
+	"Non-streaming completions answered from the idempotency cache")
+
+// cachedResponse is a successful non-streaming completion kept for replay
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyEntry is a completion either in flight or cached. done is
+// closed once the first request for the key has finished, whether or not it
+// stored a response.
+type idempotencyEntry struct {
+	done     chan struct{}
+	bodyHash [sha256.Size]byte
+	response *cachedResponse
+	stored   time.Time
+	elem     *list.Element // position in the eviction order once stored
+}
+
+type idempotencyKey struct {
+	key     string
+	modelID string
+}
+
+// idempotencyCache holds completions by (Idempotency-Key, model) for ttl.
+// Once it holds maxEntries responses, the oldest is evicted. A ttl of 0
+// disables it.
+type idempotencyCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[idempotencyKey]*idempotencyEntry
+	order      *list.List // stored keys, oldest first
+}
+
+func newIdempotencyCache(ttl time.Duration, maxEntries int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[idempotencyKey]*idempotencyEntry),
+		order:      list.New(),
+	}
+}
+
+// idempotencyClaim is held by the request that forwards a completion for an
+// idempotency key. Requests repeating the key wait until it is released.
+type idempotencyClaim struct {
+	cache *idempotencyCache
+	key   idempotencyKey
+	entry *idempotencyEntry
+}
+
+// begin looks up key for modelID. It returns the cached response if there
+// is one; otherwise it claims the key and returns the claim, which must be
+// released. A request repeating a key still in flight waits for the first
+// to finish, and returns ctx's error if ctx ends first. A repeat whose body
+// differs from the first request's returns ErrIdempotencyKeyReused. Both
+// results are nil when the cache is disabled or key is empty.
+func (c *idempotencyCache) begin(ctx context.Context, key, modelID string, body []byte) (*cachedResponse, *idempotencyClaim, error) {
+	if c == nil || c.ttl <= 0 || key == "" {
+		return nil, nil, nil
+	}
+	k := idempotencyKey{key: key, modelID: modelID}
+	bodyHash := sha256.Sum256(body)
+	for {
+		c.mu.Lock()
+		entry, exists := c.entries[k]
+		if exists && entry.response != nil && now().Sub(entry.stored) >= c.ttl {
+			c.removeLocked(k, entry)
+			exists = false
+		}
+		if exists && entry.bodyHash != bodyHash {
+			c.mu.Unlock()
+			return nil, nil, ErrIdempotencyKeyReused
+		}
+		if exists && entry.response != nil {
+			c.mu.Unlock()
+			return entry.response, nil, nil
+		}
+		if !exists {
+			entry = &idempotencyEntry{done: make(chan struct{}), bodyHash: bodyHash}
+			c.entries[k] = entry
+			c.mu.Unlock()
+			return nil, &idempotencyClaim{cache: c, key: k, entry: entry}, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (c *idempotencyCache) removeLocked(k idempotencyKey, entry *idempotencyEntry) {
+	if entry.elem != nil {
+		c.order.Remove(entry.elem)
+	}
+	delete(c.entries, k)
+}
+
+// store caches a successful response for the claimed key
+func (cl *idempotencyClaim) store(status int, header http.Header, body []byte) {
+	if cl == nil {
+		return
+	}
+	header = header.Clone()
+	// The replay gets its own request ID
+	header.Del(requestIDHeader)
+
+	c := cl.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[cl.key] != cl.entry || cl.entry.response != nil {
+		return
+	}
+	cl.entry.response = &cachedResponse{status: status, header: header, body: body}
+	cl.entry.stored = now()
+	cl.entry.elem = c.order.PushBack(cl.key)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Front().Value.(idempotencyKey)
+		c.removeLocked(oldest, c.entries[oldest])
+	}
+}
+
+// release ends the claim, dropping the key if nothing was stored so a
+// repeat forwards again, and wakes requests waiting on it
+func (cl *idempotencyClaim) release() {
+	if cl == nil {
+		return
+	}
+	c := cl.cache
+	c.mu.Lock()
+	if c.entries[cl.key] == cl.entry && cl.entry.response == nil {
+		delete(c.entries, cl.key)
+	}
+	c.mu.Unlock()
+	close(cl.entry.done)
+}
+
+// withIdempotencyClaim carries the claim to the handler that forwards the
+// request
+func withIdempotencyClaim(r *http.Request, claim *idempotencyClaim) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), idempotencyClaimKey, claim))
+}
+
+func idempotencyClaimFrom(r *http.Request) *idempotencyClaim {
+	claim, _ := r.Context().Value(idempotencyClaimKey).(*idempotencyClaim)
+	return claim
+}
+
+// writeCachedResponse replays a cached completion
+func writeCachedResponse(w http.ResponseWriter, cached *cachedResponse) {
+	copyHeaders(w, cached.header)
+	w.Header().Set(idempotentReplayHeader, "true")
+	w.WriteHeader(cached.status)
+	w.Write(cached.body)
+}
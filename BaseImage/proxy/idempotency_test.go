@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+	defer func(cache *idempotencyCache) { idempotency = cache }(idempotency)
+	idempotency = newIdempotencyCache(time.Minute, 10)
+
+	var calls atomic.Int32
+	status := http.StatusOK
+	server := newMarketplaceServer("idem-model", "Idem Model", func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"id": "completion-%d", "choices": []}`, n)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	send := func(key string, stream bool) *flushRecorder {
+		body := `{"model": "Idem Model", "messages": [{"role": "user", "content": "Hello"}]}`
+		if stream {
+			body = `{"model": "Idem Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+		}
+		req := newChatRequest(body)
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		w := newFlushRecorder()
+		ProxyChatCompletion(w, req)
+		return w
+	}
+
+	first := send("key-1", false)
+	if first.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("first request: status %v, %d upstream calls", first.Code, calls.Load())
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		w := send("key-1", false)
+		if calls.Load() != 1 {
+			t.Errorf("repeat was forwarded: %d upstream calls", calls.Load())
+		}
+		if w.Body.String() != first.Body.String() {
+			t.Errorf("replayed body = %q, want %q", w.Body.String(), first.Body.String())
+		}
+		if w.Header().Get(idempotentReplayHeader) != "true" {
+			t.Errorf("expected %s header on replay", idempotentReplayHeader)
+		}
+		if w.Header().Get(requestIDHeader) == first.Header().Get(requestIDHeader) {
+			t.Error("replay reused the original request ID")
+		}
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		req := newChatRequest(`{"model": "Idem Model", "messages": [{"role": "user", "content": "Goodbye"}]}`)
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, req)
+		if w.Code != http.StatusUnprocessableEntity || calls.Load() != 1 {
+			t.Errorf("reused key: status %v, %d upstream calls, want 422 and no forwarding", w.Code, calls.Load())
+		}
+	})
+
+	t.Run("miss", func(t *testing.T) {
+		before := calls.Load()
+		send("key-2", false)
+		send("", false)
+		send("", false)
+		if got := calls.Load() - before; got != 3 {
+			t.Errorf("upstream calls = %d, want 3", got)
+		}
+	})
+
+	t.Run("streaming is not cached", func(t *testing.T) {
+		before := calls.Load()
+		send("key-stream", true)
+		send("key-stream", true)
+		if got := calls.Load() - before; got != 2 {
+			t.Errorf("upstream calls = %d, want 2", got)
+		}
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		status = http.StatusBadRequest
+		defer func() { status = http.StatusOK }()
+		before := calls.Load()
+		send("key-error", false)
+		send("key-error", false)
+		if got := calls.Load() - before; got != 2 {
+			t.Errorf("upstream calls = %d, want 2", got)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		fake.Advance(time.Minute)
+		before := calls.Load()
+		w := send("key-1", false)
+		if got := calls.Load() - before; got != 1 {
+			t.Errorf("upstream calls after expiry = %d, want 1", got)
+		}
+		if w.Header().Get(idempotentReplayHeader) != "" {
+			t.Error("expired entry was replayed")
+		}
+	})
+}
+
+func TestIdempotencyCacheBounded(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		_, claim, _ := cache.begin(context.Background(), key, "model", nil)
+		claim.store(http.StatusOK, http.Header{}, []byte(key))
+		claim.release()
+	}
+
+	if len(cache.entries) != 2 {
+		t.Errorf("cache holds %d entries, want 2", len(cache.entries))
+	}
+	if cached, _, _ := cache.begin(context.Background(), "c", "model", nil); cached == nil {
+		t.Error("newest entry was evicted")
+	}
+	cached, claim, _ := cache.begin(context.Background(), "a", "model", nil)
+	if cached != nil {
+		t.Error("oldest entry was kept")
+	}
+	claim.release()
+
+	// Keys are scoped to the model
+	cached, claim, _ = cache.begin(context.Background(), "c", "other-model", nil)
+	if cached != nil {
+		t.Error("entry was replayed for another model")
+	}
+	claim.release()
+}
+
+func TestIdempotencyConcurrentRepeatWaits(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute, 10)
+	_, claim, _ := cache.begin(context.Background(), "key", "model", nil)
+
+	var wg sync.WaitGroup
+	replayed := make(chan []byte, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cached, _, err := cache.begin(context.Background(), "key", "model", nil)
+		if err != nil || cached == nil {
+			t.Errorf("repeat did not get the cached response: %v", err)
+			return
+		}
+		replayed <- cached.body
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	claim.store(http.StatusOK, http.Header{}, []byte("done"))
+	claim.release()
+	wg.Wait()
+	if body := <-replayed; string(body) != "done" {
+		t.Errorf("replayed body = %q, want done", body)
+	}
+
+	// A repeat gives up waiting when its request is cancelled
+	_, claim, _ = cache.begin(context.Background(), "pending", "model", nil)
+	defer claim.release()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := cache.begin(ctx, "pending", "model", nil); err == nil {
+		t.Error("expected the wait to end with the context")
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var jsonValidationFailures = metrics.counter("morpheus_proxy_json_validation_failures_total",
+	"Non-streaming completions in JSON mode whose content did not parse as JSON", "model")
+
+// requestsJSONOutput reports whether a chat request asks for JSON output
+// through response_format, either as a JSON object or against a JSON schema.
+// The response_format itself is forwarded to the provider unchanged.
+func requestsJSONOutput(requestBody map[string]interface{}) bool {
+	format, ok := requestBody["response_format"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	formatType, _ := format["type"].(string)
+	return formatType == "json_object" || formatType == "json_schema"
+}
+
+// checkJSONCompletion returns an error if the content of any choice in a
+// completion does not parse as JSON. Choices without content, such as tool
+// calls, and bodies that are not a completion are not checked.
+func checkJSONCompletion(payload []byte) error {
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content *string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(payload, &completion); err != nil {
+		return nil
+	}
+	for i, choice := range completion.Choices {
+		content := choice.Message.Content
+		if content == nil {
+			continue
+		}
+		if !json.Valid([]byte(strings.TrimSpace(*content))) {
+			return fmt.Errorf("choice %d content is not valid JSON", i)
+		}
+	}
+	return nil
+}
+
+// forwardRequestValidatingJSON forwards the chat request like forwardRequest.
+// With VALIDATE_JSON_RESPONSES on and JSON output requested, a successful
+// completion whose content does not parse as JSON is retried once; the
+// second response is returned whether or not it is valid.
+func forwardRequestValidatingJSON(r *http.Request, requestBody map[string]interface{}, modelID string) (*http.Response, error) {
+	resp, err := forwardRequest(r, requestBody, modelID)
+	if err != nil || !config.ValidateJSONResponses || !requestsJSONOutput(requestBody) {
+		return resp, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+			return resp, nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %v", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		invalid := checkJSONCompletion(body)
+		if invalid == nil {
+			return resp, nil
+		}
+		jsonValidationFailures.Inc(modelID)
+		if attempt > 1 {
+			log.Printf("JSON mode response for request %s is still invalid after a retry, relaying it: %v", r.Header.Get(requestIDHeader), invalid)
+			return resp, nil
+		}
+		log.Printf("JSON mode response for request %s is invalid, retrying once: %v", r.Header.Get(requestIDHeader), invalid)
+
+		retry, err := forwardRequest(r, requestBody, modelID)
+		if err != nil {
+			// The invalid completion is still a completion; relay it
+			log.Printf("Retry of invalid JSON mode response for request %s failed, relaying the first: %v", r.Header.Get(requestIDHeader), err)
+			return resp, nil
+		}
+		resp = retry
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestsJSONOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{name: "no response_format", body: `{}`, want: false},
+		{name: "text", body: `{"response_format": {"type": "text"}}`, want: false},
+		{name: "json object", body: `{"response_format": {"type": "json_object"}}`, want: true},
+		{name: "json schema", body: `{"response_format": {"type": "json_schema", "json_schema": {"name": "x", "schema": {}}}}`, want: true},
+		{name: "malformed", body: `{"response_format": "json_object"}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := decodeRequestBody([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requestsJSONOutput(body); got != tt.want {
+				t.Errorf("requestsJSONOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckJSONCompletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{name: "valid object", payload: `{"choices": [{"message": {"content": " {\"a\": 1}\n"}}]}`},
+		{name: "tool call without content", payload: `{"choices": [{"message": {"content": null, "tool_calls": []}}]}`},
+		{name: "not a completion", payload: `not json`},
+		{name: "prose", payload: `{"choices": [{"message": {"content": "Sure! Here it is"}}]}`, wantErr: true},
+		{name: "second choice invalid", payload: `{"choices": [{"message": {"content": "{}"}}, {"message": {"content": "{"}}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkJSONCompletion([]byte(tt.payload)); (err != nil) != tt.wantErr {
+				t.Errorf("checkJSONCompletion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONModeRetriesInvalidResponseOnce(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      bool
+		responses    []string
+		wantCalls    int32
+		wantFailures float64
+		want         string
+	}{
+		{name: "disabled", enabled: false, responses: []string{"not json"}, wantCalls: 1, want: "not json"},
+		{name: "valid first time", enabled: true, responses: []string{`{"ok": true}`}, wantCalls: 1, want: `{"ok": true}`},
+		{name: "valid on retry", enabled: true, responses: []string{"not json", `{"ok": true}`}, wantCalls: 2, wantFailures: 1, want: `{"ok": true}`},
+		{name: "invalid twice", enabled: true, responses: []string{"not json", "still not"}, wantCalls: 2, wantFailures: 2, want: "still not"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := newMarketplaceServer("json-model", "JSON Model", func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				content := tt.responses[len(tt.responses)-1]
+				if int(n) <= len(tt.responses) {
+					content = tt.responses[n-1]
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"choices": []interface{}{map[string]interface{}{
+						"message":       map[string]string{"role": "assistant", "content": content},
+						"finish_reason": "stop",
+					}},
+				})
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+
+			cfg := config
+			defer applyConfig(cfg)
+			validating := cfg
+			validating.ValidateJSONResponses = tt.enabled
+			applyConfig(validating)
+			activeSessions = make(map[string]*MorpheusSession)
+
+			failures := jsonValidationFailures.Value("json-model")
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "JSON Model", "response_format": {"type": "json_object"}, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+			var completion struct {
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil || len(completion.Choices) != 1 {
+				t.Fatalf("response %s is not a completion: %v", w.Body.String(), err)
+			}
+			if got := completion.Choices[0].Message.Content; got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if got := jsonValidationFailures.Value("json-model") - failures; got != tt.wantFailures {
+				t.Errorf("validation failures = %v, want %v", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestJSONModeForwardsResponseFormat(t *testing.T) {
+	var forwarded map[string]interface{}
+	server := newMarketplaceServer("format-model", "Format Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "{}"}}]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Format Model", "response_format": {"type": "json_schema", "json_schema": {"name": "answer", "strict": true, "schema": {"type": "object"}}}, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	format, _ := json.Marshal(forwarded["response_format"])
+	if want := `{"json_schema":{"name":"answer","schema":{"type":"object"},"strict":true},"type":"json_schema"}`; string(format) != want {
+		t.Errorf("forwarded response_format = %s, want %s", format, want)
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry holds the proxy's metrics and renders them in the Prometheus
+// text exposition format
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []collector
+}
+
+// collector is a registered metric that renders itself for /metrics
+type collector interface {
+	write(sb *strings.Builder)
+}
+
+var metrics = &metricsRegistry{}
+
+// metricVec is a counter or gauge with a fixed set of label names
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by label values joined with "\xff"
+}
+
+func (reg *metricsRegistry) register(kind, name, help string, labels []string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	reg.add(m)
+	return m
+}
+
+func (reg *metricsRegistry) add(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, c)
+}
+
+// counter registers a counter with the given label names
+func (reg *metricsRegistry) counter(name, help string, labels ...string) *metricVec {
+	return reg.register("counter", name, help, labels)
+}
+
+// gauge registers a gauge with the given label names
+func (reg *metricsRegistry) gauge(name, help string, labels ...string) *metricVec {
+	return reg.register("gauge", name, help, labels)
+}
+
+func (m *metricVec) key(labelValues []string) string {
+	return seriesKey(m.name, m.labels, labelValues)
+}
+
+// seriesKey identifies the series of metric name with labelValues
+func seriesKey(name string, labels, labelValues []string) string {
+	if len(labelValues) != len(labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", name, len(labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// formatLabels renders the label pairs of the series keyed by key, followed
+// by any extra name and value pairs, or "" if there are none
+func formatLabels(labels []string, key string, extra ...string) string {
+	var pairs []string
+	if len(labels) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, label := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", label, strconv.Quote(values[i])))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add adds delta to the series identified by labelValues
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += delta
+}
+
+// Inc adds one to the series identified by labelValues
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set replaces the value of a gauge series
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+}
+
+// Value returns the current value of the series identified by labelValues
+func (m *metricVec) Value(labelValues ...string) float64 {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+// write renders the metric in the Prometheus text format with its series
+// sorted by label values
+func (m *metricVec) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		sb.WriteString(m.name + formatLabels(m.labels, key))
+		sb.WriteString(" " + strconv.FormatFloat(m.values[key], 'g', -1, 64) + "\n")
+	}
+}
+
+// histogramVec is a histogram with a fixed set of label names and bucket
+// upper bounds
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // ascending; +Inf is implied
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries // keyed like metricVec.values
+}
+
+type histogramSeries struct {
+	counts []uint64 // observations per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// histogram registers a histogram with the given bucket upper bounds and
+// label names
+func (reg *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	reg.add(h)
+	return h
+}
+
+// Observe records value in the series identified by labelValues
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(h.name, h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Count returns the number of observations in the series identified by
+// labelValues
+func (h *histogramVec) Count(labelValues ...string) uint64 {
+	key := seriesKey(h.name, h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if series, ok := h.series[key]; ok {
+		return series.count
+	}
+	return 0
+}
+
+// write renders the histogram's cumulative buckets, sum and count for each
+// series, sorted by label values
+func (h *histogramVec) write(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(sb, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", le), cumulative)
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(sb, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), series.count)
+	}
+}
+
+// handleMetrics serves all registered metrics for Prometheus to scrape
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	registered := append([]collector(nil), metrics.metrics...)
+	metrics.mu.Unlock()
+
+	var sb strings.Builder
+	for _, m := range registered {
+		m.write(&sb)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
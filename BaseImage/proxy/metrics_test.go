@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	reg := &metricsRegistry{}
+	requests := reg.counter("test_requests_total", "Requests by wallet", "wallet")
+	requests.Inc("0xaaaa...aaaa")
+	requests.Add(2, "0xbbbb...bbbb")
+
+	saved := metrics
+	metrics = reg
+	defer func() { metrics = saved }()
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := "# HELP test_requests_total Requests by wallet\n" +
+		"# TYPE test_requests_total counter\n" +
+		"test_requests_total{wallet=\"0xaaaa...aaaa\"} 1\n" +
+		"test_requests_total{wallet=\"0xbbbb...bbbb\"} 2\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("metrics output:\n%s\nwant:\n%s", got, want)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type = %s, want text/plain", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHistogramMetrics(t *testing.T) {
+	reg := &metricsRegistry{}
+	waits := reg.histogram("test_wait_seconds", "Wait by pool", []float64{0.1, 1}, "pool")
+	waits.Observe(0.05, "upstream")
+	waits.Observe(0.5, "upstream")
+	waits.Observe(3, "upstream")
+
+	saved := metrics
+	metrics = reg
+	defer func() { metrics = saved }()
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := "# HELP test_wait_seconds Wait by pool\n" +
+		"# TYPE test_wait_seconds histogram\n" +
+		"test_wait_seconds_bucket{pool=\"upstream\",le=\"0.1\"} 1\n" +
+		"test_wait_seconds_bucket{pool=\"upstream\",le=\"1\"} 2\n" +
+		"test_wait_seconds_bucket{pool=\"upstream\",le=\"+Inf\"} 3\n" +
+		"test_wait_seconds_sum{pool=\"upstream\"} 3.55\n" +
+		"test_wait_seconds_count{pool=\"upstream\"} 3\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("metrics output:\n%s\nwant:\n%s", got, want)
+	}
+	if got := waits.Count("upstream"); got != 3 {
+		t.Errorf("Count() = %d, want 3", got)
+	}
+}
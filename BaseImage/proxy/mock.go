@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMockReply is the completion served in mock upstream mode when
+// MOCK_UPSTREAM_REPLY is unset
+const defaultMockReply = "This is a canned reply from the proxy's mock upstream."
+
+// mockProvider is the provider address the mock upstream opens sessions with
+const mockProvider = "0x0000000000000000000000000000000000000000"
+
+// mockEmbeddingDimensions is the length of the mock upstream's embeddings
+const mockEmbeddingDimensions = 8
+
+// isMockUpstream reports whether MOCK_UPSTREAM is on, in which case the
+// marketplace is never contacted and every marketplace call is answered with
+// a canned response. It is meant for local development only.
+func isMockUpstream() bool {
+	return getEnvBool("MOCK_UPSTREAM", false)
+}
+
+// getMockModels returns MOCK_UPSTREAM_MODELS, the model names the mock
+// upstream lists, e.g. "llama-3,mistral"
+func getMockModels() []string {
+	return getEnvList("MOCK_UPSTREAM_MODELS", []string{"mock-model"})
+}
+
+// getMockReply returns MOCK_UPSTREAM_REPLY, the completion the mock upstream
+// answers every chat request with
+func getMockReply() string {
+	return getEnvOrDefault("MOCK_UPSTREAM_REPLY", defaultMockReply)
+}
+
+// mockID returns a stable 0x-prefixed 32-byte hex ID for name, shaped like an
+// on-chain model or session ID
+func mockID(kind, name string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + name))
+	return "0x" + hex.EncodeToString(sum[:])
+}
+
+// warnMockUpstream logs, as loudly as the logs allow, that no model is
+// serving the proxy's responses
+func warnMockUpstream() {
+	const banner = "WARNING: ************************************************************"
+	log.Print(banner)
+	log.Print("WARNING: MOCK_UPSTREAM is enabled. The marketplace is NOT contacted and")
+	log.Print("WARNING: every completion is a canned reply. Never enable it in production.")
+	log.Print(banner)
+}
+
+// mockUpstreamTransport answers marketplace requests with canned responses:
+// the models in MOCK_UPSTREAM_MODELS, sessions that always open, and
+// MOCK_UPSTREAM_REPLY as every completion, streamed word by word when the
+// request asks for a stream. Responses are deterministic, so the same
+// request always gets the same answer.
+type mockUpstreamTransport struct{}
+
+func newMockUpstreamTransport() *mockUpstreamTransport {
+	return &mockUpstreamTransport{}
+}
+
+func (t *mockUpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/blockchain/models") && req.Method == http.MethodGet:
+		return mockModels(req), nil
+	case strings.HasSuffix(path, "/session") && req.Method == http.MethodPost:
+		return mockSession(req, path), nil
+	case strings.HasSuffix(path, "/close") && req.Method == http.MethodPost:
+		return mockResponse(req, http.StatusOK, "application/json", "{}"), nil
+	case strings.HasSuffix(path, marketplaceChatPath):
+		return mockCompletion(req, body), nil
+	case strings.HasSuffix(path, "/embeddings"):
+		return mockEmbeddings(req, body), nil
+	case strings.HasSuffix(path, "/healthcheck"):
+		return mockResponse(req, http.StatusOK, "application/json", `{"status": "healthy"}`), nil
+	}
+	return mockResponse(req, http.StatusNotFound, "application/json", `{"error": "not served by the mock upstream"}`), nil
+}
+
+func mockModels(req *http.Request) *http.Response {
+	models := make([]ModelInfo, 0, len(getMockModels()))
+	for _, name := range getMockModels() {
+		models = append(models, ModelInfo{Id: mockID("model", name), Name: name})
+	}
+	return mockJSON(req, map[string][]ModelInfo{"models": models})
+}
+
+func mockSession(req *http.Request, path string) *http.Response {
+	return mockJSON(req, map[string]string{
+		"sessionID": mockID("session", path),
+		"provider":  mockProvider,
+		"price":     "0",
+	})
+}
+
+// mockCompletion answers a chat completion with the mock reply, as an event
+// stream split into words if the request asks for one
+func mockCompletion(req *http.Request, body []byte) *http.Response {
+	var request struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	json.Unmarshal(body, &request)
+	reply := getMockReply()
+	usage := map[string]int{
+		"prompt_tokens":     len(strings.Fields(string(body))),
+		"completion_tokens": len(strings.Fields(reply)),
+	}
+	usage["total_tokens"] = usage["prompt_tokens"] + usage["completion_tokens"]
+	const id = "chatcmpl-mock"
+
+	if !request.Stream {
+		return mockJSON(req, map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": 0,
+			"model":   request.Model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": reply},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+	}
+
+	var stream bytes.Buffer
+	writeEvent := func(event map[string]interface{}) {
+		event["id"], event["object"], event["created"], event["model"] = id, "chat.completion.chunk", 0, request.Model
+		encoded, _ := json.Marshal(event)
+		fmt.Fprintf(&stream, "data: %s\n\n", encoded)
+	}
+	for i, word := range strings.SplitAfter(reply, " ") {
+		delta := map[string]string{"content": word}
+		if i == 0 {
+			delta["role"] = "assistant"
+		}
+		writeEvent(map[string]interface{}{"choices": []map[string]interface{}{{"index": 0, "delta": delta}}})
+	}
+	writeEvent(map[string]interface{}{"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{}, "finish_reason": "stop"}}})
+	writeEvent(map[string]interface{}{"choices": []interface{}{}, "usage": usage})
+	stream.WriteString("data: [DONE]\n\n")
+	return mockResponse(req, http.StatusOK, "text/event-stream", stream.String())
+}
+
+// mockEmbeddings answers an embeddings request with a vector per input
+// derived from the input's hash
+func mockEmbeddings(req *http.Request, body []byte) *http.Response {
+	var request struct {
+		Model string      `json:"model"`
+		Input interface{} `json:"input"`
+	}
+	json.Unmarshal(body, &request)
+	inputs, ok := request.Input.([]interface{})
+	if !ok {
+		inputs = []interface{}{request.Input}
+	}
+
+	data := make([]map[string]interface{}, len(inputs))
+	for i, input := range inputs {
+		encoded, _ := json.Marshal(input)
+		sum := sha256.Sum256(encoded)
+		embedding := make([]float64, mockEmbeddingDimensions)
+		for j := range embedding {
+			embedding[j] = float64(int(sum[j])-128) / 128
+		}
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": embedding}
+	}
+	return mockJSON(req, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  request.Model,
+		"usage":  map[string]int{"prompt_tokens": len(inputs), "total_tokens": len(inputs)},
+	})
+}
+
+func mockJSON(req *http.Request, v interface{}) *http.Response {
+	encoded, _ := json.Marshal(v)
+	return mockResponse(req, http.StatusOK, "application/json", string(encoded))
+}
+
+func mockResponse(req *http.Request, status int, contentType, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// useMockUpstream turns on MOCK_UPSTREAM, with MARKETPLACE_URL unset, until
+// the returned function is called
+func useMockUpstream(t *testing.T) func() {
+	t.Helper()
+	restoreURL := useMarketplaceURL("")
+	os.Setenv("MOCK_UPSTREAM", "true")
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+	activeSessions = make(map[string]*MorpheusSession)
+	return func() {
+		os.Unsetenv("MOCK_UPSTREAM")
+		restoreURL()
+		marketplaceTransport = nil
+		activeSessions = make(map[string]*MorpheusSession)
+	}
+}
+
+func TestMockUpstreamCompletion(t *testing.T) {
+	defer useMockUpstream(t)()
+	os.Setenv("MOCK_UPSTREAM_REPLY", "Hello from the mock")
+	defer os.Unsetenv("MOCK_UPSTREAM_REPLY")
+
+	if _, ok := marketplaceTransport.(*mockUpstreamTransport); !ok {
+		t.Fatalf("marketplace transport = %T, want the mock upstream", marketplaceTransport)
+	}
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "mock-model", "messages": [{"role": "user", "content": "Hi"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil {
+		t.Fatalf("invalid completion: %v: %s", err, w.Body.String())
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "Hello from the mock" {
+		t.Errorf("completion = %s, want the configured reply", w.Body.String())
+	}
+	if completion.Usage.TotalTokens == 0 {
+		t.Error("expected the mock completion to report usage")
+	}
+	if session, ok := getActiveSession(mockID("model", "mock-model")); !ok || session.Provider != mockProvider {
+		t.Errorf("session = %+v, want one opened by the mock upstream", session)
+	}
+}
+
+func TestMockUpstreamStream(t *testing.T) {
+	defer useMockUpstream(t)()
+
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "mock-model", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	var content strings.Builder
+	var done bool
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+		}
+	}
+	if content.String() != defaultMockReply {
+		t.Errorf("streamed content = %q, want %q", content.String(), defaultMockReply)
+	}
+	if !done {
+		t.Error("stream did not end with [DONE]")
+	}
+}
+
+func TestMockUpstreamEmbeddingsAreDeterministic(t *testing.T) {
+	defer useMockUpstream(t)()
+
+	embed := func() string {
+		w := httptest.NewRecorder()
+		handleEmbeddings(w, newEmbeddingsRequest(`{"model": "mock-model", "input": ["a", "b"]}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	first := embed()
+	if first != embed() {
+		t.Error("the same embeddings request got different answers")
+	}
+	var resp struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	json.Unmarshal([]byte(first), &resp)
+	if len(resp.Data) != 2 || len(resp.Data[0].Embedding) != mockEmbeddingDimensions {
+		t.Errorf("embeddings = %s, want two of %d dimensions", first, mockEmbeddingDimensions)
+	}
+}
+
+func TestMockUpstreamConfiguredModels(t *testing.T) {
+	defer useMockUpstream(t)()
+	os.Setenv("MOCK_UPSTREAM_MODELS", "llama-3, mistral")
+	defer os.Unsetenv("MOCK_UPSTREAM_MODELS")
+	modelCache.Lock()
+	delete(modelCache.m, "mistral")
+	modelCache.Unlock()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "mistral", "messages": [{"role": "user", "content": "Hi"}]}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("configured model: status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Headers letting a caller choose the model or provider for one request
+// without changing its body, e.g. for A/B tests
+const (
+	modelOverrideHeader    = "X-Model-ID"
+	providerOverrideHeader = "X-Provider"
+)
+
+// getAllowedOverrides returns the values allowed in an override header from
+// the comma-separated env var key: model IDs or names for
+// ALLOWED_MODEL_OVERRIDES, provider addresses for ALLOWED_PROVIDER_OVERRIDES.
+// "*" allows any; unset allows none, so the header is refused.
+func getAllowedOverrides(key string) []string {
+	return getEnvList(key, nil)
+}
+
+// overrideAllowed reports whether value, or the model ID it resolves to, is
+// in allowed, ignoring case as provider addresses may differ in it
+func overrideAllowed(allowed []string, value, modelID string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, value) || (modelID != "" && strings.EqualFold(a, modelID)) {
+			return true
+		}
+	}
+	return false
+}
+
+type providerOverrideKey struct{}
+
+// withProviderOverride pins the sessions for r to provider. Addresses are
+// lowercased so differently cased ones share a session.
+func withProviderOverride(r *http.Request, provider string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), providerOverrideKey{}, strings.ToLower(provider)))
+}
+
+// providerOverride returns the provider the request on ctx is pinned to, or
+// "" if the node picks one
+func providerOverride(ctx context.Context) string {
+	provider, _ := ctx.Value(providerOverrideKey{}).(string)
+	return provider
+}
+
+// sessionKey is the key of a model's session in activeSessions. Sessions
+// pinned to a provider are kept apart from the model's usual session, so
+// requests without the override never land on them and the reverse.
+func sessionKey(modelID, provider string) string {
+	if provider == "" {
+		return modelID
+	}
+	return modelID + "@" + provider
+}
+
+// sessionKeyProvider returns the provider a session key is pinned to, or ""
+func sessionKeyProvider(key string) string {
+	_, provider, _ := strings.Cut(key, "@")
+	return provider
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestModelOverrideHeader(t *testing.T) {
+	var forwarded string
+	server := newMarketplaceServer("override-model", "Override Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		forwarded, _ = body["model"].(string)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	tests := []struct {
+		name       string
+		allowed    string
+		wantStatus int
+	}{
+		{name: "allowed by ID", allowed: "override-model", wantStatus: http.StatusOK},
+		{name: "allowed by name", allowed: "other-model,Override Model", wantStatus: http.StatusOK},
+		{name: "any allowed", allowed: "*", wantStatus: http.StatusOK},
+		{name: "not allowed", allowed: "other-model", wantStatus: http.StatusForbidden},
+		{name: "overrides not configured", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("ALLOWED_MODEL_OVERRIDES", tt.allowed)
+			defer os.Unsetenv("ALLOWED_MODEL_OVERRIDES")
+			activeSessions = make(map[string]*MorpheusSession)
+			forwarded = ""
+
+			req := newChatRequest(`{"model": "Body Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+			req.Header.Set(modelOverrideHeader, "Override Model")
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && forwarded != "override-model" {
+				t.Errorf("forwarded model = %q, want override-model", forwarded)
+			}
+		})
+	}
+}
+
+// providerServer is a marketplace whose sessions are opened with the
+// provider named in the session request, or with defaultProvider when set.
+// It records the session each chat completion was sent on and the sessions
+// closed.
+type providerServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	opened   int
+	sessions []string
+	closed   []string
+}
+
+func newProviderServer(modelID, defaultProvider string) *providerServer {
+	s := &providerServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: modelID, Name: "Provider Model"}}})
+		case r.URL.Path == "/blockchain/models/"+modelID+"/session":
+			var body struct {
+				Provider string `json:"provider"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			provider := defaultProvider
+			if body.Provider != "" && defaultProvider == "" {
+				provider = body.Provider
+			}
+			s.opened++
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": "session-" + provider, "provider": provider})
+		case strings.HasSuffix(r.URL.Path, "/close"):
+			s.closed = append(s.closed, r.URL.Path)
+		case r.URL.Path == "/chat/completions":
+			s.sessions = append(s.sessions, r.Header.Get(getSessionHeader()))
+			w.Write([]byte(`{"choices": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+func TestProviderOverrideHeaderPinsSession(t *testing.T) {
+	server := newProviderServer("provider-model", "")
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("ALLOWED_PROVIDER_OVERRIDES", "0xB")
+	defer os.Unsetenv("ALLOWED_PROVIDER_OVERRIDES")
+	activeSessions = make(map[string]*MorpheusSession)
+	SessionManagerInstance.UpdateSession("", "")
+	defer func() { pinnedSessionManagers = make(map[string]*SessionManager) }()
+
+	send := func(provider string) int {
+		req := newChatRequest(`{"model": "Provider Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+		if provider != "" {
+			req.Header.Set(providerOverrideHeader, provider)
+		}
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, req)
+		return w.Code
+	}
+
+	if code := send("0xb"); code != http.StatusOK {
+		t.Fatalf("pinned request status = %d, want 200", code)
+	}
+	if code := send("0xB"); code != http.StatusOK {
+		t.Fatalf("second pinned request status = %d, want 200", code)
+	}
+	if code := send("0xC"); code != http.StatusForbidden {
+		t.Errorf("request pinned to a provider not allowed: status = %d, want 403", code)
+	}
+
+	if session, ok := getActiveSession(sessionKey("provider-model", "0xb")); !ok || session.Provider != "0xb" {
+		t.Errorf("pinned session = %+v, want one with provider 0xb", session)
+	}
+	if _, ok := getActiveSession("provider-model"); ok {
+		t.Error("pinned request stored a session for the model's unpinned requests")
+	}
+
+	// A request without the header gets the model's usual session, and
+	// neither evicts the other
+	if code := send(""); code != http.StatusOK {
+		t.Fatalf("unpinned request status = %d, want 200", code)
+	}
+	if code := send("0xb"); code != http.StatusOK {
+		t.Fatalf("pinned request after an unpinned one: status = %d, want 200", code)
+	}
+	if code := send(""); code != http.StatusOK {
+		t.Fatalf("unpinned request after a pinned one: status = %d, want 200", code)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if want := []string{"session-0xb", "session-0xb", "session-", "session-0xb", "session-"}; strings.Join(server.sessions, ",") != strings.Join(want, ",") {
+		t.Errorf("chat sessions = %v, want %v", server.sessions, want)
+	}
+	if server.opened != 2 {
+		t.Errorf("sessions opened = %d, want 2 as pinned and unpinned requests alternate", server.opened)
+	}
+}
+
+func TestProviderOverrideRejectsOtherProvider(t *testing.T) {
+	server := newProviderServer("provider-model", "0xother")
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("ALLOWED_PROVIDER_OVERRIDES", "*")
+	defer os.Unsetenv("ALLOWED_PROVIDER_OVERRIDES")
+	activeSessions = make(map[string]*MorpheusSession)
+
+	req := newChatRequest(`{"model": "Provider Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req.Header.Set(providerOverrideHeader, "0xB")
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, req)
+
+	if w.Code == http.StatusOK {
+		t.Fatalf("status = 200, want an error when the node picks another provider")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.sessions) != 0 {
+		t.Errorf("chat completions sent = %v, want none", server.sessions)
+	}
+	if len(server.closed) != 1 || !strings.Contains(server.closed[0], "session-0xother") {
+		t.Errorf("closed sessions = %v, want the one opened with the wrong provider", server.closed)
+	}
+}
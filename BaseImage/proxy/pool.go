@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	sessionPoolSize = metrics.gauge("morpheus_proxy_session_pool_size",
+		"Pre-opened sessions held in each model's pool", "model")
+	sessionPoolCheckouts = metrics.counter("morpheus_proxy_session_pool_checkouts_total",
+		"Requests forwarded on a session taken from the model's pool", "model")
+	sessionPoolRefreshes = metrics.counter("morpheus_proxy_session_pool_refreshes_total",
+		"Sessions opened to fill or refresh each model's pool", "model")
+)
+
+// sessionPool holds pre-opened sessions for one model, handed out to
+// requests in turn so they do not all share the model's active session
+type sessionPool struct {
+	modelID string
+
+	mu       sync.Mutex
+	sessions []*MorpheusSession
+	next     int  // index of the next session to hand out
+	filling  bool // a refresh is opening sessions
+}
+
+// sessionPools holds a pool per model once it has been requested. Pools are
+// only created while SESSION_POOL_SIZE is above 0.
+var sessionPools = struct {
+	sync.Mutex
+	m map[string]*sessionPool
+}{m: make(map[string]*sessionPool)}
+
+// getSessionPool returns the pool for modelID, creating it and filling it
+// in the background on first use. It returns nil if pooling is disabled.
+func getSessionPool(modelID string) *sessionPool {
+	if config.SessionPoolSize <= 0 {
+		return nil
+	}
+	sessionPools.Lock()
+	pool, exists := sessionPools.m[modelID]
+	if !exists {
+		pool = &sessionPool{modelID: modelID}
+		sessionPools.m[modelID] = pool
+	}
+	sessionPools.Unlock()
+
+	if !exists {
+		go pool.refresh(context.Background(), config.SessionPoolSize, config.SessionPoolRefreshInterval)
+	}
+	return pool
+}
+
+// lookupSessionPool returns the pool for modelID without creating one
+func lookupSessionPool(modelID string) *sessionPool {
+	sessionPools.Lock()
+	defer sessionPools.Unlock()
+	return sessionPools.m[modelID]
+}
+
+// checkout returns the next pooled session that has not expired and is
+// funded by a configured wallet, marking it used. It reports false if the
+// pool has none.
+func (p *sessionPool) checkout() (MorpheusSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < len(p.sessions); i++ {
+		index := (p.next + i) % len(p.sessions)
+		session := p.sessions[index]
+		if !now().Before(session.expiresAt()) || !walletConfigured(session.Wallet) {
+			continue
+		}
+		p.next = (index + 1) % len(p.sessions)
+		session.LastUsed = now()
+		session.Reuses++
+		return *session, true
+	}
+	return MorpheusSession{}, false
+}
+
+// ready reports whether the pool holds a session checkout would return
+func (p *sessionPool) ready() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range p.sessions {
+		if now().Before(session.expiresAt()) && walletConfigured(session.Wallet) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns copies of the pooled sessions
+func (p *sessionPool) snapshot() []MorpheusSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := make([]MorpheusSession, len(p.sessions))
+	for i, session := range p.sessions {
+		sessions[i] = *session
+	}
+	return sessions
+}
+
+// refresh drops the sessions that expire within margin or were funded by a
+// wallet no longer configured, closing those not yet expired in the
+// background, and opens new ones until the pool holds size. Only one refresh
+// runs at a time per pool; a failed establishment stops it until the next
+// refresh.
+func (p *sessionPool) refresh(ctx context.Context, size int, margin time.Duration) {
+	p.mu.Lock()
+	if p.filling {
+		p.mu.Unlock()
+		return
+	}
+	p.filling = true
+	kept := make([]*MorpheusSession, 0, len(p.sessions))
+	for _, session := range p.sessions {
+		if now().Add(margin).Before(session.expiresAt()) && walletConfigured(session.Wallet) {
+			kept = append(kept, session)
+		} else if now().Before(session.expiresAt()) {
+			go closeRetiredSession(p.modelID, session.SessionID)
+		}
+	}
+	if dropped := len(p.sessions) - len(kept); dropped > 0 {
+		log.Printf("Replacing %d expiring pooled session(s) for model %s", dropped, p.modelID)
+	}
+	p.sessions = kept
+	p.next = 0
+	missing := size - len(kept)
+	sessionPoolSize.Set(float64(len(kept)), p.modelID)
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.filling = false
+		p.mu.Unlock()
+	}()
+
+	for i := 0; i < missing; i++ {
+		session, err := openSession(ctx, p.modelID, sessionPooled)
+		if err != nil {
+			log.Printf("Failed to open pooled session for model %s: %v", p.modelID, err)
+			return
+		}
+		sessionPoolRefreshes.Inc(p.modelID)
+
+		p.mu.Lock()
+		p.sessions = append(p.sessions, session)
+		sessionPoolSize.Set(float64(len(p.sessions)), p.modelID)
+		p.mu.Unlock()
+	}
+}
+
+// runSessionPoolRefresh refreshes every model's pool each interval until ctx
+// is done
+func runSessionPoolRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshSessionPools(ctx)
+		}
+	}
+}
+
+// refreshSessionPools refreshes each model's pool in turn, ordered by model
+func refreshSessionPools(ctx context.Context) {
+	sessionPools.Lock()
+	modelIDs := make([]string, 0, len(sessionPools.m))
+	for modelID := range sessionPools.m {
+		modelIDs = append(modelIDs, modelID)
+	}
+	sessionPools.Unlock()
+	sort.Strings(modelIDs)
+
+	for _, modelID := range modelIDs {
+		if pool := lookupSessionPool(modelID); pool != nil {
+			pool.refresh(ctx, config.SessionPoolSize, config.SessionPoolRefreshInterval)
+		}
+	}
+}
+
+// checkoutSession returns the session to forward a request for modelID on:
+// the next one from the model's pool if it has one ready, otherwise the
+// model's active session
+func checkoutSession(modelID string) (MorpheusSession, bool) {
+	if pool := lookupSessionPool(modelID); pool != nil {
+		if session, ok := pool.checkout(); ok {
+			sessionPoolCheckouts.Inc(modelID)
+			return session, true
+		}
+	}
+	return getActiveSession(modelID)
+}
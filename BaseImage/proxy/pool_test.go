@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPoolMarketplaceServer serves modelID, opening a distinct session on
+// every establishment and recording the session each chat request used and
+// the sessions closed
+func newPoolMarketplaceServer(modelID string, opened *int32, used, closed *[]string, mu *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: modelID, Name: "Pool Model"}},
+			})
+		case "/blockchain/models/" + modelID + "/session":
+			n := atomic.AddInt32(opened, 1)
+			json.NewEncoder(w).Encode(map[string]string{
+				"sessionID": fmt.Sprintf("pooled-session-%d", n),
+			})
+		case "/chat/completions":
+			mu.Lock()
+			*used = append(*used, r.Header.Get(getSessionHeader()))
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "hi"}}]}`))
+		default:
+			if id, ok := strings.CutPrefix(r.URL.Path, "/blockchain/sessions/"); ok && strings.HasSuffix(id, "/close") {
+				mu.Lock()
+				*closed = append(*closed, strings.TrimSuffix(id, "/close"))
+				mu.Unlock()
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func resetSessionPools() {
+	sessionPools.Lock()
+	sessionPools.m = make(map[string]*sessionPool)
+	sessionPools.Unlock()
+}
+
+func TestSessionPoolHandsOutSessionsInTurn(t *testing.T) {
+	var opened int32
+	var used, closed []string
+	var mu sync.Mutex
+	server := newPoolMarketplaceServer("pool-model", &opened, &used, &closed, &mu)
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	cfg := config
+	defer applyConfig(cfg)
+	pooled := cfg
+	pooled.SessionPoolSize = 2
+	pooled.MaxConcurrentEstablishments = 0
+	applyConfig(pooled)
+	activeSessions = make(map[string]*MorpheusSession)
+	resetSessionPools()
+	defer resetSessionPools()
+
+	// The pool fills in the background on first use
+	pool := getSessionPool("pool-model")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(pool.snapshot()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool holds %d sessions, want 2", len(pool.snapshot()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	checkouts := sessionPoolCheckouts.Value("pool-model")
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "Pool Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	want := []string{"pooled-session-1", "pooled-session-2", "pooled-session-1", "pooled-session-2"}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(used) != fmt.Sprint(want) {
+		t.Errorf("sessions used = %v, want %v", used, want)
+	}
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Errorf("sessions opened = %d, want 2 from the pool alone", n)
+	}
+	if got := sessionPoolCheckouts.Value("pool-model") - checkouts; got != 4 {
+		t.Errorf("pool checkouts = %v, want 4", got)
+	}
+}
+
+func TestSessionPoolRefreshReplacesExpiringSessions(t *testing.T) {
+	var opened int32
+	var used, closed []string
+	var mu sync.Mutex
+	server := newPoolMarketplaceServer("refresh-model", &opened, &used, &closed, &mu)
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	clock := newFakeClock()
+	defer SetClock(SetClock(clock))
+
+	cfg := config
+	defer applyConfig(cfg)
+	pooled := cfg
+	pooled.SessionExpirationSeconds = 600
+	pooled.MaxConcurrentEstablishments = 0
+	applyConfig(pooled)
+
+	refreshes := sessionPoolRefreshes.Value("refresh-model")
+	pool := &sessionPool{modelID: "refresh-model"}
+	pool.refresh(context.Background(), 2, time.Minute)
+	if got := len(pool.snapshot()); got != 2 {
+		t.Fatalf("pool size after fill = %d, want 2", got)
+	}
+
+	// Used sessions stay; the idle one expires within the margin
+	clock.Advance(9 * time.Minute)
+	if _, ok := pool.checkout(); !ok {
+		t.Fatal("checkout() found no session")
+	}
+	pool.refresh(context.Background(), 2, time.Minute)
+
+	sessions := pool.snapshot()
+	if len(sessions) != 2 {
+		t.Fatalf("pool size after refresh = %d, want 2", len(sessions))
+	}
+	if sessions[0].SessionID != "pooled-session-1" || sessions[1].SessionID != "pooled-session-3" {
+		t.Errorf("pooled sessions = %s, %s; want pooled-session-1 kept and pooled-session-3 added", sessions[0].SessionID, sessions[1].SessionID)
+	}
+	if got := sessionPoolSize.Value("refresh-model"); got != 2 {
+		t.Errorf("pool size gauge = %v, want 2", got)
+	}
+	if got := sessionPoolRefreshes.Value("refresh-model") - refreshes; got != 3 {
+		t.Errorf("pool refreshes = %v, want 3", got)
+	}
+
+	// The replaced session is still open on the node until closed
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		got := fmt.Sprint(closed)
+		mu.Unlock()
+		if got == "[pooled-session-2]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("closed sessions = %s, want pooled-session-2", got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionPoolDisabled(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	disabled := cfg
+	disabled.SessionPoolSize = 0
+	applyConfig(disabled)
+
+	if pool := getSessionPool("any-model"); pool != nil {
+		t.Errorf("getSessionPool() = %v, want nil while SESSION_POOL_SIZE is 0", pool)
+	}
+}
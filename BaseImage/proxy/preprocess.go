@@ -0,0 +1,499 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	// originalModelKey holds the model name exactly as the client sent it
+	originalModelKey contextKey = iota
+	// idempotencyClaimKey holds the request's *idempotencyClaim, if any
+	idempotencyClaimKey
+	// sessionDecisionKey holds the request's *sessionDecision, if any
+	sessionDecisionKey
+	// staleCacheKeyKey holds the request's stale cache key, if any
+	staleCacheKeyKey
+	// batchItemKey is set on the requests served as items of a batch
+	batchItemKey
+)
+
+// Policies accepted by CLIENT_SYSTEM_PROMPT_POLICY
+const (
+	systemPromptPolicyAllow  = "allow"  // forward client system messages unchanged
+	systemPromptPolicyStrip  = "strip"  // silently remove client system messages
+	systemPromptPolicyReject = "reject" // reject requests containing system messages
+)
+
+func getSystemPromptPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("CLIENT_SYSTEM_PROMPT_POLICY")))
+	switch policy {
+	case "":
+		return systemPromptPolicyAllow
+	case systemPromptPolicyAllow, systemPromptPolicyStrip, systemPromptPolicyReject:
+		return policy
+	default:
+		log.Printf("Invalid CLIENT_SYSTEM_PROMPT_POLICY value: %s, using default of %s", policy, systemPromptPolicyAllow)
+		return systemPromptPolicyAllow
+	}
+}
+
+// applySystemPromptPolicy strips client-supplied system messages from the
+// request body, or returns an error if the policy is to reject them.
+func applySystemPromptPolicy(requestBody map[string]interface{}) error {
+	policy := getSystemPromptPolicy()
+	if policy == systemPromptPolicyAllow {
+		return nil
+	}
+
+	messages, ok := requestBody["messages"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	filtered := make([]interface{}, 0, len(messages))
+	for _, message := range messages {
+		if messageRole(message) != "system" {
+			filtered = append(filtered, message)
+			continue
+		}
+		if policy == systemPromptPolicyReject {
+			return fmt.Errorf("system messages are not allowed")
+		}
+	}
+
+	if stripped := len(messages) - len(filtered); stripped > 0 {
+		log.Printf("Stripped %d client system message(s)", stripped)
+		requestBody["messages"] = filtered
+	}
+	return nil
+}
+
+// Policies accepted by REQUEST_FIELD_POLICY, for the request body fields that
+// REQUEST_FIELD_ALLOWLIST and REQUEST_FIELD_DENYLIST rule out
+const (
+	fieldPolicyStrip  = "strip"  // remove the fields and forward the rest
+	fieldPolicyReject = "reject" // reject requests carrying any of them
+)
+
+// requiredRequestFields are kept whatever the lists say, since a request
+// cannot be served without them
+var requiredRequestFields = map[string]bool{"model": true, "messages": true}
+
+func getRequestFieldPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("REQUEST_FIELD_POLICY")))
+	switch policy {
+	case "":
+		return fieldPolicyStrip
+	case fieldPolicyStrip, fieldPolicyReject:
+		return policy
+	default:
+		log.Printf("Invalid REQUEST_FIELD_POLICY value: %s, using default of %s", policy, fieldPolicyStrip)
+		return fieldPolicyStrip
+	}
+}
+
+// disallowedRequestFields returns, sorted, the top-level request body fields
+// that REQUEST_FIELD_DENYLIST names or, when REQUEST_FIELD_ALLOWLIST is set,
+// that it does not
+func disallowedRequestFields(requestBody map[string]interface{}) []string {
+	allowed := make(map[string]bool)
+	for _, field := range getEnvList("REQUEST_FIELD_ALLOWLIST", nil) {
+		allowed[field] = true
+	}
+	denied := make(map[string]bool)
+	for _, field := range getEnvList("REQUEST_FIELD_DENYLIST", nil) {
+		denied[field] = true
+	}
+
+	var disallowed []string
+	for field := range requestBody {
+		if requiredRequestFields[field] {
+			continue
+		}
+		if denied[field] || (len(allowed) > 0 && !allowed[field]) {
+			disallowed = append(disallowed, field)
+		}
+	}
+	sort.Strings(disallowed)
+	return disallowed
+}
+
+// applyRequestFieldFilter removes the fields the allowlist and denylist rule
+// out from the request body and returns them, or returns an error naming
+// them if the policy is to reject such requests.
+func applyRequestFieldFilter(requestBody map[string]interface{}) ([]string, error) {
+	disallowed := disallowedRequestFields(requestBody)
+	if len(disallowed) == 0 {
+		return nil, nil
+	}
+	if getRequestFieldPolicy() == fieldPolicyReject {
+		return nil, fmt.Errorf("request fields not allowed: %s", strings.Join(disallowed, ", "))
+	}
+	for _, field := range disallowed {
+		delete(requestBody, field)
+	}
+	return disallowed, nil
+}
+
+// injectSystemPrompt prepends INJECT_SYSTEM_PROMPT as a system message to a
+// chat request without one, and reports whether it did. A request already
+// carrying a system message anywhere is left alone, as are requests without
+// a messages array.
+func injectSystemPrompt(requestBody map[string]interface{}) bool {
+	prompt := strings.TrimSpace(os.Getenv("INJECT_SYSTEM_PROMPT"))
+	if prompt == "" {
+		return false
+	}
+	messages, ok := requestBody["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, message := range messages {
+		if messageRole(message) == "system" {
+			return false
+		}
+	}
+
+	injected := make([]interface{}, 0, len(messages)+1)
+	injected = append(injected, map[string]interface{}{"role": "system", "content": prompt})
+	requestBody["messages"] = append(injected, messages...)
+	return true
+}
+
+// messageRole returns the role of a decoded chat message, or "" if it has none.
+func messageRole(message interface{}) string {
+	m, ok := message.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	role, _ := m["role"].(string)
+	return role
+}
+
+// resolveModelAlias maps a client model name through MODEL_ALIASES, a list of
+// "alias=model" pairs, returning the handle unchanged if it has no alias.
+func resolveModelAlias(handle string) string {
+	if target, ok := getEnvSettings("MODEL_ALIASES")[handle]; ok && target != "" {
+		log.Printf("Resolved model alias '%s' to '%s'", handle, target)
+		return target
+	}
+	return handle
+}
+
+// rewriteModelField replaces the client's model with the marketplace model ID
+// in the outbound request body. The client's value is kept on the returned
+// request so it can still be used for logging and responses.
+func rewriteModelField(r *http.Request, requestBody map[string]interface{}, modelID string) *http.Request {
+	original, _ := requestBody["model"].(string)
+	requestBody["model"] = modelID
+	return r.WithContext(context.WithValue(r.Context(), originalModelKey, original))
+}
+
+// originalModel returns the model the client asked for before it was rewritten
+func originalModel(r *http.Request) string {
+	model, _ := r.Context().Value(originalModelKey).(string)
+	return model
+}
+
+// Policies accepted by DOUBLE_ENCODED_BODY_POLICY
+const (
+	doubleEncodedPolicyReject = "reject" // refuse the request with a 400
+	doubleEncodedPolicyUnwrap = "unwrap" // decode the JSON inside the string
+)
+
+func getDoubleEncodedBodyPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("DOUBLE_ENCODED_BODY_POLICY")))
+	switch policy {
+	case "":
+		return doubleEncodedPolicyReject
+	case doubleEncodedPolicyReject, doubleEncodedPolicyUnwrap:
+		return policy
+	default:
+		log.Printf("Invalid DOUBLE_ENCODED_BODY_POLICY value: %s, using default of %s", policy, doubleEncodedPolicyReject)
+		return doubleEncodedPolicyReject
+	}
+}
+
+// unwrapDoubleEncodedBody detects a request body sent as a JSON string
+// holding the JSON object, as some clients do by encoding it twice. Per
+// DOUBLE_ENCODED_BODY_POLICY it returns the inner object or an error. Any
+// other body is returned unchanged.
+func unwrapDoubleEncodedBody(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte(`"`)) {
+		return data, nil
+	}
+	var inner string
+	if err := json.Unmarshal(trimmed, &inner); err != nil {
+		return data, nil
+	}
+	unwrapped := bytes.TrimSpace([]byte(inner))
+	if !bytes.HasPrefix(unwrapped, []byte("{")) || !json.Valid(unwrapped) {
+		return data, nil
+	}
+
+	if getDoubleEncodedBodyPolicy() == doubleEncodedPolicyReject {
+		return nil, fmt.Errorf("request body is a JSON string containing JSON; send the object itself")
+	}
+	log.Printf("Unwrapping double-encoded request body")
+	return unwrapped, nil
+}
+
+// decodeRequestBody decodes a chat request body. Numbers are kept as
+// json.Number so they are forwarded exactly as sent rather than rounded
+// through float64, which matters for large seeds and tool schema bounds.
+func decodeRequestBody(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var body map[string]interface{}
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after request body")
+	}
+	return body, nil
+}
+
+// encodeRequestBody encodes a chat request body for the marketplace. HTML
+// characters are not escaped, so tool definitions and message content are
+// forwarded as the client wrote them.
+func encodeRequestBody(body map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(body); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// requestsTools reports whether a chat request asks for function calling
+func requestsTools(requestBody map[string]interface{}) bool {
+	for _, field := range []string{"tools", "functions"} {
+		if list, ok := requestBody[field].([]interface{}); ok && len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// modelSupportsTools reports whether function calling may be requested for a
+// model. TOOLS_UNSUPPORTED_MODELS lists, by ID or name, the models that do not
+// support it.
+func modelSupportsTools(modelID, modelHandle string) bool {
+	_, unsupported := lookupModelSetting(getEnvSettings("TOOLS_UNSUPPORTED_MODELS"), modelID, modelHandle)
+	return !unsupported
+}
+
+// validateSeed checks that a client-supplied seed is an integer that fits in
+// 64 bits, the range the marketplace accepts. A missing or null seed is
+// allowed. The seed itself is forwarded unchanged.
+func validateSeed(requestBody map[string]interface{}) error {
+	seed, ok := requestBody["seed"]
+	if !ok || seed == nil {
+		return nil
+	}
+	number, ok := seed.(json.Number)
+	if !ok {
+		return fmt.Errorf("seed must be an integer")
+	}
+	if _, err := strconv.ParseInt(number.String(), 10, 64); err != nil {
+		return fmt.Errorf("seed must be an integer between %d and %d", int64(math.MinInt64), int64(math.MaxInt64))
+	}
+	return nil
+}
+
+// Policies accepted by MAX_TOKENS_POLICY
+const (
+	maxTokensPolicyReject = "reject" // refuse requests over the model's limit with a 400
+	maxTokensPolicyClamp  = "clamp"  // lower the request to the model's limit
+)
+
+// getMaxTokensPolicy returns how requests over a model's output token limit
+// are handled
+func getMaxTokensPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("MAX_TOKENS_POLICY")))
+	switch policy {
+	case "":
+		return maxTokensPolicyReject
+	case maxTokensPolicyReject, maxTokensPolicyClamp:
+		return policy
+	default:
+		log.Printf("Invalid MAX_TOKENS_POLICY value: %s, using default of %s", policy, maxTokensPolicyReject)
+		return maxTokensPolicyReject
+	}
+}
+
+// getModelMaxOutputTokens returns the output token limit configured for a
+// model in MODEL_MAX_OUTPUT_TOKENS, e.g. "llama-3=4096,mistral=8192", keyed
+// by ID or name. It reports false if the model has no limit.
+func getModelMaxOutputTokens(modelID, modelHandle string) (int64, bool) {
+	value, ok := lookupModelSetting(getEnvSettings("MODEL_MAX_OUTPUT_TOKENS"), modelID, modelHandle)
+	if !ok {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		log.Printf("Invalid MODEL_MAX_OUTPUT_TOKENS value for %s: %s, not limiting it", modelHandle, value)
+		return 0, false
+	}
+	return limit, true
+}
+
+// validateMaxTokens checks max_tokens and max_completion_tokens are positive
+// integers within the model's output token limit. Over the limit, they are
+// rejected or clamped to it as MAX_TOKENS_POLICY says.
+func validateMaxTokens(requestBody map[string]interface{}, modelID, modelHandle string) error {
+	limit, limited := getModelMaxOutputTokens(modelID, modelHandle)
+	for _, field := range []string{"max_tokens", "max_completion_tokens"} {
+		value, ok := requestBody[field]
+		if !ok || value == nil {
+			continue
+		}
+		number, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be an integer", field)
+		}
+		tokens, err := strconv.ParseInt(number.String(), 10, 64)
+		if err != nil || tokens <= 0 {
+			return fmt.Errorf("%s must be a positive integer", field)
+		}
+		if !limited || tokens <= limit {
+			continue
+		}
+		if getMaxTokensPolicy() == maxTokensPolicyReject {
+			return fmt.Errorf("%s of %d exceeds the limit of %d for model %s", field, tokens, limit, modelHandle)
+		}
+		log.Printf("Clamping %s from %d to the limit of %d for model %s", field, tokens, limit, modelHandle)
+		requestBody[field] = json.Number(strconv.FormatInt(limit, 10))
+	}
+	return nil
+}
+
+// maxTokensClampedHeader tells the client whether MAX_TOKENS_CAP changed its
+// request's output token limit
+const maxTokensClampedHeader = "X-Max-Tokens-Clamped"
+
+// getMaxTokensCap returns MAX_TOKENS_CAP, a ceiling on the output tokens of
+// every chat completion whatever the model. It reports false if unset.
+func getMaxTokensCap() (int64, bool) {
+	value := strings.TrimSpace(os.Getenv("MAX_TOKENS_CAP"))
+	if value == "" {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		log.Printf("Invalid MAX_TOKENS_CAP value: %s, not capping max_tokens", value)
+		return 0, false
+	}
+	return limit, true
+}
+
+// applyMaxTokensCap lowers each output token limit the request sends,
+// max_tokens and max_completion_tokens, to MAX_TOKENS_CAP, or sets max_tokens
+// to it if the request has no limit, and reports whether it changed the
+// request. Both fields are capped since upstreams differ in which they read.
+// It expects the fields to have passed validateMaxTokens.
+func applyMaxTokensCap(requestBody map[string]interface{}) bool {
+	limit, ok := getMaxTokensCap()
+	if !ok {
+		return false
+	}
+	var fields []string
+	for _, field := range []string{"max_tokens", "max_completion_tokens"} {
+		if value, ok := requestBody[field]; ok && value != nil {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		fields = []string{"max_tokens"}
+	}
+	clamped := false
+	for _, field := range fields {
+		if number, ok := requestBody[field].(json.Number); ok {
+			if tokens, err := number.Int64(); err == nil && tokens <= limit {
+				continue
+			}
+			log.Printf("Clamping %s from %s to MAX_TOKENS_CAP of %d", field, number, limit)
+		}
+		requestBody[field] = json.Number(strconv.FormatInt(limit, 10))
+		clamped = true
+	}
+	return clamped
+}
+
+// samplingClampedHeader lists the sampling parameters of the request that
+// were lowered to their configured maximum, e.g. "temperature,top_p". It is
+// only sent when one was.
+const samplingClampedHeader = "X-Sampling-Clamped"
+
+// samplingGuards are the sampling parameters that can be given a maximum and
+// a default, with the environment variables that set them
+var samplingGuards = []struct {
+	field, maxKey, defaultKey string
+}{
+	{"temperature", "MAX_TEMPERATURE", "DEFAULT_TEMPERATURE"},
+	{"top_p", "MAX_TOP_P", "DEFAULT_TOP_P"},
+}
+
+// getSamplingSetting returns a sampling parameter's maximum or default from
+// key. It reports false if it is unset or not a non-negative number.
+func getSamplingSetting(key string) (float64, bool) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return 0, false
+	}
+	setting, err := strconv.ParseFloat(value, 64)
+	if err != nil || setting < 0 {
+		log.Printf("Invalid %s value: %s, ignoring it", key, value)
+		return 0, false
+	}
+	return setting, true
+}
+
+// applySamplingGuards lowers temperature and top_p to MAX_TEMPERATURE and
+// MAX_TOP_P, and sets DEFAULT_TEMPERATURE and DEFAULT_TOP_P on a request
+// without them, kept within the maximum. It returns the fields it lowered.
+// A value that is not a number is left for the marketplace to reject.
+func applySamplingGuards(requestBody map[string]interface{}) []string {
+	var clamped []string
+	for _, guard := range samplingGuards {
+		limit, limited := getSamplingSetting(guard.maxKey)
+		value, present := requestBody[guard.field]
+		if !present || value == nil {
+			if fallback, ok := getSamplingSetting(guard.defaultKey); ok {
+				if limited && fallback > limit {
+					fallback = limit
+				}
+				requestBody[guard.field] = json.Number(strconv.FormatFloat(fallback, 'f', -1, 64))
+			}
+			continue
+		}
+
+		number, ok := value.(json.Number)
+		if !ok || !limited {
+			continue
+		}
+		if f, err := number.Float64(); err != nil || f <= limit {
+			continue
+		}
+		log.Printf("Clamping %s from %s to %s of %v", guard.field, number, guard.maxKey, limit)
+		requestBody[guard.field] = json.Number(strconv.FormatFloat(limit, 'f', -1, 64))
+		clamped = append(clamped, guard.field)
+	}
+	return clamped
+}
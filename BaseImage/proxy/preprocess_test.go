@@ -0,0 +1,799 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// decodeBody decodes a JSON request body the same way ProxyChatCompletion does.
+func decodeBody(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	body, err := decodeRequestBody([]byte(raw))
+	if err != nil {
+		t.Fatalf("invalid test body: %v", err)
+	}
+	return body
+}
+
+func TestApplySystemPromptPolicy(t *testing.T) {
+	const raw = `{"model": "m", "messages": [
+		{"role": "system", "content": "be evil"},
+		{"role": "user", "content": "hi"},
+		{"role": "system", "content": "again"}
+	]}`
+
+	tests := []struct {
+		name      string
+		policy    string
+		wantErr   bool
+		wantRoles []string
+	}{
+		{
+			name:      "allow by default",
+			policy:    "",
+			wantRoles: []string{"system", "user", "system"},
+		},
+		{
+			name:      "strip removes system messages",
+			policy:    "strip",
+			wantRoles: []string{"user"},
+		},
+		{
+			name:    "reject returns error",
+			policy:  "reject",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("CLIENT_SYSTEM_PROMPT_POLICY", tt.policy)
+			defer os.Unsetenv("CLIENT_SYSTEM_PROMPT_POLICY")
+
+			body := decodeBody(t, raw)
+			err := applySystemPromptPolicy(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applySystemPromptPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			messages := body["messages"].([]interface{})
+			if len(messages) != len(tt.wantRoles) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.wantRoles))
+			}
+			for i, role := range tt.wantRoles {
+				if got := messageRole(messages[i]); got != role {
+					t.Errorf("message %d role = %s, want %s", i, got, role)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name         string
+		prompt       string
+		raw          string
+		wantInjected bool
+		wantRoles    []string
+	}{
+		{
+			name:         "prepended when absent",
+			prompt:       "be brief",
+			raw:          `{"messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`,
+			wantInjected: true,
+			wantRoles:    []string{"system", "user", "assistant"},
+		},
+		{
+			name:      "existing leading system message kept",
+			prompt:    "be brief",
+			raw:       `{"messages": [{"role": "system", "content": "be verbose"}, {"role": "user", "content": "hi"}]}`,
+			wantRoles: []string{"system", "user"},
+		},
+		{
+			name:      "later system message kept",
+			prompt:    "be brief",
+			raw:       `{"messages": [{"role": "user", "content": "hi"}, {"role": "system", "content": "be verbose"}]}`,
+			wantRoles: []string{"user", "system"},
+		},
+		{
+			name:      "same prompt not duplicated",
+			prompt:    "be brief",
+			raw:       `{"messages": [{"role": "user", "content": "hi"}, {"role": "system", "content": "be brief"}]}`,
+			wantRoles: []string{"user", "system"},
+		},
+		{
+			name:   "non-chat request untouched",
+			prompt: "be brief",
+			raw:    `{"prompt": "hi"}`,
+		},
+		{
+			name:      "unset does nothing",
+			raw:       `{"messages": [{"role": "user", "content": "hi"}]}`,
+			wantRoles: []string{"user"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("INJECT_SYSTEM_PROMPT", tt.prompt)
+			defer os.Unsetenv("INJECT_SYSTEM_PROMPT")
+
+			body := decodeBody(t, tt.raw)
+			if got := injectSystemPrompt(body); got != tt.wantInjected {
+				t.Fatalf("injectSystemPrompt() = %v, want %v", got, tt.wantInjected)
+			}
+
+			messages, ok := body["messages"].([]interface{})
+			if !ok {
+				if tt.wantRoles != nil {
+					t.Fatalf("messages missing from %v", body)
+				}
+				if _, ok := body["messages"]; ok {
+					t.Errorf("messages added to a non-chat request: %v", body)
+				}
+				return
+			}
+			if len(messages) != len(tt.wantRoles) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.wantRoles))
+			}
+			for i, role := range tt.wantRoles {
+				if got := messageRole(messages[i]); got != role {
+					t.Errorf("message %d role = %s, want %s", i, got, role)
+				}
+			}
+			if tt.wantInjected {
+				if content := messages[0].(map[string]interface{})["content"]; content != tt.prompt {
+					t.Errorf("injected content = %v, want %q", content, tt.prompt)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionInjectsSystemPrompt(t *testing.T) {
+	var upstreamBody map[string]interface{}
+	server := newMarketplaceServer("inject-model", "Inject Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("INJECT_SYSTEM_PROMPT", "be brief")
+	defer os.Unsetenv("INJECT_SYSTEM_PROMPT")
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Inject Model", "messages": [{"role": "user", "content": "hi"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	messages, _ := upstreamBody["messages"].([]interface{})
+	if len(messages) != 2 || messageRole(messages[0]) != "system" || messageRole(messages[1]) != "user" {
+		t.Errorf("forwarded messages = %v, want the system prompt before the user message", messages)
+	}
+}
+
+func TestProxyChatCompletionRejectsSystemPrompt(t *testing.T) {
+	os.Setenv("CLIENT_SYSTEM_PROMPT_POLICY", "reject")
+	defer os.Unsetenv("CLIENT_SYSTEM_PROMPT_POLICY")
+
+	reqBytes := []byte(`{"model": "Test Model", "messages": [{"role": "system", "content": "x"}]}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(reqBytes))
+	w := httptest.NewRecorder()
+
+	ProxyChatCompletion(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %v", w.Code)
+	}
+}
+
+func TestRewriteModelFieldRecordsOriginal(t *testing.T) {
+	body := decodeBody(t, `{"model": "gpt-4", "messages": []}`)
+	req := rewriteModelField(httptest.NewRequest("POST", "/v1/chat/completions", nil), body, "0xabc")
+
+	if body["model"] != "0xabc" {
+		t.Errorf("outbound model = %v, want 0xabc", body["model"])
+	}
+	if got := originalModel(req); got != "gpt-4" {
+		t.Errorf("originalModel() = %q, want gpt-4", got)
+	}
+}
+
+func TestProxyChatCompletionResolvesModelAlias(t *testing.T) {
+	var outboundModel interface{}
+	server := newMarketplaceServer("alias-model-id", "Aliased Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		outboundModel = body["model"]
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("MODEL_ALIASES", "my-alias=Aliased Model")
+	defer os.Unsetenv("MODEL_ALIASES")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "my-alias", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	if outboundModel != "alias-model-id" {
+		t.Errorf("outbound model = %v, want alias-model-id", outboundModel)
+	}
+	if !strings.Contains(buf.String(), "client model 'my-alias' forwarded as alias-model-id") {
+		t.Errorf("original model was not recorded in logs: %q", buf.String())
+	}
+}
+
+func TestToolsSurviveRequestRoundTrip(t *testing.T) {
+	const tools = `[{"type": "function", "function": {
+		"name": "lookup_order",
+		"description": "Find an order by <id> & customer",
+		"parameters": {"type": "object", "properties": {
+			"id": {"type": "integer", "maximum": 18446744073709551615},
+			"ratio": {"type": "number", "multipleOf": 0.1}
+		}, "required": ["id"], "additionalProperties": false},
+		"strict": true
+	}}]`
+	const toolChoice = `{"type": "function", "function": {"name": "lookup_order"}}`
+
+	var outbound []byte
+	server := newMarketplaceServer("tools-model", "Tools Model", func(w http.ResponseWriter, r *http.Request) {
+		outbound, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Tools Model", "seed": 9007199254740993, "tools": `+tools+`, "tool_choice": `+toolChoice+`, "messages": [{"role": "user", "content": "Where is my order?"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+
+	forwarded := decodeBody(t, string(outbound))
+	if want := decodeBody(t, `{"tools": `+tools+`}`)["tools"]; !reflect.DeepEqual(forwarded["tools"], want) {
+		t.Errorf("tools changed in transit:\ngot  %v\nwant %v", forwarded["tools"], want)
+	}
+	if want := decodeBody(t, `{"tool_choice": `+toolChoice+`}`)["tool_choice"]; !reflect.DeepEqual(forwarded["tool_choice"], want) {
+		t.Errorf("tool_choice changed in transit: got %v, want %v", forwarded["tool_choice"], want)
+	}
+	for _, literal := range []string{"9007199254740993", "18446744073709551615", "<id> & customer"} {
+		if !bytes.Contains(outbound, []byte(literal)) {
+			t.Errorf("outbound body lost %q: %s", literal, outbound)
+		}
+	}
+}
+
+func TestProxyChatCompletionRejectsToolsForUnsupportedModel(t *testing.T) {
+	server := newMarketplaceServer("no-tools-model", "No Tools Model", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not be forwarded")
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("TOOLS_UNSUPPORTED_MODELS", "No Tools Model")
+	defer os.Unsetenv("TOOLS_UNSUPPORTED_MODELS")
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "No Tools Model", "tools": [{"type": "function", "function": {"name": "f"}}], "messages": []}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "does not support tools") {
+		t.Errorf("Expected 400 for tools on an unsupported model, got %v: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateSeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"absent", `{}`, false},
+		{"null", `{"seed": null}`, false},
+		{"zero", `{"seed": 0}`, false},
+		{"negative", `{"seed": -42}`, false},
+		{"max int64", `{"seed": 9223372036854775807}`, false},
+		{"min int64", `{"seed": -9223372036854775808}`, false},
+		{"beyond int64", `{"seed": 9223372036854775808}`, true},
+		{"fraction", `{"seed": 1.5}`, true},
+		{"exponent", `{"seed": 1e3}`, true},
+		{"string", `{"seed": "42"}`, true},
+		{"bool", `{"seed": true}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSeed(decodeBody(t, tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateSeed(%s) error = %v, wantErr %v", tt.body, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionSeed(t *testing.T) {
+	var forwardedSeed string
+	server := newMarketplaceServer("seed-model", "Seed Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		forwardedSeed = string(body["seed"])
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Seed Model", "seed": 1234567890123, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid seed: status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	if forwardedSeed != "1234567890123" {
+		t.Errorf("forwarded seed = %s, want 1234567890123", forwardedSeed)
+	}
+
+	forwardedSeed = ""
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Seed Model", "seed": 3.14, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "seed") {
+		t.Errorf("invalid seed: status = %v, want 400 naming the seed: %s", w.Code, w.Body.String())
+	}
+	if forwardedSeed != "" {
+		t.Error("request with an invalid seed was forwarded")
+	}
+}
+
+func TestValidateMaxTokens(t *testing.T) {
+	os.Setenv("MODEL_MAX_OUTPUT_TOKENS", "small-model=100,Large Model=8000")
+	defer os.Unsetenv("MODEL_MAX_OUTPUT_TOKENS")
+
+	tests := []struct {
+		name      string
+		policy    string
+		modelID   string
+		model     string
+		body      string
+		wantErr   bool
+		wantValue string
+	}{
+		{name: "under the limit", modelID: "small-model", model: "Small", body: `{"max_tokens": 100}`, wantValue: "100"},
+		{name: "over the limit", modelID: "small-model", model: "Small", body: `{"max_tokens": 101}`, wantErr: true},
+		{name: "limit by name", modelID: "0xlarge", model: "Large Model", body: `{"max_tokens": 8001}`, wantErr: true},
+		{name: "other model's limit does not apply", modelID: "0xlarge", model: "Large Model", body: `{"max_tokens": 5000}`, wantValue: "5000"},
+		{name: "unlimited model", modelID: "other-model", model: "Other", body: `{"max_tokens": 1000000}`, wantValue: "1000000"},
+		{name: "max_completion_tokens", modelID: "small-model", model: "Small", body: `{"max_completion_tokens": 500}`, wantErr: true},
+		{name: "clamped", policy: "clamp", modelID: "small-model", model: "Small", body: `{"max_tokens": 500}`, wantValue: "100"},
+		{name: "zero", modelID: "other-model", model: "Other", body: `{"max_tokens": 0}`, wantErr: true},
+		{name: "fraction", modelID: "other-model", model: "Other", body: `{"max_tokens": 1.5}`, wantErr: true},
+		{name: "null", modelID: "small-model", model: "Small", body: `{"max_tokens": null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("MAX_TOKENS_POLICY", tt.policy)
+			defer os.Unsetenv("MAX_TOKENS_POLICY")
+
+			body := decodeBody(t, tt.body)
+			err := validateMaxTokens(body, tt.modelID, tt.model)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateMaxTokens(%s) error = %v, wantErr %v", tt.body, err, tt.wantErr)
+			}
+			if tt.wantValue != "" {
+				if got := fmt.Sprint(body["max_tokens"]); got != tt.wantValue {
+					t.Errorf("max_tokens = %s, want %s", got, tt.wantValue)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionClampsMaxTokens(t *testing.T) {
+	os.Setenv("MODEL_MAX_OUTPUT_TOKENS", "capped-model=256")
+	defer os.Unsetenv("MODEL_MAX_OUTPUT_TOKENS")
+	os.Setenv("MAX_TOKENS_POLICY", "clamp")
+	defer os.Unsetenv("MAX_TOKENS_POLICY")
+
+	var forwarded string
+	server := newMarketplaceServer("capped-model", "Capped Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		forwarded = string(body["max_tokens"])
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Capped Model", "max_tokens": 4096, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	if forwarded != "256" {
+		t.Errorf("forwarded max_tokens = %s, want 256", forwarded)
+	}
+}
+
+func TestApplyMaxTokensCap(t *testing.T) {
+	tests := []struct {
+		name        string
+		cap         string
+		body        string
+		wantClamped bool
+		wantField   string
+		wantValue   string
+	}{
+		{name: "above the cap", cap: "1000", body: `{"max_tokens": 4096}`, wantClamped: true, wantField: "max_tokens", wantValue: "1000"},
+		{name: "below the cap", cap: "1000", body: `{"max_tokens": 200}`, wantField: "max_tokens", wantValue: "200"},
+		{name: "at the cap", cap: "1000", body: `{"max_tokens": 1000}`, wantField: "max_tokens", wantValue: "1000"},
+		{name: "omitted", cap: "1000", body: `{}`, wantClamped: true, wantField: "max_tokens", wantValue: "1000"},
+		{name: "null", cap: "1000", body: `{"max_tokens": null}`, wantClamped: true, wantField: "max_tokens", wantValue: "1000"},
+		{name: "max_completion_tokens above", cap: "1000", body: `{"max_completion_tokens": 2000}`, wantClamped: true, wantField: "max_completion_tokens", wantValue: "1000"},
+		{name: "both sent, max_tokens above", cap: "1000", body: `{"max_completion_tokens": 500, "max_tokens": 4096}`, wantClamped: true, wantField: "max_tokens", wantValue: "1000"},
+		{name: "both sent, max_completion_tokens kept", cap: "1000", body: `{"max_completion_tokens": 500, "max_tokens": 4096}`, wantClamped: true, wantField: "max_completion_tokens", wantValue: "500"},
+		{name: "both sent, both above", cap: "1000", body: `{"max_completion_tokens": 2000, "max_tokens": 4096}`, wantClamped: true, wantField: "max_completion_tokens", wantValue: "1000"},
+		{name: "no cap", body: `{"max_tokens": 4096}`, wantField: "max_tokens", wantValue: "4096"},
+		{name: "invalid cap", cap: "lots", body: `{}`, wantField: "max_tokens", wantValue: "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("MAX_TOKENS_CAP", tt.cap)
+			defer os.Unsetenv("MAX_TOKENS_CAP")
+
+			body := decodeBody(t, tt.body)
+			if got := applyMaxTokensCap(body); got != tt.wantClamped {
+				t.Errorf("applyMaxTokensCap(%s) = %v, want %v", tt.body, got, tt.wantClamped)
+			}
+			if got := fmt.Sprint(body[tt.wantField]); got != tt.wantValue {
+				t.Errorf("%s = %s, want %s", tt.wantField, got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionCapsMaxTokens(t *testing.T) {
+	os.Setenv("MAX_TOKENS_CAP", "512")
+	defer os.Unsetenv("MAX_TOKENS_CAP")
+
+	var forwarded string
+	server := newMarketplaceServer("cap-model", "Cap Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		forwarded = string(body["max_tokens"])
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	tests := []struct {
+		name          string
+		maxTokens     string
+		wantForwarded string
+		wantHeader    string
+	}{
+		{name: "above", maxTokens: `, "max_tokens": 4096`, wantForwarded: "512", wantHeader: "true"},
+		{name: "below", maxTokens: `, "max_tokens": 100`, wantForwarded: "100", wantHeader: "false"},
+		{name: "without", wantForwarded: "512", wantHeader: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Cap Model"`+tt.maxTokens+`, "messages": [{"role": "user", "content": "Hello"}]}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+			}
+			if forwarded != tt.wantForwarded {
+				t.Errorf("forwarded max_tokens = %s, want %s", forwarded, tt.wantForwarded)
+			}
+			if got := w.Header().Get(maxTokensClampedHeader); got != tt.wantHeader {
+				t.Errorf("%s = %q, want %q", maxTokensClampedHeader, got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestDoubleEncodedBody(t *testing.T) {
+	var forwarded map[string]interface{}
+	server := newMarketplaceServer("double-model", "Double Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	inner := `{"model": "Double Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	encoded, _ := json.Marshal(inner)
+
+	tests := []struct {
+		name      string
+		policy    string
+		body      string
+		wantCode  int
+		wantError string
+	}{
+		{name: "rejected by default", body: string(encoded), wantCode: http.StatusBadRequest, wantError: "JSON string containing JSON"},
+		{name: "unwrapped", policy: "unwrap", body: string(encoded), wantCode: http.StatusOK},
+		{name: "plain string is still invalid", policy: "unwrap", body: `"hello"`, wantCode: http.StatusBadRequest, wantError: "Invalid request body"},
+		{name: "object unaffected", policy: "reject", body: inner, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("DOUBLE_ENCODED_BODY_POLICY", tt.policy)
+			defer os.Unsetenv("DOUBLE_ENCODED_BODY_POLICY")
+			forwarded = nil
+
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(tt.body))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantError != "" && !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("error = %s, want it to mention %q", w.Body.String(), tt.wantError)
+			}
+			if tt.wantCode == http.StatusOK && forwarded["model"] != "double-model" {
+				t.Errorf("forwarded body = %v, want the unwrapped request", forwarded)
+			}
+		})
+	}
+}
+
+func TestApplySamplingGuards(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		body        string
+		wantClamped []string
+		wantTemp    string
+		wantTopP    string
+	}{
+		{name: "above the max", env: map[string]string{"MAX_TEMPERATURE": "1", "MAX_TOP_P": "0.9"},
+			body: `{"temperature": 1.8, "top_p": 1}`, wantClamped: []string{"temperature", "top_p"}, wantTemp: "1", wantTopP: "0.9"},
+		{name: "within range", env: map[string]string{"MAX_TEMPERATURE": "1", "MAX_TOP_P": "0.9"},
+			body: `{"temperature": 0.7, "top_p": 0.9}`, wantTemp: "0.7", wantTopP: "0.9"},
+		{name: "defaulted when absent", env: map[string]string{"DEFAULT_TEMPERATURE": "0.2", "DEFAULT_TOP_P": "0.95"},
+			body: `{"temperature": null}`, wantTemp: "0.2", wantTopP: "0.95"},
+		{name: "default kept within the max", env: map[string]string{"DEFAULT_TEMPERATURE": "1.5", "MAX_TEMPERATURE": "1"},
+			body: `{}`, wantTemp: "1", wantTopP: "<nil>"},
+		{name: "default leaves a given value", env: map[string]string{"DEFAULT_TEMPERATURE": "0.2"},
+			body: `{"temperature": 0.9}`, wantTemp: "0.9", wantTopP: "<nil>"},
+		{name: "not a number", env: map[string]string{"MAX_TEMPERATURE": "1"},
+			body: `{"temperature": "hot"}`, wantTemp: "hot", wantTopP: "<nil>"},
+		{name: "invalid max", env: map[string]string{"MAX_TEMPERATURE": "warm"},
+			body: `{"temperature": 1.8}`, wantTemp: "1.8", wantTopP: "<nil>"},
+		{name: "unconfigured", body: `{"temperature": 1.8}`, wantTemp: "1.8", wantTopP: "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			body := decodeBody(t, tt.body)
+			if got := applySamplingGuards(body); fmt.Sprint(got) != fmt.Sprint(tt.wantClamped) {
+				t.Errorf("applySamplingGuards(%s) = %v, want %v", tt.body, got, tt.wantClamped)
+			}
+			if got := fmt.Sprint(body["temperature"]); got != tt.wantTemp {
+				t.Errorf("temperature = %s, want %s", got, tt.wantTemp)
+			}
+			if got := fmt.Sprint(body["top_p"]); got != tt.wantTopP {
+				t.Errorf("top_p = %s, want %s", got, tt.wantTopP)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionSamplingGuards(t *testing.T) {
+	os.Setenv("MAX_TEMPERATURE", "1")
+	defer os.Unsetenv("MAX_TEMPERATURE")
+	os.Setenv("DEFAULT_TOP_P", "0.9")
+	defer os.Unsetenv("DEFAULT_TOP_P")
+
+	var forwarded map[string]json.RawMessage
+	server := newMarketplaceServer("sampling-model", "Sampling Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	tests := []struct {
+		name       string
+		sampling   string
+		wantTemp   string
+		wantTopP   string
+		wantHeader string
+	}{
+		{name: "clamped", sampling: `"temperature": 1.7, `, wantTemp: "1", wantTopP: "0.9", wantHeader: "temperature"},
+		{name: "within range", sampling: `"temperature": 0.5, "top_p": 0.5, `, wantTemp: "0.5", wantTopP: "0.5"},
+		{name: "defaulted", wantTopP: "0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Sampling Model", `+tt.sampling+`"user": "sampling-test", "messages": [{"role": "user", "content": "Hello"}]}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+			}
+			if got := string(forwarded["temperature"]); got != tt.wantTemp {
+				t.Errorf("forwarded temperature = %s, want %s", got, tt.wantTemp)
+			}
+			if got := string(forwarded["top_p"]); got != tt.wantTopP {
+				t.Errorf("forwarded top_p = %s, want %s", got, tt.wantTopP)
+			}
+			if got := string(forwarded["user"]); got != `"sampling-test"` {
+				t.Errorf("forwarded user = %s, want the other fields untouched", got)
+			}
+			if got := w.Header().Get(samplingClampedHeader); got != tt.wantHeader {
+				t.Errorf("%s = %q, want %q", samplingClampedHeader, got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestApplyRequestFieldFilter(t *testing.T) {
+	const raw = `{"model": "m", "messages": [], "temperature": 0.5, "logit_bias": {"50256": -100}, "user": "u", "x_vendor": true}`
+
+	tests := []struct {
+		name      string
+		allowlist string
+		denylist  string
+		policy    string
+		wantErr   bool
+		want      []string
+		wantKeys  []string
+	}{
+		{
+			name:     "no lists keeps everything",
+			wantKeys: []string{"logit_bias", "messages", "model", "temperature", "user", "x_vendor"},
+		},
+		{
+			name:     "denylist strips named fields",
+			denylist: "logit_bias, user",
+			want:     []string{"logit_bias", "user"},
+			wantKeys: []string{"messages", "model", "temperature", "x_vendor"},
+		},
+		{
+			name:      "allowlist strips unlisted fields but keeps required ones",
+			allowlist: "temperature",
+			want:      []string{"logit_bias", "user", "x_vendor"},
+			wantKeys:  []string{"messages", "model", "temperature"},
+		},
+		{
+			name:      "denylist wins over allowlist",
+			allowlist: "temperature,user",
+			denylist:  "user",
+			want:      []string{"logit_bias", "user", "x_vendor"},
+			wantKeys:  []string{"messages", "model", "temperature"},
+		},
+		{
+			name:     "required fields cannot be denied",
+			denylist: "model,messages",
+			wantKeys: []string{"logit_bias", "messages", "model", "temperature", "user", "x_vendor"},
+		},
+		{
+			name:     "reject returns error",
+			denylist: "user",
+			policy:   "reject",
+			wantErr:  true,
+		},
+		{
+			name:      "reject passes allowed requests",
+			allowlist: "temperature,logit_bias,user,x_vendor",
+			policy:    "reject",
+			wantKeys:  []string{"logit_bias", "messages", "model", "temperature", "user", "x_vendor"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("REQUEST_FIELD_ALLOWLIST", tt.allowlist)
+			defer os.Unsetenv("REQUEST_FIELD_ALLOWLIST")
+			os.Setenv("REQUEST_FIELD_DENYLIST", tt.denylist)
+			defer os.Unsetenv("REQUEST_FIELD_DENYLIST")
+			os.Setenv("REQUEST_FIELD_POLICY", tt.policy)
+			defer os.Unsetenv("REQUEST_FIELD_POLICY")
+
+			body := decodeBody(t, raw)
+			stripped, err := applyRequestFieldFilter(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyRequestFieldFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(stripped, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("stripped = %v, want %v", stripped, tt.want)
+			}
+			keys := make([]string, 0, len(body))
+			for key := range body {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("remaining fields = %v, want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionRequestFieldFilter(t *testing.T) {
+	os.Setenv("REQUEST_FIELD_DENYLIST", "logit_bias,user")
+	defer os.Unsetenv("REQUEST_FIELD_DENYLIST")
+
+	var forwarded map[string]json.RawMessage
+	server := newMarketplaceServer("fields-model", "Fields Model", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	const request = `{"model": "Fields Model", "user": "u", "logit_bias": {"50256": -100}, "temperature": 0.5, "messages": [{"role": "user", "content": "Hello"}]}`
+
+	t.Run("strip", func(t *testing.T) {
+		for _, debug := range []bool{false, true} {
+			defer func(debug bool) { config.DebugLog = debug }(config.DebugLog)
+			config.DebugLog = debug
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			forwarded = nil
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(request))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+			}
+			for _, field := range []string{"user", "logit_bias"} {
+				if _, ok := forwarded[field]; ok {
+					t.Errorf("denied field %s was forwarded", field)
+				}
+			}
+			if got := string(forwarded["temperature"]); got != "0.5" {
+				t.Errorf("forwarded temperature = %s, want the other fields untouched", got)
+			}
+			if logged := strings.Contains(logs.String(), "Stripped disallowed field(s) logit_bias, user"); logged != debug {
+				t.Errorf("with debug logging %v, stripped fields logged = %v", debug, logged)
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		os.Setenv("REQUEST_FIELD_POLICY", "reject")
+		defer os.Unsetenv("REQUEST_FIELD_POLICY")
+
+		forwarded = nil
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(request))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("status = %v, want 400: %s", w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), "logit_bias, user") {
+			t.Errorf("error = %s, want it to name the denied fields", w.Body.String())
+		}
+		if forwarded != nil {
+			t.Errorf("rejected request was forwarded: %v", forwarded)
+		}
+	})
+}
@@ -3,45 +3,139 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"sort"
 
-	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Add these new environment variable getters at the top of the file
+const defaultMarketplaceURL = "http://marketplace:9000"
+
+// marketplaceChatPath is the chat completions endpoint under the marketplace
+// base URL
+const marketplaceChatPath = "/chat/completions"
+
+// parseMarketplaceURL validates a MARKETPLACE_URL value and returns it as a
+// base URL for the marketplace endpoints: an http or https URL with a host,
+// an optional path prefix without trailing slash, and no query or fragment
+func parseMarketplaceURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid MARKETPLACE_URL %q: %v", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid MARKETPLACE_URL %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid MARKETPLACE_URL %q: missing host", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid MARKETPLACE_URL %q: must not have a query or fragment", raw)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	if strings.HasSuffix(u.Path, marketplaceChatPath) {
+		return "", fmt.Errorf("invalid MARKETPLACE_URL %q: must be the marketplace base URL, not its %s endpoint", raw, marketplaceChatPath)
+	}
+	return u.String(), nil
+}
+
+// loadMarketplaceURL returns MARKETPLACE_URL normalized by
+// parseMarketplaceURL, or as given if it is invalid, for NewMux to reject
+func loadMarketplaceURL() string {
+	raw := os.Getenv("MARKETPLACE_URL")
+	if raw == "" {
+		return ""
+	}
+	base, err := parseMarketplaceURL(raw)
+	if err != nil {
+		return raw
+	}
+	return base
+}
+
+// logMarketplaceURL logs at startup which marketplace cfg uses
+func logMarketplaceURL(cfg Config) {
+	switch {
+	case cfg.MarketplaceURL != "":
+		log.Printf("Using marketplace at %s", cfg.MarketplaceURL)
+	case !isMockUpstream():
+		log.Printf("MARKETPLACE_URL is not set; chat completions are unavailable and other requests use %s", defaultMarketplaceURL)
+	}
+}
+
+// getMarketplaceBaseURL returns the configured marketplace base URL, or the
+// default marketplace when MARKETPLACE_URL is not set
 func getMarketplaceBaseURL() string {
-    baseURL := os.Getenv("MARKETPLACE_URL")
-    if baseURL == "" {
-        baseURL = "http://marketplace:9000"
-    }
-    return baseURL
+	if config.MarketplaceURL == "" {
+		return defaultMarketplaceURL
+	}
+	return config.MarketplaceURL
 }
 
 func getMarketplaceModelsEndpoint() string {
     return fmt.Sprintf("%s/blockchain/models", getMarketplaceBaseURL())
 }
 
+const defaultSessionPathTemplate = "/blockchain/models/%s/session"
+
+// validateSessionPathTemplate checks that a session path template has exactly
+// one %s, for the model ID, and no other formatting verbs
+func validateSessionPathTemplate(template string) error {
+	if strings.Count(template, "%s") != 1 || strings.Count(template, "%") != 1 {
+		return fmt.Errorf("session path template %q must contain exactly one %%s for the model ID", template)
+	}
+	return nil
+}
+
+// getSessionPathTemplate returns SESSION_PATH, the marketplace path used to open
+// a session with %s in place of the model ID
+func getSessionPathTemplate() string {
+	template := strings.TrimSpace(os.Getenv("SESSION_PATH"))
+	if template == "" {
+		return defaultSessionPathTemplate
+	}
+	if err := validateSessionPathTemplate(template); err != nil {
+		log.Printf("Invalid SESSION_PATH value: %v, using default of %s", err, defaultSessionPathTemplate)
+		return defaultSessionPathTemplate
+	}
+	if !strings.HasPrefix(template, "/") {
+		template = "/" + template
+	}
+	return template
+}
+
 func getMarketplaceSessionEndpoint(modelID string) string {
-    return fmt.Sprintf("%s/blockchain/models/%s/session", getMarketplaceBaseURL(), modelID)
+    return getMarketplaceBaseURL() + fmt.Sprintf(getSessionPathTemplate(), modelID)
 }
 
+// getMarketplaceChatEndpoint returns the chat completions URL, or "" if
+// MARKETPLACE_URL is not set and there is no mock upstream to answer
 func getMarketplaceChatEndpoint() string {
-    marketplaceURL := os.Getenv("MARKETPLACE_URL")
-    if marketplaceURL == "" {
-        return ""
-    }
-    return fmt.Sprintf("%s/chat/completions", marketplaceURL)
+	if config.MarketplaceURL == "" && !isMockUpstream() {
+		return ""
+	}
+	return getMarketplaceBaseURL() + marketplaceChatPath
 }
 
 func getSessionExpirationSeconds() int {
@@ -57,6 +151,50 @@ func getSessionExpirationSeconds() int {
 	return expiration
 }
 
+// getSessionDurationSeconds returns SESSION_DURATION, how long the node is
+// asked to keep a new session open, as a duration such as "1h" or in seconds
+func getSessionDurationSeconds() int {
+	durationStr := strings.TrimSpace(os.Getenv("SESSION_DURATION"))
+	if durationStr == "" {
+		return 3600 // Default to 1 hour
+	}
+	seconds, err := strconv.Atoi(durationStr)
+	if err != nil {
+		duration, parseErr := time.ParseDuration(durationStr)
+		seconds, err = int(duration/time.Second), parseErr
+	}
+	if err != nil || seconds < 60 { // Minimum 1 minute
+		log.Printf("Invalid SESSION_DURATION value: %s, using default of 1h", durationStr)
+		return 3600
+	}
+	return seconds
+}
+
+// getSessionFailover reports whether sessions are opened with failover enabled.
+// With failover the node switches to an alternate provider when the primary is
+// unavailable, so the proxy keeps the session and relays the node's response
+// rather than treating a provider error as fatal.
+func getSessionFailover() bool {
+	failoverStr := os.Getenv("SESSION_FAILOVER")
+	if failoverStr == "" {
+		return false
+	}
+	failover, err := strconv.ParseBool(failoverStr)
+	if err != nil {
+		log.Printf("Invalid SESSION_FAILOVER value: %s, using default of false", failoverStr)
+		return false
+	}
+	return failover
+}
+
+// newSessionRequestBody builds the body sent to the marketplace to open a session
+func newSessionRequestBody(sessionDuration int) map[string]interface{} {
+	return map[string]interface{}{
+		"sessionDuration": sessionDuration,
+		"failover":        getSessionFailover(),
+	}
+}
+
 // Update SessionManager to track model ID
 type SessionManager struct {
 	SessionID string
@@ -77,11 +215,30 @@ func (sm *SessionManager) UpdateSession(sessionID, modelID string) {
 // SessionManagerInstance is a global instance of SessionManager
 var SessionManagerInstance = &SessionManager{}
 
+// pinnedSessionManagers holds the current session of the requests pinned to
+// each provider, kept apart from SessionManagerInstance so that pinned and
+// unpinned requests for a model do not evict each other's session. Guarded
+// by sessionMutex.
+var pinnedSessionManagers = make(map[string]*SessionManager)
+
+// currentSessionManagerLocked returns the current session slot for the
+// session key: SessionManagerInstance unless the key is pinned to a provider
+func currentSessionManagerLocked(key string) *SessionManager {
+	provider := sessionKeyProvider(key)
+	if provider == "" {
+		return SessionManagerInstance
+	}
+	sm, ok := pinnedSessionManagers[provider]
+	if !ok {
+		sm = &SessionManager{}
+		pinnedSessionManagers[provider] = sm
+	}
+	return sm
+}
+
 // Add these new vars at the top of the file
 var (
-	defaultTimeout = 30 * time.Second
-	circuitBreaker *gobreaker.CircuitBreaker
-	sessionExpirationSeconds = getSessionExpirationSeconds()
+	circuitBreaker *marketplaceBreaker
 
 	// Session and model caches with mutex protection
 	sessionCache = struct {
@@ -101,21 +258,14 @@ var (
 )
 
 func init() {
-	// Configure circuit breaker
-	circuitBreaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
-		Name:        "marketplace",
-		MaxRequests: 3,
-		Interval:    10 * time.Second,
-		Timeout:     60 * time.Second,
-		OnStateChange: func(name string, from, to gobreaker.State) {
-			log.Printf("Circuit breaker state changed from %v to %v", from, to)
-		},
-	})
+	// Load configuration and build the circuit breaker and pools from it
+	applyConfig(LoadConfig())
 
 	// Add periodic cleanup of expired sessions only if enabled
-	if enableCleanupGoroutine {
+	if enableCleanupGoroutine && config.SessionCleanupInterval > 0 {
+		interval := config.SessionCleanupInterval
 		go func() {
-			ticker := time.NewTicker(5 * time.Minute)
+			ticker := time.NewTicker(interval)
 			for range ticker.C {
 				cleanupExpiredSessions()
 			}
@@ -128,7 +278,36 @@ type MorpheusSession struct {
 	SessionID string
 	ModelID   string
 	ModelName string
+	Wallet    string // wallet funding the session, "" if not configured
+	Provider  string // provider address negotiated for the session, "" if the node did not say
+	Price     string // price agreed for the session as the node wrote it, "" if it did not say
 	Created   time.Time
+	LastUsed  time.Time
+	Reuses    int // requests served after the one that opened the session
+}
+
+// lastActive returns when the session was last used, or its creation time if
+// it has not been reused
+func (s *MorpheusSession) lastActive() time.Time {
+	if s.LastUsed.After(s.Created) {
+		return s.LastUsed
+	}
+	return s.Created
+}
+
+// expiresAt returns when the session expires if it is not used again, or
+// when it reaches MAX_SESSION_AGE if that is sooner
+func (s *MorpheusSession) expiresAt() time.Time {
+	idle := s.lastActive().Add(time.Duration(config.SessionExpirationSeconds) * time.Second)
+	if s.pastMaxAge(idle) {
+		return s.Created.Add(config.MaxSessionAge)
+	}
+	return idle
+}
+
+// pastMaxAge reports whether the session has reached MAX_SESSION_AGE by t
+func (s *MorpheusSession) pastMaxAge(t time.Time) bool {
+	return config.MaxSessionAge > 0 && !t.Before(s.Created.Add(config.MaxSessionAge))
 }
 
 // Update activeSessions to manage sessions per model ID
@@ -137,53 +316,208 @@ var (
 	sessionMutex   sync.Mutex
 )
 
+// getActiveSession returns a copy of the active session for modelID, read
+// under sessionMutex so it cannot race with ensureSession or cleanup
+func getActiveSession(modelID string) (MorpheusSession, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	session, exists := activeSessions[modelID]
+	if !exists || session == nil {
+		return MorpheusSession{}, false
+	}
+	return *session, true
+}
+
 // Remove getModelID function as modelID comes from the request
 
-// Add retry configuration constants
-const (
+// Retry configuration for session establishment and retryable upstream
+// errors, unless MODEL_RETRY_POLICIES overrides it for a model
+var (
 	maxRetries = 3
 	baseDelay  = 1 * time.Second
 )
 
+// ErrUpstreamUnavailable marks failures caused by the marketplace being
+// unreachable or refusing to open a session, as opposed to internal errors.
+var ErrUpstreamUnavailable = errors.New("marketplace unavailable")
+
+// ErrUpstreamBusy marks requests turned away because MAX_CONCURRENT_UPSTREAM
+// requests were already in flight to the marketplace
+var ErrUpstreamBusy = errors.New("too many concurrent upstream requests")
+
+// UpstreamTimeoutError reports a marketplace request that did not complete
+// within its configured timeout
+type UpstreamTimeoutError struct {
+	Waited  time.Duration
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *UpstreamTimeoutError) Error() string {
+	return fmt.Sprintf("marketplace did not respond after %v (timeout %v): %v", e.Waited, e.Timeout, e.Err)
+}
+
+func (e *UpstreamTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// isTimeout reports whether err is a client or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// getSessionRetryAfterSeconds returns the Retry-After hint sent to clients when
+// no session can be established
+func getSessionRetryAfterSeconds() int {
+	return getEnvInt("SESSION_RETRY_AFTER_SECONDS", 10)
+}
+
 // Modify ensureSession to be more robust with retry logic
-func ensureSession(modelID string) error {
+func ensureSession(ctx context.Context, modelID string) (err error) {
+	_, span := startSpan(ctx, "ensureSession", attribute.String("model.id", modelID))
+	defer func() { endSpan(span, err) }()
+
+	// A ready pool serves the request without touching the active session.
+	// Sessions pinned to a provider are not pooled.
+	key := sessionKey(modelID, providerOverride(ctx))
+	if pool := getSessionPool(modelID); key == modelID && pool != nil && pool.ready() {
+		recordSessionDecision(ctx, sessionPooled)
+		return nil
+	}
+
+	// Another request may start establishing the session between admission
+	// and the lookup; wait for it again rather than open a second session
+	var reason string
+	var done func()
+	for done == nil {
+		if err := admitDuringEstablishment(ctx, key); err != nil {
+			return err
+		}
+		if reason, done, err = claimSession(key); err != nil {
+			return err
+		}
+		if reason == sessionReused {
+			recordSessionDecision(ctx, reason)
+			return nil
+		}
+	}
+	defer done()
+
+	// Another replica may have opened the session already, or be opening it
+	adopted, release := claimStoredSession(ctx, key)
+	if adopted {
+		recordSessionDecision(ctx, sessionShared)
+		return nil
+	}
+	defer release()
+
+	recordSessionDecision(ctx, reason)
+	return establishSession(ctx, modelID, reason)
+}
+
+// claimSession reuses the active session for modelID if it is still valid,
+// returning sessionReused. Otherwise it returns why a new session is needed,
+// marks it as being established and returns the func that clears the mark,
+// or a nil func if another request got there first.
+func claimSession(modelID string) (reason string, done func(), err error) {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 
 	// Clean up expired sessions first
-	cleanupExpiredSessions()
+	cleanupExpiredSessionsLocked()
 
-	// Get current session ID from SessionManagerInstance
-	currentSessionID, currentModelID := SessionManagerInstance.GetSessionInfo()
+	// Get current session ID from the slot for the request's provider pin
+	current := currentSessionManagerLocked(modelID)
+	currentSessionID, currentModelID := current.GetSessionInfo()
 	
 	// If we have a current session but it's for a different model, we need a new session
 	if currentSessionID != "" && currentModelID != modelID {
 		log.Printf("Current session is for different model (current: %s, requested: %s). Creating new session.", currentModelID, modelID)
-		delete(activeSessions, currentModelID)
-		SessionManagerInstance.UpdateSession("", "") // Clear the current session
+		removeSessionLocked(currentModelID, sessionEvicted)
+		current.UpdateSession("", "") // Clear the current session
 	}
 
 	session, exists := activeSessions[modelID]
+	if exists && session.SessionID != "" && !walletConfigured(session.Wallet) {
+		// The wallet was changed since the session was opened; keeping it
+		// would go on billing the old one
+		log.Printf("Session %s for model %s was opened under wallet %s, which is no longer configured. Creating new session.", redactSessionID(session.SessionID), modelID, redactWallet(session.Wallet))
+		retireSessionLocked(modelID, session, sessionWalletChanged)
+		exists = false
+	}
 	if exists && session.SessionID != "" {
 		// Check if session is still valid using configurable expiration
-		if time.Since(session.Created) < time.Duration(sessionExpirationSeconds)*time.Second {
-			session.Created = time.Now() // Update last used time
-			SessionManagerInstance.UpdateSession(session.SessionID, modelID)
+		if now().Before(session.expiresAt()) {
+			session.LastUsed = now()
+			session.Reuses++
+			refreshStoredSessionLocked(modelID, session)
+			current.UpdateSession(session.SessionID, modelID)
 			log.Printf("Using existing session for model %s: %s", modelID, session.SessionID)
-			return nil
+			return sessionReused, nil, nil
 		} else {
 			// Session expired, remove it
-			delete(activeSessions, modelID)
-			log.Printf("Removed expired session for model %s", modelID)
+			expireSessionLocked(modelID, session)
 		}
 	}
 
+	// Don't wait out the retries when the marketplace is known to be down
+	if health, checked := lastMarketplaceHealth(); checked && !health.Healthy {
+		return "", nil, fmt.Errorf("%w: marketplace health check failed at %s: %s", ErrUpstreamUnavailable, health.CheckedAt.Format(time.RFC3339), health.Error)
+	}
+	reason = establishReasonLocked(modelID)
+	return reason, tryMarkSessionEstablishing(modelID), nil
+}
+
+// establishSession opens a new session for modelID and makes it the model's
+// active session, or the active session for the model and provider if the
+// request is pinned to one; reason says why one is needed. It runs without
+// sessionMutex, so establishments for different models may overlap up to
+// MAX_CONCURRENT_SESSION_ESTABLISHMENTS; the rest queue for a slot.
+//
+// Other requests for the model wait on the establishment, so it is not tied
+// to ctx: the requester that started it hanging up does not abort it for
+// them. SESSION_ESTABLISH_TIMEOUT_SECONDS bounds it instead.
+func establishSession(ctx context.Context, modelID, reason string) error {
+	ctx = detachedContext{ctx}
+	session, err := openSession(ctx, modelID, reason)
+	if err != nil {
+		return err
+	}
+
+	key := sessionKey(modelID, providerOverride(ctx))
+	sessionMutex.Lock()
+	delete(sessionRemovals, key)
+	activeSessions[key] = session
+	// Update the global session manager
+	currentSessionManagerLocked(key).UpdateSession(session.SessionID, key)
+	sessionMutex.Unlock()
+	storeSession(ctx, key, *session)
+	return nil
+}
+
+// openSession opens a new session for modelID with retries, holding an
+// establishment slot, and returns it without installing it
+func openSession(ctx context.Context, modelID, reason string) (*MorpheusSession, error) {
+	// Bound the whole establishment, queueing for a slot included, so a hung
+	// marketplace cannot hold up the requests waiting on it
+	if config.SessionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.SessionTimeout)
+		defer cancel()
+	}
+
+	if !establishmentPool.wait(ctx) {
+		return nil, sessionContextError(ctx, modelID, nil)
+	}
+	defer establishmentPool.release()
+
 	// Create new session with retry logic
-	log.Printf("Creating new session for model %s", modelID)
+	log.Printf("Creating new session for model %s (%s)", modelID, reason)
 
 	// Get model name from available models
 	modelName := "" // Default empty
-	if models, err := getModels(); err == nil {
+	if models, err := getModels(ctx); err == nil {
 		for _, model := range models {
 			if model.Id == modelID {
 				modelName = model.Name
@@ -192,32 +526,44 @@ func ensureSession(modelID string) error {
 		}
 	}
 
-	reqBody := map[string]interface{}{
-		"sessionDuration": 3600,
-		"failover":        false,
+	wallet := selectWallet()
+	reqBody := newSessionRequestBody(config.SessionDurationSeconds)
+	pinned := providerOverride(ctx)
+	if pinned != "" {
+		reqBody["provider"] = pinned
 	}
 
 	reqBytes, err := json.Marshal(reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal session request: %v", err)
-	}
-
-	var result struct {
-		Id string `json:"sessionID"`
+		return nil, fmt.Errorf("failed to marshal session request: %v", err)
 	}
 
 	// Implement retry logic with exponential backoff
+	policy := getRetryPolicy(modelID, modelName)
+	maxRetries := policy.maxRetries
 	var lastErr error
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			delay := baseDelay * time.Duration(1<<uint(attempt-1))
+			delay := policy.backoff(attempt)
 			log.Printf("Retrying session creation (attempt %d/%d) after %v delay", attempt+1, maxRetries, delay)
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, sessionContextError(ctx, modelID, lastErr)
+			}
 		}
 
 		sessionURL := getMarketplaceSessionEndpoint(modelID)
-		resp, err := http.Post(sessionURL, "application/json", bytes.NewBuffer(reqBytes))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sessionURL, bytes.NewReader(reqBytes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := newMarketplaceClient(0).Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, sessionContextError(ctx, modelID, err)
+			}
 			lastErr = fmt.Errorf("failed to establish session: %v", err)
 			log.Printf("Session establishment failed (attempt %d/%d): %v", attempt+1, maxRetries, err)
 			continue
@@ -226,51 +572,137 @@ func ensureSession(modelID string) error {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
+		var terms sessionTerms
 		if resp.StatusCode != http.StatusOK {
-			// Check for nonce error in response
-			var errorResp struct {
-				Error string `json:"error"`
+			// A wallet that cannot fund the session will not recover by retrying
+			if isInsufficientBalanceResponse(resp.StatusCode, bodyBytes) {
+				log.Printf("Session establishment refused for insufficient balance (status %d): %s", resp.StatusCode, string(bodyBytes))
+				recordModelError(modelID, resp.StatusCode, string(bodyBytes))
+				invalidateWalletBalance()
+				return nil, fmt.Errorf("%w: %s", ErrInsufficientBalance, string(bodyBytes))
+			}
+
+			// The node may refuse because it already has a session open
+			// for the model; that session serves as well as a new one
+			var ok bool
+			terms, ok = existingSessionFromError(bodyBytes)
+			if !ok {
+				// Check for nonce error in response
+				var errorResp struct {
+					Error string `json:"error"`
+				}
+				if err := json.Unmarshal(bodyBytes, &errorResp); err == nil && strings.Contains(strings.ToLower(errorResp.Error), "nonce") {
+					lastErr = fmt.Errorf("nonce error: %s", errorResp.Error)
+					log.Printf("Nonce error detected (attempt %d/%d): %s", attempt+1, maxRetries, errorResp.Error)
+					continue
+				}
+
+				lastErr = fmt.Errorf("failed to establish session: %s", string(bodyBytes))
+				log.Printf("Session establishment failed with status %d (attempt %d/%d): %s", resp.StatusCode, attempt+1, maxRetries, string(bodyBytes))
+				continue
 			}
-			if err := json.Unmarshal(bodyBytes, &errorResp); err == nil && strings.Contains(strings.ToLower(errorResp.Error), "nonce") {
-				lastErr = fmt.Errorf("nonce error: %s", errorResp.Error)
-				log.Printf("Nonce error detected (attempt %d/%d): %s", attempt+1, maxRetries, errorResp.Error)
+		} else {
+			terms, err = parseSessionResponse(bodyBytes)
+			if errors.Is(err, errNoSessionID) {
+				lastErr = fmt.Errorf("%w for model %s", err, modelID)
+				log.Printf("Session response for model %s has no sessionID field (attempt %d/%d): %s", modelID, attempt+1, maxRetries, string(bodyBytes))
+				continue
+			}
+			if err != nil {
+				lastErr = err
+				log.Printf("Failed to decode session response (attempt %d/%d): %v", attempt+1, maxRetries, err)
 				continue
 			}
 
-			lastErr = fmt.Errorf("failed to establish session: %s", string(bodyBytes))
-			log.Printf("Session establishment failed with status %d (attempt %d/%d): %s", resp.StatusCode, attempt+1, maxRetries, string(bodyBytes))
-			continue
-		}
+			if terms.ID == "" {
+				lastErr = fmt.Errorf("failed to get valid session ID from response")
+				log.Printf("Empty session ID received (attempt %d/%d)", attempt+1, maxRetries)
+				continue
+			}
 
-		if err := json.Unmarshal(bodyBytes, &result); err != nil {
-			lastErr = fmt.Errorf("failed to decode session response: %v", err)
-			log.Printf("Failed to decode session response (attempt %d/%d): %v", attempt+1, maxRetries, err)
-			continue
+			if err := checkSessionSuccessCriteria(bodyBytes); err != nil {
+				lastErr = err
+				log.Printf("Session %s not accepted (attempt %d/%d): %v", redactSessionID(terms.ID), attempt+1, maxRetries, err)
+				// The node opened it all the same, and will bill for it
+				// until it is closed
+				if err := closeSession(ctx, terms.ID); err != nil {
+					log.Printf("Failed to close rejected session %s: %v", redactSessionID(terms.ID), err)
+				}
+				continue
+			}
 		}
+		id, provider, existing := terms.ID, terms.Provider, terms.Existing
 
-		if result.Id == "" {
-			lastErr = fmt.Errorf("failed to get valid session ID from response")
-			log.Printf("Empty session ID received (attempt %d/%d)", attempt+1, maxRetries)
-			continue
+		// A node that ignored the requested provider opened a session
+		// the caller did not ask for; close it rather than use it
+		if pinned != "" && provider != "" && !strings.EqualFold(provider, pinned) {
+			if err := closeSession(ctx, id); err != nil {
+				log.Printf("Failed to close session %s opened with the wrong provider: %v", redactSessionID(id), err)
+			}
+			return nil, fmt.Errorf("node opened session for model %s with provider %s, not the requested %s", modelID, provider, pinned)
+		}
+		if provider == "" {
+			provider = pinned
 		}
 
-		// Success! Update the session and return
-		activeSessions[modelID] = &MorpheusSession{
-			SessionID: result.Id,
+		// Success!
+		if wallet != "" && !existing {
+			walletSessions.Inc(redactWallet(wallet))
+		}
+		if existing {
+			log.Printf("Node already has session %s open for model %s, reusing it (attempt %d)", redactSessionID(id), modelID, attempt+1)
+		} else {
+			log.Printf("Successfully established new session for model %s: %s (attempt %d)", modelID, id, attempt+1)
+		}
+		if provider != "" {
+			log.Printf("Session %s for model %s is served by provider %s", redactSessionID(id), modelID, redactWallet(provider))
+		}
+		if terms.Price != "" {
+			log.Printf("Session %s for model %s is priced at %s", redactSessionID(id), modelID, terms.Price)
+		}
+		return &MorpheusSession{
+			SessionID: id,
 			ModelID:   modelID,
 			ModelName: modelName,
-			Created:   time.Now(),
-		}
-
-		// Update the global session manager
-		SessionManagerInstance.UpdateSession(result.Id, modelID)
-
-		log.Printf("Successfully established new session for model %s: %s (attempt %d)", modelID, result.Id, attempt+1)
-		return nil
+			Wallet:    wallet,
+			Provider:  provider,
+			Price:     terms.Price,
+			Created:   now(),
+		}, nil
 	}
 
 	// If we get here, all retries failed
-	return fmt.Errorf("failed to establish session after %d attempts: %v", maxRetries, lastErr)
+	recordModelError(modelID, 0, lastErr.Error())
+	retriesExhausted.Inc("session")
+	return nil, fmt.Errorf("%w: %w establishing session after %d attempts: %w", ErrUpstreamUnavailable, ErrRetriesExhausted, maxRetries, lastErr)
+}
+
+// detachedContext carries the values of the context it wraps, such as the
+// trace and a provider pin, but none of its deadline or cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// sessionContextError reports establishment cut short by ctx. Running out of
+// SESSION_ESTABLISH_TIMEOUT_SECONDS means the marketplace is unavailable;
+// otherwise the request was cancelled.
+func sessionContextError(ctx context.Context, modelID string, cause error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ctx.Err()
+	}
+	recordModelError(modelID, 0, "session establishment timed out")
+	if cause == nil {
+		cause = ctx.Err()
+	}
+	return fmt.Errorf("%w: establishing session timed out after %v: %w", ErrUpstreamUnavailable, config.SessionTimeout, cause)
 }
 
 // ModelInfo represents the model information from the marketplace
@@ -390,9 +822,15 @@ func findModelID(modelHandle string) (string, error) {
 		return "", fmt.Errorf("model handle cannot be empty")
 	}
 
+	// An on-chain model ID needs no lookup
+	if isModelID(modelHandle) {
+		log.Printf("Model handle '%s' is already a model ID", modelHandle)
+		return modelHandle, nil
+	}
+
 	// Check cache first
 	modelCache.RLock()
-	if cached, exists := modelCache.m[modelHandle]; exists && time.Since(cached.Created) < time.Hour {
+	if cached, exists := modelCache.m[modelHandle]; exists && now().Sub(cached.Created) < config.ModelCacheTTL {
 		modelCache.RUnlock()
 		log.Printf("Found cached model ID for '%s': %s", modelHandle, cached.ModelID)
 		return cached.ModelID, nil
@@ -403,7 +841,7 @@ func findModelID(modelHandle string) (string, error) {
 	log.Printf("Fetching models from: %s", endpoint)
 
 	// Query the marketplace API
-	resp, err := http.Get(fmt.Sprintf("%s?limit=100&order=desc", endpoint))
+	resp, err := newMarketplaceClient(0).Get(fmt.Sprintf("%s?limit=100&order=desc", endpoint))
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch models: %v", err)
 	}
@@ -414,7 +852,7 @@ func findModelID(modelHandle string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to read response body: %v", err)
 	}
-	log.Printf("Marketplace response: %s", string(bodyBytes))
+	log.Printf("Marketplace response: %s", formatBodyForLog(bodyBytes))
 
 	var searchResp ModelSearchResponse
 	if err := json.Unmarshal(bodyBytes, &searchResp); err != nil {
@@ -435,6 +873,21 @@ func findModelID(modelHandle string) (string, error) {
 	searchHandle := strings.ToLower(modelHandle)
 	log.Printf("Searching for model matching: '%s'", modelHandle)
 
+	// An exact ID or name match wins over any partial match
+	for _, model := range searchResp.Models {
+		if strings.EqualFold(model.Id, modelHandle) || strings.ToLower(model.Name) == searchHandle {
+			log.Printf("Found exact match: '%s' (ID: %s)", model.Name, model.Id)
+			modelCache.Lock()
+			modelCache.m[modelHandle] = CachedModel{
+				ModelID:   model.Id,
+				ModelName: model.Name,
+				Created:   now(),
+			}
+			modelCache.Unlock()
+			return model.Id, nil
+		}
+	}
+
 	// Try finding a model that contains the search term
 	var matches []struct {
 		id    string
@@ -476,7 +929,7 @@ func findModelID(modelHandle string) (string, error) {
 		modelCache.m[modelHandle] = CachedModel{
 			ModelID:   bestMatch.id,
 			ModelName: bestMatch.name,
-			Created:   time.Now(),
+			Created:   now(),
 		}
 		modelCache.Unlock()
 
@@ -506,13 +959,27 @@ func findModelID(modelHandle string) (string, error) {
 	modelCache.m[modelHandle] = CachedModel{
 		ModelID:   bestMatch,
 		ModelName: modelHandle,
-		Created:   time.Now(),
+		Created:   now(),
 	}
 	modelCache.Unlock()
 
 	return bestMatch, nil
 }
 
+// isModelID reports whether handle is an on-chain model ID: 0x followed by
+// 64 hex digits
+func isModelID(handle string) bool {
+	if len(handle) != 66 || !strings.HasPrefix(handle, "0x") {
+		return false
+	}
+	for _, c := range handle[2:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
 // validateModelHandle checks if the model handle is valid and returns the corresponding ID
 func validateModelHandle(handle string) (string, error) {
 	modelID, err := findModelID(handle)
@@ -528,131 +995,501 @@ func validateModelHandle(handle string) (string, error) {
 
 // Update ProxyChatCompletion to ensure proper model and session handling
 func ProxyChatCompletion(w http.ResponseWriter, r *http.Request) {
+	requestID := ensureRequestID(w, r)
+	log.Printf("Received chat completion request %s from %s", requestID, r.RemoteAddr)
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, "ProxyChatCompletion", attribute.String("request.id", requestID))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	outcome := trackResult(w, requestID)
+	if outcome != nil {
+		w = outcome
+		defer outcome.publish()
+	}
+
+	if isDraining() {
+		respondDraining(w)
+		return
+	}
+
+	if err := checkBalanceAdmission(r); err != nil {
+		log.Printf("Request refused by admission control: %v", err)
+		respondWithError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+
 	// Read and log the request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to read request body")
 		return
 	}
-	// Restore the request body for further processing
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	fmt.Printf("Received chat request body: %s\n", string(bodyBytes))
+	log.Printf("Received chat request body: %s", formatBodyForLog(bodyBytes))
+
+	if len(bytes.TrimSpace(bodyBytes)) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Request body is empty")
+		return
+	}
+
+	if bodyBytes, err = unwrapDoubleEncodedBody(bodyBytes); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	var requestBody map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+	requestBody, err := decodeRequestBody(bodyBytes)
+	if err != nil || requestBody == nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	// Extract and validate model handle
+	// X-Model-ID replaces the body's model for this request; whether it
+	// is allowed is checked once it is resolved
+	modelOverride := strings.TrimSpace(r.Header.Get(modelOverrideHeader))
+	if modelOverride != "" {
+		requestBody["model"] = modelOverride
+	}
+
 	modelHandle, ok := requestBody["model"].(string)
 	if !ok {
 		respondWithError(w, http.StatusBadRequest, "model field is required")
 		return
 	}
+	outcome.setModel(modelHandle, "")
+	setAccessLogModel(r.Context(), modelHandle)
+	outcome.setPromptHash(hashPrompt(requestBody))
 
-	// Convert model handle to ID
-	modelID, err := validateModelHandle(modelHandle)
+	stripped, err := applyRequestFieldFilter(requestBody)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if len(stripped) > 0 {
+		debugf("Stripped disallowed field(s) %s from request %s", strings.Join(stripped, ", "), requestID)
+	}
 
-	// Ensure we have an active session for this model ID
-	if err := ensureSession(modelID); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to establish session")
+	if err := applySystemPromptPolicy(requestBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if injectSystemPrompt(requestBody) {
+		log.Printf("Injected the configured system prompt into request %s", requestID)
+	}
 
-	sessionId := activeSessions[modelID].SessionID
+	if err := validateSeed(requestBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	fmt.Printf("--- Update Session with Model ID: %s\n ---", modelID)
-	fmt.Printf("------ Session ID: %s\n ------", sessionId)
-	fmt.Printf("------ Active Sessions: %+v\n ------", activeSessions)
-	fmt.Print("\n---\n\n")
+	// Convert model handle, after alias resolution, to ID
+	modelID, err := validateModelHandle(resolveModelAlias(modelHandle))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.String("model.id", modelID))
+	outcome.setModel(modelHandle, modelID)
 
-	// Update SessionManager with the new or existing session ID
-	SessionManagerInstance.UpdateSession(activeSessions[modelID].SessionID, modelID)
+	if modelOverride != "" && !overrideAllowed(getAllowedOverrides("ALLOWED_MODEL_OVERRIDES"), modelOverride, modelID) {
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("%s override to model %s is not allowed", modelOverrideHeader, modelOverride))
+		return
+	}
+	if provider := strings.TrimSpace(r.Header.Get(providerOverrideHeader)); provider != "" {
+		if !overrideAllowed(getAllowedOverrides("ALLOWED_PROVIDER_OVERRIDES"), provider, "") {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("%s override to provider %s is not allowed", providerOverrideHeader, provider))
+			return
+		}
+		log.Printf("Request %s is pinned to provider %s", requestID, redactWallet(provider))
+		r = withProviderOverride(r, provider)
+	}
 
-	// Create a new request body with the model ID
-	newRequestBody := make(map[string]interface{})
-	for k, v := range requestBody {
-		if k == "model" {
-			// Get the model name from the matched model
-			if models, err := getModels(); err == nil {
-				for _, model := range models {
-					if model.Id == modelID {
-						newRequestBody[k] = model.Name
-						break
-					}
-				}
-			}
-			if _, exists := newRequestBody[k]; !exists {
-				newRequestBody[k] = modelHandle // Fallback to original handle
+	if requestsTools(requestBody) && !modelSupportsTools(modelID, modelHandle) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Model %s does not support tools", modelHandle))
+		return
+	}
+
+	if err := validateMaxTokens(requestBody, modelID, modelHandle); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, capped := getMaxTokensCap(); capped {
+		w.Header().Set(maxTokensClampedHeader, strconv.FormatBool(applyMaxTokensCap(requestBody)))
+	}
+	if clamped := applySamplingGuards(requestBody); len(clamped) > 0 {
+		w.Header().Set(samplingClampedHeader, strings.Join(clamped, ","))
+	}
+
+	// A client that cannot take an event stream gets the completion as
+	// JSON, or is refused, rather than a stream it did not ask to accept
+	if stream, _ := requestBody["stream"].(bool); stream && !acceptsEventStream(r) {
+		if getStreamAcceptPolicy(modelID) == streamAcceptReject {
+			respondWithError(w, http.StatusNotAcceptable, "Streaming responses are sent as text/event-stream, which the Accept header does not allow")
+			return
+		}
+		log.Printf("Request %s asks for a stream but does not accept text/event-stream, answering with JSON", requestID)
+		requestBody["stream"] = false
+		delete(requestBody, "stream_options")
+	}
+
+	// A repeated Idempotency-Key is answered from cache, or waits for the
+	// first request with it, rather than paying for the completion again
+	if stream, _ := requestBody["stream"].(bool); !stream {
+		cached, claim, err := idempotency.begin(r.Context(), r.Header.Get(idempotencyKeyHeader), modelID, bodyBytes)
+		if errors.Is(err, ErrIdempotencyKeyReused) {
+			log.Printf("Request %s refused: %v", requestID, err)
+			respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body")
+			return
+		}
+		if err != nil {
+			log.Printf("Request %s gave up waiting for its idempotency key: %v", requestID, err)
+			return
+		}
+		if cached != nil {
+			log.Printf("Replaying cached completion for request %s", requestID)
+			idempotencyHits.Inc()
+			writeCachedResponse(w, cached)
+			return
+		}
+		defer claim.release()
+		r = withIdempotencyClaim(r, claim)
+		r = withStaleCacheKey(r, staleResponses.key(modelID, requestBody))
+	}
+
+	// Keep a stream's connection open while its session is established and
+	// its first chunk awaited
+	if stream, _ := requestBody["stream"].(bool); stream {
+		if interval := getStreamKeepaliveInterval(); interval > 0 {
+			keepalive := newKeepaliveWriter(w, interval)
+			defer keepalive.stop()
+			w = keepalive
+		}
+	}
+
+	// Ensure we have an active session for this model ID, noting why it
+	// was reused or established
+	r, decision := withSessionDecision(r)
+	err = ensureSession(r.Context(), modelID)
+	if errors.Is(err, ErrUpstreamUnavailable) && providerOverride(r.Context()) == "" {
+		if fallbackID, ok := getFallbackModelID(modelID); ok {
+			log.Printf("No session for model %s (%v), falling back to model %s", modelID, err, fallbackID)
+			if fallbackErr := ensureSession(r.Context(), fallbackID); fallbackErr != nil {
+				// The primary's error decides the response
+				err = fmt.Errorf("%w (fallback model %s: %v)", err, fallbackID, fallbackErr)
+			} else {
+				err = nil
+				modelID = fallbackID
+				span.SetAttributes(attribute.String("model.fallback", fallbackID))
+				outcome.setModel(modelHandle, modelID)
 			}
-		} else {
-			newRequestBody[k] = v
 		}
 	}
-	newRequestBody["model"] = modelID
+	if err != nil {
+		log.Printf("Failed to establish session for model %s: %v", modelID, err)
+		if errors.Is(err, ErrUpstreamUnavailable) && serveStale(w, r, err.Error()) {
+			return
+		}
+		if errors.Is(err, ErrInsufficientBalance) {
+			respondWithError(w, http.StatusPaymentRequired, insufficientBalanceMessage)
+			return
+		}
+		if errors.Is(err, ErrSessionEstablishing) {
+			w.Header().Set("Retry-After", "1")
+			respondWithError(w, http.StatusServiceUnavailable, "Session for this model is being established, retry shortly")
+			return
+		}
+		if errors.Is(err, ErrRetriesExhausted) {
+			respondRetriesExhausted(w)
+			return
+		}
+		if errors.Is(err, ErrUpstreamUnavailable) {
+			w.Header().Set("Retry-After", strconv.Itoa(getSessionRetryAfterSeconds()))
+			respondWithError(w, http.StatusServiceUnavailable, "Marketplace unavailable, failed to establish session")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to establish session")
+		return
+	}
+
+	log.Printf("Request %s uses a %s session for model %s", requestID, decision.reason, modelID)
+
+	// Copy the request body and point it at the marketplace model ID
+	newRequestBody := make(map[string]interface{}, len(requestBody))
+	for k, v := range requestBody {
+		newRequestBody[k] = v
+	}
+	r = rewriteModelField(r, newRequestBody, modelID)
 
 	stream, ok := newRequestBody["stream"].(bool)
 	if !ok {
 		stream = false // Default to non-streaming if not specified
 	}
+	span.SetAttributes(attribute.Bool("chat.stream", stream))
+	outcome.setStream(stream)
 
+	buffered := false
 	if stream {
-		handleStreamingRequest(w, newRequestBody, modelID)
+		switch getStreamingPolicy(modelID, modelHandle) {
+		case streamingPolicyReject:
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Streaming is not supported for model %s", modelHandle))
+			return
+		case streamingPolicyBuffer:
+			newRequestBody["stream"] = false
+			buffered = true
+		}
+	}
+
+	// Streams hold their slot far longer, so they are limited separately
+	pool := requestPool
+	if stream && !buffered {
+		pool = streamPool
+	}
+	if !acquireSlot(r.Context(), pool, 0) {
+		log.Printf("Rejecting request %s: %s concurrency limit reached", requestID, pool.name)
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusTooManyRequests, fmt.Sprintf("Too many concurrent %s requests", pool.name))
+		return
+	}
+	defer pool.release()
+
+	streamPolicy := streamingPolicyAllow
+	if buffered {
+		streamPolicy = streamingPolicyBuffer
+	}
+	setDebugConfigHeader(w, r, RequestDebugConfig{
+		RequestID:       requestID,
+		Model:           modelHandle,
+		ModelID:         modelID,
+		Stream:          stream,
+		StreamPolicy:    streamPolicy,
+		TimeoutMs:       forwardTimeout(modelID).Milliseconds(),
+		BodyTimeoutMs:   config.BodyTimeout.Milliseconds(),
+		SessionRetries:  getRetryPolicy(modelID, modelHandle).maxRetries,
+		SessionDecision: decision.reason,
+		Node:            getMarketplaceBaseURL(),
+	})
+
+	if buffered {
+		handleBufferedStreamingRequest(w, r, newRequestBody, modelID)
+	} else if stream {
+		handleStreamingRequest(w, r, newRequestBody, modelID)
 	} else {
-		handleNonStreamingRequest(w, newRequestBody, modelID)
+		handleNonStreamingRequest(w, r, newRequestBody, modelID)
+	}
+}
+
+// forwardRequest forwards the chat request for modelID. If its provider is
+// unavailable, the request is sent to FALLBACK_MODEL_ID instead. The response
+// names the model that answered in its X-Served-Model header.
+func forwardRequest(r *http.Request, requestBody map[string]interface{}, modelID string) (*http.Response, error) {
+	resp, err := forwardWithRetries(r, requestBody, modelID)
+	exhausted := errors.Is(err, ErrRetriesExhausted)
+	if err != nil && !exhausted {
+		return nil, err
+	}
+	resp.Header.Set(servedModelHeader, modelID)
+	if !isProviderUnavailable(resp.StatusCode) {
+		if exhausted {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	served, fallbackErr := forwardToFallback(r, requestBody, modelID, resp)
+	if exhausted && served == resp {
+		// No fallback took over from a primary still failing after retries
+		resp.Body.Close()
+		return nil, err
+	}
+	return served, fallbackErr
+}
+
+// forwardWithRetries forwards the chat request, retrying with backoff per the
+// model's retry policy when the marketplace answers with an error matching
+// RETRYABLE_ERROR_SUBSTRINGS. A non-streaming request is also retried up to
+// FORWARD_RETRIES times after a connection failure before any of it was
+// sent, or after a 502, 503 or 504 that no fallback model would take over
+// from. Any other response is returned as is. Once retries run out, the last
+// response is returned, still readable, along with an error wrapping
+// ErrRetriesExhausted.
+func forwardWithRetries(r *http.Request, requestBody map[string]interface{}, modelID string) (*http.Response, error) {
+	policy := getRetryPolicy(modelID, originalModel(r))
+	// A stream may already have reached the client when it fails
+	transientRetries, transientPolicy := config.ForwardRetries, retryPolicy{baseDelay: config.ForwardRetryDelay}
+	if stream, _ := requestBody["stream"].(bool); stream {
+		transientRetries = 0
+	}
+	for attempt, transient := 1, 0; ; attempt++ {
+		// A request the marketplace may have started on is not sent twice
+		var sent atomic.Bool
+		traced := r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			WroteHeaderField: func(string, []string) { sent.Store(true) },
+		}))
+		resp, err := forwardRequestOnce(traced, requestBody, modelID)
+		if err != nil && !sent.Load() && isTransientTransportError(err) && transient < transientRetries {
+			transient++
+			if !waitToRetryForward(r, transient, transientRetries, transientPolicy.backoff(transient), err.Error()) {
+				return nil, r.Context().Err()
+			}
+			attempt--
+			continue
+		}
+		if err != nil || resp.StatusCode == http.StatusOK {
+			return resp, err
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if !isRetryableUpstreamError(body) {
+			if isTransientStatus(resp.StatusCode) && transient < transientRetries && !fallsBack(r, modelID, resp.StatusCode) {
+				transient++
+				cause := fmt.Sprintf("marketplace returned %d: %s", resp.StatusCode, string(body))
+				if !waitToRetryForward(r, transient, transientRetries, transientPolicy.backoff(transient), cause) {
+					return nil, r.Context().Err()
+				}
+				attempt--
+				continue
+			}
+			return resp, nil
+		}
+		if attempt >= policy.maxRetries {
+			// The last response stays readable for a fallback model to
+			// take over from
+			retriesExhausted.Inc("forward")
+			return resp, fmt.Errorf("%w after %d attempts: marketplace returned %d: %s", ErrRetriesExhausted, attempt, resp.StatusCode, string(body))
+		}
+
+		delay := policy.backoff(attempt)
+		log.Printf("Retryable marketplace error for request %s (attempt %d/%d), retrying after %v: %s", r.Header.Get(requestIDHeader), attempt, policy.maxRetries, delay, string(body))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
 	}
 }
 
-// Modify forwardRequest to accept modelID and use the correct session
-func forwardRequest(requestBody map[string]interface{}, modelID string) (*http.Response, error) {
+// waitToRetryForward logs a transient forwarding failure and waits delay
+// before the given retry, reporting false if the request ends first
+func waitToRetryForward(r *http.Request, retry, retries int, delay time.Duration, cause string) bool {
+	log.Printf("Transient marketplace failure for request %s (retry %d/%d), retrying after %v: %s", r.Header.Get(requestIDHeader), retry, retries, delay, cause)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// forwardRequestOnce sends the chat request to the marketplace on the model's
+// session, carrying over the allowlisted headers from the inbound request r
+func forwardRequestOnce(r *http.Request, requestBody map[string]interface{}, modelID string) (resp *http.Response, err error) {
+	ctx, span := startSpan(r.Context(), "forwardRequest", attribute.String("model.id", modelID))
+	defer func() { endSpan(span, err) }()
+
 	marketplaceURL := getMarketplaceChatEndpoint()
 	if marketplaceURL == "" {
 		return nil, fmt.Errorf("MARKETPLACE_URL environment variable is not set")
 	}
 
 	// Add debug logging for URL
-	log.Printf("Attempting to forward request to: %s", marketplaceURL)
+	log.Printf("Attempting to forward request %s to: %s", r.Header.Get(requestIDHeader), marketplaceURL)
+	if original := originalModel(r); original != "" && original != modelID {
+		log.Printf("Request %s: client model '%s' forwarded as %s", r.Header.Get(requestIDHeader), original, modelID)
+	}
 
-	reqBodyBytes, err := json.Marshal(requestBody)
+	reqBodyBytes, err := encodeRequestBody(requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", marketplaceURL, bytes.NewBuffer(reqBodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", marketplaceURL, bytes.NewBuffer(reqBodyBytes))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-
-	log.Printf("Active session for model %s: %+v", modelID, activeSessions[modelID])
-	if session, exists := activeSessions[modelID]; exists && session.SessionID != "" {
-		// Add session ID to request headers
-		req.Header.Set("session_id", session.SessionID)
-		log.Printf("Setting session ID in request headers: %s", session.SessionID)
+	forwardClientHeaders(req.Header, r.Header)
+	// Continue the trace from this span rather than the client's
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if session, exists := checkoutSession(sessionKey(modelID, providerOverride(ctx))); exists && session.SessionID != "" {
+		setUpstreamHeaders(req.Header, session)
+		setSessionHeader(req.Header, session.SessionID)
+		log.Printf("Setting session ID in request headers: %s", redactSessionID(session.SessionID))
+		if session.Wallet != "" {
+			walletRequests.Inc(redactWallet(session.Wallet))
+		}
 	} else {
 		log.Printf("Warning: No active session ID available for model %s", modelID)
 		return nil, fmt.Errorf("no active session for model %s", modelID)
 	}
 
-	// Add debug logging for all headers
-	log.Printf("Request headers: %v", req.Header)
-	log.Printf("Request body: %s", reqBodyBytes)
+	logRequestHeaders(req.Header)
+	log.Printf("Request body: %s", formatBodyForLog(reqBodyBytes))
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	if err := circuitBreaker.allow(); err != nil {
+		log.Printf("Rejecting request %s: circuit breaker is open", r.Header.Get(requestIDHeader))
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
 	}
 
-	resp, err := client.Do(req)
+	// The slot is held until the response body is closed, so streams count
+	// as in flight for as long as they last
+	pool := upstreamPool
+	if !acquireSlot(ctx, pool, config.UpstreamQueueTimeout) {
+		log.Printf("Rejecting request %s: %d upstream requests already in flight", r.Header.Get(requestIDHeader), pool.inUse())
+		return nil, ErrUpstreamBusy
+	}
+	upstreamInFlight.Add(1)
+	var releaseOnce sync.Once
+	releaseUpstream := func() {
+		releaseOnce.Do(func() {
+			upstreamInFlight.Add(-1)
+			pool.release()
+		})
+	}
+
+	// The wait for the first byte and the body read are timed separately, so
+	// a slow-generating upstream is not cut off like a hung one
+	client := newMarketplaceClient(0)
+	reqCtx, cancel := context.WithCancel(ctx)
+	req = req.WithContext(reqCtx)
+	timeout := forwardTimeout(modelID)
+	firstByte := time.AfterFunc(timeout, cancel)
+
+	start := now()
+	resp, err = circuitBreaker.do(ctx, func() (*http.Response, error) { return client.Do(req) })
+	firstByteTimedOut := !firstByte.Stop()
 	if err != nil {
+		cancel()
+		releaseUpstream()
+		if errors.Is(err, ErrBreakerOpen) {
+			log.Printf("Rejecting request %s: circuit breaker is open", r.Header.Get(requestIDHeader))
+			return nil, fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+		}
 		log.Printf("Request failed: %v", err)
-		return nil, fmt.Errorf("failed to forward request: %v", err)
+		recordModelError(modelID, 0, err.Error())
+		if firstByteTimedOut || isTimeout(err) {
+			return nil, &UpstreamTimeoutError{Waited: now().Sub(start), Timeout: timeout, Err: err}
+		}
+		return nil, fmt.Errorf("failed to forward request: %w", err)
+	}
+	resp.Body = newDeadlineBody(resp.Body, config.BodyTimeout, func() {
+		cancel()
+		releaseUpstream()
+	})
+
+	upstreamStatus := attribute.Int("upstream.status_code", resp.StatusCode)
+	span.SetAttributes(upstreamStatus)
+	trace.SpanFromContext(r.Context()).SetAttributes(upstreamStatus)
+
+	if err := checkRedirectResponse(resp); err != nil {
+		recordModelError(modelID, resp.StatusCode, err.Error())
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -660,25 +1497,67 @@ func forwardRequest(requestBody map[string]interface{}, modelID string) (*http.R
 		resp.Body.Close()
 		log.Printf("Marketplace returned error status %d: %s", resp.StatusCode, string(body))
 		resp.Body = io.NopCloser(bytes.NewBuffer(body))
+		recordModelError(modelID, resp.StatusCode, string(body))
+		if isInsufficientBalanceResponse(resp.StatusCode, body) {
+			resp.Body.Close()
+			invalidateWalletBalance()
+			return nil, fmt.Errorf("%w: %s", ErrInsufficientBalance, string(body))
+		}
+		if getSessionFailover() && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable) {
+			log.Printf("Provider unavailable for model %s; session failover is enabled so the node will switch providers", modelID)
+		}
 	}
 
 	// Add response logging
-	log.Printf("Response status: %d", resp.StatusCode)
+	log.Printf("Response status for request %s: %d", r.Header.Get(requestIDHeader), resp.StatusCode)
 	log.Printf("Response headers: %v", resp.Header)
 
 	return resp, nil
 }
 
 // Update handleStreamingRequest and handleNonStreamingRequest
-func handleStreamingRequest(w http.ResponseWriter, requestBody map[string]interface{}, modelID string) {
-	resp, err := forwardRequest(requestBody, modelID)
+func handleStreamingRequest(w http.ResponseWriter, r *http.Request, requestBody map[string]interface{}, modelID string) {
+	resp, err := forwardRequest(r, requestBody, modelID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to forward streaming request")
+		respondWithForwardError(w, err, "Failed to forward streaming request")
 		return
 	}
 	defer resp.Body.Close()
 
+	// An error is answered as one before any stream headers are sent, so it
+	// is never relayed to the client as a successful stream
+	if resp.StatusCode != http.StatusOK {
+		relayStreamError(w, resp, modelID)
+		return
+	}
+
+	// Older nodes answer stream requests with a single JSON body; relay it as
+	// is rather than wrapping it in SSE framing. Backends streaming NDJSON
+	// are relayed line by line like SSE, but labelled and framed as NDJSON.
+	// Once keepalives have sent the response as an event stream, NDJSON is
+	// relayed as its events and a single JSON body as one chunk. An event
+	// stream leaves them running until its first chunk.
+	ndjson := isNDJSONStream(resp.Header)
+	asEvents := !isEventStream(resp.Header) && keepaliveCommitted(w)
+	if !ndjson && !isEventStream(resp.Header) {
+		if asEvents {
+			relayCompletionAsEvents(w, resp, modelID)
+			return
+		}
+		log.Printf("Marketplace answered stream request for model %s with %s, relaying it unframed", modelID, resp.Header.Get("Content-Type"))
+		if err := copyResponse(w, resp); err != nil {
+			log.Printf("Error copying response body: %v", err)
+		}
+		return
+	}
+
 	setStreamingHeaders(w)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	}
+	copyMetadataHeaders(w, resp.Header)
+	w.Header().Set(servedModelHeader, resp.Header.Get(servedModelHeader))
+	clearWriteDeadline(w)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -686,30 +1565,177 @@ func handleStreamingRequest(w http.ResponseWriter, requestBody map[string]interf
 		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
+	sw := newStreamWriter(w, flusher)
+	sw.ndjson = ndjson && !asEvents
+	defer sw.Close()
+
+	// Events are relayed whole, so one that grows past the limit can be
+	// dropped without sending the client a partial event
+	maxEventBytes := getMaxSSEEventBytes()
+	normalize := getNormalizeLineEndings()
+	sseScanner := newSSEScanner(resp.Body, maxEventBytes)
+	var scanner lineScanner = sseScanner
+	if chunks := getStreamPrefetchChunks(); chunks > 0 {
+		prefetch := newPrefetchScanner(sseScanner, chunks)
+		defer prefetch.Close()
+		scanner = prefetch
+	}
+	var event strings.Builder
 	for scanner.Scan() {
-		fmt.Fprintf(w, "%s\n", scanner.Text())
-		flusher.Flush()
+		// Lines are relayed exactly as received, line endings included, so
+		// chunks such as tool_calls deltas reach the client byte for byte
+		line := scanner.Text()
+		if normalize {
+			line = normalizeLineEnding(line)
+		}
+		if asEvents && ndjson {
+			if isBlankLine(line) {
+				continue
+			}
+			line = "data: " + strings.TrimRight(line, "\r\n") + "\n\n"
+		}
+		if event.Len()+len(line) > maxEventBytes {
+			terminateOversizedStream(sw, modelID, maxEventBytes)
+			return
+		}
+		event.WriteString(line)
+
+		// Each NDJSON line is a whole object, while an SSE event ends at a
+		// blank line
+		done := !ndjson && isStreamDone(line)
+		if !ndjson && !isBlankLine(line) && !done {
+			continue
+		}
+		if done {
+			// Terminate the final event even if the upstream did not,
+			// with the upstream's own line ending
+			ending := "\n"
+			if strings.HasSuffix(line, "\r\n") {
+				ending = "\r\n"
+			}
+			if !strings.HasSuffix(line, "\n") {
+				event.WriteString(ending)
+			}
+			event.WriteString(ending)
+		}
+		recordEventFinishReasons(modelID, event.String())
+		if err := sw.WriteLine(event.String()); err != nil {
+			log.Printf("Error writing streaming response: %v", err)
+			return
+		}
+		event.Reset()
+		if done {
+			return
+		}
 	}
 
+	// The status and headers have already been sent, so a failure now can only
+	// be reported to the client as an event in the stream
 	if err := scanner.Err(); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error reading streaming response")
+		if errors.Is(err, bufio.ErrTooLong) {
+			terminateOversizedStream(sw, modelID, maxEventBytes)
+			return
+		}
+		log.Printf("Error reading streaming response for model %s: %v", modelID, err)
+		recordModelError(modelID, resp.StatusCode, err.Error())
+		sw.WriteError("Error reading streaming response")
+		return
+	}
+	if event.Len() > 0 {
+		sw.WriteLine(event.String())
+	}
+	// An NDJSON stream simply ends
+	if ndjson && asEvents {
+		sw.WriteLine("data: [DONE]\n\n")
+	}
+	if !ndjson {
+		log.Printf("Warning: stream for model %s ended without [DONE]", modelID)
 	}
 }
 
-func handleNonStreamingRequest(w http.ResponseWriter, requestBody map[string]interface{}, modelID string) {
-	resp, err := forwardRequest(requestBody, modelID)
+// relayStreamError answers a stream request the marketplace failed with its
+// status, relaying the error body as is when it is JSON, as it would be for a
+// non-streaming request, and with a generic error otherwise
+func relayStreamError(w http.ResponseWriter, resp *http.Response, modelID string) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	log.Printf("Marketplace answered stream request for model %s with status %d", modelID, resp.StatusCode)
+	if err != nil || !json.Valid(body) {
+		respondWithError(w, resp.StatusCode, fmt.Sprintf("Marketplace returned status %d", resp.StatusCode))
+		return
+	}
+	copyHeaders(w, resp.Header)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+func handleNonStreamingRequest(w http.ResponseWriter, r *http.Request, requestBody map[string]interface{}, modelID string) {
+	resp, err := forwardRequestValidatingJSON(r, requestBody, modelID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to forward request")
+		if isMarketplaceOutage(err) && serveStale(w, r, err.Error()) {
+			return
+		}
+		respondWithForwardError(w, err, "Failed to forward request")
 		return
 	}
 	defer resp.Body.Close()
+	if isProviderUnavailable(resp.StatusCode) || resp.StatusCode == http.StatusGatewayTimeout {
+		if serveStale(w, r, fmt.Sprintf("marketplace returned %d", resp.StatusCode)) {
+			return
+		}
+	}
 
+	// Keep a copy of a successful completion to record its finish reasons
+	// once it has been relayed
+	var completion bytes.Buffer
+	if resp.StatusCode == http.StatusOK {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(resp.Body, &completion), resp.Body}
+	}
+	if shouldCompress(r, resp) {
+		err = copyCompressedResponse(w, resp)
+	} else {
+		err = copyResponse(w, resp)
+	}
+	if err != nil {
+		// Stop reading a response nobody is waiting for; closing the body
+		// cancels the marketplace request and frees its upstream slot
+		if isClientGone(r, err) {
+			log.Printf("Client for request %s disconnected during the response, abandoning it: %v", r.Header.Get(requestIDHeader), err)
+			relayErrors.Inc("client_disconnect")
+			resp.Body.Close()
+			return
+		}
+		log.Printf("Error reading marketplace response for request %s: %v", r.Header.Get(requestIDHeader), err)
+		relayErrors.Inc("upstream")
+	}
+	if completion.Len() > 0 {
+		recordFinishReasons(modelID, completion.Bytes())
+	}
+
+	// Keep the completion for retries and outages once it has been read in
+	// full. One abandoned because the client disconnected is not kept, so
+	// the client's retry is forwarded again.
+	claim, staleKey := idempotencyClaimFrom(r), staleCacheKeyFrom(r)
+	if (claim != nil || staleKey != "") && resp.StatusCode == http.StatusOK {
+		if _, err := io.Copy(io.Discard, resp.Body); err == nil {
+			claim.store(resp.StatusCode, resp.Header, completion.Bytes())
+			staleResponses.store(staleKey, resp.Header, completion.Bytes())
+		}
+	}
+}
+
+// copyResponse relays a marketplace response to the client unchanged. An
+// error writing to the client wraps errClientGone.
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
 	copyHeaders(w, resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("Error copying response body: %v", err)
-	}
+	_, err := io.Copy(clientWriter{w}, resp.Body)
+	return err
 }
 
 // setStreamingHeaders sets the necessary headers for streaming responses
@@ -719,35 +1745,179 @@ func setStreamingHeaders(w http.ResponseWriter) {
 	w.Header().Set("Connection", "keep-alive")
 }
 
-// copyHeaders copies headers from the marketplace response to the client response
+// copyHeaders copies headers from the marketplace response to the client response.
+// The request ID replaces rather than duplicates the one already set by the proxy.
 func copyHeaders(w http.ResponseWriter, headers http.Header) {
 	for key, values := range headers {
+		if http.CanonicalHeaderKey(key) == requestIDHeader && len(values) > 0 {
+			w.Header().Set(requestIDHeader, values[0])
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
 }
 
-// respondWithError sends an error response to the client
+// respondWithForwardError reports a failed forwardRequest to the client,
+// mapping known upstream conditions to a specific status and falling back to
+// a 500 with message
+func respondWithForwardError(w http.ResponseWriter, err error, message string) {
+	log.Printf("%s: %v", message, err)
+	if errors.Is(err, ErrInsufficientBalance) {
+		respondWithError(w, http.StatusPaymentRequired, insufficientBalanceMessage)
+		return
+	}
+	if errors.Is(err, ErrUpstreamBusy) {
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusTooManyRequests, "Too many concurrent upstream requests")
+		return
+	}
+	if errors.Is(err, ErrSessionEstablishing) {
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusServiceUnavailable, "Session for this model is being established, retry shortly")
+		return
+	}
+	if errors.Is(err, ErrRetriesExhausted) {
+		respondRetriesExhausted(w)
+		return
+	}
+	if errors.Is(err, ErrUpstreamUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(getSessionRetryAfterSeconds()))
+		respondWithError(w, http.StatusServiceUnavailable, "Marketplace unavailable")
+		return
+	}
+	var timeoutErr *UpstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		apiErr := newAPIError(http.StatusGatewayTimeout, "Timed out waiting for the marketplace")
+		apiErr.WaitedMs = timeoutErr.Waited.Milliseconds()
+		apiErr.TimeoutMs = timeoutErr.Timeout.Milliseconds()
+		writeAPIError(w, http.StatusGatewayTimeout, apiErr)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, message)
+}
+
+// respondWithError sends an OpenAI-compatible error response to the client
 func respondWithError(w http.ResponseWriter, statusCode int, message string) {
+	writeAPIError(w, statusCode, newAPIError(statusCode, message))
+}
+
+// writeAPIError sends apiErr as the body of an error response
+func writeAPIError(w http.ResponseWriter, statusCode int, apiErr APIError) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	json.NewEncoder(w).Encode(errorResponse{Error: apiErr})
 }
 
-// StartProxyServer starts the proxy server
-func StartProxyServer() {
-	proxy := NewProxy()
+// NewMux returns the proxy's routes on a new ServeMux, so they can be mounted
+// under a larger application or wrapped in middleware. The routes and their
+// handlers are configured from cfg, or from the active configuration when cfg
+// is nil. The sessions, pools and circuit breaker are shared by the process
+// and follow the active configuration, so NewMux leaves it untouched. It
+// fails if cfg is invalid.
+func NewMux(cfg *Config) (*http.ServeMux, error) {
+	if cfg == nil {
+		active := config
+		cfg = &active
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
-	})
+	proxy := newProxy(*cfg)
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
 
 	// Add handlers for blockchain/models endpoints
-	http.HandleFunc("/blockchain/models", proxy.handleGetModels)
-	http.HandleFunc("/blockchain/models/", proxy.handleModelOperations)
-	http.HandleFunc("/v1/chat/completions", proxy.handleChatCompletions)
+	mux.HandleFunc("/blockchain/models", proxy.withAccessLog(proxy.handleGetModels))
+	mux.HandleFunc("/blockchain/models/", proxy.withAccessLog(proxy.handleModelOperations))
+	mux.HandleFunc("/v1/chat/completions", proxy.withAccessLog(proxy.withCORS(withMethods(proxy.handleChatCompletions, http.MethodPost))))
+	mux.HandleFunc("/v1/embeddings", proxy.withAccessLog(proxy.withCORS(handleEmbeddings)))
+	mux.HandleFunc("/v1/batch", proxy.withAccessLog(proxy.withCORS(handleBatch)))
+	if cfg.AnthropicMessagesAPI {
+		mux.HandleFunc("/v1/messages", proxy.withAccessLog(proxy.withCORS(handleAnthropicMessages)))
+	}
+
+	// With ADMIN_PORT set, the operational endpoints are served by
+	// NewAdminMux on their own listener instead
+	if cfg.AdminPort == "" {
+		registerAdminRoutes(mux)
+	}
+
+	return mux, nil
+}
+
+// NewAdminMux returns the operational endpoints served on ADMIN_PORT: the
+// metrics, the stats and the admin and debug endpoints, along with /health
+// so the admin listener can be probed too
+func NewAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	registerAdminRoutes(mux)
+	return mux
+}
+
+// registerAdminRoutes adds the operational endpoints to mux
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/stats", handleStats)
+
+	// Admin endpoints, protected by API_KEY
+	mux.HandleFunc("/admin/errors", requireAPIKey(handleModelErrors))
+	mux.HandleFunc("/admin/breaker", requireAPIKey(handleBreaker))
+	mux.HandleFunc("/admin/breaker/", requireAPIKey(handleBreaker))
+	mux.HandleFunc("/admin/drain", requireAPIKey(handleDrain))
+	mux.HandleFunc("/admin/undrain", requireAPIKey(handleUndrain))
+	mux.HandleFunc("/debug/session", requireAPIKey(handleDebugSession))
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+}
+
+// Handler loads the configuration from the environment, makes it the active
+// one and returns the proxy's routes configured from it. It fails, leaving
+// the active configuration untouched, if the configuration is invalid.
+func Handler() (http.Handler, error) {
+	cfg := LoadConfig()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	applyConfig(cfg)
+	return NewMux(&cfg)
+}
+
+// StartProxyServer configures the process-wide marketplace transport and
+// tracing, then serves Handler on PORT. It blocks until the server fails or
+// the process receives SIGINT or SIGTERM, which shut the server down.
+func StartProxyServer() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := configureMarketplaceTransport(); err != nil {
+		log.Fatalf("Failed to configure marketplace transport: %v", err)
+	}
+
+	shutdownTracing, err := configureTracing(context.Background())
+	if err != nil {
+		log.Printf("Failed to configure tracing, continuing without it: %v", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	handler, err := Handler()
+	if err != nil {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
+	logMarketplaceURL(config)
+	logConfigReport(config)
+
+	if getEnvBool("WALLET_BALANCE_CHECK", false) {
+		checkWalletBalanceAtStartup()
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -756,39 +1926,112 @@ func StartProxyServer() {
 			port = "8081"
 		}
 	}
+	if config.SessionSummaryInterval > 0 {
+		go runSessionSummary(ctx, config.SessionSummaryInterval)
+	}
+	if config.HealthCheckInterval > 0 {
+		go runHealthChecks(ctx, config.HealthCheckInterval)
+	}
+	if config.SessionPoolSize > 0 && config.SessionPoolRefreshInterval > 0 {
+		go runSessionPoolRefresh(ctx, config.SessionPoolRefreshInterval)
+	}
+
+	servers := []*http.Server{newServer(":"+port, handler, config)}
+	if config.AdminPort != "" {
+		servers = append(servers, newServer(":"+config.AdminPort, NewAdminMux(), config))
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Printf("Shutting down proxy server")
+		setDraining(true)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdownServers(shutdownCtx, servers)
+
+		// With no requests left in flight, release the sessions rather
+		// than leave them to time out on the node
+		if config.SessionCloseTimeout > 0 {
+			closeCtx, cancelClose := context.WithTimeout(context.Background(), config.SessionCloseTimeout)
+			defer cancelClose()
+			closeAllSessions(closeCtx)
+		}
+		closeAuditLog()
+
+		// Flush the spans still batched, those of the closes included
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelFlush()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+	}()
+
+	listeners := make([]net.Listener, len(servers))
+	for i, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners[i] = listener
+	}
+	// The listeners are bound first so /health answers while the session is
+	// being opened
+	go warmSession(ctx)
+
 	log.Printf("Proxy server is running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if config.AdminPort != "" {
+		log.Printf("Admin endpoints are served on port %s", config.AdminPort)
+	}
+	err = serveAll(servers, listeners, stop)
+	<-shutdownDone
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
+// shutdownTimeout bounds how long in-flight requests may run after shutdown
+// begins
+const shutdownTimeout = 10 * time.Second
+
 // Add a cleanup function for expired sessions
 func cleanupExpiredSessions() {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 
+	cleanupExpiredSessionsLocked()
+}
+
+// cleanupExpiredSessionsLocked removes expired sessions. The caller must hold sessionMutex.
+func cleanupExpiredSessionsLocked() {
 	for modelID, session := range activeSessions {
-		if time.Since(session.Created) > time.Duration(sessionExpirationSeconds)*time.Second {
-			delete(activeSessions, modelID)
-			log.Printf("Cleaned up expired session for model %s", modelID)
+		if now().After(session.expiresAt()) {
+			expireSessionLocked(modelID, session)
 		}
 	}
 }
 
 func (p *Proxy) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
     log.Printf("Received chat completions request from %s", r.RemoteAddr)
+
+    if isDraining() {
+        respondDraining(w)
+        return
+    }
     
     // Read and parse request body
     body, err := io.ReadAll(r.Body)
     if err != nil {
         log.Printf("Error reading request body: %v", err)
-        http.Error(w, "Error reading request body", http.StatusBadRequest)
+        respondWithError(w, http.StatusBadRequest, "Error reading request body")
         return
     }
-    log.Printf("Raw request body: %s", string(body))
+    log.Printf("Raw request body: %s", formatBodyForLog(body))
 
     var chatRequest ChatCompletionRequest
     if err := json.Unmarshal(body, &chatRequest); err != nil {
         log.Printf("Error parsing chat request: %v", err)
-        http.Error(w, "Error parsing request body", http.StatusBadRequest)
+        respondWithError(w, http.StatusBadRequest, "Error parsing request body")
         return
     }
 
@@ -796,17 +2039,17 @@ func (p *Proxy) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
     chatRequest.Stream = true
     
     // Check for existing session ID in header using consistent header name
-    sessionID := r.Header.Get("session_id")
+    sessionID := r.Header.Get(getSessionHeader())
     log.Printf("Session ID from header: %s", sessionID)
     
     if sessionID != "" {
         sessionCache.RLock()
-        if session, exists := sessionCache.m[sessionID]; exists && time.Now().Before(session.ExpiresAt) {
+        if session, exists := sessionCache.m[sessionID]; exists && now().Before(session.ExpiresAt) {
             sessionCache.RUnlock()
             log.Printf("Using existing session: %s for model %s", sessionID, session.ModelID)
             if err := p.forwardChatRequest(w, r, session.ModelID, chatRequest, sessionID); err != nil {
                 log.Printf("Error forwarding chat request: %v", err)
-                http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusInternalServerError)
+                respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error forwarding request: %v", err))
             }
             return
         }
@@ -818,7 +2061,7 @@ func (p *Proxy) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
     modelID, err := validateModelHandle(chatRequest.Model)
     if err != nil {
         log.Printf("Error validating model handle: %v", err)
-        http.Error(w, fmt.Sprintf("Error finding model ID: %v", err), http.StatusBadRequest)
+        respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Error finding model ID: %v", err))
         return
     }
     log.Printf("Validated model ID: %s", modelID)
@@ -827,21 +2070,21 @@ func (p *Proxy) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
     sessionID, err = p.createSession(modelID)
     if err != nil {
         log.Printf("Error creating session: %v", err)
-        http.Error(w, fmt.Sprintf("Error creating session: %v", err), http.StatusInternalServerError)
+        respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error creating session: %v", err))
         return
     }
     log.Printf("Created new session: %s", sessionID)
 
     if err := p.forwardChatRequest(w, r, modelID, chatRequest, sessionID); err != nil {
         log.Printf("Error forwarding chat request: %v", err)
-        http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusInternalServerError)
+        respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error forwarding request: %v", err))
     }
 }
 
 func (p *Proxy) findModelID(modelHandle string) (string, error) {
     // Check model cache first
     modelCache.RLock()
-    if model, exists := modelCache.m[modelHandle]; exists && time.Since(model.Created) < time.Hour {
+    if model, exists := modelCache.m[modelHandle]; exists && now().Sub(model.Created) < p.cfg.ModelCacheTTL {
         modelCache.RUnlock()
         return model.ModelID, nil
     }
@@ -871,7 +2114,7 @@ func (p *Proxy) findModelID(modelHandle string) (string, error) {
             modelCache.m[modelHandle] = CachedModel{
                 ModelID:   model.Id,
                 ModelName: model.Name,
-                Created:   time.Now(),
+                Created:   now(),
             }
             modelCache.Unlock()
             
@@ -889,13 +2132,10 @@ func (p *Proxy) findModelID(modelHandle string) (string, error) {
 func (p *Proxy) createSession(modelID string) (string, error) {
     log.Printf("Creating new session for model ID: %s", modelID)
     
-    endpoint := fmt.Sprintf("%s/blockchain/models/%s/session", p.getMarketplaceBaseURL(), modelID)
+    endpoint := p.getMarketplaceBaseURL() + fmt.Sprintf(getSessionPathTemplate(), modelID)
     log.Printf("Session creation endpoint: %s", endpoint)
     
-    reqBody := map[string]interface{}{
-        "sessionDuration": sessionExpirationSeconds,
-        "failover": false,
-    }
+    reqBody := newSessionRequestBody(p.cfg.SessionDurationSeconds)
     jsonBody, err := json.Marshal(reqBody)
     if err != nil {
         log.Printf("Error marshaling session request: %v", err)
@@ -949,7 +2189,7 @@ func (p *Proxy) createSession(modelID string) (string, error) {
     sessionCache.m[result.SessionID] = CachedSession{
         SessionID:  result.SessionID,
         ModelID:    modelID,
-        ExpiresAt:  time.Now().Add(time.Duration(sessionExpirationSeconds) * time.Second),
+        ExpiresAt:  now().Add(time.Duration(p.cfg.SessionExpirationSeconds) * time.Second),
     }
     sessionCache.Unlock()
     
@@ -1012,16 +2252,23 @@ func getMatchScore(a, b string) float32 {
 
 type Proxy struct {
 	client *http.Client
+	cfg    Config
 }
 
+// NewProxy returns a Proxy configured from the active configuration
 func NewProxy() *Proxy {
+	return newProxy(config)
+}
+
+func newProxy(cfg Config) *Proxy {
 	return &Proxy{
-		client: &http.Client{},
+		client: newMarketplaceClient(0),
+		cfg:    cfg,
 	}
 }
 
 func (p *Proxy) getMarketplaceBaseURL() string {
-    if url := os.Getenv("MARKETPLACE_URL"); url != "" {
+    if url := p.cfg.MarketplaceURL; url != "" {
         return url
     }
     return "https://consumer-node-yalzemm5uq-uc.a.run.app"
@@ -1049,7 +2296,7 @@ func (p *Proxy) getMarketplaceModels() ([]MarketplaceModel, error) {
         log.Printf("Error reading response body: %v", err)
         return nil, err
     }
-    log.Printf("Raw response body: %s", string(body))
+    log.Printf("Raw response body: %s", formatBodyForLog(body))
 
     if resp.StatusCode != http.StatusOK {
         log.Printf("Received non-200 status code: %d", resp.StatusCode)
@@ -1091,21 +2338,22 @@ func (p *Proxy) forwardChatRequest(w http.ResponseWriter, r *http.Request, model
     // Set required headers
     proxyReq.Header.Set("Content-Type", "application/json")
     proxyReq.Header.Set("Accept", "application/json")
-    proxyReq.Header.Set("session_id", sessionID) // Use consistent session_id header
+    setSessionHeader(proxyReq.Header, sessionID)
 
     // Log request details
     log.Printf("Forwarding request to: %s", endpoint)
-    log.Printf("Request headers: %v", proxyReq.Header)
-    log.Printf("Request body: %s", string(jsonBody))
+    logRequestHeaders(proxyReq.Header)
+    log.Printf("Request body: %s", formatBodyForLog(jsonBody))
 
     // Send the request with increased timeout
-    client := &http.Client{
-        Timeout: time.Minute * 5,
-    }
+    client := newMarketplaceClient(p.cfg.ChatTimeout)
     resp, err := client.Do(proxyReq)
     if err != nil {
         return fmt.Errorf("error sending request: %v", err)
     }
+    if err := checkRedirectResponse(resp); err != nil {
+        return err
+    }
     defer resp.Body.Close()
 
     // Check response status
@@ -1118,6 +2366,7 @@ func (p *Proxy) forwardChatRequest(w http.ResponseWriter, r *http.Request, model
     w.Header().Set("Content-Type", "text/event-stream")
     w.Header().Set("Cache-Control", "no-cache")
     w.Header().Set("Connection", "keep-alive")
+    clearWriteDeadline(w)
     w.WriteHeader(http.StatusOK)
 
     // Stream the response
@@ -1161,9 +2410,13 @@ type Model struct {
 }
 
 // getModels fetches the list of available models from the consumer node
-func getModels() ([]Model, error) {
+func getModels(ctx context.Context) ([]Model, error) {
 	modelsURL := fmt.Sprintf("%s/blockchain/models", consumerNodeURL)
-	resp, err := http.Get(modelsURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create models request: %v", err)
+	}
+	resp, err := newMarketplaceClient(0).Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch models: %v", err)
 	}
@@ -1192,24 +2445,85 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvInt returns an environment variable parsed as a non-negative integer,
+// or defaultValue if it is unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value: %s, using default of %d", key, valueStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvBool returns an environment variable parsed as a boolean, or
+// defaultValue if it is unset or invalid
+func getEnvBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		log.Printf("Invalid %s value: %s, using default of %t", key, valueStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvSettings parses an environment variable of the form
+// "key1=value1,key2=value2", such as a per-model setting keyed by model.
+// Entries without "=" map to an empty value.
+func getEnvSettings(key string) map[string]string {
+	return parseSettings(os.Getenv(key))
+}
+
+// parseSettings parses a comma-separated list of "name=value" pairs
+func parseSettings(list string) map[string]string {
+	settings := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		settings[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return settings
+}
+
+// lookupModelSetting returns the setting for a model by ID, falling back to the
+// handle the client used to name it
+func lookupModelSetting(settings map[string]string, modelID, modelHandle string) (string, bool) {
+	if value, ok := settings[modelID]; ok {
+		return value, true
+	}
+	value, ok := settings[modelHandle]
+	return value, ok
+}
+
 // Add handler for getting models
 func (p *Proxy) handleGetModels(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	marketplaceURL := getMarketplaceModelsEndpoint()
 	req, err := http.NewRequest(http.MethodGet, marketplaceURL, nil)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create request")
 		return
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := newMarketplaceClient(p.cfg.ModelsTimeout)
 	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "Failed to fetch models", http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch models")
 		return
 	}
 	defer resp.Body.Close()
@@ -1225,7 +2539,7 @@ func (p *Proxy) handleModelOperations(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/blockchain/models/"), "/")
 	if len(pathParts) < 1 {
 		log.Printf("Invalid path: %s", r.URL.Path)
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		respondWithError(w, http.StatusBadRequest, "Invalid path")
 		return
 	}
 
@@ -1236,7 +2550,7 @@ func (p *Proxy) handleModelOperations(w http.ResponseWriter, r *http.Request) {
 	req, err := http.NewRequest(r.Method, marketplaceURL, r.Body)
 	if err != nil {
 		log.Printf("Failed to create request: %v", err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create request")
 		return
 	}
 
@@ -1246,13 +2560,13 @@ func (p *Proxy) handleModelOperations(w http.ResponseWriter, r *http.Request) {
 			req.Header.Add(key, value)
 		}
 	}
-	log.Printf("Request headers: %v", req.Header)
+	logRequestHeaders(req.Header)
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := newMarketplaceClient(p.cfg.ModelsTimeout)
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Failed to forward request: %v", err)
-		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Failed to forward request")
 		return
 	}
 	defer resp.Body.Close()
@@ -1260,7 +2574,7 @@ func (p *Proxy) handleModelOperations(w http.ResponseWriter, r *http.Request) {
 	// Log response details
 	body, _ := io.ReadAll(resp.Body)
 	log.Printf("Response status: %d", resp.StatusCode)
-	log.Printf("Response body: %s", string(body))
+	log.Printf("Response body: %s", formatBodyForLog(body))
 
 	copyHeaders(w, resp.Header)
 	w.WriteHeader(resp.StatusCode)
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,6 +19,14 @@ func init() {
 	enableCleanupGoroutine = false
 }
 
+// useMarketplaceURL makes url the active configuration's MarketplaceURL
+// until the returned function is called
+func useMarketplaceURL(url string) func() {
+	previous := config.MarketplaceURL
+	config.MarketplaceURL = url
+	return func() { config.MarketplaceURL = previous }
+}
+
 func TestGetMarketplaceBaseURL(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -34,6 +43,11 @@ func TestGetMarketplaceBaseURL(t *testing.T) {
 			envValue: "",
 			want:     "http://marketplace:9000",
 		},
+		{
+			name:     "trailing slash and path prefix",
+			envValue: "https://gateway.example.com/marketplace/",
+			want:     "https://gateway.example.com/marketplace",
+		},
 	}
 
 	for _, tt := range tests {
@@ -44,6 +58,7 @@ func TestGetMarketplaceBaseURL(t *testing.T) {
 			} else {
 				os.Unsetenv("MARKETPLACE_URL")
 			}
+			defer useMarketplaceURL(loadMarketplaceURL())()
 
 			got := getMarketplaceBaseURL()
 			if got != tt.want {
@@ -53,6 +68,55 @@ func TestGetMarketplaceBaseURL(t *testing.T) {
 	}
 }
 
+func TestParseMarketplaceURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr string
+	}{
+		{raw: "http://marketplace:9000", want: "http://marketplace:9000"},
+		{raw: " http://marketplace:9000/ ", want: "http://marketplace:9000"},
+		{raw: "https://node.example.com/api/v1", want: "https://node.example.com/api/v1"},
+		{raw: "marketplace:9000", wantErr: "scheme must be http or https"},
+		{raw: "ftp://marketplace", wantErr: "scheme must be http or https"},
+		{raw: "http://", wantErr: "missing host"},
+		{raw: "http://marketplace:9000?x=1", wantErr: "query or fragment"},
+		{raw: "http://marketplace:9000/v1/chat/completions", wantErr: "not its /chat/completions endpoint"},
+		{raw: "http://[::1", wantErr: "invalid MARKETPLACE_URL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseMarketplaceURL(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseMarketplaceURL(%q) error = %v, want %q", tt.raw, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseMarketplaceURL(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarketplaceEndpointsFromBaseURL(t *testing.T) {
+	os.Setenv("MARKETPLACE_URL", "http://marketplace:9000/")
+	defer os.Unsetenv("MARKETPLACE_URL")
+	defer useMarketplaceURL(loadMarketplaceURL())()
+
+	if got := getMarketplaceChatEndpoint(); got != "http://marketplace:9000/chat/completions" {
+		t.Errorf("chat endpoint = %s", got)
+	}
+	if got := getMarketplaceEmbeddingsEndpoint(); got != "http://marketplace:9000/embeddings" {
+		t.Errorf("embeddings endpoint = %s", got)
+	}
+	if got := getMarketplaceModelsEndpoint(); got != "http://marketplace:9000/blockchain/models" {
+		t.Errorf("models endpoint = %s", got)
+	}
+}
+
 func TestSessionManager(t *testing.T) {
 	sm := &SessionManager{}
 
@@ -128,11 +192,10 @@ func TestEnsureSession(t *testing.T) {
 	defer server.Close()
 
 	// Set environment variable for test
-	os.Setenv("MARKETPLACE_URL", server.URL)
-	defer os.Unsetenv("MARKETPLACE_URL")
+	defer useMarketplaceURL(server.URL)()
 
 	// Test creating new session
-	err := ensureSession("test-model")
+	err := ensureSession(context.Background(), "test-model")
 	if err != nil {
 		t.Errorf("ensureSession() error = %v", err)
 	}
@@ -160,8 +223,7 @@ func TestFindModelID(t *testing.T) {
 	defer server.Close()
 
 	// Set environment variable for test
-	os.Setenv("MARKETPLACE_URL", server.URL)
-	defer os.Unsetenv("MARKETPLACE_URL")
+	defer useMarketplaceURL(server.URL)()
 
 	tests := []struct {
 		name        string
@@ -217,8 +279,7 @@ func TestProxyChatCompletion(t *testing.T) {
 	defer server.Close()
 
 	// Set environment variable for test
-	os.Setenv("MARKETPLACE_URL", server.URL)
-	defer os.Unsetenv("MARKETPLACE_URL")
+	defer useMarketplaceURL(server.URL)()
 
 	// Create test request
 	reqBody := map[string]interface{}{
@@ -286,8 +347,7 @@ func TestValidateModelHandle(t *testing.T) {
 	defer server.Close()
 
 	// Set environment variable for test
-	os.Setenv("MARKETPLACE_URL", server.URL)
-	defer os.Unsetenv("MARKETPLACE_URL")
+	defer useMarketplaceURL(server.URL)()
 
 	tests := []struct {
 		name    string
@@ -323,6 +383,68 @@ func TestValidateModelHandle(t *testing.T) {
 	}
 }
 
+func TestFindModelIDByName(t *testing.T) {
+	const (
+		llamaID    = "0x1111111111111111111111111111111111111111111111111111111111111111"
+		instructID = "0x2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	var lookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		json.NewEncoder(w).Encode(map[string][]ModelInfo{
+			"models": {
+				{Id: instructID, Name: "llama-3.1-8b-instruct"},
+				{Id: llamaID, Name: "llama-3.1-8b"},
+			},
+		})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	modelCache.Lock()
+	modelCache.m = make(map[string]CachedModel)
+	modelCache.Unlock()
+
+	t.Run("name resolves to ID", func(t *testing.T) {
+		for _, handle := range []string{"llama-3.1-8b", "LLaMA-3.1-8B"} {
+			got, err := findModelID(handle)
+			if err != nil {
+				t.Fatalf("findModelID(%q) error: %v", handle, err)
+			}
+			if got != llamaID {
+				t.Errorf("findModelID(%q) = %s, want %s", handle, got, llamaID)
+			}
+		}
+	})
+
+	t.Run("resolved name is cached", func(t *testing.T) {
+		before := lookups
+		if _, err := findModelID("llama-3.1-8b"); err != nil {
+			t.Fatal(err)
+		}
+		if lookups != before {
+			t.Errorf("Expected cached lookup, marketplace was queried %d more times", lookups-before)
+		}
+	})
+
+	t.Run("ID passes through", func(t *testing.T) {
+		before := lookups
+		unlisted := "0x3333333333333333333333333333333333333333333333333333333333333333"
+		for _, id := range []string{instructID, unlisted} {
+			got, err := findModelID(id)
+			if err != nil {
+				t.Fatalf("findModelID(%q) error: %v", id, err)
+			}
+			if got != id {
+				t.Errorf("findModelID(%q) = %s, want it unchanged", id, got)
+			}
+		}
+		if lookups != before {
+			t.Errorf("Expected no marketplace lookup for IDs, got %d", lookups-before)
+		}
+	})
+}
+
 func TestGetSessionExpirationSeconds(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -373,6 +495,27 @@ func TestGetSessionExpirationSeconds(t *testing.T) {
 	}
 }
 
+func TestGetSessionDurationSeconds(t *testing.T) {
+	tests := []struct {
+		envValue string
+		expected int
+	}{
+		{envValue: "", expected: 3600},
+		{envValue: "1h", expected: 3600},
+		{envValue: "90m", expected: 5400},
+		{envValue: "7200", expected: 7200},
+		{envValue: "30s", expected: 3600},
+		{envValue: "forever", expected: 3600},
+	}
+	for _, tt := range tests {
+		os.Setenv("SESSION_DURATION", tt.envValue)
+		if got := getSessionDurationSeconds(); got != tt.expected {
+			t.Errorf("getSessionDurationSeconds() with %q = %v, want %v", tt.envValue, got, tt.expected)
+		}
+	}
+	os.Unsetenv("SESSION_DURATION")
+}
+
 func TestMin3(t *testing.T) {
 	tests := []struct {
 		a, b, c  int
@@ -394,3 +537,224 @@ func TestMin3(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyChatCompletionInvalidBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantMessage string
+	}{
+		{
+			name:        "empty body",
+			body:        "",
+			wantMessage: "Request body is empty",
+		},
+		{
+			name:        "whitespace body",
+			body:        "  \n",
+			wantMessage: "Request body is empty",
+		},
+		{
+			name:        "malformed json",
+			body:        "{invalid-json",
+			wantMessage: "Invalid request body",
+		},
+		{
+			name:        "null json",
+			body:        "null",
+			wantMessage: "Invalid request body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			ProxyChatCompletion(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status 400, got %v", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantMessage) {
+				t.Errorf("Expected error %q, got %s", tt.wantMessage, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewSessionRequestBodyFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		envValue string
+		want     bool
+	}{
+		{name: "default", envValue: "", want: false},
+		{name: "enabled", envValue: "true", want: true},
+		{name: "disabled", envValue: "false", want: false},
+		{name: "invalid", envValue: "maybe", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SESSION_FAILOVER", tt.envValue)
+			defer os.Unsetenv("SESSION_FAILOVER")
+
+			reqBytes, err := json.Marshal(newSessionRequestBody(3600))
+			if err != nil {
+				t.Fatalf("failed to marshal session request: %v", err)
+			}
+
+			var decoded struct {
+				SessionDuration int  `json:"sessionDuration"`
+				Failover        bool `json:"failover"`
+			}
+			if err := json.Unmarshal(reqBytes, &decoded); err != nil {
+				t.Fatalf("failed to decode session request: %v", err)
+			}
+			if decoded.Failover != tt.want {
+				t.Errorf("failover = %v, want %v (body %s)", decoded.Failover, tt.want, reqBytes)
+			}
+			if decoded.SessionDuration != 3600 {
+				t.Errorf("sessionDuration = %d, want 3600", decoded.SessionDuration)
+			}
+		})
+	}
+}
+
+func TestProxyChatCompletionSessionUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: "unavailable-model", Name: "Unavailable Model"}},
+			})
+		case "/blockchain/models/unavailable-model/session":
+			http.Error(w, `{"error": "no providers available"}`, http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+
+	defer func(delay time.Duration) { baseDelay = delay }(baseDelay)
+	baseDelay = time.Millisecond
+
+	reqBytes := []byte(`{"model": "Unavailable Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(reqBytes))
+	w := httptest.NewRecorder()
+
+	ProxyChatCompletion(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on 503")
+	}
+}
+
+// newMarketplaceServer starts a fake marketplace serving a single model. Chat
+// completion requests are passed to chat.
+func newMarketplaceServer(modelID, modelName string, chat http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{
+				"models": {{Id: modelID, Name: modelName}},
+			})
+		case "/blockchain/models/" + modelID + "/session":
+			json.NewEncoder(w).Encode(map[string]string{
+				"sessionID": modelID + "-session",
+			})
+		case "/chat/completions":
+			chat(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// newChatRequest builds a chat completion request for ProxyChatCompletion
+func newChatRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestProxyChatCompletionUpstreamTimeout(t *testing.T) {
+	server := newMarketplaceServer("slow-model", "Slow Model", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	defer func(timeout time.Duration) { config.ForwardTimeout = timeout }(config.ForwardTimeout)
+	config.ForwardTimeout = 50 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Slow Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status 504, got %v: %s", w.Code, w.Body.String())
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid 504 body: %v", err)
+	}
+	if body.Error.TimeoutMs != 50 {
+		t.Errorf("timeoutMs = %d, want 50", body.Error.TimeoutMs)
+	}
+	if body.Error.WaitedMs < 50 || body.Error.Message == "" {
+		t.Errorf("unexpected timing details: %+v", body.Error)
+	}
+}
+
+func TestGetSessionPathTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		envValue string
+		expected string
+	}{
+		{name: "default", envValue: "", expected: defaultSessionPathTemplate},
+		{name: "custom", envValue: "/v2/models/%s/sessions", expected: "/v2/models/%s/sessions"},
+		{name: "missing leading slash", envValue: "models/%s/session", expected: "/models/%s/session"},
+		{name: "no placeholder", envValue: "/v2/session", expected: defaultSessionPathTemplate},
+		{name: "two placeholders", envValue: "/v2/%s/models/%s", expected: defaultSessionPathTemplate},
+		{name: "other verb", envValue: "/v2/%d/models/%s", expected: defaultSessionPathTemplate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SESSION_PATH", tt.envValue)
+			defer os.Unsetenv("SESSION_PATH")
+
+			if got := getSessionPathTemplate(); got != tt.expected {
+				t.Errorf("getSessionPathTemplate() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEnsureSessionUsesSessionPath(t *testing.T) {
+	var sessionPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		sessionPath = r.URL.Path
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": "staging-session"})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("SESSION_PATH", "/v2/sessions/%s/open")
+	defer os.Unsetenv("SESSION_PATH")
+
+	if err := ensureSession(context.Background(), "staging-model"); err != nil {
+		t.Fatalf("ensureSession() error = %v", err)
+	}
+	if sessionPath != "/v2/sessions/staging-model/open" {
+		t.Errorf("session opened at %s, want /v2/sessions/staging-model/open", sessionPath)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var relayErrors = metrics.counter("morpheus_proxy_relay_errors_total",
+	"Marketplace responses not relayed in full, by cause (client_disconnect, upstream)", "cause")
+
+// errClientGone marks a relay cut short by a failed write to the client,
+// which has gone away, as opposed to a failed read from the marketplace
+var errClientGone = errors.New("client disconnected")
+
+// clientWriter tags errors writing to the client with errClientGone
+type clientWriter struct {
+	w io.Writer
+}
+
+func (cw clientWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", errClientGone, err)
+	}
+	return n, nil
+}
+
+// isClientGone reports whether a relay error for r was caused by its client
+// disconnecting: either a write to it failed, or its context was cancelled,
+// which also fails the marketplace read since that shares the context
+func isClientGone(r *http.Request, err error) bool {
+	return errors.Is(err, errClientGone) || r.Context().Err() != nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNonStreamingRelayAbortsWhenClientDisconnects(t *testing.T) {
+	upstreamCancelled := make(chan struct{})
+	upstream := newMarketplaceServer("gone-model", "Gone Model", func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the proxy hanging up once the body is read
+		io.Copy(io.Discard, r.Body)
+		// Send more than the proxy buffers, so the client sees the response
+		// start before hanging up
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [` + strings.Repeat(" ", 16<<10)))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(upstreamCancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer upstream.Close()
+	defer useMarketplaceURL(upstream.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	server := httptest.NewServer(http.HandlerFunc(ProxyChatCompletion))
+	defer server.Close()
+
+	disconnects, upstreamErrors := relayErrors.Value("client_disconnect"), relayErrors.Value("upstream")
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model": "Gone Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the start of the completion, then hang up
+	if _, err := io.ReadFull(resp.Body, make([]byte, len(`{"choices": [`))); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the marketplace request was not cancelled after the client disconnected")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for relayErrors.Value("client_disconnect")-disconnects != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := relayErrors.Value("client_disconnect") - disconnects; got != 1 {
+		t.Errorf("client disconnects counted = %v, want 1", got)
+	}
+	if got := relayErrors.Value("upstream") - upstreamErrors; got != 0 {
+		t.Errorf("upstream errors counted = %v, want 0", got)
+	}
+}
+
+func TestNonStreamingRelayCountsUpstreamReadError(t *testing.T) {
+	upstream := newMarketplaceServer("short-model", "Short Model", func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than is sent, so the read fails with the client still there
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte(`{"choices": [`))
+	})
+	defer upstream.Close()
+	defer useMarketplaceURL(upstream.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	disconnects, upstreamErrors := relayErrors.Value("client_disconnect"), relayErrors.Value("upstream")
+	ProxyChatCompletion(httptest.NewRecorder(), newChatRequest(`{"model": "Short Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if got := relayErrors.Value("upstream") - upstreamErrors; got != 1 {
+		t.Errorf("upstream errors counted = %v, want 1", got)
+	}
+	if got := relayErrors.Value("client_disconnect") - disconnects; got != 0 {
+		t.Errorf("client disconnects counted = %v, want 0", got)
+	}
+}
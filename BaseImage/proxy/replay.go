@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Exchange is a recorded marketplace request/response pair
+type Exchange struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"` // path and query only, so recordings replay against any host
+	RequestBody  string      `json:"requestBody,omitempty"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	ResponseBody string      `json:"responseBody"`
+}
+
+// configureMarketplaceTransport installs the mock upstream when MOCK_UPSTREAM
+// is on, a replaying transport when MARKETPLACE_REPLAY_FILE is set, or a
+// recording one when MARKETPLACE_RECORD_FILE is set, in that order of
+// precedence. Otherwise the transport uses the upstream TLS settings, if any;
+// an error loading them should stop startup.
+func configureMarketplaceTransport() error {
+	if isMockUpstream() {
+		warnMockUpstream()
+		marketplaceTransport = newMockUpstreamTransport()
+		return nil
+	}
+
+	if path := os.Getenv("MARKETPLACE_REPLAY_FILE"); path != "" {
+		transport, err := loadReplayTransport(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("WARNING: replaying marketplace responses from %s; the marketplace will not be contacted", path)
+		marketplaceTransport = transport
+		return nil
+	}
+
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		return err
+	}
+	if transport != http.DefaultTransport {
+		marketplaceTransport = transport
+	}
+
+	if path := os.Getenv("MARKETPLACE_RECORD_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open record file: %v", err)
+		}
+		log.Printf("WARNING: recording marketplace exchanges to %s; recordings include session IDs and prompts", path)
+		marketplaceTransport = newRecordingTransport(transport, file)
+	}
+	return nil
+}
+
+// recordingTransport passes requests through and appends each exchange to a
+// JSONL recording. Response bodies are buffered in full, including streams.
+type recordingTransport struct {
+	next http.RoundTripper
+	mu   sync.Mutex
+	out  io.Writer
+}
+
+func newRecordingTransport(next http.RoundTripper, out io.Writer) *recordingTransport {
+	return &recordingTransport{next: next, out: out}
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := json.NewEncoder(t.out).Encode(Exchange{
+		Method:       req.Method,
+		URL:          req.URL.RequestURI(),
+		RequestBody:  string(reqBody),
+		Status:       resp.StatusCode,
+		Header:       resp.Header,
+		ResponseBody: string(respBody),
+	}); err != nil {
+		log.Printf("Failed to record marketplace exchange: %v", err)
+	}
+	return resp, nil
+}
+
+// replayTransport serves responses from a recording. Each request is answered
+// by the first unused exchange with the same method and URL, so repeated calls
+// replay in the order they were recorded.
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	used      []bool
+}
+
+func loadReplayTransport(path string) (*replayTransport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay file: %v", err)
+	}
+	defer file.Close()
+
+	t := &replayTransport{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var exchange Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("invalid exchange on line %d of %s: %v", line, path, err)
+		}
+		t.exchanges = append(t.exchanges, exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replay file: %v", err)
+	}
+	t.used = make([]bool, len(t.exchanges))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uri := req.URL.RequestURI()
+	for i, exchange := range t.exchanges {
+		if t.used[i] || exchange.Method != req.Method || exchange.URL != uri {
+			continue
+		}
+		t.used[i] = true
+
+		header := exchange.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-Length", strconv.Itoa(len(exchange.ResponseBody)))
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+			StatusCode:    exchange.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader([]byte(exchange.ResponseBody))),
+			ContentLength: int64(len(exchange.ResponseBody)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded exchange for %s %s", req.Method, uri)
+}
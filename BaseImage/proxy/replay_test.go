@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplayMarketplaceExchange(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"content": "recorded answer"}}]}`))
+	}))
+
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions["replay-model"] = &MorpheusSession{
+		SessionID: "replay-session",
+		ModelID:   "replay-model",
+		Created:   time.Now(),
+	}
+	defer delete(activeSessions, "replay-model")
+	defer func() { marketplaceTransport = nil }()
+
+	recordPath := filepath.Join(t.TempDir(), "exchanges.jsonl")
+	os.Setenv("MARKETPLACE_RECORD_FILE", recordPath)
+	defer os.Unsetenv("MARKETPLACE_RECORD_FILE")
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+
+	forward := func() (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		resp, err := forwardRequest(req, map[string]interface{}{"model": "replay-model"}, "replay-model")
+		if err != nil {
+			t.Fatalf("forwardRequest() error = %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	recordedStatus, recordedBody := forward()
+	server.Close()
+	if calls != 1 {
+		t.Fatalf("expected one upstream call while recording, got %d", calls)
+	}
+
+	os.Unsetenv("MARKETPLACE_RECORD_FILE")
+	os.Setenv("MARKETPLACE_REPLAY_FILE", recordPath)
+	defer os.Unsetenv("MARKETPLACE_REPLAY_FILE")
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+
+	replayedStatus, replayedBody := forward()
+	if replayedStatus != recordedStatus || replayedBody != recordedBody {
+		t.Errorf("replay = (%d, %q), want (%d, %q)", replayedStatus, replayedBody, recordedStatus, recordedBody)
+	}
+	if calls != 1 {
+		t.Errorf("replay contacted the marketplace, calls = %d", calls)
+	}
+
+	// The recording held one exchange, so a second identical request has nothing to replay
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	if _, err := forwardRequest(req, map[string]interface{}{"model": "replay-model"}, "replay-model"); err == nil {
+		t.Error("Expected an error once the recording is exhausted")
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reportedEnvSettings are the settings read from the environment as
+// requests arrive rather than held in Config. The report lists those that
+// are set; the rest take their defaults.
+var reportedEnvSettings = []string{
+	"ADMISSION_MIN_BALANCE",
+	"ALLOWED_MODEL_OVERRIDES",
+	"ALLOWED_PROVIDER_OVERRIDES",
+	"API_KEY",
+	"BATCH_MAX_SIZE",
+	"BATCH_TIMEOUT_SECONDS",
+	"CLIENT_SYSTEM_PROMPT_POLICY",
+	"CONSUMER_NODE_URL",
+	"DEFAULT_PORT",
+	"DEFAULT_TEMPERATURE",
+	"DEFAULT_TOP_P",
+	"DOUBLE_ENCODED_BODY_POLICY",
+	"EMBEDDING_MODEL_ID",
+	"FALLBACK_MODEL_ID",
+	"FORWARD_HEADERS",
+	"INJECT_SYSTEM_PROMPT",
+	"LOG_BODY_MAX_BYTES",
+	"LOG_REQUEST_HEADERS",
+	"MARKETPLACE_RECORD_FILE",
+	"MARKETPLACE_REDIRECT_POLICY",
+	"MARKETPLACE_REPLAY_FILE",
+	"MAX_TEMPERATURE",
+	"MAX_TOKENS_CAP",
+	"MAX_TOKENS_POLICY",
+	"MAX_TOP_P",
+	"MIN_WALLET_BALANCE",
+	"MOCK_UPSTREAM",
+	"MOCK_UPSTREAM_MODELS",
+	"MOCK_UPSTREAM_REPLY",
+	"MODEL_ALIASES",
+	"MODEL_ID",
+	"MODEL_MAX_OUTPUT_TOKENS",
+	"MODEL_PRICING",
+	"MODEL_RETRY_POLICIES",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+	"PORT",
+	"REQUEST_FIELD_ALLOWLIST",
+	"REQUEST_FIELD_DENYLIST",
+	"REQUEST_FIELD_POLICY",
+	"RETRYABLE_ERROR_SUBSTRINGS",
+	"SESSION_ESTABLISHING_POLICY",
+	"SESSION_ESTABLISHING_TIMEOUT_MS",
+	"SESSION_FAILOVER",
+	"SESSION_HEADER_NAME",
+	"SESSION_PATH",
+	"SESSION_RETRY_AFTER_SECONDS",
+	"SESSION_SUCCESS_CRITERIA",
+	"SSE_MAX_EVENT_BYTES",
+	"SSE_NORMALIZE_LINE_ENDINGS",
+	"STREAMING_DISABLED_MODELS",
+	"STREAM_ACCEPT_POLICY",
+	"STREAM_COALESCE_BYTES",
+	"STREAM_COALESCE_DELAY_MS",
+	"STREAM_KEEPALIVE_INTERVAL_MS",
+	"STREAM_PREFETCH_CHUNKS",
+	"TOOLS_UNSUPPORTED_MODELS",
+	"UPSTREAM_CA_CERT",
+	"UPSTREAM_CLIENT_CERT",
+	"UPSTREAM_CLIENT_KEY",
+	"UPSTREAM_HEADERS",
+	"UPSTREAM_INSECURE_SKIP_VERIFY",
+	"UPSTREAM_PROVIDER_HEADER",
+	"WALLET_ADDRESS",
+	"WALLET_ADDRESSES",
+	"WALLET_BALANCE_CACHE_SECONDS",
+	"WALLET_BALANCE_CHECK",
+	"WALLET_BALANCE_URL",
+	"WARM_SESSION",
+}
+
+// redactedValue replaces secrets in the report
+const redactedValue = "[redacted]"
+
+// ConfigReport is the effective configuration, with secrets redacted, as
+// logged at startup
+type ConfigReport struct {
+	// Config holds every Config field by name
+	Config map[string]string `json:"config"`
+	// Environment holds the per-request settings that are set
+	Environment map[string]string `json:"environment"`
+}
+
+// NewConfigReport reports cfg and the per-request settings currently set
+func NewConfigReport(cfg Config) ConfigReport {
+	report := ConfigReport{Config: make(map[string]string), Environment: make(map[string]string)}
+
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		report.Config[name] = redactSetting(name, fmt.Sprint(value.Field(i).Interface()))
+	}
+	for _, name := range reportedEnvSettings {
+		if setting, ok := os.LookupEnv(name); ok {
+			report.Environment[name] = redactSetting(name, setting)
+		}
+	}
+	return report
+}
+
+// redactSetting hides secrets: keys and tokens entirely, wallets but for
+// a prefix and suffix, and credentials and query strings in URLs
+func redactSetting(name, value string) string {
+	upper := strings.ToUpper(name)
+	switch {
+	case value == "":
+		return value
+	case strings.Contains(upper, "KEY") || strings.Contains(upper, "TOKEN") ||
+		strings.Contains(upper, "SECRET") || strings.Contains(upper, "PASSWORD"):
+		return redactedValue
+	case upper == "UPSTREAM_HEADERS":
+		// Header values may be credentials
+		headers := parseSettings(value)
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = name + "=" + redactHeaderValue(name, headers[name])
+		}
+		return strings.Join(names, ",")
+	case strings.HasPrefix(upper, "WALLET_ADDRESS"):
+		wallets := strings.Split(value, ",")
+		for i, wallet := range wallets {
+			wallets[i] = redactWallet(strings.TrimSpace(wallet))
+		}
+		return strings.Join(wallets, ",")
+	case strings.HasSuffix(upper, "URL") || strings.HasSuffix(upper, "ENDPOINT"):
+		return redactURL(value)
+	}
+	return value
+}
+
+// redactHeaderValue hides the value of a header that carries credentials
+func redactHeaderValue(name, value string) string {
+	upper := strings.ToUpper(name)
+	if redactedHeaders[strings.ToLower(name)] || strings.Contains(upper, "AUTH") || strings.Contains(upper, "COOKIE") {
+		return redactedValue
+	}
+	return redactSetting(name, value)
+}
+
+// redactURL drops the password and query values from a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedValue
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query.Set(key, "xxxxx")
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// logConfigReport logs the effective configuration once, as JSON
+func logConfigReport(cfg Config) {
+	report, err := json.Marshal(NewConfigReport(cfg))
+	if err != nil {
+		log.Printf("Failed to report configuration: %v", err)
+		return
+	}
+	log.Printf("Effective configuration: %s", report)
+}
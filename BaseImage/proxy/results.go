@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestResult is the outcome of one chat completion request, published
+// once its response has been written
+type RequestResult struct {
+	RequestID string
+	// Model is the model handle the client asked for and ModelID the
+	// marketplace model that served it; ModelID is empty if the request
+	// failed before the model was resolved
+	Model   string
+	ModelID string
+	Stream  bool
+	Status  int
+	Latency time.Duration
+	// Token counts are taken from the response's usage object and are 0
+	// when the upstream did not report one
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	// PromptHash is a truncated SHA-256 of the request's messages, empty
+	// if the request was refused before they were read
+	PromptHash string
+	// Error is the message of an error response
+	Error string
+}
+
+// resultTailSize bounds how much of a response body is kept to find its
+// usage or error, and how long a stream's line may be
+const resultTailSize = 64 << 10
+
+var resultsDropped = metrics.counter("morpheus_proxy_results_dropped_total",
+	"Request results dropped because the results channel was full")
+
+var results struct {
+	sync.RWMutex
+	ch chan<- RequestResult
+}
+
+// SetResults sets the channel each completed chat request's outcome is
+// published to and returns the previous one; nil stops publishing. Sends
+// never block: when ch is full the result is dropped and counted, so its
+// capacity bounds how far a slow reader may fall behind.
+func SetResults(ch chan<- RequestResult) chan<- RequestResult {
+	results.Lock()
+	defer results.Unlock()
+	previous := results.ch
+	results.ch = ch
+	return previous
+}
+
+func getResults() chan<- RequestResult {
+	results.RLock()
+	defer results.RUnlock()
+	return results.ch
+}
+
+// resultWriter records the status and the tail of a response so its outcome
+// can be published when the request completes. Its setters are no-ops on a
+// nil writer, which is used while publishing, auditing and usage accounting
+// are all off.
+type resultWriter struct {
+	http.ResponseWriter
+	ch     chan<- RequestResult
+	audit  AuditLogger
+	usage  bool
+	start  time.Time
+	result RequestResult
+	tail   responseTail
+}
+
+// trackResult wraps w to publish the request's outcome, write it to the
+// audit log and tally its usage, or returns nil if there is no results
+// channel, no audit logger and usage accounting is off
+func trackResult(w http.ResponseWriter, requestID string) *resultWriter {
+	ch, audit := getResults(), getAuditLogger()
+	if ch == nil && audit == nil && !config.UsageAccounting {
+		return nil
+	}
+	return &resultWriter{
+		ResponseWriter: w,
+		ch:             ch,
+		audit:          audit,
+		usage:          config.UsageAccounting,
+		start:          now(),
+		result:         RequestResult{RequestID: requestID},
+	}
+}
+
+func (rw *resultWriter) setModel(model, modelID string) {
+	if rw != nil {
+		rw.result.Model, rw.result.ModelID = model, modelID
+	}
+}
+
+func (rw *resultWriter) setPromptHash(hash string) {
+	if rw != nil {
+		rw.result.PromptHash = hash
+	}
+}
+
+func (rw *resultWriter) setStream(stream bool) {
+	if rw != nil {
+		rw.result.Stream = stream
+	}
+}
+
+func (rw *resultWriter) WriteHeader(code int) {
+	if rw.result.Status == 0 {
+		rw.result.Status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *resultWriter) Write(p []byte) (int, error) {
+	if rw.result.Status == 0 {
+		rw.result.Status = http.StatusOK
+	}
+	rw.tail.write(rw.Header(), p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *resultWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *resultWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// publish completes the result from the recorded response and sends it, and
+// its audit record, without blocking, and tallies its usage
+func (rw *resultWriter) publish() {
+	result := rw.result
+	result.Latency = now().Sub(rw.start)
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	// A fallback may have served the request in place of the resolved model
+	if served := rw.Header().Get(servedModelHeader); served != "" {
+		result.ModelID = served
+	}
+	rw.tail.parse(&result)
+	if result.Status >= 400 && result.Error == "" {
+		result.Error = http.StatusText(result.Status)
+	}
+
+	if rw.usage {
+		recordUsage(result)
+	}
+	if rw.audit != nil {
+		rw.audit.Log(newAuditRecord(result))
+	}
+	if rw.ch == nil {
+		return
+	}
+	select {
+	case rw.ch <- result:
+	default:
+		resultsDropped.Inc()
+	}
+}
+
+// responseTail follows a response body for its usage and error, both of
+// which come at its end, without holding all of it. The lines of an SSE or
+// NDJSON stream are parsed as they are written, where the last usage
+// reported wins; of any other body only the last resultTailSize bytes are
+// kept, in a ring.
+type responseTail struct {
+	started bool
+	stream  bool // parsed line by line
+	ndjson  bool // every line is an object, not only the data: lines
+	gzipped bool
+
+	ring    []byte
+	next    int  // where the ring's oldest byte is, once it is full
+	wrapped bool // the body outgrew the ring
+
+	line     []byte // the stream's unfinished line
+	skipping bool   // that line outgrew resultTailSize and is dropped
+	found    RequestResult
+}
+
+// write records p, written to a response with header
+func (t *responseTail) write(header http.Header, p []byte) {
+	if !t.started {
+		t.started = true
+		t.gzipped = header.Get("Content-Encoding") == "gzip"
+		t.ndjson = isNDJSONStream(header)
+		t.stream = !t.gzipped && (t.ndjson || strings.HasPrefix(header.Get("Content-Type"), "text/event-stream"))
+	}
+	if t.stream {
+		t.writeLines(p)
+		return
+	}
+
+	if len(p) >= resultTailSize {
+		t.wrapped = t.wrapped || len(t.ring) > 0 || len(p) > resultTailSize
+		t.ring = append(t.ring[:0], p[len(p)-resultTailSize:]...)
+		t.next = 0
+		return
+	}
+	if room := resultTailSize - len(t.ring); room > 0 {
+		n := len(p)
+		if n > room {
+			n = room
+		}
+		t.ring = append(t.ring, p[:n]...)
+		p = p[n:]
+	}
+	for len(p) > 0 {
+		t.wrapped = true
+		n := copy(t.ring[t.next:], p)
+		p = p[n:]
+		t.next = (t.next + n) % resultTailSize
+	}
+}
+
+// writeLines parses each line of a stream completed by p
+func (t *responseTail) writeLines(p []byte) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.bufferLine(p)
+			return
+		}
+		if len(t.line) == 0 && !t.skipping {
+			t.parseLine(p[:i])
+		} else {
+			t.bufferLine(p[:i])
+			if !t.skipping {
+				t.parseLine(t.line)
+			}
+			t.line, t.skipping = t.line[:0], false
+		}
+		p = p[i+1:]
+	}
+}
+
+// bufferLine holds part of an unfinished line, dropping the line once it
+// grows past resultTailSize
+func (t *responseTail) bufferLine(p []byte) {
+	if t.skipping {
+		return
+	}
+	if len(t.line)+len(p) > resultTailSize {
+		t.line, t.skipping = t.line[:0], true
+		return
+	}
+	t.line = append(t.line, p...)
+}
+
+func (t *responseTail) parseLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+		line = bytes.TrimSpace(data)
+	} else if !t.ndjson {
+		return
+	}
+	if isStreamDone(string(line)) {
+		return
+	}
+	applyResultPayload(line, &t.found)
+}
+
+// parse fills in the usage and error message found in the response
+func (t *responseTail) parse(result *RequestResult) {
+	if t.stream {
+		if !t.skipping {
+			t.parseLine(t.line)
+		}
+		t.line, t.skipping = t.line[:0], false
+		result.PromptTokens = t.found.PromptTokens
+		result.CompletionTokens = t.found.CompletionTokens
+		result.TotalTokens = t.found.TotalTokens
+		if t.found.Error != "" {
+			result.Error = t.found.Error
+		}
+		return
+	}
+
+	body := append(t.ring[t.next:len(t.ring):len(t.ring)], t.ring[:t.next]...)
+	// A gzipped body can only be read if the ring holds all of it
+	if t.gzipped {
+		if t.wrapped {
+			return
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		if body, err = io.ReadAll(gz); err != nil {
+			return
+		}
+	}
+	if !applyResultPayload(body, result) {
+		applyLastUsage(body, result)
+	}
+}
+
+// resultUsage is a response's usage object
+type resultUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u resultUsage) apply(result *RequestResult) {
+	result.PromptTokens = u.PromptTokens
+	result.CompletionTokens = u.CompletionTokens
+	result.TotalTokens = u.TotalTokens
+}
+
+// applyResultPayload fills in the usage and error message of a JSON object,
+// and reports whether it parsed
+func applyResultPayload(data []byte, result *RequestResult) bool {
+	var payload struct {
+		Usage *resultUsage `json:"usage"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &payload) != nil {
+		return false
+	}
+	if payload.Usage != nil {
+		payload.Usage.apply(result)
+	}
+	if payload.Error != nil {
+		result.Error = payload.Error.Message
+	}
+	return true
+}
+
+// applyLastUsage fills in the usage from the last "usage" member in the
+// tail of a JSON body too long for the tail to parse whole. The key cannot
+// occur unescaped within a string, so only the member itself matches.
+func applyLastUsage(tail []byte, result *RequestResult) {
+	i := bytes.LastIndex(tail, []byte(`"usage"`))
+	if i < 0 {
+		return
+	}
+	rest, ok := bytes.CutPrefix(bytes.TrimLeft(tail[i+len(`"usage"`):], " \t\r\n"), []byte(":"))
+	if !ok {
+		return
+	}
+	var usage resultUsage
+	if json.NewDecoder(bytes.NewReader(rest)).Decode(&usage) == nil {
+		usage.apply(result)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestResultsPublished(t *testing.T) {
+	server := newMarketplaceServer("results-model", "Results Model", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if decodeBody(t, string(body))["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hi\"}, \"finish_reason\": \"stop\"}]}\n\n" +
+				"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 3, \"completion_tokens\": 1, \"total_tokens\": 4}}\n\n" +
+				"data: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [], "usage": {"prompt_tokens": 5, "completion_tokens": 7, "total_tokens": 12}}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	ch := make(chan RequestResult, 3)
+	defer SetResults(SetResults(ch))
+
+	// The truncated SHA-256 of the messages sent by both successful requests
+	const helloPromptHash = "013cf0c05f083773"
+
+	tests := []struct {
+		name string
+		body string
+		want RequestResult
+	}{
+		{
+			name: "non-streaming",
+			body: `{"model": "Results Model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			want: RequestResult{Model: "Results Model", ModelID: "results-model", Status: http.StatusOK, PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12, PromptHash: helloPromptHash},
+		},
+		{
+			name: "streaming",
+			body: `{"model": "Results Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`,
+			want: RequestResult{Model: "Results Model", ModelID: "results-model", Stream: true, Status: http.StatusOK, PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4, PromptHash: helloPromptHash},
+		},
+		{
+			name: "error",
+			body: `{"messages": [{"role": "user", "content": "Hello"}]}`,
+			want: RequestResult{Status: http.StatusBadRequest, Error: "model field is required"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(tt.body))
+
+			var got RequestResult
+			select {
+			case got = <-ch:
+			default:
+				t.Fatal("no result published")
+			}
+			if got.RequestID == "" || got.Latency <= 0 {
+				t.Errorf("result missing request ID or latency: %+v", got)
+			}
+			got.RequestID, got.Latency = "", 0
+			if got != tt.want {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestResultsDroppedWhenFull(t *testing.T) {
+	ch := make(chan RequestResult) // never read
+	defer SetResults(SetResults(ch))
+
+	before := resultsDropped.Value()
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"messages": []}`))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %v, want 400", w.Code)
+	}
+	if got := resultsDropped.Value() - before; got != 1 {
+		t.Errorf("dropped results = %v, want 1", got)
+	}
+}
+
+func TestResponseTail(t *testing.T) {
+	const usage = `"usage": {"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5}`
+	long := strings.Repeat("x", 2*resultTailSize)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "JSON body",
+			contentType: "application/json",
+			body:        `{"choices": [], ` + usage + `}`,
+		},
+		{
+			name:        "JSON body longer than the tail",
+			contentType: "application/json",
+			body:        `{"choices": [{"message": {"content": "` + long + `"}}], ` + usage + `}`,
+		},
+		{
+			name:        "SSE stream with an event longer than the tail",
+			contentType: "text/event-stream",
+			body: `data: {"choices": [{"delta": {"content": "` + long + `"}}]}` + "\n\n" +
+				`data: {"choices": [], ` + usage + `}` + "\n\ndata: [DONE]\n\n",
+		},
+		{
+			name:        "NDJSON stream",
+			contentType: "application/x-ndjson",
+			body: `{"choices": [{"delta": {"content": "Hi"}, "finish_reason": "stop"}]}` + "\n" +
+				`{"choices": [], ` + usage + `}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Content-Type": {tt.contentType}}
+			var tail responseTail
+			// Written in pieces that split lines and objects
+			for body := tt.body; body != ""; {
+				n := len(body)
+				if n > 1000 {
+					n = 1000
+				}
+				tail.write(header, []byte(body[:n]))
+				body = body[n:]
+			}
+
+			var result RequestResult
+			tail.parse(&result)
+			if result.PromptTokens != 3 || result.CompletionTokens != 2 || result.TotalTokens != 5 {
+				t.Errorf("usage = %d/%d/%d, want 3/2/5", result.PromptTokens, result.CompletionTokens, result.TotalTokens)
+			}
+			if len(tail.ring) > resultTailSize || len(tail.line) > resultTailSize {
+				t.Errorf("tail holds %d bytes of body and %d of line, want at most %d", len(tail.ring), len(tail.line), resultTailSize)
+			}
+		})
+	}
+}
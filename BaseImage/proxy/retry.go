@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrRetriesExhausted marks failures that persisted through every retry, as
+// opposed to a first attempt failing, so a marketplace that is down can be
+// told from one that blipped. It wraps the last attempt's cause.
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+var retriesExhausted = metrics.counter("morpheus_proxy_retries_exhausted_total",
+	"Operations that failed after exhausting their retries, by operation (session, forward, embeddings)", "operation")
+
+// retriesExhaustedCode is the error code clients see when the proxy gave up
+// retrying the marketplace
+const retriesExhaustedCode = "retries_exhausted"
+
+// respondRetriesExhausted answers a request whose marketplace calls failed on
+// every retry with a 503 the client may retry later
+func respondRetriesExhausted(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(getSessionRetryAfterSeconds()))
+	apiErr := newAPIError(http.StatusServiceUnavailable, "Marketplace still unavailable after retries")
+	code := retriesExhaustedCode
+	apiErr.Code = &code
+	writeAPIError(w, http.StatusServiceUnavailable, apiErr)
+}
+
+// getRetryableErrorSubstrings returns RETRYABLE_ERROR_SUBSTRINGS, a
+// comma-separated list of phrases marking a marketplace error response as
+// transient (e.g. "provider busy"). They are matched case-insensitively.
+func getRetryableErrorSubstrings() []string {
+	var substrings []string
+	for _, s := range strings.Split(os.Getenv("RETRYABLE_ERROR_SUBSTRINGS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			substrings = append(substrings, strings.ToLower(s))
+		}
+	}
+	return substrings
+}
+
+// isRetryableUpstreamError reports whether a marketplace error body contains
+// one of the configured retryable substrings
+func isRetryableUpstreamError(body []byte) bool {
+	lower := strings.ToLower(string(body))
+	for _, s := range getRetryableErrorSubstrings() {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientTransportError reports whether sending a request failed on a
+// connection that was refused, reset or closed, as happens while a provider
+// fails over. Timeouts and cancelled requests are not transient.
+func isTransientTransportError(err error) bool {
+	if isTimeout(err) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// isTransientStatus reports whether a marketplace status is worth retrying
+// the request for: a gateway error or a provider briefly unavailable. Client
+// errors never are.
+func isTransientStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
+// retryPolicy is how many attempts a marketplace call gets, and the delay
+// before the first retry, which doubles with each further one
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// backoff returns the delay before the given attempt, counting from 1
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	return p.baseDelay * time.Duration(1<<uint(attempt-1))
+}
+
+// getRetryPolicy returns the retry policy for a model. MODEL_RETRY_POLICIES,
+// e.g. "llama-3=5:500ms,mistral=2", gives models, by ID or name, their own
+// number of attempts and optionally base delay; others use maxRetries and
+// baseDelay.
+func getRetryPolicy(modelID, modelHandle string) retryPolicy {
+	policy := retryPolicy{maxRetries: maxRetries, baseDelay: baseDelay}
+	value, ok := lookupModelSetting(getEnvSettings("MODEL_RETRY_POLICIES"), modelID, modelHandle)
+	if !ok {
+		return policy
+	}
+
+	attempts, delay, hasDelay := strings.Cut(value, ":")
+	n, err := strconv.Atoi(strings.TrimSpace(attempts))
+	if err != nil || n <= 0 {
+		log.Printf("Invalid MODEL_RETRY_POLICIES value for %s: %s, using default of %d attempts", modelID, value, maxRetries)
+		return policy
+	}
+	policy.maxRetries = n
+	if hasDelay {
+		d, err := time.ParseDuration(strings.TrimSpace(delay))
+		if err != nil || d < 0 {
+			log.Printf("Invalid MODEL_RETRY_POLICIES delay for %s: %s, using default of %v", modelID, delay, baseDelay)
+			return policy
+		}
+		policy.baseDelay = d
+	}
+	return policy
+}
@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryableUpstreamErrors(t *testing.T) {
+	os.Setenv("RETRYABLE_ERROR_SUBSTRINGS", "provider busy, try again")
+	defer os.Unsetenv("RETRYABLE_ERROR_SUBSTRINGS")
+	defer func(delay time.Duration) { baseDelay = delay }(baseDelay)
+	baseDelay = time.Millisecond
+	// Only the substrings decide here, not the 502 itself
+	cfg := config
+	defer applyConfig(cfg)
+	noTransient := cfg
+	noTransient.ForwardRetries = 0
+	applyConfig(noTransient)
+
+	tests := []struct {
+		name      string
+		errorBody string
+		wantCalls int
+		wantCode  int
+	}{
+		{"matching error is retried", `{"error": "Provider Busy, please wait"}`, 2, http.StatusOK},
+		{"other error is not retried", `{"error": "model not supported"}`, 1, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := newMarketplaceServer("retry-model", "Retry Model", func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					http.Error(w, tt.errorBody, http.StatusBadGateway)
+					return
+				}
+				w.Write([]byte(`{"choices": []}`))
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Retry Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if calls != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRetryableUpstreamErrorGivesUp(t *testing.T) {
+	os.Setenv("RETRYABLE_ERROR_SUBSTRINGS", "provider busy")
+	defer os.Unsetenv("RETRYABLE_ERROR_SUBSTRINGS")
+	defer func(delay time.Duration) { baseDelay = delay }(baseDelay)
+	baseDelay = time.Millisecond
+
+	calls := 0
+	server := newMarketplaceServer("busy-model", "Busy Model", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, `{"error": "provider busy"}`, http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	before := retriesExhausted.Value("forward")
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Busy Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if calls != maxRetries {
+		t.Errorf("upstream calls = %d, want %d", calls, maxRetries)
+	}
+	assertRetriesExhaustedResponse(t, w)
+	if got := retriesExhausted.Value("forward") - before; got != 1 {
+		t.Errorf("forward retries exhausted count = %v, want 1", got)
+	}
+}
+
+func TestFirstFailureIsNotRetriesExhausted(t *testing.T) {
+	server := newMarketplaceServer("blip-model", "Blip Model", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "provider busy"}`, http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	before := retriesExhausted.Value("forward")
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Blip Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if strings.Contains(w.Body.String(), retriesExhaustedCode) {
+		t.Errorf("unretried failure reported as retries exhausted: %s", w.Body.String())
+	}
+	if got := retriesExhausted.Value("forward") - before; got != 0 {
+		t.Errorf("forward retries exhausted count = %v, want 0", got)
+	}
+}
+
+func TestSessionRetriesExhausted(t *testing.T) {
+	defer func(delay time.Duration) { baseDelay = delay }(baseDelay)
+	baseDelay = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: "down-model", Name: "Down Model"}}})
+			return
+		}
+		http.Error(w, "provider offline", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionMutex.Unlock()
+
+	before := retriesExhausted.Value("session")
+	err := ensureSession(context.Background(), "down-model")
+	if !errors.Is(err, ErrRetriesExhausted) || !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("ensureSession() error = %v, want ErrRetriesExhausted and ErrUpstreamUnavailable", err)
+	}
+	if !strings.Contains(err.Error(), "provider offline") {
+		t.Errorf("error does not carry the last cause: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Down Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	assertRetriesExhaustedResponse(t, w)
+	if got := retriesExhausted.Value("session") - before; got != 2 {
+		t.Errorf("session retries exhausted count = %v, want 2", got)
+	}
+}
+
+func assertRetriesExhaustedResponse(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %v, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After")
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error body %q: %v", w.Body.String(), err)
+	}
+	if resp.Error.Code == nil || *resp.Error.Code != retriesExhaustedCode {
+		t.Errorf("error code = %v, want %s", resp.Error.Code, retriesExhaustedCode)
+	}
+}
+
+func TestGetRetryPolicy(t *testing.T) {
+	defer func(retries int, delay time.Duration) { maxRetries, baseDelay = retries, delay }(maxRetries, baseDelay)
+	maxRetries, baseDelay = 3, time.Second
+	os.Setenv("MODEL_RETRY_POLICIES", "steady=5:250ms,flaky=1,Named Model=4,bad=zero,slow=2:never")
+	defer os.Unsetenv("MODEL_RETRY_POLICIES")
+
+	tests := []struct {
+		modelID, handle string
+		want            retryPolicy
+	}{
+		{"steady", "", retryPolicy{5, 250 * time.Millisecond}},
+		{"flaky", "", retryPolicy{1, time.Second}},
+		{"named-id", "Named Model", retryPolicy{4, time.Second}},
+		{"bad", "", retryPolicy{3, time.Second}},
+		{"slow", "", retryPolicy{2, time.Second}},
+		{"other", "", retryPolicy{3, time.Second}},
+	}
+	for _, tt := range tests {
+		if got := getRetryPolicy(tt.modelID, tt.handle); got != tt.want {
+			t.Errorf("getRetryPolicy(%q, %q) = %+v, want %+v", tt.modelID, tt.handle, got, tt.want)
+		}
+	}
+}
+
+func TestModelRetryPolicy(t *testing.T) {
+	os.Setenv("RETRYABLE_ERROR_SUBSTRINGS", "provider busy")
+	defer os.Unsetenv("RETRYABLE_ERROR_SUBSTRINGS")
+	os.Setenv("MODEL_RETRY_POLICIES", "patient-model=5:1ms")
+	defer os.Unsetenv("MODEL_RETRY_POLICIES")
+	defer func(delay time.Duration) { baseDelay = delay }(baseDelay)
+	baseDelay = time.Millisecond
+
+	tests := []struct {
+		modelID, name string
+		wantCalls     int
+	}{
+		{"patient-model", "Patient Model", 5},
+		{"default-model", "Default Model", maxRetries},
+	}
+	cfg := config
+	defer applyConfig(cfg)
+	for _, tt := range tests {
+		t.Run(tt.modelID, func(t *testing.T) {
+			// Each run fails every forward, enough to trip a shared breaker
+			applyConfig(cfg)
+			calls := 0
+			server := newMarketplaceServer(tt.modelID, tt.name, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				http.Error(w, `{"error": "provider busy"}`, http.StatusServiceUnavailable)
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "`+tt.name+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if calls != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.wantCalls)
+			}
+			assertRetriesExhaustedResponse(t, w)
+		})
+	}
+}
+
+func TestModelRetryPolicyForSessions(t *testing.T) {
+	os.Setenv("MODEL_RETRY_POLICIES", "brittle-model=2:1ms")
+	defer os.Unsetenv("MODEL_RETRY_POLICIES")
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: "brittle-model", Name: "Brittle Model"}}})
+			return
+		}
+		attempts++
+		http.Error(w, "provider offline", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionMutex.Unlock()
+
+	if err := ensureSession(context.Background(), "brittle-model"); !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("ensureSession() error = %v, want ErrRetriesExhausted", err)
+	}
+	if attempts != 2 {
+		t.Errorf("session attempts = %d, want 2", attempts)
+	}
+}
+
+// resetConnection drops the client's connection with a TCP reset, as a
+// provider failing over does
+func resetConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Errorf("hijack failed: %v", err)
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func TestForwardRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    bool
+		fail      func(t *testing.T, w http.ResponseWriter)
+		failures  int
+		wantCalls int
+		wantCode  int
+	}{
+		{
+			name:      "connection reset after sending is not retried",
+			fail:      resetConnection,
+			failures:  1,
+			wantCalls: 1,
+			wantCode:  http.StatusInternalServerError,
+		},
+		{
+			name: "gateway timeouts then success",
+			fail: func(t *testing.T, w http.ResponseWriter) {
+				http.Error(w, `{"error": "upstream timed out"}`, http.StatusGatewayTimeout)
+			},
+			failures:  2,
+			wantCalls: 3,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name: "gives up after the configured retries",
+			fail: func(t *testing.T, w http.ResponseWriter) {
+				http.Error(w, `{"error": "bad gateway"}`, http.StatusBadGateway)
+			},
+			failures:  3,
+			wantCalls: 3,
+			wantCode:  http.StatusBadGateway,
+		},
+		{
+			name: "client error is not retried",
+			fail: func(t *testing.T, w http.ResponseWriter) {
+				http.Error(w, `{"error": "bad request"}`, http.StatusBadRequest)
+			},
+			failures:  1,
+			wantCalls: 1,
+			wantCode:  http.StatusBadRequest,
+		},
+		{
+			name:      "stream is not retried",
+			stream:    true,
+			fail:      resetConnection,
+			failures:  1,
+			wantCalls: 1,
+			wantCode:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config
+			defer applyConfig(cfg)
+			retrying := cfg
+			retrying.ForwardRetries = 2
+			retrying.ForwardRetryDelay = time.Millisecond
+			applyConfig(retrying)
+
+			var calls atomic.Int32
+			server := newMarketplaceServer("transient-model", "Transient Model", func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				if int(calls.Add(1)) <= tt.failures {
+					tt.fail(t, w)
+					return
+				}
+				w.Write([]byte(`{"choices": []}`))
+			})
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+
+			body := `{"model": "Transient Model", "messages": [{"role": "user", "content": "Hello"}]}`
+			if tt.stream {
+				body = `{"model": "Transient Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+			}
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(body))
+
+			if got := int(calls.Load()); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+// refusingTransport refuses the first n chat requests before sending any of
+// them, as a provider's closed port does while it fails over
+type refusingTransport struct {
+	next    http.RoundTripper
+	n       int32
+	refused atomic.Int32
+}
+
+func (t *refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/chat/completions") && t.refused.Add(1) <= t.n {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func TestForwardRetriesRefusedConnection(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	retrying := cfg
+	retrying.ForwardRetries = 2
+	retrying.ForwardRetryDelay = time.Millisecond
+	applyConfig(retrying)
+
+	var calls atomic.Int32
+	server := newMarketplaceServer("refused-model", "Refused Model", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(transport http.RoundTripper) { marketplaceTransport = transport }(marketplaceTransport)
+	refusing := &refusingTransport{next: http.DefaultTransport, n: 1}
+	marketplaceTransport = refusing
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Refused Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusOK || calls.Load() != 1 || refusing.refused.Load() != 2 {
+		t.Errorf("status = %v after %d chat attempts, %d served, want 200 on the retry after one refusal", w.Code, refusing.refused.Load(), calls.Load())
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newServer returns the HTTP server for handler on addr with cfg's timeouts.
+//
+// The write timeout runs from the end of the request headers to the end of
+// the response, so on its own it would cut off any stream outlasting it.
+// Streaming handlers therefore call clearWriteDeadline as the stream starts;
+// a stream is then bounded by FORWARD_BODY_TIMEOUT_SECONDS on the upstream
+// side instead. A handler added later that streams must do the same, and a
+// writer wrapping the ResponseWriter must implement Unwrap for it to work.
+func newServer(addr string, handler http.Handler, cfg Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+}
+
+// withMethods serves next for the given methods only. OPTIONS is answered
+// with the allowed methods and HEAD with the headers a request would get,
+// without a body, for clients that probe an endpoint before using it; any
+// other method gets a 405. CORS preflights are answered by withCORS first.
+func withMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(append(methods, http.MethodHead, http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		switch r.Method {
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodHead:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+		default:
+			respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for the rest of the
+// response, for streams that may run longer than it
+func clearWriteDeadline(w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Failed to clear the write deadline for a stream: %v", err)
+	}
+}
+
+// serveAll serves each server on its listener and returns once all of them
+// have stopped, with the first error other than http.ErrServerClosed. The
+// servers run and stop together: when one fails, stop is called so the
+// others are shut down as well.
+func serveAll(servers []*http.Server, listeners []net.Listener, stop func()) error {
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			err := server.Serve(listener)
+			if err == http.ErrServerClosed {
+				err = nil
+			} else {
+				stop()
+			}
+			errs <- err
+		}(servers[i], listeners[i])
+	}
+
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// shutdownServers shuts the servers down concurrently, letting in-flight
+// requests finish until ctx is done
+func shutdownServers(ctx context.Context, servers []*http.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down server on %s: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTimeoutServer serves ProxyChatCompletion through newServer with a short
+// write timeout, as StartProxyServer would
+func newTimeoutServer(t *testing.T, writeTimeout time.Duration) *httptest.Server {
+	t.Helper()
+	cfg := config
+	cfg.ServerWriteTimeout = writeTimeout
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newServer("", http.HandlerFunc(ProxyChatCompletion), cfg)
+	server.Start()
+	return server
+}
+
+func TestSlowStreamOutlastsWriteTimeout(t *testing.T) {
+	upstream := newMarketplaceServer("slow-stream-model", "Slow Stream Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"tick\"}}]}\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	defer upstream.Close()
+	defer useMarketplaceURL(upstream.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	server := newTimeoutServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model": "Slow Stream Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream was cut off after %q: %v", body, err)
+	}
+	if got := strings.Count(string(body), "tick"); got != 4 || !strings.Contains(string(body), "[DONE]") {
+		t.Errorf("stream = %q, want 4 chunks and [DONE]", body)
+	}
+}
+
+func TestWriteTimeoutBoundsNonStreamingResponse(t *testing.T) {
+	upstream := newMarketplaceServer("slow-reply-model", "Slow Reply Model", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer upstream.Close()
+	defer useMarketplaceURL(upstream.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	server := newTimeoutServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model": "Slow Reply Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("response outlasting the write timeout was delivered; want the connection closed")
+	}
+}
+
+func TestAdminPortSeparatesOperationalEndpoints(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	split := cfg
+	split.AdminPort = "0"
+
+	servers := []*http.Server{newServer("", newTestMux(t, &split), split), newServer("", NewAdminMux(), split)}
+	listeners := make([]net.Listener, len(servers))
+	for i := range servers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- serveAll(servers, listeners, stop) }()
+
+	status := func(listener net.Listener, path string) int {
+		t.Helper()
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	main, admin := listeners[0], listeners[1]
+	for _, path := range []string{"/metrics", "/stats", "/admin/errors", "/debug/session"} {
+		if got := status(main, path); got != http.StatusNotFound {
+			t.Errorf("main port %s: status = %d, want 404", path, got)
+		}
+		if got := status(admin, path); got == http.StatusNotFound {
+			t.Errorf("admin port %s: status = 404, want it served", path)
+		}
+	}
+	if got := status(main, "/v1/chat/completions"); got == http.StatusNotFound {
+		t.Error("main port /v1/chat/completions: status = 404, want it served")
+	}
+	if got := status(admin, "/v1/chat/completions"); got != http.StatusNotFound {
+		t.Errorf("admin port /v1/chat/completions: status = %d, want 404", got)
+	}
+	for _, listener := range listeners {
+		if got := status(listener, "/health"); got != http.StatusOK {
+			t.Errorf("%s /health: status = %d, want 200", listener.Addr(), got)
+		}
+	}
+
+	// A failing listener stops the other server with it
+	go func() {
+		<-ctx.Done()
+		shutdownServers(context.Background(), servers)
+	}()
+	admin.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("serveAll() error = nil, want the admin listener's failure")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers still running after the admin listener failed")
+	}
+	if _, err := http.Get("http://" + main.Addr().String() + "/health"); err == nil {
+		t.Error("main port still answering after shutdown")
+	}
+}
+
+func TestNewMuxServesOperationalEndpointsWithoutAdminPort(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	mux := newTestMux(t, &cfg)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/metrics: status = %d, want 200", w.Code)
+	}
+}
+
+func TestChatCompletionsMethods(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	mux := newTestMux(t, &cfg)
+	const allow = "POST, HEAD, OPTIONS"
+
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{http.MethodOptions, http.StatusNoContent},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPut, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, "/v1/chat/completions", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get("Allow"); got != allow {
+				t.Errorf("Allow = %q, want %q", got, allow)
+			}
+			if tt.wantStatus != http.StatusMethodNotAllowed && w.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", w.Body.String())
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed && !strings.Contains(w.Body.String(), "Method not allowed") {
+				t.Errorf("body = %q, want an error", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("POST", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages": []}`)))
+		if w.Code != http.StatusBadRequest || w.Header().Get("Allow") != "" {
+			t.Errorf("status = %d, Allow = %q, want the completion handler's 400", w.Code, w.Header().Get("Allow"))
+		}
+	})
+
+	t.Run("CORS preflight", func(t *testing.T) {
+		withOrigins := cfg
+		withOrigins.CORSAllowedOrigins = []string{"https://app.example"}
+		mux := newTestMux(t, &withOrigins)
+
+		req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+		req.Header.Set("Origin", "https://app.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") == "" {
+			t.Errorf("status = %d, headers = %v, want a CORS preflight answer", w.Code, w.Header())
+		}
+	})
+}
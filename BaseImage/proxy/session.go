@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// getSessionSuccessCriteria returns SESSION_SUCCESS_CRITERIA, the fields a
+// session response must carry beyond a session ID, as "field=value" pairs.
+// A field without a value only has to be present. Nested fields are named
+// with dots, e.g. "session.status=ready".
+func getSessionSuccessCriteria() map[string]string {
+	return getEnvSettings("SESSION_SUCCESS_CRITERIA")
+}
+
+// sessionResponse is a node's reply to a request to open a session. Some
+// nodes with a session already open for the model do not open another: they
+// either return the open one with existing set, or refuse with an error and
+// name it in existingSessionID (or, on some versions, sessionID).
+// The agreed price comes as price or, on some versions, pricePerSecond, and
+// as a number or a decimal string.
+type sessionResponse struct {
+	Id             *string         `json:"sessionID"`
+	Provider       string          `json:"provider"`
+	Price          json.RawMessage `json:"price"`
+	PricePerSecond json.RawMessage `json:"pricePerSecond"`
+	Existing       bool            `json:"existing"`
+	ExistingId     string          `json:"existingSessionID"`
+	Error          string          `json:"error"`
+}
+
+// sessionTerms is what a session response says about the session it names
+type sessionTerms struct {
+	ID       string
+	Provider string // provider address, "" if the node did not say
+	Price    string // agreed price as the node wrote it, "" if it did not say
+	Existing bool   // the session was already open rather than newly opened
+}
+
+// terms returns the provider and price of the response, for the session id
+func (r sessionResponse) terms(id string, existing bool) sessionTerms {
+	price := rawPrice(r.Price)
+	if price == "" {
+		price = rawPrice(r.PricePerSecond)
+	}
+	return sessionTerms{ID: id, Provider: r.Provider, Price: price, Existing: existing}
+}
+
+// rawPrice returns a price field's value, unquoting a string
+func rawPrice(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return strings.TrimSpace(s)
+	}
+	var n json.Number
+	if json.Unmarshal(raw, &n) == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// errNoSessionID is returned for a successful session response that does not
+// carry a sessionID field at all, as opposed to an empty one
+var errNoSessionID = errors.New("session response has no sessionID field")
+
+// parseSessionResponse decodes a successful session response
+func parseSessionResponse(body []byte) (sessionTerms, error) {
+	var result sessionResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return sessionTerms{}, fmt.Errorf("failed to decode session response: %v", err)
+	}
+	if result.Id == nil {
+		if result.ExistingId == "" {
+			return sessionTerms{}, errNoSessionID
+		}
+		return result.terms(result.ExistingId, true), nil
+	}
+	return result.terms(*result.Id, result.Existing), nil
+}
+
+// existingSessionFromError returns the session a node says is already open
+// when it refuses to open another, if the error response names one
+func existingSessionFromError(body []byte) (sessionTerms, bool) {
+	var result sessionResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return sessionTerms{}, false
+	}
+	if result.ExistingId != "" {
+		return result.terms(result.ExistingId, true), true
+	}
+	message := strings.ToLower(result.Error)
+	if result.Id != nil && *result.Id != "" && strings.Contains(message, "already") && strings.Contains(message, "session") {
+		return result.terms(*result.Id, true), true
+	}
+	return sessionTerms{}, false
+}
+
+// checkSessionSuccessCriteria returns an error naming the first criterion, in
+// field order, that the session response body does not meet
+func checkSessionSuccessCriteria(body []byte) error {
+	criteria := getSessionSuccessCriteria()
+	if len(criteria) == 0 {
+		return nil
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("session response is not a JSON object: %v", err)
+	}
+
+	fields := make([]string, 0, len(criteria))
+	for field := range criteria {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value, ok := lookupField(response, field)
+		if !ok {
+			return fmt.Errorf("session response is missing required field %q", field)
+		}
+		if want := criteria[field]; want != "" && fmt.Sprint(value) != want {
+			return fmt.Errorf("session response field %q is %v, want %s", field, value, want)
+		}
+	}
+	return nil
+}
+
+// lookupField finds a dot-separated field in a decoded JSON object
+func lookupField(object map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = object
+	for _, part := range strings.Split(path, ".") {
+		current, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = current[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// runSessionSummary logs a summary of the active sessions every interval
+// until ctx is done
+func runSessionSummary(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logSessionSummary()
+		}
+	}
+}
+
+// logSessionSummary logs each active session with its age and how many times
+// it has been reused, ordered by model
+func logSessionSummary() {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	modelIDs := make([]string, 0, len(activeSessions))
+	for modelID := range activeSessions {
+		modelIDs = append(modelIDs, modelID)
+	}
+	sort.Strings(modelIDs)
+
+	log.Printf("Session summary: %d active", len(modelIDs))
+	for _, modelID := range modelIDs {
+		session := activeSessions[modelID]
+		log.Printf("Session summary: model %s session %s age %v reuses %d expires in %v",
+			modelID, redactSessionID(session.SessionID), now().Sub(session.Created).Round(time.Second),
+			session.Reuses, session.expiresAt().Sub(now()).Round(time.Second))
+	}
+}
+
+// warmSession opens a session for MODEL_ID ahead of the first request when
+// WARM_SESSION is enabled, so that request does not pay for it. Session
+// establishment retries as usual; a failure is only logged and the first
+// request tries again.
+func warmSession(ctx context.Context) {
+	if !getEnvBool("WARM_SESSION", false) {
+		return
+	}
+	handle := strings.TrimSpace(os.Getenv("MODEL_ID"))
+	if handle == "" {
+		log.Printf("WARM_SESSION is enabled but MODEL_ID is not set, skipping session warm-up")
+		return
+	}
+
+	modelID, err := validateModelHandle(resolveModelAlias(handle))
+	if err != nil {
+		log.Printf("Session warm-up skipped, cannot resolve model %s: %v", handle, err)
+		return
+	}
+	start := now()
+	if err := ensureSession(ctx, modelID); err != nil {
+		log.Printf("Session warm-up for model %s failed, the first request will retry: %v", modelID, err)
+		return
+	}
+	log.Printf("Warmed up session for model %s in %v", modelID, now().Sub(start))
+}
+
+// Policies accepted by SESSION_ESTABLISHING_POLICY
+const (
+	establishingPolicyBlock  = "block"  // wait for the session, up to SESSION_ESTABLISHING_TIMEOUT_MS
+	establishingPolicyReject = "reject" // fail at once with 503
+)
+
+// ErrSessionEstablishing marks requests turned away because their model's
+// session was still being established
+var ErrSessionEstablishing = errors.New("session is being established")
+
+// establishing holds, per model, a channel that is closed once the session
+// being opened for it is established or has failed
+var establishing = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+// getSessionEstablishingPolicy returns how requests are admitted while their
+// model's session is being established
+func getSessionEstablishingPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("SESSION_ESTABLISHING_POLICY")))
+	switch policy {
+	case "":
+		return establishingPolicyBlock
+	case establishingPolicyBlock, establishingPolicyReject:
+		return policy
+	default:
+		log.Printf("Invalid SESSION_ESTABLISHING_POLICY value: %s, using default of %s", policy, establishingPolicyBlock)
+		return establishingPolicyBlock
+	}
+}
+
+// getSessionEstablishingTimeout returns how long a request blocks for its
+// model's session; 0 waits as long as the establishment takes
+func getSessionEstablishingTimeout() time.Duration {
+	return time.Duration(getEnvInt("SESSION_ESTABLISHING_TIMEOUT_MS", 0)) * time.Millisecond
+}
+
+// tryMarkSessionEstablishing records that a session is being opened for
+// modelID and returns the function that clears the mark and releases waiting
+// requests. It returns nil if the session is already being established.
+func tryMarkSessionEstablishing(modelID string) func() {
+	done := make(chan struct{})
+	establishing.Lock()
+	if _, inProgress := establishing.m[modelID]; inProgress {
+		establishing.Unlock()
+		return nil
+	}
+	establishing.m[modelID] = done
+	establishing.Unlock()
+	return func() {
+		establishing.Lock()
+		delete(establishing.m, modelID)
+		establishing.Unlock()
+		close(done)
+	}
+}
+
+// admitDuringEstablishment applies SESSION_ESTABLISHING_POLICY when a session
+// for modelID is being established. It returns nil once the request may go on
+// to use the session, or ErrSessionEstablishing if it is turned away.
+func admitDuringEstablishment(ctx context.Context, modelID string) error {
+	establishing.Lock()
+	done, inProgress := establishing.m[modelID]
+	establishing.Unlock()
+	if !inProgress {
+		return nil
+	}
+
+	if getSessionEstablishingPolicy() == establishingPolicyReject {
+		return ErrSessionEstablishing
+	}
+
+	var timeout <-chan time.Time
+	if wait := getSessionEstablishingTimeout(); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("%w: gave up waiting after %v", ErrSessionEstablishing, getSessionEstablishingTimeout())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reasons ensureSession gives for the session a request is served on
+const (
+	sessionReused  = "reused"  // the model's session was still valid
+	sessionNew     = "new"     // the model had no session yet
+	sessionExpired = "expired" // the model's session passed its idle timeout
+	sessionEvicted = "evicted" // the model's session was dropped for a request to another model
+	sessionPooled  = "pooled"  // a pre-opened session from the model's pool
+	sessionShared  = "shared"  // a session another replica opened, from the session store
+	sessionRotated = "rotated" // the model's session reached MAX_SESSION_AGE
+	// the model's session was funded by a wallet no longer configured
+	sessionWalletChanged = "wallet_changed"
+)
+
+// sessionRemovals records why each model's last session was removed, so the
+// next establishment can say why it was needed. Guarded by sessionMutex.
+var sessionRemovals = make(map[string]string)
+
+// removeSessionLocked drops the session for modelID, noting why. Unless it
+// was only evicted for another model, and so is still fit for use, it is
+// removed from a shared session store too.
+func removeSessionLocked(modelID, reason string) {
+	if session, ok := activeSessions[modelID]; ok && reason != sessionEvicted {
+		unstoreSessionLocked(modelID, session.SessionID)
+	}
+	delete(activeSessions, modelID)
+	sessionRemovals[modelID] = reason
+}
+
+// retiredSessionCloseTimeout bounds closing a session retired before it
+// expired
+const retiredSessionCloseTimeout = 10 * time.Second
+
+// expireSessionLocked removes the expired session for modelID. A session
+// rotated out for reaching MAX_SESSION_AGE may still have time left on the
+// node, so it is retired rather than just dropped.
+func expireSessionLocked(modelID string, session *MorpheusSession) {
+	if !session.pastMaxAge(now()) {
+		removeSessionLocked(modelID, sessionExpired)
+		log.Printf("Removed expired session for model %s", modelID)
+		return
+	}
+	log.Printf("Rotating session %s for model %s after MAX_SESSION_AGE of %v", redactSessionID(session.SessionID), modelID, config.MaxSessionAge)
+	retireSessionLocked(modelID, session, sessionRotated)
+}
+
+// retireSessionLocked removes a session that is still open on the node for
+// reason, and closes it there in the background
+func retireSessionLocked(modelID string, session *MorpheusSession, reason string) {
+	removeSessionLocked(modelID, reason)
+	go closeRetiredSession(modelID, session.SessionID)
+}
+
+// closeRetiredSession closes a session for modelID that is no longer used
+// but may still be open on the node, logging a failure
+func closeRetiredSession(modelID, sessionID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), retiredSessionCloseTimeout)
+	defer cancel()
+	if err := closeSession(ctx, sessionID); err != nil {
+		log.Printf("Failed to close retired session %s for model %s: %v", redactSessionID(sessionID), modelID, err)
+	}
+}
+
+// establishReasonLocked returns why a new session is needed for modelID
+func establishReasonLocked(modelID string) string {
+	if reason, ok := sessionRemovals[modelID]; ok {
+		return reason
+	}
+	return sessionNew
+}
+
+// sessionDecision holds the reason ensureSession gave for a request's session
+type sessionDecision struct {
+	reason string
+}
+
+// withSessionDecision lets ensureSession record, on r's context, why the
+// request's session was reused or established
+func withSessionDecision(r *http.Request) (*http.Request, *sessionDecision) {
+	decision := &sessionDecision{}
+	return r.WithContext(context.WithValue(r.Context(), sessionDecisionKey, decision)), decision
+}
+
+// recordSessionDecision notes the reason on the request's trace and, if the
+// request asked for it, its sessionDecision
+func recordSessionDecision(ctx context.Context, reason string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("session.decision", reason))
+	if decision, ok := ctx.Value(sessionDecisionKey).(*sessionDecision); ok {
+		decision.reason = reason
+	}
+}
+
+// sessionClosePathTemplate is the marketplace path that closes a session,
+// with %s in place of the session ID
+const sessionClosePathTemplate = "/blockchain/sessions/%s/close"
+
+// closeSession asks the marketplace to close sessionID, releasing what is
+// left of its reserved duration
+func closeSession(ctx context.Context, sessionID string) error {
+	closeURL := getMarketplaceBaseURL() + fmt.Sprintf(sessionClosePathTemplate, url.PathEscape(sessionID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, closeURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create session close request: %v", err)
+	}
+	resp, err := newMarketplaceClient(0).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to close session: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("marketplace returned %d closing session: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// closeAllSessions closes every active and pooled session on the marketplace
+// at once and forgets them. It is best effort: failures are logged, and
+// closes still running when ctx ends are abandoned. With a shared session
+// store, the active sessions are left open for the other replicas.
+func closeAllSessions(ctx context.Context) {
+	shared := isSharedSessionStore()
+	sessionMutex.Lock()
+	sessions := make([]MorpheusSession, 0, len(activeSessions))
+	for modelID, session := range activeSessions {
+		if !shared {
+			sessions = append(sessions, *session)
+		}
+		delete(activeSessions, modelID)
+	}
+	SessionManagerInstance.UpdateSession("", "")
+	pinnedSessionManagers = make(map[string]*SessionManager)
+	sessionMutex.Unlock()
+
+	sessionPools.Lock()
+	pools := sessionPools.m
+	sessionPools.m = make(map[string]*sessionPool)
+	sessionPools.Unlock()
+	for _, pool := range pools {
+		sessions = append(sessions, pool.snapshot()...)
+	}
+
+	if len(sessions) == 0 {
+		return
+	}
+	log.Printf("Closing %d session(s) on the marketplace", len(sessions))
+
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		if session.SessionID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(session MorpheusSession) {
+			defer wg.Done()
+			if err := closeSession(ctx, session.SessionID); err != nil {
+				log.Printf("Failed to close session %s for model %s: %v", redactSessionID(session.SessionID), session.ModelID, err)
+				return
+			}
+			log.Printf("Closed session %s for model %s", redactSessionID(session.SessionID), session.ModelID)
+		}(session)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,770 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckSessionSuccessCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria string
+		body     string
+		wantErr  string
+	}{
+		{name: "no criteria", criteria: "", body: `{"sessionID": "abc"}`},
+		{name: "required value met", criteria: "status=ready", body: `{"sessionID": "abc", "status": "ready"}`},
+		{name: "required field present", criteria: "provider", body: `{"sessionID": "abc", "provider": "0x1"}`},
+		{name: "nested field", criteria: "session.ready=true", body: `{"sessionID": "abc", "session": {"ready": true}}`},
+		{name: "field absent", criteria: "status=ready", body: `{"sessionID": "abc"}`, wantErr: `missing required field "status"`},
+		{name: "wrong value", criteria: "status=ready", body: `{"sessionID": "abc", "status": "pending"}`, wantErr: `"status" is pending, want ready`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SESSION_SUCCESS_CRITERIA", tt.criteria)
+			defer os.Unsetenv("SESSION_SUCCESS_CRITERIA")
+
+			err := checkSessionSuccessCriteria([]byte(tt.body))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkSessionSuccessCriteria() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkSessionSuccessCriteria() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureSessionFailsWithoutSuccessField(t *testing.T) {
+	var mu sync.Mutex
+	var closed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/close") {
+			mu.Lock()
+			closed = append(closed, r.URL.Path)
+			mu.Unlock()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": "not-ready-session"})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("SESSION_SUCCESS_CRITERIA", "status=ready")
+	defer os.Unsetenv("SESSION_SUCCESS_CRITERIA")
+
+	defer func(d time.Duration) { baseDelay = d }(baseDelay)
+	baseDelay = time.Millisecond
+
+	err := ensureSession(context.Background(), "criteria-model")
+	if !errors.Is(err, ErrUpstreamUnavailable) || !strings.Contains(err.Error(), `missing required field "status"`) {
+		t.Errorf("ensureSession() error = %v, want a clear criteria failure", err)
+	}
+	if _, exists := activeSessions["criteria-model"]; exists {
+		t.Errorf("session that failed the success criteria was stored")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != maxRetries || closed[0] != "/blockchain/sessions/not-ready-session/close" {
+		t.Errorf("closed = %v, want each of the %d rejected sessions closed", closed, maxRetries)
+	}
+}
+
+func TestEnsureSessionTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+	defer func(d time.Duration) { config.SessionTimeout = d }(config.SessionTimeout)
+	config.SessionTimeout = 100 * time.Millisecond
+
+	sessionMutex.Lock()
+	activeSessions["ready-model"] = &MorpheusSession{SessionID: "ready-session", ModelID: "ready-model", Created: now()}
+	sessionMutex.Unlock()
+	defer func() {
+		sessionMutex.Lock()
+		delete(activeSessions, "ready-model")
+		sessionMutex.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- ensureSession(context.Background(), "hung-model") }()
+
+	// The hung establishment must not hold up requests for other models
+	time.Sleep(20 * time.Millisecond)
+	if err := ensureSession(context.Background(), "ready-model"); err != nil {
+		t.Errorf("ensureSession() for a ready model = %v while another was establishing", err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrUpstreamUnavailable) || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("ensureSession() error = %v, want a timeout reported as ErrUpstreamUnavailable", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("establishment took %v, want it cut off after about 100ms", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ensureSession() hung on an unresponsive marketplace")
+	}
+}
+
+func TestEstablishmentOutlivesCancelledRequester(t *testing.T) {
+	requested, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		close(requested)
+		<-release
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": "detached-session"})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+	defer func() {
+		sessionMutex.Lock()
+		delete(activeSessions, "detached-model")
+		SessionManagerInstance.UpdateSession("", "")
+		sessionMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ensureSession(ctx, "detached-model") }()
+
+	// The first requester hangs up while the session is being opened
+	<-requested
+	cancel()
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ensureSession() error = %v, want the establishment to finish", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ensureSession() did not return")
+	}
+	sessionMutex.Lock()
+	session := activeSessions["detached-model"]
+	sessionMutex.Unlock()
+	if session == nil || session.SessionID != "detached-session" {
+		t.Errorf("active session = %+v, want the session opened for the waiters", session)
+	}
+}
+
+func TestSessionSummaryLoggedPeriodically(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+
+	sessionMutex.Lock()
+	activeSessions = map[string]*MorpheusSession{
+		"summary-model": {SessionID: "0xsummarysession", ModelID: "summary-model", Created: fake.Now(), Reuses: 3},
+	}
+	sessionMutex.Unlock()
+	fake.Advance(2 * time.Minute)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runSessionSummary(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("summary loop did not stop when its context was cancelled")
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "Session summary: 1 active") {
+		t.Errorf("summary not logged after the interval: %q", out)
+	}
+	if !strings.Contains(out, "model summary-model session 0xsummar... age 2m0s reuses 3") {
+		t.Errorf("summary lacks the session's details: %q", out)
+	}
+}
+
+func TestWarmSession(t *testing.T) {
+	defer func(d time.Duration) { baseDelay = d }(baseDelay)
+	baseDelay = time.Millisecond
+
+	tests := []struct {
+		name        string
+		warm        string
+		modelID     string
+		sessionCode int
+		wantSession bool
+		wantOpened  int
+	}{
+		{name: "enabled", warm: "true", modelID: "Warm Model", sessionCode: http.StatusOK, wantSession: true, wantOpened: 1},
+		{name: "disabled", warm: "", modelID: "Warm Model", sessionCode: http.StatusOK, wantOpened: 0},
+		{name: "no model", warm: "true", modelID: "", sessionCode: http.StatusOK, wantOpened: 0},
+		{name: "marketplace down", warm: "true", modelID: "Warm Model", sessionCode: http.StatusServiceUnavailable, wantOpened: maxRetries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/blockchain/models":
+					json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: "warm-model", Name: "Warm Model"}}})
+				case "/blockchain/models/warm-model/session":
+					opened++
+					if tt.sessionCode != http.StatusOK {
+						http.Error(w, `{"error": "no providers"}`, tt.sessionCode)
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]string{"sessionID": "warm-session"})
+				}
+			}))
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("WARM_SESSION", tt.warm)
+			defer os.Unsetenv("WARM_SESSION")
+			os.Setenv("MODEL_ID", tt.modelID)
+			defer os.Unsetenv("MODEL_ID")
+
+			sessionMutex.Lock()
+			activeSessions = make(map[string]*MorpheusSession)
+			sessionMutex.Unlock()
+
+			warmSession(context.Background())
+
+			if opened != tt.wantOpened {
+				t.Errorf("session requests = %d, want %d", opened, tt.wantOpened)
+			}
+			if _, ok := activeSessions["warm-model"]; ok != tt.wantSession {
+				t.Errorf("session established = %v, want %v", ok, tt.wantSession)
+			}
+		})
+	}
+}
+
+func TestAdmissionDuringSessionEstablishment(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		timeoutMs  string
+		release    bool // let the establishment finish while the request waits
+		wantCode   int
+		wantOpened int
+	}{
+		{name: "reject", policy: "reject", wantCode: http.StatusServiceUnavailable, wantOpened: 1},
+		{name: "block times out", policy: "block", timeoutMs: "20", wantCode: http.StatusServiceUnavailable, wantOpened: 1},
+		{name: "block until established", policy: "block", timeoutMs: "5000", release: true, wantCode: http.StatusOK, wantOpened: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SESSION_ESTABLISHING_POLICY", tt.policy)
+			defer os.Unsetenv("SESSION_ESTABLISHING_POLICY")
+			os.Setenv("SESSION_ESTABLISHING_TIMEOUT_MS", tt.timeoutMs)
+			defer os.Unsetenv("SESSION_ESTABLISHING_TIMEOUT_MS")
+
+			var mu sync.Mutex
+			opened := 0
+			started := make(chan struct{})
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/blockchain/models":
+					json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {{Id: "slow-session-model", Name: "Slow Session Model"}}})
+				case "/blockchain/models/slow-session-model/session":
+					mu.Lock()
+					opened++
+					mu.Unlock()
+					close(started)
+					<-release
+					json.NewEncoder(w).Encode(map[string]string{"sessionID": "slow-session"})
+				case "/chat/completions":
+					w.Write([]byte(`{"choices": []}`))
+				}
+			}))
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+
+			sessionMutex.Lock()
+			activeSessions = make(map[string]*MorpheusSession)
+			sessionMutex.Unlock()
+
+			first := make(chan error)
+			go func() { first <- ensureSession(context.Background(), "slow-session-model") }()
+			<-started
+
+			if tt.release {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					close(release)
+				}()
+			}
+			w := httptest.NewRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Slow Session Model", "messages": [{"role": "user", "content": "Hello"}]}`))
+			if !tt.release {
+				close(release)
+			}
+			if err := <-first; err != nil {
+				t.Fatalf("establishing request failed: %v", err)
+			}
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("Expected Retry-After on 503")
+			}
+			if opened != tt.wantOpened {
+				t.Errorf("sessions opened = %d, want %d", opened, tt.wantOpened)
+			}
+		})
+	}
+}
+
+// TestForwardDuringSessionRollover forwards requests for two models at once.
+// Each new session for one model drops the other's, so sessions roll over
+// while requests read them; run with -race.
+func TestForwardDuringSessionRollover(t *testing.T) {
+	var mu sync.Mutex
+	sessionCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {
+				{Id: "roll-a", Name: "Roll A"},
+				{Id: "roll-b", Name: "Roll B"},
+			}})
+		case strings.HasSuffix(r.URL.Path, "/session"):
+			mu.Lock()
+			sessionCount++
+			id := fmt.Sprintf("session-%d", sessionCount)
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": id})
+		case r.URL.Path == "/chat/completions":
+			w.Write([]byte(`{"choices": []}`))
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	// Sessions are opened constantly here; keep their model name lookups local
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+	// The logger's lock would order the goroutines and hide races
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		model := "Roll A"
+		if i%2 == 1 {
+			model = "Roll B"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := httptest.NewRecorder()
+				ProxyChatCompletion(w, newChatRequest(`{"model": "`+model+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+				// A session dropped between establishment and forwarding
+				// fails the request, but must never panic
+				if w.Code != http.StatusOK && w.Code != http.StatusInternalServerError {
+					t.Errorf("unexpected status %v: %s", w.Code, w.Body.String())
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			cleanupExpiredSessions()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestSessionDecisionReasons(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+	defer func(seconds int) { config.SessionExpirationSeconds = seconds }(config.SessionExpirationSeconds)
+	config.SessionExpirationSeconds = 60
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": "session-for-" + r.URL.Path})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionRemovals = make(map[string]string)
+	sessionMutex.Unlock()
+	SessionManagerInstance.UpdateSession("", "")
+
+	steps := []struct {
+		name    string
+		modelID string
+		advance time.Duration
+		want    string
+	}{
+		{name: "first request", modelID: "decision-a", want: sessionNew},
+		{name: "valid session", modelID: "decision-a", advance: 30 * time.Second, want: sessionReused},
+		{name: "idle timeout", modelID: "decision-a", advance: 61 * time.Second, want: sessionExpired},
+		{name: "other model", modelID: "decision-b", want: sessionNew},
+		{name: "evicted by other model", modelID: "decision-a", want: sessionEvicted},
+	}
+	for _, step := range steps {
+		fake.Advance(step.advance)
+		r, decision := withSessionDecision(httptest.NewRequest("POST", "/v1/chat/completions", nil))
+		if err := ensureSession(r.Context(), step.modelID); err != nil {
+			t.Fatalf("%s: ensureSession() error = %v", step.name, err)
+		}
+		if decision.reason != step.want {
+			t.Errorf("%s: session decision = %q, want %q", step.name, decision.reason, step.want)
+		}
+	}
+}
+
+func TestSessionRotatedAtMaxAge(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+	defer func(cfg Config) { config = cfg }(config)
+	config.SessionExpirationSeconds = 60
+	config.MaxSessionAge = 90 * time.Second
+
+	var mu sync.Mutex
+	var opened int
+	closed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+		case strings.HasSuffix(r.URL.Path, "/close"):
+			closed <- r.URL.Path
+			w.Write([]byte(`{"result": true}`))
+		default:
+			mu.Lock()
+			opened++
+			sessionID := fmt.Sprintf("0xsession%d", opened)
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": sessionID})
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionRemovals = make(map[string]string)
+	sessionMutex.Unlock()
+	SessionManagerInstance.UpdateSession("", "")
+
+	// Used every 40s, the session never goes idle long enough to expire,
+	// so only the age cap retires it
+	steps := []struct {
+		advance time.Duration
+		want    string
+		session string
+	}{
+		{want: sessionNew, session: "0xsession1"},
+		{advance: 40 * time.Second, want: sessionReused, session: "0xsession1"},
+		{advance: 40 * time.Second, want: sessionReused, session: "0xsession1"},
+		{advance: 40 * time.Second, want: sessionRotated, session: "0xsession2"},
+		{advance: 40 * time.Second, want: sessionReused, session: "0xsession2"},
+	}
+	for i, step := range steps {
+		fake.Advance(step.advance)
+		r, decision := withSessionDecision(httptest.NewRequest("POST", "/v1/chat/completions", nil))
+		if err := ensureSession(r.Context(), "aged-model"); err != nil {
+			t.Fatalf("step %d: ensureSession() error = %v", i, err)
+		}
+		if decision.reason != step.want {
+			t.Errorf("step %d: session decision = %q, want %q", i, decision.reason, step.want)
+		}
+		if session, _ := getActiveSession("aged-model"); session.SessionID != step.session {
+			t.Errorf("step %d: session = %q, want %q", i, session.SessionID, step.session)
+		}
+	}
+
+	select {
+	case path := <-closed:
+		if path != "/blockchain/sessions/0xsession1/close" {
+			t.Errorf("closed %s, want the rotated session", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotated session was not closed on the marketplace")
+	}
+}
+
+func TestCloseAllSessionsClosesActiveAndPooledSessions(t *testing.T) {
+	var mu sync.Mutex
+	var closed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("close request method = %s, want POST", r.Method)
+		}
+		mu.Lock()
+		closed = append(closed, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(`{"result": true}`))
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions = map[string]*MorpheusSession{
+		"close-model": {SessionID: "0xactive", ModelID: "close-model", Created: time.Now()},
+	}
+	SessionManagerInstance.UpdateSession("0xactive", "close-model")
+	resetSessionPools()
+	defer resetSessionPools()
+	sessionPools.m["close-model"] = &sessionPool{
+		modelID:  "close-model",
+		sessions: []*MorpheusSession{{SessionID: "0xpooled", ModelID: "close-model", Created: time.Now()}},
+	}
+
+	closeAllSessions(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"/blockchain/sessions/0xactive/close": true, "/blockchain/sessions/0xpooled/close": true}
+	if len(closed) != len(want) {
+		t.Fatalf("close calls = %v, want %d", closed, len(want))
+	}
+	for _, path := range closed {
+		if !want[path] {
+			t.Errorf("unexpected close call %s", path)
+		}
+	}
+	if len(activeSessions) != 0 {
+		t.Errorf("active sessions after close = %d, want 0", len(activeSessions))
+	}
+	if sessionID, _ := SessionManagerInstance.GetSessionInfo(); sessionID != "" {
+		t.Errorf("current session after close = %q, want none", sessionID)
+	}
+}
+
+func TestCloseAllSessionsGivesUpAtDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	defer useMarketplaceURL(server.URL)()
+
+	activeSessions = map[string]*MorpheusSession{
+		"hung-model": {SessionID: "0xhung", ModelID: "hung-model", Created: time.Now()},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	closeAllSessions(ctx)
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("closeAllSessions() took %v with a hung marketplace, want it to stop at the deadline", waited)
+	}
+}
+
+func TestEnsureSessionStoresProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": "provider-session", "provider": "0xabcdef0123456789abcd"})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+
+	if err := ensureSession(context.Background(), "provider-model"); err != nil {
+		t.Fatalf("ensureSession() error = %v", err)
+	}
+	session, _ := getActiveSession("provider-model")
+	if session.Provider != "0xabcdef0123456789abcd" {
+		t.Errorf("session provider = %q, want 0xabcdef0123456789abcd", session.Provider)
+	}
+}
+
+func TestEnsureSessionHandlesSessionResponseShapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr string
+	}{
+		{name: "new session", status: http.StatusOK, body: `{"sessionID": "fresh-session"}`, want: "fresh-session"},
+		{name: "existing session returned", status: http.StatusOK, body: `{"sessionID": "open-session", "existing": true}`, want: "open-session"},
+		{name: "existing session named", status: http.StatusOK, body: `{"existingSessionID": "open-session"}`, want: "open-session"},
+		{name: "refused naming existing session", status: http.StatusConflict, body: `{"error": "session already open", "existingSessionID": "open-session"}`, want: "open-session"},
+		{name: "refused with already have a session", status: http.StatusBadRequest, body: `{"error": "you already have a session with this provider", "sessionID": "open-session"}`, want: "open-session"},
+		{name: "refused without naming it", status: http.StatusBadRequest, body: `{"error": "you already have a session with this provider"}`, wantErr: "failed to establish session"},
+		{name: "no sessionID field", status: http.StatusOK, body: `{"id": "elsewhere"}`, wantErr: "no sessionID field"},
+		{name: "empty sessionID", status: http.StatusOK, body: `{"sessionID": ""}`, wantErr: "valid session ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/blockchain/models" {
+					json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			defer useMarketplaceURL(server.URL)()
+			os.Setenv("MODEL_RETRY_POLICIES", "shape-model=1")
+			defer os.Unsetenv("MODEL_RETRY_POLICIES")
+			activeSessions = make(map[string]*MorpheusSession)
+
+			err := ensureSession(context.Background(), "shape-model")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ensureSession() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if _, exists := getActiveSession("shape-model"); exists {
+					t.Error("a session was stored for a failed establishment")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ensureSession() error = %v", err)
+			}
+			session, _ := getActiveSession("shape-model")
+			if session.SessionID != tt.want {
+				t.Errorf("session ID = %q, want %q", session.SessionID, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSessionResponsePrice(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "decimal string", body: `{"sessionID": "s", "price": "31250000000"}`, want: "31250000000"},
+		{name: "number", body: `{"sessionID": "s", "price": 0.0025}`, want: "0.0025"},
+		{name: "price per second", body: `{"sessionID": "s", "pricePerSecond": 125}`, want: "125"},
+		{name: "price preferred", body: `{"sessionID": "s", "price": "1", "pricePerSecond": "2"}`, want: "1"},
+		{name: "absent", body: `{"sessionID": "s"}`},
+		{name: "not a price", body: `{"sessionID": "s", "price": {"amount": 1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms, err := parseSessionResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("parseSessionResponse() error = %v", err)
+			}
+			if terms.Price != tt.want {
+				t.Errorf("price = %q, want %q", terms.Price, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureSessionRecordsProviderAndPrice(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "session", "open.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		w.Write(fixture)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	activeSessions = make(map[string]*MorpheusSession)
+	defer func() { activeSessions = make(map[string]*MorpheusSession) }()
+
+	if err := ensureSession(context.Background(), "priced-session-model"); err != nil {
+		t.Fatalf("ensureSession() error = %v", err)
+	}
+	session, _ := getActiveSession("priced-session-model")
+	const provider = "0x9a3f5c7e1b2d4f6a8c0e2b4d6f8a1c3e5b7d9f0a"
+	if session.Provider != provider || session.Price != "31250000000" {
+		t.Fatalf("session provider = %q, price = %q, want %q and 31250000000", session.Provider, session.Price, provider)
+	}
+
+	for _, tt := range []struct {
+		query        string
+		wantProvider string
+	}{
+		{query: "", wantProvider: redactWallet(provider)},
+		{query: "?reveal=true", wantProvider: provider},
+	} {
+		w := httptest.NewRecorder()
+		handleDebugSession(w, httptest.NewRequest(http.MethodGet, "/debug/session"+tt.query, nil))
+		var resp SessionDebugResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode /debug/session: %v", err)
+		}
+		if len(resp.Sessions) != 1 {
+			t.Fatalf("got %d sessions, want 1", len(resp.Sessions))
+		}
+		if got := resp.Sessions[0]; got.Provider != tt.wantProvider || got.Price != "31250000000" {
+			t.Errorf("/debug/session%s provider = %q, price = %q, want %q and 31250000000", tt.query, got.Provider, got.Price, tt.wantProvider)
+		}
+	}
+}
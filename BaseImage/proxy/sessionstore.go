@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session stores accepted by SESSION_STORE
+const (
+	sessionStoreMemory = "memory" // sessions are kept to this process
+	sessionStoreRedis  = "redis"  // sessions are shared through REDIS_URL
+)
+
+// SessionStore holds the sessions requests are served on, by session key
+// (see sessionKey). ensureSession looks a session up in the store before
+// opening one and stores each session it opens, so with a store shared
+// between replicas, a session one replica opened is reused by the others
+// rather than each opening its own.
+type SessionStore interface {
+	// Get returns the unexpired session stored under key, if there is one
+	Get(ctx context.Context, key string) (MorpheusSession, bool, error)
+	// Set stores session under key until it has gone unused for ttl
+	Set(ctx context.Context, key string, session MorpheusSession, ttl time.Duration) error
+	// Delete removes the session stored under key if it is still
+	// sessionID, so a session stored since is left in place
+	Delete(ctx context.Context, key, sessionID string) error
+	// Lock claims the right to open the session for key, for at most ttl,
+	// so that only one holder opens it at a time. It reports false if
+	// another holder has the claim; unlock releases a claim that was made.
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// memorySessionStore is the default store: the process's own activeSessions,
+// so sessions are shared by this process's requests only. Entries expire
+// through cleanupExpiredSessions rather than by ttl.
+type memorySessionStore struct{}
+
+func (memorySessionStore) Get(ctx context.Context, key string) (MorpheusSession, bool, error) {
+	session, ok := getActiveSession(key)
+	if !ok || session.SessionID == "" || !now().Before(session.expiresAt()) {
+		return MorpheusSession{}, false, nil
+	}
+	return session, true, nil
+}
+
+func (memorySessionStore) Set(ctx context.Context, key string, session MorpheusSession, ttl time.Duration) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	// establishSession has usually installed it already
+	if current, ok := activeSessions[key]; ok && current.SessionID == session.SessionID {
+		return nil
+	}
+	activeSessions[key] = &session
+	return nil
+}
+
+func (memorySessionStore) Delete(ctx context.Context, key, sessionID string) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	if current, ok := activeSessions[key]; ok && current.SessionID == sessionID {
+		delete(activeSessions, key)
+	}
+	return nil
+}
+
+// Lock always succeeds: within a process, establishments for the same key
+// are already serialised by tryMarkSessionEstablishing
+func (memorySessionStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	return func() {}, true, nil
+}
+
+// sessionStorePollInterval is how often a replica waiting on another to open
+// a session checks the store for it
+const sessionStorePollInterval = 100 * time.Millisecond
+
+var sessionStoreState = struct {
+	sync.Mutex
+	store SessionStore
+	url   string // REDIS_URL of the Redis store, to reuse it across applyConfig
+	// storedAt records when each reused session was last written to a
+	// shared store, to refresh its expiry there
+	storedAt map[string]time.Time
+}{store: memorySessionStore{}, storedAt: make(map[string]time.Time)}
+
+// getSessionStore returns the configured session store
+func getSessionStore() SessionStore {
+	sessionStoreState.Lock()
+	defer sessionStoreState.Unlock()
+	return sessionStoreState.store
+}
+
+// isSharedSessionStore reports whether sessions are shared with other
+// replicas rather than kept to this process
+func isSharedSessionStore() bool {
+	_, local := getSessionStore().(memorySessionStore)
+	return !local
+}
+
+// configureSessionStore installs the store named by cfg.SessionStore. An
+// invalid store falls back to memory, with the reason logged.
+func configureSessionStore(cfg Config) {
+	sessionStoreState.Lock()
+	defer sessionStoreState.Unlock()
+
+	var store SessionStore = memorySessionStore{}
+	switch cfg.SessionStore {
+	case "", sessionStoreMemory:
+	case sessionStoreRedis:
+		if _, ok := sessionStoreState.store.(*redisSessionStore); ok && sessionStoreState.url == cfg.RedisURL {
+			return
+		}
+		redis, err := newRedisSessionStore(cfg.RedisURL)
+		if err != nil {
+			log.Printf("Invalid REDIS_URL, keeping sessions in memory: %v", err)
+			break
+		}
+		store = redis
+	default:
+		log.Printf("Invalid SESSION_STORE %q, keeping sessions in memory", cfg.SessionStore)
+	}
+	if old, ok := sessionStoreState.store.(*redisSessionStore); ok {
+		old.Close()
+	}
+	sessionStoreState.store = store
+	sessionStoreState.url = cfg.RedisURL
+	sessionStoreState.storedAt = make(map[string]time.Time)
+}
+
+// sessionStoreTTL is how long a session just used lasts in the store: until
+// it has gone unused for the session expiry, or reaches MAX_SESSION_AGE
+func sessionStoreTTL(session MorpheusSession) time.Duration {
+	return session.expiresAt().Sub(now())
+}
+
+// sessionLockTTL bounds how long a replica may hold the claim to open a
+// session, so one that dies while opening it does not block the others
+func sessionLockTTL() time.Duration {
+	if config.SessionTimeout > 0 {
+		return config.SessionTimeout
+	}
+	return 30 * time.Second
+}
+
+// claimStoredSession looks in the session store for a session for key that
+// another replica opened, and makes it the active session if there is one.
+// Otherwise it claims the store's lock on key, waiting while another replica
+// holds it in case that replica stores the session, and returns the function
+// that releases the claim once the caller has opened and stored the session.
+// Store failures are logged and leave the caller to open its own session.
+func claimStoredSession(ctx context.Context, key string) (adopted bool, release func()) {
+	store := getSessionStore()
+	noop := func() {}
+	waitCtx, cancel := context.WithTimeout(ctx, sessionLockTTL())
+	defer cancel()
+	for {
+		if session, ok := getStoredSession(waitCtx, store, key); ok {
+			adoptStoredSession(key, session)
+			return true, noop
+		}
+		unlock, locked, err := store.Lock(waitCtx, key, sessionLockTTL())
+		if err != nil {
+			log.Printf("Failed to lock session for %s in the session store, opening one without it: %v", key, err)
+			return false, noop
+		}
+		if locked {
+			// It may have been stored between the lookup and the lock
+			if session, ok := getStoredSession(waitCtx, store, key); ok {
+				unlock()
+				adoptStoredSession(key, session)
+				return true, noop
+			}
+			return false, unlock
+		}
+
+		timer := time.NewTimer(sessionStorePollInterval)
+		select {
+		case <-timer.C:
+		case <-waitCtx.Done():
+			timer.Stop()
+			log.Printf("Gave up waiting for another replica to open the session for %s, opening one", key)
+			return false, noop
+		}
+	}
+}
+
+func getStoredSession(ctx context.Context, store SessionStore, key string) (MorpheusSession, bool) {
+	session, ok, err := store.Get(ctx, key)
+	if err != nil {
+		log.Printf("Failed to read session for %s from the session store: %v", key, err)
+		return MorpheusSession{}, false
+	}
+	// A replica still configured with another wallet may have stored it
+	return session, ok && session.SessionID != "" && walletConfigured(session.Wallet)
+}
+
+// adoptStoredSession makes a session read from the store the active session
+// for key
+func adoptStoredSession(key string, session MorpheusSession) {
+	session.LastUsed = now()
+	session.Reuses++
+	sessionMutex.Lock()
+	delete(sessionRemovals, key)
+	activeSessions[key] = &session
+	currentSessionManagerLocked(key).UpdateSession(session.SessionID, key)
+	sessionStoreState.Lock()
+	sessionStoreState.storedAt[key] = now()
+	sessionStoreState.Unlock()
+	sessionMutex.Unlock()
+	log.Printf("Using stored session for %s: %s", key, redactSessionID(session.SessionID))
+}
+
+// storeSession writes a newly opened session to the session store
+func storeSession(ctx context.Context, key string, session MorpheusSession) {
+	if err := getSessionStore().Set(ctx, key, session, sessionStoreTTL(session)); err != nil {
+		log.Printf("Failed to write session for %s to the session store: %v", key, err)
+		return
+	}
+	sessionStoreState.Lock()
+	sessionStoreState.storedAt[key] = now()
+	sessionStoreState.Unlock()
+}
+
+// refreshStoredSessionLocked rewrites a reused session to a shared store, at
+// most once per quarter of its expiry, so it stays there for the other
+// replicas while this one keeps using it. The caller must hold sessionMutex.
+func refreshStoredSessionLocked(key string, session *MorpheusSession) {
+	if !isSharedSessionStore() {
+		return
+	}
+	sessionStoreState.Lock()
+	due := now().Sub(sessionStoreState.storedAt[key]) >= sessionStoreTTL(*session)/4
+	if due {
+		sessionStoreState.storedAt[key] = now()
+	}
+	sessionStoreState.Unlock()
+	if !due {
+		return
+	}
+	go func(session MorpheusSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := getSessionStore().Set(ctx, key, session, sessionStoreTTL(session)); err != nil {
+			log.Printf("Failed to refresh session for %s in the session store: %v", key, err)
+		}
+	}(*session)
+}
+
+// unstoreSessionLocked removes a session this replica stopped using from a
+// shared store in the background, so the other replicas do not adopt it.
+// The caller must hold sessionMutex.
+func unstoreSessionLocked(key, sessionID string) {
+	if sessionID == "" || !isSharedSessionStore() {
+		return
+	}
+	sessionStoreState.Lock()
+	delete(sessionStoreState.storedAt, key)
+	sessionStoreState.Unlock()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := getSessionStore().Delete(ctx, key, sessionID); err != nil {
+			log.Printf("Failed to remove session %s for %s from the session store: %v", redactSessionID(sessionID), key, err)
+		}
+	}()
+}
+
+// redisKeyPrefix namespaces the proxy's keys in Redis
+const redisKeyPrefix = "morpheus-proxy:"
+
+// redisUnlockScript deletes a lock only if it still holds the token it was
+// taken with, so a claim that outlived its ttl cannot release another's
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisDeleteSessionScript deletes a stored session only if it is still the
+// one with session ID ARGV[1]
+const redisDeleteSessionScript = `local v = redis.call("get", KEYS[1]) if v and cjson.decode(v).SessionID == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisSessionStore keeps sessions in Redis, as JSON under
+// "morpheus-proxy:session:<key>" with the session expiry as their TTL, so
+// every replica pointed at the same Redis shares them
+type redisSessionStore struct {
+	client *redisClient
+}
+
+func newRedisSessionStore(rawURL string) (*redisSessionStore, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSessionStore{client: client}, nil
+}
+
+func (s *redisSessionStore) Get(ctx context.Context, key string) (MorpheusSession, bool, error) {
+	reply, err := s.client.do(ctx, "GET", redisKeyPrefix+"session:"+key)
+	if err != nil || reply == nil {
+		return MorpheusSession{}, false, err
+	}
+	encoded, ok := reply.(string)
+	if !ok {
+		return MorpheusSession{}, false, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	var session MorpheusSession
+	if err := json.Unmarshal([]byte(encoded), &session); err != nil {
+		return MorpheusSession{}, false, fmt.Errorf("invalid stored session: %v", err)
+	}
+	return session, true, nil
+}
+
+func (s *redisSessionStore) Set(ctx context.Context, key string, session MorpheusSession, ttl time.Duration) error {
+	// A session with no time left is not worth sharing
+	if ttl <= 0 {
+		return s.Delete(ctx, key, session.SessionID)
+	}
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.do(ctx, "SET", redisKeyPrefix+"session:"+key, string(encoded), "PX", redisMillis(ttl))
+	return err
+}
+
+func (s *redisSessionStore) Delete(ctx context.Context, key, sessionID string) error {
+	_, err := s.client.do(ctx, "EVAL", redisDeleteSessionScript, "1", redisKeyPrefix+"session:"+key, sessionID)
+	return err
+}
+
+func (s *redisSessionStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, false, err
+	}
+	lockKey := redisKeyPrefix + "lock:" + key
+	value := hex.EncodeToString(token[:])
+	reply, err := s.client.do(ctx, "SET", lockKey, value, "NX", "PX", redisMillis(ttl))
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if _, err := s.client.do(ctx, "EVAL", redisUnlockScript, "1", lockKey, value); err != nil {
+			log.Printf("Failed to release session lock for %s: %v", key, err)
+		}
+	}
+	return unlock, true, nil
+}
+
+// redisMillis formats a positive ttl for PX, rounding up so a ttl under a
+// millisecond does not become the invalid PX 0
+func redisMillis(ttl time.Duration) string {
+	return strconv.FormatInt(int64((ttl+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+// Close closes the store's connections to Redis
+func (s *redisSessionStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	tokensUsed = metrics.counter("morpheus_proxy_tokens_total",
+		"Tokens reported in completion usage objects, by model and kind (prompt, completion)", "model", "kind")
+	estimatedSpend = metrics.gauge("morpheus_proxy_estimated_spend_usd",
+		"Estimated spend in US dollars since start, by model, for models with MODEL_PRICING set", "model")
+)
+
+// modelPrice is what a model costs in US dollars per 1,000 tokens
+type modelPrice struct {
+	prompt     float64
+	completion float64
+}
+
+// cost returns the price of the given token counts
+func (p modelPrice) cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*p.prompt + float64(completionTokens)*p.completion) / 1000
+}
+
+// getModelPrice returns the price configured for a model in MODEL_PRICING,
+// e.g. "llama-3=0.0005:0.0015", keyed by ID or name, with the prompt and
+// completion prices per 1,000 tokens. It reports false if the model has no
+// valid price.
+func getModelPrice(modelID, modelHandle string) (modelPrice, bool) {
+	value, ok := lookupModelSetting(getEnvSettings("MODEL_PRICING"), modelID, modelHandle)
+	if !ok {
+		return modelPrice{}, false
+	}
+	prompt, completion, found := strings.Cut(value, ":")
+	if !found {
+		log.Printf("Invalid MODEL_PRICING value for %s: %s, want prompt:completion", modelID, value)
+		return modelPrice{}, false
+	}
+	var price modelPrice
+	var errPrompt, errCompletion error
+	price.prompt, errPrompt = strconv.ParseFloat(strings.TrimSpace(prompt), 64)
+	price.completion, errCompletion = strconv.ParseFloat(strings.TrimSpace(completion), 64)
+	if errPrompt != nil || errCompletion != nil || price.prompt < 0 || price.completion < 0 {
+		log.Printf("Invalid MODEL_PRICING value for %s: %s, not estimating its spend", modelID, value)
+		return modelPrice{}, false
+	}
+	return price, true
+}
+
+// ModelUsage is the token usage, and the estimated spend where the model is
+// priced, of the completions served by one model
+type ModelUsage struct {
+	Model            string   `json:"model"`
+	Requests         int      `json:"requests"`
+	PromptTokens     int      `json:"promptTokens"`
+	CompletionTokens int      `json:"completionTokens"`
+	TotalTokens      int      `json:"totalTokens"`
+	EstimatedSpend   *float64 `json:"estimatedSpendUsd,omitempty"`
+}
+
+// usage tallies the usage reported by completions, by model ID
+var usage = struct {
+	sync.Mutex
+	m map[string]*ModelUsage
+}{m: make(map[string]*ModelUsage)}
+
+// recordUsage adds a completed request's reported usage to the tally. The
+// spend is estimated at the price configured when the request completes.
+func recordUsage(result RequestResult) {
+	if result.ModelID == "" || result.TotalTokens == 0 && result.PromptTokens == 0 && result.CompletionTokens == 0 {
+		return
+	}
+	tokensUsed.Add(float64(result.PromptTokens), result.ModelID, "prompt")
+	tokensUsed.Add(float64(result.CompletionTokens), result.ModelID, "completion")
+
+	usage.Lock()
+	defer usage.Unlock()
+	u, ok := usage.m[result.ModelID]
+	if !ok {
+		u = &ModelUsage{Model: result.ModelID}
+		usage.m[result.ModelID] = u
+	}
+	u.Requests++
+	u.PromptTokens += result.PromptTokens
+	u.CompletionTokens += result.CompletionTokens
+	u.TotalTokens += result.TotalTokens
+
+	if price, ok := getModelPrice(result.ModelID, result.Model); ok {
+		spend := price.cost(result.PromptTokens, result.CompletionTokens)
+		if u.EstimatedSpend != nil {
+			spend += *u.EstimatedSpend
+		}
+		u.EstimatedSpend = &spend
+		estimatedSpend.Set(spend, result.ModelID)
+	}
+}
+
+// UsageStats is the body of /stats
+type UsageStats struct {
+	Models []ModelUsage `json:"models"`
+	// EstimatedSpend sums the spend of the priced models only
+	EstimatedSpend float64 `json:"estimatedSpendUsd"`
+}
+
+// usageStats returns the usage tallied so far, ordered by model
+func usageStats() UsageStats {
+	usage.Lock()
+	defer usage.Unlock()
+	stats := UsageStats{Models: make([]ModelUsage, 0, len(usage.m))}
+	for _, u := range usage.m {
+		model := *u
+		if u.EstimatedSpend != nil {
+			spend := *u.EstimatedSpend
+			model.EstimatedSpend = &spend
+			stats.EstimatedSpend += spend
+		}
+		stats.Models = append(stats.Models, model)
+	}
+	sort.Slice(stats.Models, func(i, j int) bool { return stats.Models[i].Model < stats.Models[j].Model })
+	return stats
+}
+
+// handleStats serves the token usage and estimated spend by model. Usage is
+// only tallied with USAGE_ACCOUNTING on.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageStats())
+}
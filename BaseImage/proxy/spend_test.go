@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readUsageFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "usage", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetModelPrice(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing string
+		want    modelPrice
+		wantOK  bool
+	}{
+		{name: "by ID", pricing: "price-model=0.5:1.5", want: modelPrice{prompt: 0.5, completion: 1.5}, wantOK: true},
+		{name: "by name", pricing: "Price Model=0.25:0", want: modelPrice{prompt: 0.25}, wantOK: true},
+		{name: "other model", pricing: "other=1:1"},
+		{name: "missing completion price", pricing: "price-model=0.5"},
+		{name: "negative", pricing: "price-model=-1:1"},
+		{name: "not a number", pricing: "price-model=cheap:1"},
+		{name: "unset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("MODEL_PRICING", tt.pricing)
+			defer os.Unsetenv("MODEL_PRICING")
+			got, ok := getModelPrice("price-model", "Price Model")
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("getModelPrice() = %+v, %v; want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestUsageAccountingEstimatesSpend(t *testing.T) {
+	completion, stream := readUsageFixture(t, "completion.json"), readUsageFixture(t, "stream.txt")
+	chat := func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(stream)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(completion)
+	}
+	priced := newMarketplaceServer("priced-model", "Priced Model", chat)
+	defer priced.Close()
+	unpriced := newMarketplaceServer("unpriced-model", "Unpriced Model", chat)
+	defer unpriced.Close()
+	defer useMarketplaceURL("")()
+
+	// $0.50 per 1K prompt tokens and $1.50 per 1K completion tokens
+	os.Setenv("MODEL_PRICING", "Priced Model=0.5:1.5")
+	defer os.Unsetenv("MODEL_PRICING")
+	cfg := config
+	defer applyConfig(cfg)
+	accounting := cfg
+	accounting.UsageAccounting = true
+	applyConfig(accounting)
+	usage.Lock()
+	usage.m = make(map[string]*ModelUsage)
+	usage.Unlock()
+	promptTokens := tokensUsed.Value("priced-model", "prompt")
+
+	send := func(server *httptest.Server, body string) {
+		t.Helper()
+		config.MarketplaceURL = server.URL
+		activeSessions = make(map[string]*MorpheusSession)
+		w := newFlushRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+		}
+	}
+	send(priced, `{"model": "Priced Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	send(priced, `{"model": "Priced Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	send(unpriced, `{"model": "Unpriced Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+
+	w := httptest.NewRecorder()
+	handleStats(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats UsageStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || len(stats.Models) != 2 {
+		t.Fatalf("stats = %s, want two models: %v", w.Body.String(), err)
+	}
+
+	// 2,000 prompt tokens at $0.50 and 500 completion tokens at $1.50
+	const wantSpend = 1.75
+	got := stats.Models[0]
+	if got.Model != "priced-model" || got.Requests != 2 || got.PromptTokens != 2000 || got.CompletionTokens != 500 || got.TotalTokens != 2500 {
+		t.Errorf("priced model usage = %+v", got)
+	}
+	if got.EstimatedSpend == nil || math.Abs(*got.EstimatedSpend-wantSpend) > 1e-9 {
+		t.Errorf("priced model spend = %v, want %v", got.EstimatedSpend, wantSpend)
+	}
+	if math.Abs(stats.EstimatedSpend-wantSpend) > 1e-9 {
+		t.Errorf("total spend = %v, want %v", stats.EstimatedSpend, wantSpend)
+	}
+	if gauge := estimatedSpend.Value("priced-model"); math.Abs(gauge-wantSpend) > 1e-9 {
+		t.Errorf("spend gauge = %v, want %v", gauge, wantSpend)
+	}
+	if got := tokensUsed.Value("priced-model", "prompt") - promptTokens; got != 2000 {
+		t.Errorf("prompt tokens counted = %v, want 2000", got)
+	}
+
+	// Without a price only the tokens are reported
+	other := stats.Models[1]
+	if other.Model != "unpriced-model" || other.TotalTokens != 1500 || other.EstimatedSpend != nil {
+		t.Errorf("unpriced model usage = %+v, want tokens only", other)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cacheStatusHeader marks a response served from the stale cache
+const cacheStatusHeader = "X-Cache"
+
+// staleResponses is rebuilt by applyConfig. It is nil unless
+// SERVE_STALE_ON_OUTAGE is set.
+var staleResponses *staleCache
+
+var staleServed = metrics.counter("morpheus_proxy_stale_responses_total",
+	"Non-streaming completions answered from the stale cache during a marketplace outage")
+
+type staleEntry struct {
+	key      string
+	response *cachedResponse
+	stored   time.Time
+}
+
+// staleCache keeps the most recent successful non-streaming completion for
+// each distinct request, however old, to answer repeats of it while the
+// marketplace is down. Once it holds maxEntries responses, the least
+// recently stored is evicted.
+type staleCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element // of *staleEntry
+	order      *list.List               // least recently stored first
+}
+
+func newStaleCache(enabled bool, maxEntries int) *staleCache {
+	if !enabled {
+		return nil
+	}
+	return &staleCache{maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// key identifies a request for modelID by its body. Maps encode with sorted
+// keys, so the same request always gives the same key. It is empty when the
+// cache is disabled.
+func (c *staleCache) key(modelID string, requestBody map[string]interface{}) string {
+	if c == nil {
+		return ""
+	}
+	encoded, err := encodeRequestBody(requestBody)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(modelID+"\x00"), encoded...))
+	return hex.EncodeToString(sum[:])
+}
+
+// store keeps a successful response for key, replacing any older one
+func (c *staleCache) store(key string, header http.Header, body []byte) {
+	if c == nil || key == "" {
+		return
+	}
+	header = header.Clone()
+	header.Del(requestIDHeader)
+	entry := &staleEntry{key: key, response: &cachedResponse{status: http.StatusOK, header: header, body: body}, stored: now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, exists := c.entries[key]; exists {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushBack(entry)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Remove(c.order.Front()).(*staleEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+func (c *staleCache) lookup(key string) (*staleEntry, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	return elem.Value.(*staleEntry), true
+}
+
+// withStaleCacheKey carries the request's stale cache key to the handler
+// that forwards it
+func withStaleCacheKey(r *http.Request, key string) *http.Request {
+	if key == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), staleCacheKeyKey, key))
+}
+
+func staleCacheKeyFrom(r *http.Request) string {
+	key, _ := r.Context().Value(staleCacheKeyKey).(string)
+	return key
+}
+
+// isMarketplaceOutage reports whether err means no answer could be had from
+// the marketplace, as opposed to the request being refused
+func isMarketplaceOutage(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrInsufficientBalance) &&
+		!errors.Is(err, ErrUpstreamBusy) &&
+		!errors.Is(err, ErrSessionEstablishing) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// serveStale answers r from the stale cache, reporting whether it did. The
+// response is marked "X-Cache: STALE" and carries its age.
+func serveStale(w http.ResponseWriter, r *http.Request, cause string) bool {
+	entry, ok := staleResponses.lookup(staleCacheKeyFrom(r))
+	if !ok {
+		return false
+	}
+	age := now().Sub(entry.stored)
+	log.Printf("Serving request %s from the stale cache (%v old): %s", r.Header.Get(requestIDHeader), age.Round(time.Second), cause)
+	staleServed.Inc()
+	copyHeaders(w, entry.response.header)
+	w.Header().Set(cacheStatusHeader, "STALE")
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	w.WriteHeader(entry.response.status)
+	w.Write(entry.response.body)
+	return true
+}
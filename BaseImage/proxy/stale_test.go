@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleResponseDuringOutage(t *testing.T) {
+	fake := newFakeClock()
+	defer SetClock(SetClock(fake))
+	cfg := config
+	defer applyConfig(cfg)
+	enabled := cfg
+	enabled.StaleOnOutage = true
+	enabled.StaleCacheSize = 10
+	applyConfig(enabled)
+
+	var down atomic.Bool
+	server := newMarketplaceServer("stale-model", "Stale Model", func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, `{"error": "provider offline"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"content": "cached answer"}}]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	const body = `{"model": "Stale Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusOK || w.Header().Get(cacheStatusHeader) != "" {
+		t.Fatalf("first request: status = %v, X-Cache = %q", w.Code, w.Header().Get(cacheStatusHeader))
+	}
+
+	// Long past any normal cache lifetime, the marketplace goes down
+	fake.Advance(2 * time.Hour)
+	down.Store(true)
+	before := staleServed.Value()
+
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status during outage = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(cacheStatusHeader); got != "STALE" {
+		t.Errorf("X-Cache = %q, want STALE", got)
+	}
+	if got := w.Header().Get("Age"); got != "7200" {
+		t.Errorf("Age = %q, want 7200", got)
+	}
+	if got := w.Body.String(); got != `{"choices": [{"message": {"content": "cached answer"}}]}` {
+		t.Errorf("body = %s, want the cached completion", got)
+	}
+	if got := staleServed.Value() - before; got != 1 {
+		t.Errorf("stale responses count = %v, want 1", got)
+	}
+
+	// A request never answered before has nothing to fall back on
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Stale Model", "messages": [{"role": "user", "content": "Goodbye"}]}`))
+	if w.Code == http.StatusOK || w.Header().Get(cacheStatusHeader) != "" {
+		t.Errorf("uncached request during outage: status = %v, X-Cache = %q", w.Code, w.Header().Get(cacheStatusHeader))
+	}
+
+	// It also covers a marketplace that cannot be reached at all
+	server.Close()
+	w = httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusOK || w.Header().Get(cacheStatusHeader) != "STALE" {
+		t.Errorf("unreachable marketplace: status = %v, X-Cache = %q", w.Code, w.Header().Get(cacheStatusHeader))
+	}
+}
+
+func TestStaleResponseDisabled(t *testing.T) {
+	cfg := config
+	defer applyConfig(cfg)
+	disabled := cfg
+	disabled.StaleOnOutage = false
+	applyConfig(disabled)
+
+	var calls atomic.Int32
+	server := newMarketplaceServer("fresh-model", "Fresh Model", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			http.Error(w, `{"error": "provider offline"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	const body = `{"model": "Fresh Model", "messages": [{"role": "user", "content": "Hello"}]}`
+	ProxyChatCompletion(httptest.NewRecorder(), newChatRequest(body))
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(body))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(cacheStatusHeader) != "" {
+		t.Errorf("status = %v, X-Cache = %q, want the outage relayed", w.Code, w.Header().Get(cacheStatusHeader))
+	}
+}
@@ -0,0 +1,627 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStreamCoalesceDelay = 50 * time.Millisecond
+
+// Per-model streaming policies accepted by STREAMING_DISABLED_MODELS
+const (
+	streamingPolicyAllow  = "allow"  // stream normally
+	streamingPolicyReject = "reject" // refuse stream requests with 400
+	streamingPolicyBuffer = "buffer" // request a full response and replay it as SSE
+)
+
+// getStreamingPolicy returns how stream requests are served for a model.
+// STREAMING_DISABLED_MODELS lists models with streaming disabled as
+// "model[=reject|buffer]"; a model listed without a policy is rejected.
+func getStreamingPolicy(modelID, modelHandle string) string {
+	policy, ok := lookupModelSetting(getEnvSettings("STREAMING_DISABLED_MODELS"), modelID, modelHandle)
+	if !ok {
+		return streamingPolicyAllow
+	}
+	switch strings.ToLower(policy) {
+	case "", streamingPolicyReject:
+		return streamingPolicyReject
+	case streamingPolicyBuffer:
+		return streamingPolicyBuffer
+	default:
+		log.Printf("Invalid STREAMING_DISABLED_MODELS policy %q for model %s, using %s", policy, modelID, streamingPolicyReject)
+		return streamingPolicyReject
+	}
+}
+
+// Policies for stream requests whose Accept header rules out an event
+// stream, set by STREAM_ACCEPT_POLICY
+const (
+	streamAcceptBuffer = "buffer" // answer with the completion as a single JSON response
+	streamAcceptReject = "reject" // refuse the request with 406
+)
+
+// getStreamAcceptPolicy returns STREAM_ACCEPT_POLICY, how a stream request
+// from a client that does not accept text/event-stream is served
+func getStreamAcceptPolicy(modelID string) string {
+	switch policy := strings.ToLower(getEnvOrDefault("STREAM_ACCEPT_POLICY", streamAcceptBuffer)); policy {
+	case streamAcceptBuffer, streamAcceptReject:
+		return policy
+	default:
+		log.Printf("Invalid STREAM_ACCEPT_POLICY %q for model %s, using %s", policy, modelID, streamAcceptBuffer)
+		return streamAcceptBuffer
+	}
+}
+
+// acceptsEventStream reports whether the client's Accept header allows a
+// text/event-stream response, directly or through the text/* and */*
+// wildcards. A request without an Accept header accepts anything; a range
+// with "q=0" is a refusal.
+func acceptsEventStream(r *http.Request) bool {
+	headers := r.Header.Values("Accept")
+	if len(headers) == 0 {
+		return true
+	}
+	accepted := map[string]bool{}
+	for _, header := range headers {
+		for _, mediaRange := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(mediaRange, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "text/event-stream" && name != "text/*" && name != "*/*" {
+				continue
+			}
+			weight := 1.0
+			for _, param := range strings.Split(params, ";") {
+				if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+					if weight, _ = strconv.ParseFloat(strings.TrimSpace(q), 64); weight < 0 {
+						weight = 0
+					}
+				}
+			}
+			accepted[name] = weight > 0
+		}
+	}
+	// The most specific range that matches decides
+	for _, name := range []string{"text/event-stream", "text/*", "*/*"} {
+		if ok, matched := accepted[name]; matched {
+			return ok
+		}
+	}
+	return false
+}
+
+// getStreamCoalesceBytes returns the number of bytes to accumulate before
+// flushing a stream to the client. Zero flushes after every line.
+func getStreamCoalesceBytes() int {
+	return getEnvInt("STREAM_COALESCE_BYTES", 0)
+}
+
+// getStreamCoalesceDelay returns the longest time coalesced stream data may
+// wait before it is flushed, bounding the latency coalescing adds.
+func getStreamCoalesceDelay() time.Duration {
+	delayMs := getEnvInt("STREAM_COALESCE_DELAY_MS", 0)
+	if delayMs == 0 {
+		return defaultStreamCoalesceDelay
+	}
+	return time.Duration(delayMs) * time.Millisecond
+}
+
+const defaultMaxSSEEventBytes = 1 << 20
+
+// getMaxSSEEventBytes returns the largest single SSE event relayed to the
+// client. Larger events end the stream with an error.
+func getMaxSSEEventBytes() int {
+	maxBytes := getEnvInt("SSE_MAX_EVENT_BYTES", defaultMaxSSEEventBytes)
+	if maxBytes == 0 {
+		return defaultMaxSSEEventBytes
+	}
+	return maxBytes
+}
+
+// newSSEScanner returns a line scanner for an upstream stream that fails with
+// bufio.ErrTooLong instead of buffering a line longer than maxEventBytes.
+// Lines keep their terminators so events can be relayed byte for byte.
+func newSSEScanner(r io.Reader, maxEventBytes int) *bufio.Scanner {
+	initial := 4096
+	if maxEventBytes+1 < initial {
+		initial = maxEventBytes + 1
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initial), maxEventBytes+1)
+	scanner.Split(scanRawLines)
+	return scanner
+}
+
+// getStreamPrefetchChunks returns how many upstream chunks, each one line of
+// the stream, may be read ahead of delivery to the client. Zero reads only as
+// fast as the client takes them.
+func getStreamPrefetchChunks() int {
+	return getEnvInt("STREAM_PREFETCH_CHUNKS", 0)
+}
+
+// sseKeepalive is the SSE comment sent while the first chunk is awaited;
+// clients ignore comments
+const sseKeepalive = ": keepalive\n\n"
+
+// getStreamKeepaliveInterval returns how often a keepalive comment is sent
+// while a stream request waits for its session and its first upstream chunk,
+// so proxies with idle timeouts do not drop the connection during a long
+// time to first token. Zero sends none.
+func getStreamKeepaliveInterval() time.Duration {
+	return time.Duration(getEnvInt("STREAM_KEEPALIVE_INTERVAL_MS", 0)) * time.Millisecond
+}
+
+// keepaliveWriter answers a stream request with sseKeepalive every interval
+// until the handler first writes or flushes, covering the session's
+// establishment and the wait for the first upstream chunk. The first
+// keepalive sends the response as a 200 event stream, so an error answered
+// after it is sent as an SSE error event instead, and any status and
+// headers set after it are dropped. The handler sets its headers on a copy,
+// sent with its own status, as the keepalives may send w's at any moment.
+type keepaliveWriter struct {
+	http.ResponseWriter
+	header     http.Header
+	headerSent bool
+	mu         sync.Mutex
+	stopped    bool
+	committed  bool // a keepalive has sent the status and headers
+	failed     bool // the handler answered an error once committed
+	done       chan struct{}
+	once       sync.Once
+}
+
+// newKeepaliveWriter starts sending keepalives on w every interval
+func newKeepaliveWriter(w http.ResponseWriter, interval time.Duration) *keepaliveWriter {
+	kw := &keepaliveWriter{ResponseWriter: w, header: w.Header().Clone(), done: make(chan struct{})}
+	go kw.run(interval)
+	return kw
+}
+
+func (kw *keepaliveWriter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kw.done:
+			return
+		case <-ticker.C:
+		}
+		kw.mu.Lock()
+		if !kw.stopped {
+			if !kw.committed {
+				setStreamingHeaders(kw.ResponseWriter)
+				clearWriteDeadline(kw.ResponseWriter)
+				kw.ResponseWriter.WriteHeader(http.StatusOK)
+				kw.committed = true
+			}
+			if _, err := io.WriteString(kw.ResponseWriter, sseKeepalive); err == nil {
+				if f, ok := kw.ResponseWriter.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+		kw.mu.Unlock()
+	}
+}
+
+// stop ends the keepalives; none is written once it has returned. It may
+// be called any number of times.
+func (kw *keepaliveWriter) stop() {
+	kw.once.Do(func() {
+		kw.mu.Lock()
+		kw.stopped = true
+		kw.mu.Unlock()
+		close(kw.done)
+	})
+}
+
+// isCommitted reports whether keepalives have sent the response's status
+// and headers. It stops them, so the answer cannot change, and otherwise
+// hands the handler's headers over to be sent with its response.
+func (kw *keepaliveWriter) isCommitted() bool {
+	kw.stop()
+	if !kw.committed && !kw.headerSent {
+		header := kw.ResponseWriter.Header()
+		for name := range header {
+			if _, ok := kw.header[name]; !ok {
+				delete(header, name)
+			}
+		}
+		for name, values := range kw.header {
+			header[name] = values
+		}
+		kw.headerSent = true
+	}
+	return kw.committed
+}
+
+func (kw *keepaliveWriter) Header() http.Header {
+	return kw.header
+}
+
+func (kw *keepaliveWriter) WriteHeader(code int) {
+	if kw.isCommitted() {
+		kw.failed = code != http.StatusOK
+		return
+	}
+	kw.ResponseWriter.WriteHeader(code)
+}
+
+func (kw *keepaliveWriter) Write(p []byte) (int, error) {
+	if !kw.isCommitted() || !kw.failed {
+		return kw.ResponseWriter.Write(p)
+	}
+	// Error responses carry the error object an SSE error event does
+	var event bytes.Buffer
+	if json.Compact(&event, p) != nil {
+		apiErr, _ := json.Marshal(errorResponse{Error: newAPIError(http.StatusBadGateway, "Marketplace request failed")})
+		event.Reset()
+		event.Write(apiErr)
+	}
+	if _, err := fmt.Fprintf(kw.ResponseWriter, "data: %s\n\n", event.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (kw *keepaliveWriter) Flush() {
+	kw.isCommitted()
+	if f, ok := kw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (kw *keepaliveWriter) Unwrap() http.ResponseWriter {
+	return kw.ResponseWriter
+}
+
+// keepaliveCommitted reports whether keepalives have already sent w's
+// response as an event stream
+func keepaliveCommitted(w http.ResponseWriter) bool {
+	kw, ok := w.(*keepaliveWriter)
+	return ok && kw.isCommitted()
+}
+
+// lineScanner is the part of bufio.Scanner the streaming loop reads through
+type lineScanner interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// prefetchScanner reads lines from an upstream stream in the background, up
+// to a fixed number ahead of the reader, so a slow client write does not
+// stall the upstream read. Lines are bounded by the scanner's buffer, so at
+// most chunks+1 of them are held.
+type prefetchScanner struct {
+	lines chan string
+	stop  chan struct{}
+	line  string
+	err   error // set before lines is closed
+}
+
+func newPrefetchScanner(scanner *bufio.Scanner, chunks int) *prefetchScanner {
+	p := &prefetchScanner{lines: make(chan string, chunks), stop: make(chan struct{})}
+	go func() {
+		defer close(p.lines)
+		for scanner.Scan() {
+			select {
+			case p.lines <- scanner.Text():
+			case <-p.stop:
+				return
+			}
+		}
+		p.err = scanner.Err()
+	}()
+	return p
+}
+
+func (p *prefetchScanner) Scan() bool {
+	line, ok := <-p.lines
+	p.line = line
+	return ok
+}
+
+func (p *prefetchScanner) Text() string {
+	return p.line
+}
+
+// Err returns the upstream read error once Scan has returned false
+func (p *prefetchScanner) Err() error {
+	return p.err
+}
+
+// Close stops reading ahead. A read blocked on the upstream ends when its
+// body is closed.
+func (p *prefetchScanner) Close() {
+	close(p.stop)
+}
+
+// scanRawLines is a bufio.SplitFunc like bufio.ScanLines that leaves the line
+// ending, "\n" or "\r\n", on each line
+func scanRawLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// getNormalizeLineEndings reports whether SSE_NORMALIZE_LINE_ENDINGS is set,
+// in which case "\r\n" line endings from the upstream are relayed as "\n"
+// for clients that only accept the latter
+func getNormalizeLineEndings() bool {
+	return getEnvBool("SSE_NORMALIZE_LINE_ENDINGS", false)
+}
+
+// normalizeLineEnding replaces a raw line's "\r\n" ending with "\n"
+func normalizeLineEnding(line string) string {
+	if strings.HasSuffix(line, "\r\n") {
+		return strings.TrimSuffix(line, "\r\n") + "\n"
+	}
+	return line
+}
+
+// isBlankLine reports whether a raw SSE line, ending included, is empty and
+// so ends an event
+func isBlankLine(line string) bool {
+	return strings.TrimRight(line, "\r\n") == ""
+}
+
+// terminateOversizedStream ends a stream whose current event exceeded
+// maxEventBytes with an error event
+func terminateOversizedStream(sw *streamWriter, modelID string, maxEventBytes int) {
+	message := fmt.Sprintf("Stream event exceeded the maximum size of %d bytes", maxEventBytes)
+	log.Printf("Terminating stream for model %s: %s", modelID, message)
+	recordModelError(modelID, http.StatusOK, message)
+	sw.WriteError(message)
+}
+
+// isEventStream reports whether a marketplace response is an SSE stream. A
+// response without a Content-Type is assumed to be one, as before.
+func isEventStream(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// ndjsonContentType is the Content-Type of a stream relayed as
+// newline-delimited JSON
+const ndjsonContentType = "application/x-ndjson"
+
+// isNDJSONStream reports whether a marketplace response streams
+// newline-delimited JSON objects rather than SSE events
+func isNDJSONStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
+	}
+	return false
+}
+
+// isStreamDone reports whether an SSE line is the end-of-stream sentinel
+func isStreamDone(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "data: [DONE]" || line == "data:[DONE]"
+}
+
+// streamWriter writes streamed lines to the client. By default every line is
+// flushed immediately; with coalescing enabled, flushes are deferred until
+// maxBytes have accumulated or maxDelay has passed since the first unflushed
+// line. The [DONE] sentinel is always flushed at once.
+type streamWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	flusher  http.Flusher
+	maxBytes int
+	maxDelay time.Duration
+	pending  int
+	timer    *time.Timer
+	closed   bool
+	ndjson   bool // errors are written as NDJSON lines rather than SSE events
+}
+
+func newStreamWriter(w io.Writer, flusher http.Flusher) *streamWriter {
+	return &streamWriter{
+		w:        w,
+		flusher:  flusher,
+		maxBytes: getStreamCoalesceBytes(),
+		maxDelay: getStreamCoalesceDelay(),
+	}
+}
+
+// WriteLine writes a line, including its terminator, and flushes as configured
+func (sw *streamWriter) WriteLine(line string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if _, err := io.WriteString(sw.w, line); err != nil {
+		return err
+	}
+	sw.pending += len(line)
+
+	if sw.maxBytes <= 0 || sw.pending >= sw.maxBytes || isStreamDone(line) {
+		sw.flushLocked()
+		return nil
+	}
+	if sw.timer == nil {
+		sw.timer = time.AfterFunc(sw.maxDelay, sw.Flush)
+	}
+	return nil
+}
+
+// WriteError ends the stream with an SSE error event, or an error line for
+// an NDJSON stream, carrying the same error object as an error response, and
+// flushes it at once. It is used for
+// failures after the response status has been sent.
+func (sw *streamWriter) WriteError(message string) error {
+	event, err := json.Marshal(errorResponse{Error: newAPIError(http.StatusBadGateway, message)})
+	if err != nil {
+		return err
+	}
+
+	format := "data: %s\n\n"
+	if sw.ndjson {
+		format = "%s\n"
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if _, err := fmt.Fprintf(sw.w, format, event); err != nil {
+		return err
+	}
+	sw.pending++
+	sw.flushLocked()
+	return nil
+}
+
+// Flush sends any pending data to the client
+func (sw *streamWriter) Flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.flushLocked()
+}
+
+// Close flushes pending data and stops the coalescing timer. The writer must
+// not be used after the handler returns, so Close is deferred by callers.
+func (sw *streamWriter) Close() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.flushLocked()
+	sw.closed = true
+}
+
+func (sw *streamWriter) flushLocked() {
+	if sw.timer != nil {
+		sw.timer.Stop()
+		sw.timer = nil
+	}
+	if sw.closed || sw.pending == 0 {
+		return
+	}
+	sw.flusher.Flush()
+	sw.pending = 0
+}
+
+// handleBufferedStreamingRequest serves a stream request for a model that
+// cannot stream: the completion is fetched in full and sent to the client as
+// a single SSE chunk followed by [DONE].
+func handleBufferedStreamingRequest(w http.ResponseWriter, r *http.Request, requestBody map[string]interface{}, modelID string) {
+	resp, err := forwardRequestValidatingJSON(r, requestBody, modelID)
+	if err != nil {
+		respondWithForwardError(w, err, "Failed to forward request")
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Error reading marketplace response")
+		return
+	}
+
+	var events []string
+	if resp.StatusCode == http.StatusOK {
+		events, err = completionToSSE(body)
+	}
+	if resp.StatusCode != http.StatusOK || err != nil {
+		if err != nil {
+			log.Printf("Cannot convert completion for model %s to a stream: %v", modelID, err)
+		}
+		copyHeaders(w, resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	recordFinishReasons(modelID, body)
+	setStreamingHeaders(w)
+	copyMetadataHeaders(w, resp.Header)
+	w.Header().Set(servedModelHeader, resp.Header.Get(servedModelHeader))
+	w.WriteHeader(http.StatusOK)
+	for _, event := range events {
+		fmt.Fprintf(w, "data: %s\n\n", event)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// relayCompletionAsEvents relays the single JSON completion a marketplace
+// answered a stream request with as one chunk event followed by [DONE]
+func relayCompletionAsEvents(w http.ResponseWriter, resp *http.Response, modelID string) {
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		var events []string
+		if events, err = completionToSSE(body); err == nil {
+			recordFinishReasons(modelID, body)
+			for _, event := range events {
+				fmt.Fprintf(w, "data: %s\n\n", event)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+	}
+	log.Printf("Cannot relay the response for model %s as a stream: %v", modelID, err)
+	respondWithError(w, http.StatusBadGateway, "Invalid response from the marketplace")
+}
+
+// completionToSSE converts a non-streaming chat completion into the payload of
+// an equivalent chat.completion.chunk event
+func completionToSSE(body []byte) ([]string, error) {
+	var completion struct {
+		ID      string `json:"id"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Index        int                    `json:"index"`
+			Message      map[string]interface{} `json:"message"`
+			FinishReason interface{}            `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("failed to decode completion: %v", err)
+	}
+
+	choices := make([]map[string]interface{}, 0, len(completion.Choices))
+	for _, choice := range completion.Choices {
+		choices = append(choices, map[string]interface{}{
+			"index":         choice.Index,
+			"delta":         choice.Message,
+			"finish_reason": choice.FinishReason,
+		})
+	}
+
+	chunk, err := json.Marshal(map[string]interface{}{
+		"id":      completion.ID,
+		"object":  "chat.completion.chunk",
+		"created": completion.Created,
+		"model":   completion.Model,
+		"choices": choices,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(chunk)}, nil
+}
@@ -0,0 +1,815 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushRecorder is a ResponseRecorder that counts flushes
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushes int
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.flushes++
+	fr.ResponseRecorder.Flush()
+}
+
+func (fr *flushRecorder) flushCount() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.flushes
+}
+
+func TestStreamWriterFlushesEveryLineByDefault(t *testing.T) {
+	os.Unsetenv("STREAM_COALESCE_BYTES")
+
+	rec := newFlushRecorder()
+	sw := newStreamWriter(rec, rec)
+	for i := 0; i < 5; i++ {
+		sw.WriteLine(fmt.Sprintf("data: %d\n", i))
+	}
+	sw.Close()
+
+	if got := rec.flushCount(); got != 5 {
+		t.Errorf("flushes = %d, want 5", got)
+	}
+}
+
+func TestStreamWriterCoalescesSmallChunks(t *testing.T) {
+	os.Setenv("STREAM_COALESCE_BYTES", "40")
+	defer os.Unsetenv("STREAM_COALESCE_BYTES")
+	os.Setenv("STREAM_COALESCE_DELAY_MS", "10000")
+	defer os.Unsetenv("STREAM_COALESCE_DELAY_MS")
+
+	rec := newFlushRecorder()
+	sw := newStreamWriter(rec, rec)
+
+	// Each line is 10 bytes, so every fourth line crosses the threshold
+	for i := 0; i < 8; i++ {
+		sw.WriteLine(fmt.Sprintf("data: 00%d\n", i))
+	}
+	if got := rec.flushCount(); got != 2 {
+		t.Errorf("flushes after 8 lines = %d, want 2", got)
+	}
+
+	// [DONE] must go out immediately even below the threshold
+	sw.WriteLine("data: 008\n")
+	sw.WriteLine("data: [DONE]\n")
+	if got := rec.flushCount(); got != 3 {
+		t.Errorf("flushes after [DONE] = %d, want 3", got)
+	}
+	sw.Close()
+
+	body := rec.Body.String()
+	if !strings.HasSuffix(body, "data: [DONE]\n") || strings.Count(body, "\n") != 10 {
+		t.Errorf("coalescing altered stream content: %q", body)
+	}
+}
+
+func TestStreamWriterFlushesAfterDelay(t *testing.T) {
+	os.Setenv("STREAM_COALESCE_BYTES", "1000")
+	defer os.Unsetenv("STREAM_COALESCE_BYTES")
+	os.Setenv("STREAM_COALESCE_DELAY_MS", "20")
+	defer os.Unsetenv("STREAM_COALESCE_DELAY_MS")
+
+	rec := newFlushRecorder()
+	sw := newStreamWriter(rec, rec)
+	defer sw.Close()
+
+	sw.WriteLine("data: 1\n")
+	if got := rec.flushCount(); got != 0 {
+		t.Fatalf("flushes before delay = %d, want 0", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for rec.flushCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := rec.flushCount(); got != 1 {
+		t.Errorf("flushes after delay = %d, want 1", got)
+	}
+}
+
+// BenchmarkStreamWriter relays a token-level stream over a real connection,
+// flushing every line against coalescing up to 4KiB. Compare the two with
+// go test -bench StreamWriter -run '^$' ./proxy/
+func BenchmarkStreamWriter(b *testing.B) {
+	const events = 1000
+	event := "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"tok\"}}]}\n\n"
+
+	for _, bc := range []struct {
+		name  string
+		bytes string
+	}{
+		{name: "flush-per-line", bytes: "0"},
+		{name: "coalesce-4KiB", bytes: "4096"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			os.Setenv("STREAM_COALESCE_BYTES", bc.bytes)
+			defer os.Unsetenv("STREAM_COALESCE_BYTES")
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				sw := newStreamWriter(w, w.(http.Flusher))
+				defer sw.Close()
+				for i := 0; i < events; i++ {
+					for _, line := range strings.SplitAfter(event, "\n")[:2] {
+						sw.WriteLine(line)
+					}
+				}
+				sw.WriteLine("data: [DONE]\n")
+			}))
+			defer server.Close()
+
+			b.SetBytes(int64(events * len(event)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestStreamingDisabledPerModel(t *testing.T) {
+	var upstreamStream interface{}
+	server := newMarketplaceServer("nostream-model", "NoStream Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamStream = body["stream"]
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "cmpl-1", "model": "nostream-model", "choices": [{"index": 0, "message": {"role": "assistant", "content": "buffered answer"}, "finish_reason": "stop"}]}`))
+	})
+	defer server.Close()
+
+	defer useMarketplaceURL(server.URL)()
+
+	const body = `{"model": "NoStream Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+
+	t.Run("reject", func(t *testing.T) {
+		os.Setenv("STREAMING_DISABLED_MODELS", "nostream-model")
+		defer os.Unsetenv("STREAMING_DISABLED_MODELS")
+
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %v", w.Code)
+		}
+	})
+
+	t.Run("buffer", func(t *testing.T) {
+		os.Setenv("STREAMING_DISABLED_MODELS", "other-model=reject,nostream-model=buffer")
+		defer os.Unsetenv("STREAMING_DISABLED_MODELS")
+
+		w := httptest.NewRecorder()
+		ProxyChatCompletion(w, newChatRequest(body))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v", w.Code)
+		}
+		if upstreamStream != false {
+			t.Errorf("upstream stream = %v, want false", upstreamStream)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Content-Type = %s, want text/event-stream", ct)
+		}
+		out := w.Body.String()
+		if !strings.Contains(out, `"content":"buffered answer"`) || !strings.HasSuffix(out, "data: [DONE]\n\n") {
+			t.Errorf("unexpected buffered stream: %q", out)
+		}
+	})
+
+	t.Run("other models stream normally", func(t *testing.T) {
+		if got := getStreamingPolicy("some-model", "Some Model"); got != streamingPolicyAllow {
+			t.Errorf("getStreamingPolicy() = %s, want %s", got, streamingPolicyAllow)
+		}
+	})
+}
+
+func TestStreamingUpstreamClosesAbruptly(t *testing.T) {
+	server := newMarketplaceServer("abrupt-model", "Abrupt Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"partial\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		conn.Close()
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Abrupt Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %v, want the 200 already sent", w.Code)
+	}
+	out := w.Body.String()
+	if !strings.Contains(out, "partial") {
+		t.Errorf("chunks before the failure were lost: %q", out)
+	}
+	if !strings.HasSuffix(out, "data: {\"error\":{\"message\":\"Error reading streaming response\",\"type\":\"server_error\",\"param\":null,\"code\":null}}\n\n") {
+		t.Errorf("stream did not end with an error event: %q", out)
+	}
+	if strings.Count(out, `"error"`) != 1 {
+		t.Errorf("expected exactly one error in the stream: %q", out)
+	}
+}
+
+func TestStreamingStopsAtDone(t *testing.T) {
+	server := newMarketplaceServer("done-model", "Done Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\": []}\n\ndata: [DONE]\n\ndata: trailing garbage\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Done Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if out := w.Body.String(); !strings.HasSuffix(out, "data: [DONE]\n\n") {
+		t.Errorf("stream did not end cleanly at [DONE]: %q", out)
+	}
+}
+
+func TestStreamingRelaysLineOverScannerDefault(t *testing.T) {
+	// Larger than bufio.Scanner's default 64KB token limit, as large tool
+	// call arguments and base64 images can be
+	line := "data: {\"choices\": [{\"delta\": {\"content\": \"" + strings.Repeat("z", 100*1024) + "\"}}]}\n\n"
+	server := newMarketplaceServer("wide-model", "Wide Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(line))
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Unsetenv("SSE_MAX_EVENT_BYTES")
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Wide Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if out := w.Body.String(); out != line+"data: [DONE]\n\n" {
+		t.Errorf("stream with a %d byte line was not relayed intact (got %d bytes)", len(line), len(out))
+	}
+}
+
+func TestStreamingTerminatesOversizedEvent(t *testing.T) {
+	server := newMarketplaceServer("big-model", "Big Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\": []}\n\n"))
+		w.Write([]byte("data: " + strings.Repeat("x", 4096) + "\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("SSE_MAX_EVENT_BYTES", "1024")
+	defer os.Unsetenv("SSE_MAX_EVENT_BYTES")
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Big Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	out := w.Body.String()
+	if strings.Contains(out, "xxxx") || strings.Contains(out, "[DONE]") {
+		t.Errorf("oversized event or later events were relayed: %q", out)
+	}
+	if !strings.HasPrefix(out, "data: {\"choices\": []}\n\n") {
+		t.Errorf("events before the oversized one were lost: %q", out)
+	}
+	if !strings.HasSuffix(out, "data: {\"error\":{\"message\":\"Stream event exceeded the maximum size of 1024 bytes\",\"type\":\"server_error\",\"param\":null,\"code\":null}}\n\n") {
+		t.Errorf("stream was not terminated with a size error: %q", out)
+	}
+}
+
+func TestStreamingOversizedMultilineEvent(t *testing.T) {
+	server := newMarketplaceServer("multiline-model", "Multiline Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(w, "data: %s\n", strings.Repeat("y", 100))
+		}
+		w.Write([]byte("\ndata: [DONE]\n\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	os.Setenv("SSE_MAX_EVENT_BYTES", "1024")
+	defer os.Unsetenv("SSE_MAX_EVENT_BYTES")
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Multiline Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if out := w.Body.String(); strings.Contains(out, "yyyy") || !strings.Contains(out, "maximum size") {
+		t.Errorf("multi-line oversized event was not terminated: %q", out)
+	}
+}
+
+func TestStreamRequestWithJSONUpstream(t *testing.T) {
+	const completion = `{"id": "cmpl-1", "choices": [{"index": 0, "message": {"role": "assistant", "content": "not streamed"}}]}`
+	server := newMarketplaceServer("json-model", "JSON Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(completion))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "JSON Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %s, want the upstream JSON type", ct)
+	}
+	if w.Body.String() != completion {
+		t.Errorf("JSON body was altered: %q", w.Body.String())
+	}
+}
+
+func TestIsEventStream(t *testing.T) {
+	tests := map[string]bool{
+		"text/event-stream":                true,
+		"text/event-stream; charset=utf-8": true,
+		"":                                 true,
+		"application/json":                 false,
+		"text/plain; charset=utf-8":        false,
+	}
+	for contentType, want := range tests {
+		header := http.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		if got := isEventStream(header); got != want {
+			t.Errorf("isEventStream(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestStreamingToolCallsRelayedByteExact(t *testing.T) {
+	// Tool call arguments arrive as JSON fragments split across chunks, with
+	// escapes and characters a re-encoder would change
+	const fixture = "data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]},\"finish_reason\":null}]}\n\n" +
+		"data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"city\\\": \\\"S\"}}]},\"finish_reason\":null}]}\n\n" +
+		"data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"ão <Paulo> \\u0026 \\\\n\\\"}\"}}]},\"finish_reason\":null}]}\r\n\r\n" +
+		"data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n" +
+		"data: [DONE]\n\n"
+
+	server := newMarketplaceServer("tool-model", "Tool Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(fixture))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Tool Model", "stream": true, "tools": [{"type": "function", "function": {"name": "get_weather"}}], "messages": [{"role": "user", "content": "Weather?"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", w.Code)
+	}
+	if got := w.Body.String(); got != fixture {
+		t.Errorf("tool call stream was altered:\ngot  %q\nwant %q", got, fixture)
+	}
+}
+
+func TestStreamingNormalizesLineEndings(t *testing.T) {
+	server := newMarketplaceServer("crlf-model", "CRLF Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"a\\r\\nb\"}}]}\r\n\r\n" +
+			"event: message\r\ndata: {\"choices\": []}\r\n\r\n" +
+			"data: [DONE]\r\n\r\n"))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	tests := []struct {
+		name      string
+		normalize string
+		want      string
+	}{
+		{
+			name:      "enabled",
+			normalize: "true",
+			want: "data: {\"choices\": [{\"delta\": {\"content\": \"a\\r\\nb\"}}]}\n\n" +
+				"event: message\ndata: {\"choices\": []}\n\n" +
+				"data: [DONE]\n\n",
+		},
+		{
+			name:      "disabled by default",
+			normalize: "",
+			want: "data: {\"choices\": [{\"delta\": {\"content\": \"a\\r\\nb\"}}]}\r\n\r\n" +
+				"event: message\r\ndata: {\"choices\": []}\r\n\r\n" +
+				"data: [DONE]\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SSE_NORMALIZE_LINE_ENDINGS", tt.normalize)
+			defer os.Unsetenv("SSE_NORMALIZE_LINE_ENDINGS")
+
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "CRLF Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefetchScannerBuffersConfiguredChunks(t *testing.T) {
+	const chunks = 4
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	var mu sync.Mutex
+	written := 0
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := fmt.Fprintf(pw, "data: %d\n", i); err != nil {
+				return
+			}
+			mu.Lock()
+			written++
+			mu.Unlock()
+		}
+		pw.Close()
+	}()
+	writtenLines := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return written
+	}
+
+	p := newPrefetchScanner(newSSEScanner(pr, 1024), chunks)
+	defer p.Close()
+
+	// Without a reader, the configured chunks fill the buffer and one more
+	// line waits to be sent; the upstream is not read further
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.lines) < chunks && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := len(p.lines); got != chunks {
+		t.Errorf("buffered chunks = %d, want %d", got, chunks)
+	}
+	if got := writtenLines(); got != chunks+1 {
+		t.Errorf("upstream lines read = %d, want %d", got, chunks+1)
+	}
+
+	for i := 0; i < 20; i++ {
+		if !p.Scan() {
+			t.Fatalf("stream ended after %d lines: %v", i, p.Err())
+		}
+		if want := fmt.Sprintf("data: %d\n", i); p.Text() != want {
+			t.Errorf("line %d = %q, want %q", i, p.Text(), want)
+		}
+	}
+	if p.Scan() || p.Err() != nil {
+		t.Errorf("expected a clean end of stream, got error %v", p.Err())
+	}
+}
+
+func TestStreamingWithPrefetch(t *testing.T) {
+	os.Setenv("STREAM_PREFETCH_CHUNKS", "2")
+	defer os.Unsetenv("STREAM_PREFETCH_CHUNKS")
+
+	const stream = "data: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}\n\n" +
+		"data: {\"choices\": [{\"delta\": {\"content\": \"b\"}}]}\n\n" +
+		"data: {\"choices\": [{\"delta\": {\"content\": \"c\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	server := newMarketplaceServer("prefetch-model", "Prefetch Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(stream))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Prefetch Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200", w.Code)
+	}
+	if got := w.Body.String(); got != stream {
+		t.Errorf("relayed stream = %q, want %q", got, stream)
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", true},
+		{"text/event-stream", true},
+		{"*/*", true},
+		{"application/json, text/*;q=0.5", true},
+		{"Text/Event-Stream; charset=utf-8", true},
+		{"application/json", false},
+		{"application/json, text/event-stream;q=0", false},
+		{"text/event-stream;q=0, */*", false},
+		{"*/*;q=0", false},
+		{"text/html", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := acceptsEventStream(r); got != tt.want {
+			t.Errorf("acceptsEventStream(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestStreamRequestAcceptHeader(t *testing.T) {
+	var upstreamStream interface{}
+	server := newMarketplaceServer("accept-model", "Accept Model", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		upstreamStream = body["stream"]
+		if body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"streamed\"}}]}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "cmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "whole answer"}, "finish_reason": "stop"}]}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	const body = `{"model": "Accept Model", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "Hello"}]}`
+	serve := func(accept string) *flushRecorder {
+		upstreamStream = nil
+		req := newChatRequest(body)
+		req.Header.Set("Accept", accept)
+		w := newFlushRecorder()
+		ProxyChatCompletion(w, req)
+		return w
+	}
+
+	t.Run("event stream accepted", func(t *testing.T) {
+		for _, accept := range []string{"text/event-stream", "*/*"} {
+			w := serve(accept)
+			if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" || !strings.Contains(w.Body.String(), "streamed") {
+				t.Errorf("Accept %s: Content-Type = %s, body = %q, want the stream", accept, ct, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("json only falls back to a JSON response", func(t *testing.T) {
+		w := serve("application/json")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %v, want 200: %s", w.Code, w.Body.String())
+		}
+		if upstreamStream != false {
+			t.Errorf("upstream stream = %v, want false", upstreamStream)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s, want application/json", ct)
+		}
+		if !strings.Contains(w.Body.String(), "whole answer") {
+			t.Errorf("body = %q, want the whole completion", w.Body.String())
+		}
+	})
+
+	t.Run("json only rejected", func(t *testing.T) {
+		os.Setenv("STREAM_ACCEPT_POLICY", "reject")
+		defer os.Unsetenv("STREAM_ACCEPT_POLICY")
+
+		w := serve("application/json")
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("status = %v, want 406: %s", w.Code, w.Body.String())
+		}
+		if upstreamStream != nil {
+			t.Error("a rejected request was forwarded to the marketplace")
+		}
+	})
+}
+
+func TestStreamRequestUpstreamError(t *testing.T) {
+	var contentType, reply string
+	server := newMarketplaceServer("failing-stream", "Failing Stream", func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(reply))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	cfg := config
+	defer applyConfig(cfg)
+	noRetries := cfg
+	noRetries.ForwardRetries = 0
+	applyConfig(noRetries)
+
+	tests := []struct {
+		name        string
+		contentType string
+		reply       string
+		wantBody    string
+	}{
+		{"JSON error", "application/json", `{"error": {"message": "provider crashed"}}`, "provider crashed"},
+		{"SSE error", "text/event-stream", "data: {\"error\": \"provider crashed\"}\n\n", "Marketplace returned status 500"},
+		{"untyped error", "", "provider crashed", "Marketplace returned status 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, reply = tt.contentType, tt.reply
+
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Failing Stream", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want the upstream 500", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json rather than a stream", ct)
+			}
+			if !json.Valid(w.Body.Bytes()) || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want a JSON error containing %q", w.Body.String(), tt.wantBody)
+			}
+			if w.flushCount() != 0 {
+				t.Error("error response was flushed as a stream")
+			}
+			if n := upstreamPool.inUse(); n != 0 {
+				t.Errorf("%d upstream slots still held after the error", n)
+			}
+		})
+	}
+}
+
+func TestStreamingUpstreamFormats(t *testing.T) {
+	const sse = "data: {\"choices\": [{\"delta\": {\"content\": \"Hel\"}}]}\n\ndata: {\"choices\": [{\"delta\": {\"content\": \"lo\"}}]}\n\ndata: [DONE]\n\n"
+	const ndjson = "{\"choices\": [{\"delta\": {\"content\": \"Hel\"}}]}\n{\"choices\": [{\"delta\": {\"content\": \"lo\"}}]}\r\n{\"choices\": [], \"done\": true}\n"
+	var contentType, stream string
+	server := newMarketplaceServer("format-model", "Format Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(stream))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	tests := []struct {
+		name            string
+		contentType     string
+		stream          string
+		wantContentType string
+		wantFlushes     int
+	}{
+		{"SSE", "text/event-stream", sse, "text/event-stream", 3},
+		{"NDJSON", "application/x-ndjson", ndjson, ndjsonContentType, 3},
+		{"NDJSON with charset", "application/x-ndjson; charset=utf-8", ndjson, ndjsonContentType, 3},
+		{"JSON Lines", "application/jsonl", ndjson, ndjsonContentType, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, stream = tt.contentType, tt.stream
+
+			w := newFlushRecorder()
+			ProxyChatCompletion(w, newChatRequest(`{"model": "Format Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+			if ct := w.Header().Get("Content-Type"); ct != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantContentType)
+			}
+			if w.Body.String() != tt.stream {
+				t.Errorf("stream = %q, want it relayed byte for byte: %q", w.Body.String(), tt.stream)
+			}
+			if got := w.flushCount(); got < tt.wantFlushes {
+				t.Errorf("flushes = %d, want at least %d, one per line or event", got, tt.wantFlushes)
+			}
+		})
+	}
+
+	t.Run("NDJSON error", func(t *testing.T) {
+		os.Setenv("SSE_MAX_EVENT_BYTES", "64")
+		defer os.Unsetenv("SSE_MAX_EVENT_BYTES")
+		contentType, stream = "application/x-ndjson", "{\"ok\": true}\n{\"content\": \""+strings.Repeat("x", 100)+"\"}\n"
+
+		w := newFlushRecorder()
+		ProxyChatCompletion(w, newChatRequest(`{"model": "Format Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if len(lines) != 2 || lines[0] != `{"ok": true}` {
+			t.Fatalf("stream = %q, want the first line and an error line", w.Body.String())
+		}
+		var errLine errorResponse
+		if err := json.Unmarshal([]byte(lines[1]), &errLine); err != nil || errLine.Error.Message == "" {
+			t.Errorf("last line = %q, want an NDJSON error object", lines[1])
+		}
+	})
+}
+
+func TestIsNDJSONStream(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/x-ndjson":             true,
+		"application/ndjson":               true,
+		"application/jsonl; charset=utf-8": true,
+		"application/x-jsonlines":          true,
+		"text/event-stream":                false,
+		"application/json":                 false,
+		"":                                 false,
+	} {
+		header := http.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		if got := isNDJSONStream(header); got != want {
+			t.Errorf("isNDJSONStream(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestStreamingKeepaliveUntilFirstChunk(t *testing.T) {
+	os.Setenv("STREAM_KEEPALIVE_INTERVAL_MS", "20")
+	defer os.Unsetenv("STREAM_KEEPALIVE_INTERVAL_MS")
+
+	const first = "data: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}\n\n"
+	const rest = "data: {\"choices\": [{\"delta\": {\"content\": \"b\"}}]}\n\ndata: [DONE]\n\n"
+	server := newMarketplaceServer("keepalive-model", "Keepalive Model", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte(first))
+		w.(http.Flusher).Flush()
+		// Quiet as long again once data flows, which must not bring
+		// keepalives back
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte(rest))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Keepalive Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200", w.Code)
+	}
+	out := w.Body.String()
+	before, after, found := strings.Cut(out, first)
+	if !found {
+		t.Fatalf("first chunk missing from stream: %q", out)
+	}
+	if before == "" || strings.ReplaceAll(before, sseKeepalive, "") != "" {
+		t.Errorf("stream before the first chunk = %q, want only keepalives", before)
+	}
+	if after != rest {
+		t.Errorf("stream after the first chunk = %q, want %q", after, rest)
+	}
+}
+
+func TestStreamingKeepaliveWhileSessionOpens(t *testing.T) {
+	os.Setenv("STREAM_KEEPALIVE_INTERVAL_MS", "20")
+	defer os.Unsetenv("STREAM_KEEPALIVE_INTERVAL_MS")
+	activeSessions = make(map[string]*MorpheusSession)
+
+	marketplace := newMarketplaceServer("slow-session-model", "Slow Session Model", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"message": "provider failed"}}`, http.StatusInternalServerError)
+	})
+	defer marketplace.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/session") {
+			time.Sleep(150 * time.Millisecond)
+		}
+		marketplace.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	w := newFlushRecorder()
+	ProxyChatCompletion(w, newChatRequest(`{"model": "Slow Session Model", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want the 200 sent with the first keepalive", w.Code)
+	}
+	keepalives, errorEvent, _ := strings.Cut(w.Body.String(), "data: ")
+	if keepalives == "" || strings.ReplaceAll(keepalives, sseKeepalive, "") != "" {
+		t.Errorf("stream before the error = %q, want only keepalives", keepalives)
+	}
+	if !strings.Contains(errorEvent, `"provider failed"`) || !strings.HasSuffix(errorEvent, "\n\n") {
+		t.Errorf("stream ended with %q, want the marketplace error as an SSE event", errorEvent)
+	}
+}
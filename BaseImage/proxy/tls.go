@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// newUpstreamTLSConfig builds the TLS configuration for marketplace requests
+// from the environment, or returns nil when nothing is configured:
+//
+//   - UPSTREAM_CA_CERT: PEM bundle of CAs trusted in addition to the system ones
+//   - UPSTREAM_CLIENT_CERT, UPSTREAM_CLIENT_KEY: PEM client certificate and
+//     key for mutual TLS; both or neither must be set
+//   - UPSTREAM_INSECURE_SKIP_VERIFY: skip verifying the marketplace's
+//     certificate, for development only. It cannot be combined with
+//     UPSTREAM_CA_CERT, since one of the two is then a mistake.
+func newUpstreamTLSConfig() (*tls.Config, error) {
+	caPath := strings.TrimSpace(os.Getenv("UPSTREAM_CA_CERT"))
+	certPath := strings.TrimSpace(os.Getenv("UPSTREAM_CLIENT_CERT"))
+	keyPath := strings.TrimSpace(os.Getenv("UPSTREAM_CLIENT_KEY"))
+	insecure := getEnvBool("UPSTREAM_INSECURE_SKIP_VERIFY", false)
+	if caPath == "" && certPath == "" && keyPath == "" && !insecure {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath != "" {
+		if insecure {
+			return nil, errors.New("UPSTREAM_INSECURE_SKIP_VERIFY cannot be combined with UPSTREAM_CA_CERT")
+		}
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UPSTREAM_CA_CERT: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("UPSTREAM_CA_CERT %s contains no PEM certificates", caPath)
+		}
+		cfg.RootCAs = pool
+		log.Printf("Trusting marketplace certificates signed by the CAs in %s", caPath)
+	}
+
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, errors.New("UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		log.Printf("Presenting client certificate %s to the marketplace", certPath)
+	}
+
+	if insecure {
+		log.Printf("WARNING: UPSTREAM_INSECURE_SKIP_VERIFY is set; the marketplace's TLS certificate is not verified. Do not use this in production")
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// newUpstreamTransport returns the base transport for marketplace requests:
+// http.DefaultTransport, or a copy of it using the configured TLS settings
+func newUpstreamTransport() (http.RoundTripper, error) {
+	tlsConfig, err := newUpstreamTLSConfig()
+	if err != nil || tlsConfig == nil {
+		return http.DefaultTransport, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeServerPEM writes the test server's certificate and key as PEM files,
+// returning their paths
+func writeServerPEM(t *testing.T, server *httptest.Server) (certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	return certPath, keyPath
+}
+
+func TestUpstreamTLSWithCustomCA(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	certPath, keyPath := writeServerPEM(t, server)
+	defer func() { marketplaceTransport = nil }()
+
+	get := func() (int, error) {
+		resp, err := newMarketplaceClient(0).Get(server.URL)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+	if _, err := get(); err == nil {
+		t.Fatal("request to a server signed by an unknown CA succeeded without UPSTREAM_CA_CERT")
+	}
+
+	os.Setenv("UPSTREAM_CA_CERT", certPath)
+	defer os.Unsetenv("UPSTREAM_CA_CERT")
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+	if status, err := get(); err != nil || status != http.StatusUnauthorized {
+		t.Fatalf("request with the CA trusted = %d, %v; want a 401 for the missing client certificate", status, err)
+	}
+
+	os.Setenv("UPSTREAM_CLIENT_CERT", certPath)
+	defer os.Unsetenv("UPSTREAM_CLIENT_CERT")
+	os.Setenv("UPSTREAM_CLIENT_KEY", keyPath)
+	defer os.Unsetenv("UPSTREAM_CLIENT_KEY")
+	if err := configureMarketplaceTransport(); err != nil {
+		t.Fatalf("configureMarketplaceTransport() error = %v", err)
+	}
+	if status, err := get(); err != nil || status != http.StatusOK {
+		t.Errorf("request with a client certificate = %d, %v; want 200", status, err)
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "missing CA file", env: map[string]string{"UPSTREAM_CA_CERT": filepath.Join(dir, "missing.pem")}, wantErr: "failed to read UPSTREAM_CA_CERT"},
+		{name: "CA file without certificates", env: map[string]string{"UPSTREAM_CA_CERT": notPEM}, wantErr: "no PEM certificates"},
+		{name: "certificate without key", env: map[string]string{"UPSTREAM_CLIENT_CERT": notPEM}, wantErr: "must be set together"},
+		{name: "invalid key pair", env: map[string]string{"UPSTREAM_CLIENT_CERT": notPEM, "UPSTREAM_CLIENT_KEY": notPEM}, wantErr: "client certificate"},
+		{name: "skip verify with CA", env: map[string]string{"UPSTREAM_CA_CERT": notPEM, "UPSTREAM_INSECURE_SKIP_VERIFY": "true"}, wantErr: "cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			defer func() { marketplaceTransport = nil }()
+			if err := configureMarketplaceTransport(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("configureMarketplaceTransport() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamInsecureSkipVerify(t *testing.T) {
+	os.Setenv("UPSTREAM_INSECURE_SKIP_VERIFY", "true")
+	defer os.Unsetenv("UPSTREAM_INSECURE_SKIP_VERIFY")
+
+	cfg, err := newUpstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil || !cfg.InsecureSkipVerify {
+		t.Errorf("TLS config = %+v, want verification skipped", cfg)
+	}
+}
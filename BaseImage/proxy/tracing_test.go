@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProxyChatCompletionTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var outboundTraceparent string
+	server := newMarketplaceServer("traced-model", "Traced Model", func(w http.ResponseWriter, r *http.Request) {
+		outboundTraceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"choices": []}`))
+	})
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	req := newChatRequest(`{"model": "Traced Model", "messages": [{"role": "user", "content": "Hello"}]}`)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	ProxyChatCompletion(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", w.Code)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s trace ID = %s, want inbound %s", span.Name(), got, traceID)
+		}
+	}
+	for _, name := range []string{"ProxyChatCompletion", "ensureSession", "forwardRequest"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("missing %s span, got %v", name, spans)
+		}
+	}
+
+	forward := spans["forwardRequest"]
+	if !strings.Contains(outboundTraceparent, traceID) || !strings.Contains(outboundTraceparent, forward.SpanContext().SpanID().String()) {
+		t.Errorf("outbound traceparent %q does not continue the forwardRequest span", outboundTraceparent)
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range spans["ProxyChatCompletion"].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["model.id"].AsString() != "traced-model" {
+		t.Errorf("model.id = %v, want traced-model", attrs["model.id"].AsString())
+	}
+	if v, ok := attrs["chat.stream"]; !ok || v.AsBool() {
+		t.Errorf("chat.stream = %v, want false", v.AsBool())
+	}
+	if attrs["upstream.status_code"].AsInt64() != http.StatusOK {
+		t.Errorf("upstream.status_code = %v, want 200", attrs["upstream.status_code"].AsInt64())
+	}
+}
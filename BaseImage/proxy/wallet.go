@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	walletSessions = metrics.counter("morpheus_proxy_wallet_sessions_total",
+		"Sessions opened per wallet (address redacted)", "wallet")
+	walletRequests = metrics.counter("morpheus_proxy_wallet_requests_total",
+		"Chat requests forwarded on sessions funded by each wallet (address redacted)", "wallet")
+)
+
+// walletCursor advances on every selection to rotate through the wallets
+var walletCursor uint64
+
+// getWalletAddresses returns the wallets sessions may be funded from:
+// WALLET_ADDRESSES as a comma-separated list, or the single WALLET_ADDRESS.
+func getWalletAddresses() []string {
+	var wallets []string
+	for _, wallet := range strings.Split(os.Getenv("WALLET_ADDRESSES"), ",") {
+		if wallet = strings.TrimSpace(wallet); wallet != "" {
+			wallets = append(wallets, wallet)
+		}
+	}
+	if len(wallets) == 0 {
+		if wallet := strings.TrimSpace(os.Getenv("WALLET_ADDRESS")); wallet != "" {
+			wallets = append(wallets, wallet)
+		}
+	}
+	return wallets
+}
+
+// selectWallet picks the wallet for a new session, rotating round-robin
+// through the configured wallets. It returns "" when none is configured.
+//
+// The wallet is only recorded on the session, for the per-wallet metrics and
+// to retire the session once its wallet is no longer configured. It is not
+// sent to the marketplace, whose session API has no field naming a wallet:
+// sessions are funded by the marketplace's own wallet whatever is selected.
+func selectWallet() string {
+	wallets := getWalletAddresses()
+	if len(wallets) == 0 {
+		return ""
+	}
+	next := atomic.AddUint64(&walletCursor, 1) - 1
+	return wallets[next%uint64(len(wallets))]
+}
+
+// walletConfigured reports whether a session funded by wallet may still be
+// used: its wallet must be one of those configured now, or none if none is.
+// Addresses are compared without regard to case.
+func walletConfigured(wallet string) bool {
+	wallets := getWalletAddresses()
+	if len(wallets) == 0 {
+		return wallet == ""
+	}
+	for _, configured := range wallets {
+		if strings.EqualFold(configured, wallet) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactWallet shortens a wallet address for logs and metric labels while
+// keeping wallets distinguishable
+func redactWallet(wallet string) string {
+	if len(wallet) <= 10 {
+		return wallet
+	}
+	return wallet[:6] + "..." + wallet[len(wallet)-4:]
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectWalletRoundRobin(t *testing.T) {
+	os.Setenv("WALLET_ADDRESSES", "0xaaa1, 0xbbb2,0xccc3")
+	defer os.Unsetenv("WALLET_ADDRESSES")
+	walletCursor = 0
+
+	want := []string{"0xaaa1", "0xbbb2", "0xccc3", "0xaaa1"}
+	for i, w := range want {
+		if got := selectWallet(); got != w {
+			t.Errorf("selection %d = %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestSelectSingleWallet(t *testing.T) {
+	os.Setenv("WALLET_ADDRESS", "0x1111111111111111111111111111111111111111")
+	defer os.Unsetenv("WALLET_ADDRESS")
+
+	for i := 0; i < 2; i++ {
+		if wallet := selectWallet(); wallet != "0x1111111111111111111111111111111111111111" {
+			t.Errorf("selectWallet() = %s, want WALLET_ADDRESS", wallet)
+		}
+	}
+}
+
+func TestEnsureSessionSpreadsAcrossWallets(t *testing.T) {
+	const walletA = "0xaaaa00000000000000000000000000000000aaaa"
+	const walletB = "0xbbbb00000000000000000000000000000000bbbb"
+	os.Setenv("WALLET_ADDRESSES", walletA+","+walletB)
+	defer os.Unsetenv("WALLET_ADDRESSES")
+	walletCursor = 0
+
+	var requested []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blockchain/models" {
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requested = append(requested, body)
+		modelID := strings.Split(strings.TrimPrefix(r.URL.Path, "/blockchain/models/"), "/")[0]
+		json.NewEncoder(w).Encode(map[string]string{"sessionID": modelID + "-session"})
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+
+	sessionsA := walletSessions.Value(redactWallet(walletA))
+	sessionsB := walletSessions.Value(redactWallet(walletB))
+
+	for i, modelID := range []string{"wallet-model-1", "wallet-model-2"} {
+		if err := ensureSession(context.Background(), modelID); err != nil {
+			t.Fatalf("ensureSession(%s) error = %v", modelID, err)
+		}
+		session, ok := getActiveSession(modelID)
+		if want := []string{walletA, walletB}[i]; !ok || session.Wallet != want {
+			t.Errorf("session for %s = %+v, want it funded by %s", modelID, session, want)
+		}
+	}
+	// The marketplace opens sessions with its own wallet; the one selected
+	// is what the session is accounted to
+	for _, body := range requested {
+		if _, ok := body["walletAddress"]; ok {
+			t.Errorf("session request names a wallet: %v", body)
+		}
+	}
+	if walletSessions.Value(redactWallet(walletA)) != sessionsA+1 || walletSessions.Value(redactWallet(walletB)) != sessionsB+1 {
+		t.Errorf("wallet session metrics were not incremented per wallet")
+	}
+}
+
+func TestWalletChangeForcesNewSession(t *testing.T) {
+	const walletA = "0xaaaa00000000000000000000000000000000aaaa"
+	const walletB = "0xbbbb00000000000000000000000000000000bbbb"
+	os.Setenv("WALLET_ADDRESS", walletA)
+	defer os.Unsetenv("WALLET_ADDRESS")
+
+	var mu sync.Mutex
+	var opened int
+	closed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/blockchain/models":
+			json.NewEncoder(w).Encode(map[string][]ModelInfo{"models": {}})
+		case strings.HasSuffix(r.URL.Path, "/close"):
+			closed <- r.URL.Path
+			w.Write([]byte(`{"result": true}`))
+		default:
+			mu.Lock()
+			opened++
+			sessionID := fmt.Sprintf("0xwallet%d", opened)
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"sessionID": sessionID})
+		}
+	}))
+	defer server.Close()
+	defer useMarketplaceURL(server.URL)()
+	defer func(url string) { consumerNodeURL = url }(consumerNodeURL)
+	consumerNodeURL = server.URL
+
+	sessionMutex.Lock()
+	activeSessions = make(map[string]*MorpheusSession)
+	sessionRemovals = make(map[string]string)
+	sessionMutex.Unlock()
+	SessionManagerInstance.UpdateSession("", "")
+
+	steps := []struct {
+		wallet  string
+		want    string
+		session string
+	}{
+		{wallet: walletA, want: sessionNew, session: "0xwallet1"},
+		{wallet: walletA, want: sessionReused, session: "0xwallet1"},
+		{wallet: walletB, want: sessionWalletChanged, session: "0xwallet2"},
+		{wallet: strings.ToUpper(walletB), want: sessionReused, session: "0xwallet2"},
+	}
+	for i, step := range steps {
+		os.Setenv("WALLET_ADDRESS", step.wallet)
+		r, decision := withSessionDecision(httptest.NewRequest("POST", "/v1/chat/completions", nil))
+		if err := ensureSession(r.Context(), "wallet-bound-model"); err != nil {
+			t.Fatalf("step %d: ensureSession() error = %v", i, err)
+		}
+		if decision.reason != step.want {
+			t.Errorf("step %d: session decision = %q, want %q", i, decision.reason, step.want)
+		}
+		session, _ := getActiveSession("wallet-bound-model")
+		if session.SessionID != step.session {
+			t.Errorf("step %d: session = %q, want %q", i, session.SessionID, step.session)
+		}
+		if !strings.EqualFold(session.Wallet, step.wallet) {
+			t.Errorf("step %d: session wallet = %s, want %s", i, session.Wallet, step.wallet)
+		}
+	}
+
+	select {
+	case path := <-closed:
+		if path != "/blockchain/sessions/0xwallet1/close" {
+			t.Errorf("closed %s, want the session opened under the old wallet", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session opened under the old wallet was not closed")
+	}
+}
+
+func TestWalletConfigured(t *testing.T) {
+	tests := []struct {
+		name    string
+		wallets string
+		wallet  string
+		want    bool
+	}{
+		{name: "none configured, none recorded", want: true},
+		{name: "none configured, one recorded", wallet: "0xaaa1", want: false},
+		{name: "configured, none recorded", wallets: "0xaaa1", want: false},
+		{name: "one of several", wallets: "0xaaa1,0xbbb2", wallet: "0xbbb2", want: true},
+		{name: "case differs", wallets: "0xAAA1", wallet: "0xaaa1", want: true},
+		{name: "removed", wallets: "0xbbb2", wallet: "0xaaa1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("WALLET_ADDRESSES", tt.wallets)
+			defer os.Unsetenv("WALLET_ADDRESSES")
+			if got := walletConfigured(tt.wallet); got != tt.want {
+				t.Errorf("walletConfigured(%q) = %v, want %v", tt.wallet, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactWallet(t *testing.T) {
+	if got := redactWallet("0x1234567890abcdef1234567890abcdef12345678"); got != "0x1234...5678" {
+		t.Errorf("redactWallet() = %s, want 0x1234...5678", got)
+	}
+}